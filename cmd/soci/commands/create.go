@@ -17,21 +17,50 @@
 package commands
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/fs"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
+	oraslib "oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote"
 )
 
 const (
-	buildToolIdentifier = "AWS SOCI CLI v0.1"
-	spanSizeFlag        = "span-size"
-	minLayerSizeFlag    = "min-layer-size"
+	buildToolIdentifier    = "AWS SOCI CLI v0.1"
+	spanSizeFlag           = "span-size"
+	minLayerSizeFlag       = "min-layer-size"
+	ztocConcurrencyFlag    = "ztoc-concurrency"
+	spanAlignmentFlag      = "span-alignment"
+	compactCheckpointsFlag = "compact-checkpoints"
+	remoteFlag             = "remote"
+	pushFlag               = "push"
+	plainHTTPFlag          = "plain-http"
+	forceRebuildFlag       = "force-rebuild"
+	parallelismFlag        = "parallelism"
+	layerPolicyFlag        = "layer-policy"
+	includeLayerFlag       = "include-layer"
+	excludeLayerFlag       = "exclude-layer"
+	includeMediaTypeFlag   = "include-media-type"
+	excludeMediaTypeFlag   = "exclude-media-type"
+	topLayersFlag          = "top-layers"
+	skipBottomLayersFlag   = "skip-bottom-layers"
+	maxLayerSizeFlag       = "max-layer-size"
+	createdFlag            = "created"
+	spanSizeAnnotationFlag = "span-size-annotation"
 )
 
 // CreateCommand creates SOCI index for an image
@@ -54,6 +83,81 @@ var CreateCommand = cli.Command{
 			Usage: "Minimum layer size to build zTOC for. Smaller layers won't have zTOC and not lazy pulled. Default is 10 MiB.",
 			Value: 10 << 20,
 		},
+		cli.StringFlag{
+			Name:  layerPolicyFlag,
+			Usage: "Path to a TOML file with the policy selecting the layers to build zTOCs for. The layer selection flags below extend or override it.",
+		},
+		cli.StringSliceFlag{
+			Name:  includeLayerFlag,
+			Usage: "Only build zTOCs for the layers with these digests",
+		},
+		cli.StringSliceFlag{
+			Name:  excludeLayerFlag,
+			Usage: "Don't build zTOCs for the layers with these digests (e.g., base layers cached on every node)",
+		},
+		cli.StringSliceFlag{
+			Name:  includeMediaTypeFlag,
+			Usage: "Only build zTOCs for the layers with these media types",
+		},
+		cli.StringSliceFlag{
+			Name:  excludeMediaTypeFlag,
+			Usage: "Don't build zTOCs for the layers with these media types",
+		},
+		cli.IntFlag{
+			Name:  topLayersFlag,
+			Usage: "Only build zTOCs for this number of top-most layers. Default is 0, which builds zTOCs for all layers.",
+		},
+		cli.IntFlag{
+			Name:  skipBottomLayersFlag,
+			Usage: "Don't build zTOCs for this number of bottom-most layers",
+		},
+		cli.Int64Flag{
+			Name:  maxLayerSizeFlag,
+			Usage: "Maximum layer size to build zTOC for. Default is 0, which doesn't limit the layer size.",
+		},
+		cli.IntFlag{
+			Name:  ztocConcurrencyFlag,
+			Usage: "Number of span digests computed concurrently while a layer is decompressed to build its zTOC. Default is 0, which builds zTOCs sequentially.",
+			Value: 0,
+		},
+		cli.Int64Flag{
+			Name:  spanAlignmentFlag,
+			Usage: "Align spans to file boundaries so that files up to this size (in bytes) are stored in a single span. Only applies to gzip layers and can't be combined with --ztoc-concurrency. Default is 0, which disables the alignment.",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  compactCheckpointsFlag,
+			Usage: "Compress the checkpoints of gzip zTOCs to make them smaller. zTOCs with compact checkpoints can't be read by older versions of the snapshotter.",
+		},
+		cli.IntFlag{
+			Name:  parallelismFlag,
+			Usage: "Number of layers whose zTOCs are built at the same time. Default is 0, which uses the number of CPUs.",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  forceRebuildFlag,
+			Usage: "Build zTOCs for every layer instead of reusing the zTOCs already built for the same layers (e.g., for other images sharing the layers) with the same span size",
+		},
+		cli.StringFlag{
+			Name:  createdFlag,
+			Usage: "Record this creation time (RFC 3339, or \"now\") in the org.opencontainers.image.created annotation of the index, so that the snapshotter's \"newest\" index selection policy can use it. By default the index has no creation time, so that its digest is reproducible.",
+		},
+		cli.BoolFlag{
+			Name:  spanSizeAnnotationFlag,
+			Usage: "Record the span size in the com.amazon.soci.span-size annotation of the index, so that the snapshotter's preferred span size can match it. By default the index has no span size annotation, so that its digest is the same as with earlier versions.",
+		},
+		cli.BoolFlag{
+			Name:  remoteFlag,
+			Usage: "Stream the image from its registry instead of reading it from the containerd content store, so that the image doesn't need to be pulled. Credentials are read from the docker config.",
+		},
+		cli.BoolFlag{
+			Name:  pushFlag,
+			Usage: "Push the SOCI index and zTOCs to the image's registry after creating them",
+		},
+		cli.BoolFlag{
+			Name:  plainHTTPFlag,
+			Usage: "Use plain HTTP to connect to the registry with --remote or --push",
+		},
 	),
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
@@ -61,20 +165,61 @@ var CreateCommand = cli.Command{
 			return errors.New("source image needs to be specified")
 		}
 
-		client, ctx, cancel, err := commands.NewClient(cliContext)
-		if err != nil {
-			return err
+		var repo *remote.Repository
+		if cliContext.Bool(remoteFlag) || cliContext.Bool(pushFlag) {
+			refspec, err := reference.Parse(srcRef)
+			if err != nil {
+				return err
+			}
+			// Layers are streamed with a single request each, so the requests can't time out
+			// like the short requests of the snapshotter.
+			httpConfig := config.NewRetryableHTTPClientConfig()
+			httpConfig.RequestTimeoutMsec = 0
+			repo, err = fs.NewRemoteStore(refspec, httpConfig)
+			if err != nil {
+				return err
+			}
+			repo.PlainHTTP = cliContext.Bool(plainHTTPFlag)
 		}
-		defer cancel()
 
-		cs := client.ContentStore()
-		is := client.ImageService()
-		srcImg, err := is.Get(ctx, srcRef)
-		if err != nil {
-			return err
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+			cs     content.Provider
+			srcImg images.Image
+		)
+		if cliContext.Bool(remoteFlag) {
+			ctx, cancel = commands.AppContext(cliContext)
+			defer cancel()
+			refspec, err := reference.Parse(srcRef)
+			if err != nil {
+				return err
+			}
+			target, err := repo.Resolve(ctx, refspec.Object)
+			if err != nil {
+				return fmt.Errorf("cannot resolve %s: %w", srcRef, err)
+			}
+			srcImg = images.Image{Name: srcRef, Target: target}
+			cs = soci.NewRemoteProvider(repo)
+		} else {
+			client, clientCtx, clientCancel, err := commands.NewClient(cliContext)
+			if err != nil {
+				return err
+			}
+			defer clientCancel()
+			ctx = clientCtx
+
+			srcImg, err = client.ImageService().Get(ctx, srcRef)
+			if err != nil {
+				return err
+			}
+			cs = client.ContentStore()
 		}
 		spanSize := cliContext.Int64(spanSizeFlag)
 		minLayerSize := cliContext.Int64(minLayerSizeFlag)
+		if cliContext.Int64(spanAlignmentFlag) > 0 && cliContext.Int(ztocConcurrencyFlag) > 0 {
+			return fmt.Errorf("--%s can't be combined with --%s", spanAlignmentFlag, ztocConcurrencyFlag)
+		}
 		// Creating the snapshotter's root path first if it does not exist, since this ensures, that
 		// it has the limited permission set as drwx--x--x.
 		// The subsequent oci.New creates a root path dir with too broad permission set.
@@ -100,10 +245,34 @@ var CreateCommand = cli.Command{
 			return err
 		}
 
+		layerPolicy, err := getLayerPolicy(cliContext)
+		if err != nil {
+			return err
+		}
+
 		builderOpts := []soci.BuildOption{
 			soci.WithMinLayerSize(minLayerSize),
 			soci.WithSpanSize(spanSize),
 			soci.WithBuildToolIdentifier(buildToolIdentifier),
+			soci.WithZtocConcurrency(cliContext.Int(ztocConcurrencyFlag)),
+			soci.WithSpanAlignment(cliContext.Int64(spanAlignmentFlag)),
+			soci.WithCompactCheckpoints(cliContext.Bool(compactCheckpointsFlag)),
+			soci.WithForceRebuild(cliContext.Bool(forceRebuildFlag)),
+			soci.WithParallelism(cliContext.Int(parallelismFlag)),
+			soci.WithLayerPolicy(layerPolicy),
+		}
+		if created := cliContext.String(createdFlag); created != "" {
+			createdAt := time.Now()
+			if created != "now" {
+				createdAt, err = time.Parse(time.RFC3339, created)
+				if err != nil {
+					return fmt.Errorf("invalid --%s %q, expected an RFC 3339 time or \"now\": %w", createdFlag, created, err)
+				}
+			}
+			builderOpts = append(builderOpts, soci.WithCreatedAnnotation(createdAt))
+		}
+		if cliContext.Bool(spanSizeAnnotationFlag) {
+			builderOpts = append(builderOpts, soci.WithSpanSizeAnnotation())
 		}
 
 		for _, plat := range ps {
@@ -117,13 +286,57 @@ var CreateCommand = cli.Command{
 			if err != nil {
 				return err
 			}
+			if sociIndexWithMetadata.ReusedZtocs > 0 {
+				fmt.Printf("reused %d existing ztocs out of %d\n", sociIndexWithMetadata.ReusedZtocs, len(sociIndexWithMetadata.Index.Blobs))
+			}
 
 			err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore, builder.ArtifactsDb)
 			if err != nil {
 				return err
 			}
+
+			if cliContext.Bool(pushFlag) {
+				manifest, err := soci.MarshalIndex(sociIndexWithMetadata.Index)
+				if err != nil {
+					return err
+				}
+				indexDesc := ocispec.Descriptor{
+					MediaType: sociIndexWithMetadata.Index.MediaType,
+					Digest:    digest.FromBytes(manifest),
+					Size:      int64(len(manifest)),
+				}
+				fmt.Printf("pushing soci index with digest: %v\n", indexDesc.Digest)
+				if err := soci.PushArtifact(ctx, blobStore, repo, indexDesc, oraslib.DefaultCopyGraphOptions); err != nil {
+					return fmt.Errorf("error pushing graph to remote: %w", err)
+				}
+			}
 		}
 
 		return nil
 	},
 }
+
+// getLayerPolicy returns the layer policy of the policy file, extended or overridden by the layer selection flags.
+func getLayerPolicy(cliContext *cli.Context) (soci.LayerPolicy, error) {
+	var policy soci.LayerPolicy
+	if path := cliContext.String(layerPolicyFlag); path != "" {
+		var err error
+		if policy, err = soci.LoadLayerPolicy(path); err != nil {
+			return policy, err
+		}
+	}
+	policy.IncludeDigests = append(policy.IncludeDigests, cliContext.StringSlice(includeLayerFlag)...)
+	policy.ExcludeDigests = append(policy.ExcludeDigests, cliContext.StringSlice(excludeLayerFlag)...)
+	policy.IncludeMediaTypes = append(policy.IncludeMediaTypes, cliContext.StringSlice(includeMediaTypeFlag)...)
+	policy.ExcludeMediaTypes = append(policy.ExcludeMediaTypes, cliContext.StringSlice(excludeMediaTypeFlag)...)
+	if cliContext.IsSet(topLayersFlag) {
+		policy.TopLayers = cliContext.Int(topLayersFlag)
+	}
+	if cliContext.IsSet(skipBottomLayersFlag) {
+		policy.SkipBottomLayers = cliContext.Int(skipBottomLayersFlag)
+	}
+	if cliContext.IsSet(maxLayerSizeFlag) {
+		policy.MaxLayerSize = cliContext.Int64(maxLayerSizeFlag)
+	}
+	return policy, nil
+}
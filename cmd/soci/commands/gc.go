@@ -0,0 +1,86 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	dryRunFlag      = "dry-run"
+	gracePeriodFlag = "grace-period"
+)
+
+// GCCommand removes the SOCI artifacts of the local store that no index references anymore
+var GCCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove SOCI artifacts that are not referenced by any index",
+	Description: `Remove the ztocs, index manifests and signatures of the local store that are not reachable from
+an index (e.g., after "soci index rm"), and their database entries. The indices are those of the artifacts
+database and those fetched into the local store by the snapshotter.
+Artifacts written less than --grace-period ago are kept, since they may belong to an index that
+is being created or fetched.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  dryRunFlag,
+			Usage: "only show the artifacts that would be removed",
+		},
+		cli.DurationFlag{
+			Name:  gracePeriodFlag,
+			Usage: "keep the artifacts written less than this long ago",
+			Value: time.Hour,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+
+		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		blobStorePath := filepath.Join(config.SociContentStorePath, "blobs")
+		dryRun := cliContext.Bool(dryRunFlag)
+		result, err := soci.CollectGarbage(ctx, blobStore, blobStorePath, artifactsDb, cliContext.Duration(gracePeriodFlag), dryRun)
+		if err != nil {
+			return err
+		}
+
+		action := "removed"
+		if dryRun {
+			action = "would remove"
+		}
+		for _, desc := range result.RemovedBlobs {
+			fmt.Printf("%s %s (%d bytes)\n", action, desc.Digest, desc.Size)
+		}
+		fmt.Printf("%s %d blobs and %d database entries, reclaiming %d bytes\n",
+			action, len(result.RemovedBlobs), len(result.RemovedEntries), result.ReclaimedBytes)
+		return nil
+	},
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var diffCommand = cli.Command{
+	Name:  "diff",
+	Usage: "compare two indices",
+	Description: `compare two SOCI indices layer by layer: the layers that gained or lost a ztoc, and for the
+layers whose ztoc changed, the build config and the files added, removed or changed in the ztoc.
+Files are compared by content only if both ztocs have file digests (see "contentCompared" in the json
+output); otherwise a file whose content changed without changing its metadata isn't reported.`,
+	ArgsUsage: "<digest> <digest>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, text or json",
+			Value: "text",
+		},
+		cli.BoolFlag{
+			Name:  "exit-code",
+			Usage: "exit with status 1 if the indices differ",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		if cliContext.NArg() != 2 {
+			return fmt.Errorf("please provide the digests of the two indices to compare")
+		}
+		from, err := digest.Parse(cliContext.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		to, err := digest.Parse(cliContext.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		format := cliContext.String("format")
+		if format != "text" && format != "json" {
+			return fmt.Errorf("unexpected format %q, expected text or json", format)
+		}
+
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+		defer cancel()
+		diff, err := soci.DiffIndices(ctx, store, db, from, to)
+		if err != nil {
+			return err
+		}
+
+		if format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(diff); err != nil {
+				return err
+			}
+		} else {
+			writeIndexDiff(os.Stdout, diff)
+		}
+		if cliContext.Bool("exit-code") && diff.HasChanges() {
+			return cli.NewExitError("", 1)
+		}
+		return nil
+	},
+}
+
+func writeIndexDiff(w io.Writer, diff *soci.IndexDiff) {
+	writeChange(w, "", "subject", diff.Subject)
+	writeChange(w, "", "build tool", diff.BuildTool)
+	for _, layer := range diff.Layers {
+		switch {
+		case layer.FromLayer == "":
+			fmt.Fprintf(w, "layer %s: %s\n", layer.ToLayer, layer.Status)
+		case layer.ToLayer == "" || layer.ToLayer == layer.FromLayer:
+			fmt.Fprintf(w, "layer %s: %s\n", layer.FromLayer, layer.Status)
+		default:
+			fmt.Fprintf(w, "layer %s -> %s: %s\n", layer.FromLayer, layer.ToLayer, layer.Status)
+		}
+		if layer.Status != soci.LayerDiffChanged {
+			continue
+		}
+		writeChange(w, "  ", "ztoc", &soci.Change{From: layer.FromZtoc, To: layer.ToZtoc})
+		writeChange(w, "  ", "build tool", layer.BuildTool)
+		writeChange(w, "  ", "span size", layer.SpanSize)
+		writeChange(w, "  ", "compression algorithm", layer.CompressionAlgorithm)
+		if !layer.ContentCompared {
+			fmt.Fprintf(w, "  content not compared: a ztoc has no file digests, so only metadata changes are listed\n")
+		}
+		for _, file := range layer.AddedFiles {
+			fmt.Fprintf(w, "  + %s\n", file)
+		}
+		for _, file := range layer.RemovedFiles {
+			fmt.Fprintf(w, "  - %s\n", file)
+		}
+		for _, file := range layer.ChangedFiles {
+			fmt.Fprintf(w, "  ~ %s\n", file)
+		}
+	}
+}
+
+func writeChange(w io.Writer, indent, name string, change *soci.Change) {
+	if change != nil {
+		fmt.Fprintf(w, "%s%s: %s -> %s\n", indent, name, change.From, change.To)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export the indices of an image to an OCI image layout archive",
+	Description: `export the SOCI indices of an image with their ztocs and signatures to a tar archive of an
+OCI image layout. The archive can be loaded with "soci index import" on a host without access to this one,
+e.g. to push the indices to a private registry in an air-gapped environment.`,
+	ArgsUsage: "[flags] <image_ref>",
+	Flags: append(internal.PlatformFlags,
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path of the archive to write",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference to export the indices of")
+		}
+		output := cliContext.String("output")
+		if output == "" {
+			return fmt.Errorf("please provide the path of the archive with --output")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		indexDescriptors, _, err := soci.GetIndexDescriptorCollection(ctx, cs, db, img, ps)
+		if err != nil {
+			return err
+		}
+		if len(indexDescriptors) == 0 {
+			return fmt.Errorf("could not find any soci indices to export")
+		}
+		var indexDigests []digest.Digest
+		for _, desc := range indexDescriptors {
+			indexDigests = append(indexDigests, desc.Digest)
+		}
+
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create OCI local store: %w", err)
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		if err := soci.ExportIndices(ctx, f, store, db, indexDigests); err != nil {
+			f.Close()
+			os.Remove(output)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		for _, dgst := range indexDigests {
+			fmt.Println(dgst)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "import indices from an OCI image layout archive",
+	Description: `import the SOCI indices, ztocs and signatures of an archive written by "soci index export"
+into the local store. The imported indices can then be pushed with "soci push".`,
+	ArgsUsage: "<archive>",
+	Action: func(cliContext *cli.Context) error {
+		path := cliContext.Args().First()
+		if path == "" {
+			return fmt.Errorf("please provide the path of the archive to import")
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create OCI local store: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+		defer cancel()
+		indexDescs, err := soci.ImportIndices(ctx, f, store, db)
+		if err != nil {
+			return err
+		}
+		for _, desc := range indexDescs {
+			fmt.Println(desc.Digest)
+		}
+		return nil
+	},
+}
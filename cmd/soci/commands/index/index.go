@@ -25,5 +25,10 @@ var Command = cli.Command{
 		listCommand,
 		infoCommand,
 		rmCommand,
+		signCommand,
+		exportCommand,
+		importCommand,
+		diffCommand,
+		verifyCommand,
 	},
 }
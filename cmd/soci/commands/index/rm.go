@@ -18,7 +18,9 @@ package index
 
 import (
 	"fmt"
+	"path/filepath"
 
+	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/urfave/cli"
@@ -28,7 +30,7 @@ var rmCommand = cli.Command{
 	Name:        "remove",
 	Aliases:     []string{"rm"},
 	Usage:       "remove indices",
-	Description: "remove an index from local db",
+	Description: "remove an index and its signatures from local db and local store, leaving its ztocs to \"soci gc\"",
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "ref",
@@ -47,27 +49,32 @@ var rmCommand = cli.Command{
 		if err != nil {
 			return err
 		}
+		blobStorePath := filepath.Join(config.SociContentStorePath, "blobs")
 		if ref == "" {
-			for _, desc := range args {
-				err := db.RemoveArtifactEntryByIndexDigest(desc)
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			client, ctx, cancel, err := commands.NewClient(cliContext)
-			if err != nil {
-				return err
-			}
-			defer cancel()
+			return soci.RemoveIndices(db, blobStorePath, args)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
 
-			is := client.ImageService()
-			img, err := is.Get(ctx, ref)
-			if err != nil {
-				return err
+		is := client.ImageService()
+		img, err := is.Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		var indexDigests []string
+		err = db.Walk(func(ae *soci.ArtifactEntry) error {
+			if ae.Type == soci.ArtifactEntryTypeIndex && ae.ImageDigest == img.Target.Digest.String() {
+				indexDigests = append(indexDigests, ae.Digest)
 			}
-			return db.RemoveArtifactEntryByImageDigest(img.Target.Digest.String())
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
+		return soci.RemoveIndices(db, blobStorePath, indexDigests)
 	},
 }
@@ -0,0 +1,88 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const keyFlag = "key"
+
+var signCommand = cli.Command{
+	Name:  "sign",
+	Usage: "sign an index",
+	Description: `sign an index with a private key. The signature is stored as an artifact referring to the index
+and is pushed along with it by "soci push".`,
+	ArgsUsage: "<digest>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  keyFlag,
+			Usage: "path to the PEM encoded private key (ECDSA, Ed25519 or RSA) used to sign the index",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		dgst, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return err
+		}
+		keyPath := cliContext.String(keyFlag)
+		if keyPath == "" {
+			return fmt.Errorf("please provide the private key with --%s", keyFlag)
+		}
+		key, err := soci.LoadSigningKey(keyPath)
+		if err != nil {
+			return err
+		}
+
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		entry, err := db.GetArtifactEntry(dgst.String())
+		if err != nil {
+			return err
+		}
+		if entry.Type != soci.ArtifactEntryTypeIndex {
+			return fmt.Errorf("the provided digest %v is not of a SOCI index", dgst)
+		}
+
+		signature, err := soci.SignIndex(v1.Descriptor{Digest: dgst, Size: entry.Size}, key)
+		if err != nil {
+			return err
+		}
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+		defer cancel()
+		desc, err := soci.WriteIndexSignature(ctx, signature, entry, store, db)
+		if err != nil {
+			return err
+		}
+		fmt.Println(desc.Digest)
+		return nil
+	},
+}
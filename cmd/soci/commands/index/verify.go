@@ -0,0 +1,190 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var verifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "verify the indices of an image against its layers",
+	Description: `verify that every ztoc of the SOCI indices of an image refers to a layer of the image, that its span
+digests match the bytes of the layer and that its TOC matches the files of the layer. Every layer is read
+in full, since the span digests cover the whole layer and the TOC can only be checked by decompressing it;
+with --remote, the layers are downloaded, but not stored.
+
+By default, the indices are read from the local store and the image from the containerd content store.
+With --remote, the indices and the image are read from the image's registry.`,
+	ArgsUsage: "[flags] <image_ref>",
+	Flags: append(internal.PlatformFlags,
+		cli.BoolFlag{
+			Name:  "remote",
+			Usage: "read the indices and the image from the image's registry. Credentials are read from the docker config.",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "use plain HTTP to connect to the registry with --remote",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference to verify the indices of")
+		}
+
+		var (
+			ctx     context.Context
+			cancel  context.CancelFunc
+			layers  content.Provider
+			ztocs   orascontent.Fetcher
+			img     images.Image
+			indices func(manifestDesc ocispec.Descriptor) ([]ocispec.Descriptor, error)
+		)
+		if cliContext.Bool("remote") {
+			ctx, cancel = commands.AppContext(cliContext)
+			defer cancel()
+			refspec, err := reference.Parse(ref)
+			if err != nil {
+				return err
+			}
+			// Layers are read with a single request each, so the requests can't time out
+			// like the short requests of the snapshotter.
+			httpConfig := config.NewRetryableHTTPClientConfig()
+			httpConfig.RequestTimeoutMsec = 0
+			repo, err := fs.NewRemoteStore(refspec, httpConfig)
+			if err != nil {
+				return err
+			}
+			repo.PlainHTTP = cliContext.Bool("plain-http")
+			target, err := repo.Resolve(ctx, refspec.Object)
+			if err != nil {
+				return fmt.Errorf("cannot resolve %s: %w", ref, err)
+			}
+			img = images.Image{Name: ref, Target: target}
+			layers = soci.NewRemoteProvider(repo)
+			ztocs = repo
+			client := fs.NewOCIArtifactClient(repo)
+			indices = func(manifestDesc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+				descs, err := client.AllReferrers(ctx, manifestDesc)
+				if err != nil && !errors.Is(err, fs.ErrNoReferrers) {
+					return nil, fmt.Errorf("failed to fetch list of referrers: %w", err)
+				}
+				return descs, nil
+			}
+		} else {
+			client, clientCtx, clientCancel, err := commands.NewClient(cliContext)
+			if err != nil {
+				return err
+			}
+			defer clientCancel()
+			ctx = clientCtx
+			img, err = client.ImageService().Get(ctx, ref)
+			if err != nil {
+				return err
+			}
+			layers = client.ContentStore()
+			store, err := oci.New(config.SociContentStorePath)
+			if err != nil {
+				return fmt.Errorf("cannot create OCI local store: %w", err)
+			}
+			ztocs = store
+			db, err := soci.NewDB(soci.ArtifactsDbPath())
+			if err != nil {
+				return err
+			}
+			indices = func(manifestDesc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+				var descs []ocispec.Descriptor
+				err := db.Walk(func(ae *soci.ArtifactEntry) error {
+					if ae.Type == soci.ArtifactEntryTypeIndex && ae.OriginalDigest == manifestDesc.Digest.String() {
+						descs = append(descs, ocispec.Descriptor{Digest: digest.Digest(ae.Digest), Size: ae.Size})
+					}
+					return nil
+				})
+				return descs, err
+			}
+		}
+
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, layers)
+		if err != nil {
+			return err
+		}
+		var verified int
+		ok := true
+		for _, platform := range ps {
+			manifestDesc, err := soci.GetImageManifestDescriptor(ctx, layers, img.Target, platforms.OnlyStrict(platform))
+			if err != nil {
+				return err
+			}
+			indexDescs, err := indices(*manifestDesc)
+			if err != nil {
+				return err
+			}
+			for _, indexDesc := range indexDescs {
+				b, err := orascontent.FetchAll(ctx, ztocs, indexDesc)
+				if err != nil {
+					return fmt.Errorf("cannot read index %v: %w", indexDesc.Digest, err)
+				}
+				var index soci.Index
+				if err := soci.UnmarshalIndex(b, &index); err != nil {
+					return err
+				}
+				result, err := soci.VerifyIndex(ctx, &index, ztocs, layers)
+				if err != nil {
+					return fmt.Errorf("cannot verify index %v: %w", indexDesc.Digest, err)
+				}
+				verified++
+				fmt.Printf("index %v (%s)\n", indexDesc.Digest, platforms.Format(platform))
+				for _, layer := range result.Layers {
+					if len(layer.Errors) == 0 {
+						fmt.Printf("  layer %v -> ztoc %v: ok\n", layer.Layer, layer.Ztoc)
+						continue
+					}
+					ok = false
+					fmt.Printf("  layer %v -> ztoc %v: FAILED\n", layer.Layer, layer.Ztoc)
+					for _, err := range layer.Errors {
+						fmt.Printf("    %v\n", err)
+					}
+				}
+			}
+		}
+		if verified == 0 {
+			return fmt.Errorf("could not find any soci indices to verify")
+		}
+		if !ok {
+			return errors.New("some indices don't match the image")
+		}
+		return nil
+	},
+}
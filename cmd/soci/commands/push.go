@@ -32,6 +32,7 @@ import (
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/reference"
 	dockercliconfig "github.com/docker/cli/cli/config"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 	oraslib "oras.land/oras-go/v2"
@@ -224,11 +225,29 @@ if they are available in the snapshotter's local content store.
 				fmt.Printf("pushing soci index with digest: %v\n", indexDesc.Digest)
 			}
 
-			err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc.Descriptor, options)
+			err = soci.PushArtifact(context.Background(), src, dst, indexDesc.Descriptor, options)
 			if err != nil {
 				return fmt.Errorf("error pushing graph to remote: %w", err)
 			}
 
+			signatures, err := artifactsDb.GetIndexSignatures(indexDesc.Digest.String())
+			if err != nil {
+				return fmt.Errorf("cannot get signatures of index %v: %w", indexDesc.Digest, err)
+			}
+			for _, signature := range signatures {
+				if !quiet {
+					fmt.Printf("pushing soci index signature with digest: %v\n", signature.Digest)
+				}
+				signatureDesc := ocispec.Descriptor{
+					MediaType: signature.MediaType,
+					Digest:    digest.Digest(signature.Digest),
+					Size:      signature.Size,
+				}
+				err = soci.PushArtifact(context.Background(), src, dst, signatureDesc, options)
+				if err != nil {
+					return fmt.Errorf("error pushing signature to remote: %w", err)
+				}
+			}
 		}
 		return nil
 	},
@@ -0,0 +1,87 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export a ztoc as JSON",
+	ArgsUsage: "[<digest>]",
+	Description: `export the ztoc with <digest> from the local content store, or the ztoc file given
+with --file, as JSON. Every field of the ztoc is exported, including the span digests and the
+checkpoints, so that "soci ztoc import" can convert it back to an identical ztoc.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "file, f",
+			Usage: "the ztoc file to export instead of a ztoc of the local content store",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "the file to write the JSON to. Defaults to stdout",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		var toc *ztoc.Ztoc
+		if file := cliContext.String("file"); file != "" {
+			if len(cliContext.Args()) != 0 {
+				return errors.New("please provide either a ztoc digest or a ztoc file, not both")
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if toc, err = ztoc.Unmarshal(f); err != nil {
+				return err
+			}
+		} else {
+			if len(cliContext.Args()) != 1 {
+				return errors.New("please provide a ztoc digest or a ztoc file with --file")
+			}
+			ztocDigest, err := digest.Parse(cliContext.Args().First())
+			if err != nil {
+				return err
+			}
+			ctx, cancel := commands.AppContext(cliContext)
+			defer cancel()
+			if toc, err = getZtoc(ctx, ztocDigest); err != nil {
+				return err
+			}
+		}
+
+		var w io.Writer = os.Stdout
+		if outfile := cliContext.String("output"); outfile != "" {
+			f, err := os.Create(outfile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return ztoc.ToJSON(toc, w)
+	},
+}
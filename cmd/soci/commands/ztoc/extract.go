@@ -0,0 +1,74 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"io"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+var extractCommand = cli.Command{
+	Name:      "extract",
+	Usage:     "extract a directory tree from a local image layer using a specified ztoc",
+	ArgsUsage: "<digest> <path>",
+	Description: `extract the file or directory at <path> and everything under it, keeping the
+paths, modes, ownership, links and xattrs of the entries. Use "/" to extract the whole layer.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "the directory to extract the tree to",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		if len(cliContext.Args()) != 2 {
+			return errors.New("please provide both a ztoc digest and a path to extract")
+		}
+		outdir := cliContext.String("output")
+		if outdir == "" {
+			return errors.New("please provide the directory to extract to with --output")
+		}
+
+		ztocDigest, err := digest.Parse(cliContext.Args()[0])
+		if err != nil {
+			return err
+		}
+		root := cliContext.Args()[1]
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		toc, err := getZtoc(ctx, ztocDigest)
+		if err != nil {
+			return err
+		}
+
+		layerReader, err := getLayer(ctx, ztocDigest, client.ContentStore())
+		if err != nil {
+			return err
+		}
+		defer layerReader.Close()
+
+		return toc.ExtractTree(io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize)), root, outdir)
+	},
+}
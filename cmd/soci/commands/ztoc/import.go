@@ -0,0 +1,79 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/urfave/cli"
+)
+
+var importCommand = cli.Command{
+	Name:      "import",
+	Usage:     "convert a ztoc exported as JSON back to a ztoc",
+	ArgsUsage: "<json file>",
+	Description: `convert the JSON written by "soci ztoc export" back to a ztoc, write it to the
+file given with --output and print its digest. Use "-" to read the JSON from stdin.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "the file to write the ztoc to",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		if len(cliContext.Args()) != 1 {
+			return errors.New("please provide a JSON file to import")
+		}
+		outfile := cliContext.String("output")
+		if outfile == "" {
+			return errors.New("please provide the file to write the ztoc to with --output")
+		}
+
+		var r io.Reader = os.Stdin
+		if infile := cliContext.Args().First(); infile != "-" {
+			f, err := os.Open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		toc, err := ztoc.FromJSON(r)
+		if err != nil {
+			return err
+		}
+		zr, desc, err := ztoc.Marshal(toc)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Create(outfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(f, zr); err != nil {
+			return err
+		}
+		fmt.Println(desc.Digest)
+		return nil
+	},
+}
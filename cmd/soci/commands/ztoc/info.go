@@ -49,6 +49,7 @@ type FileInfo struct {
 	Type      string             `json:"type"`
 	StartSpan compression.SpanID `json:"start_span"`
 	EndSpan   compression.SpanID `json:"end_span"`
+	Digest    string             `json:"digest,omitempty"`
 }
 
 var infoCommand = cli.Command{
@@ -102,7 +103,7 @@ var infoCommand = cli.Command{
 		}
 		for _, v := range ztoc.FileMetadata {
 			startSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset)
-			endSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset + v.UncompressedSize)
+			endSpan := gzInfo.UncompressedOffsetToSpanID(v.UncompressedOffset + v.StoredSize())
 			if startSpan != endSpan {
 				multiSpanFiles++
 			}
@@ -113,6 +114,7 @@ var infoCommand = cli.Command{
 				Type:      v.Type,
 				StartSpan: startSpan,
 				EndSpan:   endSpan,
+				Digest:    v.Digest.String(),
 			})
 		}
 		zinfo.NumMultiSpanFiles = multiSpanFiles
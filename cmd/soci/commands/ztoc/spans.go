@@ -0,0 +1,101 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+type SpanInfo struct {
+	SpanID            compression.SpanID `json:"span_id"`
+	CompressedStart   compression.Offset `json:"compressed_start"`
+	CompressedEnd     compression.Offset `json:"compressed_end"`
+	UncompressedStart compression.Offset `json:"uncompressed_start"`
+	UncompressedEnd   compression.Offset `json:"uncompressed_end"`
+	Files             []string           `json:"files"`
+}
+
+var spansCommand = cli.Command{
+	Name:      "spans",
+	Usage:     "list the files in the spans of a ztoc",
+	ArgsUsage: "<digest>",
+	Description: `list the compressed and uncompressed ranges of the spans of a ztoc, along with the
+files whose content is in each span. Ranges include their start and exclude their end.`,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "span",
+			Usage: "only list the span with this ID",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		if len(cliContext.Args()) != 1 {
+			return errors.New("please provide a ztoc digest")
+		}
+		ztocDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		toc, err := getZtoc(ctx, ztocDigest)
+		if err != nil {
+			return err
+		}
+
+		var spans []ztoc.SpanFiles
+		if cliContext.IsSet("span") {
+			span, err := toc.FilesInSpan(compression.SpanID(cliContext.Int("span")))
+			if err != nil {
+				return err
+			}
+			spans = append(spans, span)
+		} else if spans, err = toc.FilesBySpan(); err != nil {
+			return err
+		}
+
+		spanInfos := make([]SpanInfo, 0, len(spans))
+		for _, span := range spans {
+			info := SpanInfo{
+				SpanID:            span.SpanID,
+				CompressedStart:   span.StartCompressedOffset,
+				CompressedEnd:     span.EndCompressedOffset,
+				UncompressedStart: span.StartUncompressedOffset,
+				UncompressedEnd:   span.EndUncompressedOffset,
+				Files:             make([]string, 0, len(span.Files)),
+			}
+			for _, f := range span.Files {
+				info.Files = append(info.Files, f.Name)
+			}
+			spanInfos = append(spanInfos, info)
+		}
+		j, err := json.MarshalIndent(spanInfos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+		return nil
+	},
+}
@@ -24,6 +24,10 @@ var Command = cli.Command{
 	Subcommands: []cli.Command{
 		infoCommand,
 		getFileCommand,
+		extractCommand,
 		listCommand,
+		exportCommand,
+		importCommand,
+		spansCommand,
 	},
 }
@@ -45,6 +45,7 @@ type FSConfig struct {
 	Debug                          bool   `toml:"debug"`
 	AllowNoVerification            bool   `toml:"allow_no_verification"`
 	DisableVerification            bool   `toml:"disable_verification"`
+	DisableFileVerification        bool   `toml:"disable_file_verification"`
 	MaxConcurrency                 int64  `toml:"max_concurrency"`
 	NoPrometheus                   bool   `toml:"no_prometheus"`
 	MountTimeoutSec                int64  `toml:"mount_timeout_sec"`
@@ -58,6 +59,10 @@ type FSConfig struct {
 	FuseConfig `toml:"fuse"`
 
 	BackgroundFetchConfig `toml:"background_fetch"`
+
+	SignatureVerificationConfig `toml:"signature_verification"`
+
+	IndexSelectionConfig `toml:"index_selection"`
 }
 
 // BlobConfig is config for layer blob management.
@@ -120,6 +125,36 @@ type BackgroundFetchConfig struct {
 	EmitMetricPeriodSec int64 `toml:"emit_metric_period_sec"`
 }
 
+// SignatureVerificationConfig is config for verifying the signatures of SOCI indices.
+type SignatureVerificationConfig struct {
+	// Require defines whether a SOCI index must have a valid signature from one of the
+	// TrustedPublicKeys before it is used to lazily load an image.
+	Require bool `toml:"require"`
+
+	// TrustedPublicKeys are the paths to PEM-encoded public keys whose signatures are trusted.
+	TrustedPublicKeys []string `toml:"trusted_public_keys"`
+}
+
+// IndexSelectionConfig is config for selecting the SOCI index of an image among several indices
+// discovered with the Referrers API (e.g., built with different span sizes or tools).
+type IndexSelectionConfig struct {
+	// Policy selects an index among the remaining candidates: "first" (the default) selects
+	// the first index returned by the registry and "newest" the most recently created one,
+	// according to the creation time recorded with `soci create --created` (or the first one
+	// if none of them has a creation time).
+	Policy string `toml:"policy"`
+
+	// PreferredBuildTool, if set, prefers the indices built by this build tool.
+	PreferredBuildTool string `toml:"preferred_build_tool"`
+
+	// PreferredSpanSize, if set, prefers the indices built with this span size. Only indices
+	// built with `soci create --span-size-annotation` record their span size.
+	PreferredSpanSize int64 `toml:"preferred_span_size"`
+
+	// RequiredAnnotations are the annotations an index must have to be selected.
+	RequiredAnnotations map[string]string `toml:"required_annotations"`
+}
+
 // RetryConfig represents the settings for retries in a retryable http client.
 type RetryConfig struct {
 	// MaxRetries is the maximum number of retries before giving up on a retryable request.
@@ -152,6 +187,22 @@ type RetryableHTTPClientConfig struct {
 	RetryConfig
 }
 
+// NewRetryableHTTPClientConfig returns a RetryableHTTPClientConfig with the default settings.
+func NewRetryableHTTPClientConfig() RetryableHTTPClientConfig {
+	return RetryableHTTPClientConfig{
+		TimeoutConfig: TimeoutConfig{
+			DialTimeoutMsec:           defaultDialTimeoutMsec,
+			ResponseHeaderTimeoutMsec: defaultResponseHeaderTimeoutMsec,
+			RequestTimeoutMsec:        defaultRequestTimeoutMsec,
+		},
+		RetryConfig: RetryConfig{
+			MaxRetries:  defaultMaxRetries,
+			MinWaitMsec: defaultMinWaitMsec,
+			MaxWaitMsec: defaultMaxWaitMsec,
+		},
+	}
+}
+
 func parseFSConfig(cfg *Config) {
 	// Parse top level fs config
 	if cfg.MountTimeoutSec == 0 {
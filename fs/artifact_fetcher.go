@@ -68,7 +68,9 @@ func newArtifactFetcher(refspec reference.Spec, localStore content.Storage, remo
 	}, nil
 }
 
-func newRemoteStore(refspec reference.Spec, httpConfig config.RetryableHTTPClientConfig) (*remote.Repository, error) {
+// NewRemoteStore creates a repository for `refspec` that authenticates with the credentials
+// of the docker config and retries requests according to `httpConfig`.
+func NewRemoteStore(refspec reference.Spec, httpConfig config.RetryableHTTPClientConfig) (*remote.Repository, error) {
 	repo, err := remote.NewRepository(refspec.Locator)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create repository %s: %w", refspec.Locator, err)
@@ -75,6 +75,9 @@ func (c *OCIArtifactClient) SelectReferrer(ctx context.Context, desc ocispec.Des
 	return fn(descs)
 }
 
+// AllReferrers returns the SOCI indices referring to the manifest `desc`. If the registry doesn't
+// support the Referrers API (i.e., it returns 404), `Inner` is expected to fall back to the
+// referrers tag schema, like an oras `remote.Repository` does.
 func (c *OCIArtifactClient) AllReferrers(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
 	descs := []ocispec.Descriptor{}
 	err := c.Referrers(ctx, desc, soci.SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
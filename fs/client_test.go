@@ -17,11 +17,17 @@
 package fs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/reference"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -104,3 +110,69 @@ func TestOCIArtifactClientSelectReferrer(t *testing.T) {
 		})
 	}
 }
+
+func TestOCIArtifactClientReferrersTagSchema(t *testing.T) {
+	testCases := []struct {
+		name         string
+		referrersAPI bool
+	}{
+		{
+			name:         "registry with referrers API",
+			referrersAPI: true,
+		},
+		{
+			name: "registry without referrers API",
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := testutil.NewRegistry(tc.referrersAPI, true)
+			defer registry.Close()
+			refspec, err := reference.Parse(registry.Host + "/test/image:latest")
+			if err != nil {
+				t.Fatalf("can't parse reference: %v", err)
+			}
+			repo, err := NewRemoteStore(refspec, config.RetryableHTTPClientConfig{})
+			if err != nil {
+				t.Fatalf("can't create remote store: %v", err)
+			}
+			repo.PlainHTTP = true
+
+			push := func(mediaType string, v interface{}) ocispec.Descriptor {
+				b, err := json.Marshal(v)
+				if err != nil {
+					t.Fatalf("can't marshal %s: %v", mediaType, err)
+				}
+				desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+				if err := repo.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+					t.Fatalf("can't push %s: %v", mediaType, err)
+				}
+				return desc
+			}
+			imageConfig := push(ocispec.MediaTypeImageConfig, ocispec.Image{})
+			manifest := push(ocispec.MediaTypeImageManifest, ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: imageConfig})
+			indexConfig := push(soci.SociIndexArtifactType, struct{}{})
+			index := push(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    indexConfig,
+				Subject:   &manifest,
+			})
+
+			// the snapshotter discovers indices with a new repository for each image.
+			repo, err = NewRemoteStore(refspec, config.RetryableHTTPClientConfig{})
+			if err != nil {
+				t.Fatalf("can't create remote store: %v", err)
+			}
+			repo.PlainHTTP = true
+			desc, err := NewOCIArtifactClient(repo).SelectReferrer(ctx, ocispec.Descriptor{Digest: manifest.Digest}, SelectFirstPolicy)
+			if err != nil {
+				t.Fatalf("can't select referrer %v", err)
+			}
+			if desc.Digest != index.Digest {
+				t.Fatalf("unexpected referrer . expect: %v, actual: %v", index.Digest, desc.Digest)
+			}
+		})
+	}
+}
@@ -76,8 +76,7 @@ import (
 )
 
 var (
-	defaultIndexSelectionPolicy = SelectFirstPolicy
-	fusermountBin               = "fusermount"
+	fusermountBin = "fusermount"
 )
 
 type Option func(*options)
@@ -148,6 +147,15 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		return nil, fmt.Errorf("cannot create local store: %w", err)
 	}
 
+	verifier, err := newIndexVerifier(cfg.SignatureVerificationConfig)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := newIndexSelector(cfg.IndexSelectionConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	var bgFetcher *bf.BackgroundFetcher
 
 	if !cfg.BackgroundFetchConfig.Disable {
@@ -206,6 +214,8 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		negativeTimeout:             negativeTimeout,
 		httpConfig:                  cfg.RetryableHTTPClientConfig,
 		orasStore:                   store,
+		indexVerifier:               verifier,
+		indexSelector:               selector,
 		bgFetcher:                   bgFetcher,
 		mountTimeout:                mountTimeout,
 		fuseMetricsEmitWaitDuration: fuseMetricsEmitWaitDuration,
@@ -222,7 +232,7 @@ type sociContext struct {
 	fuseOperationCounter *layer.FuseOperationCounter
 }
 
-func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store orascontent.Storage, fuseOpEmitWaitDuration time.Duration, httpConfig config.RetryableHTTPClientConfig) error {
+func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store orascontent.Storage, fuseOpEmitWaitDuration time.Duration, httpConfig config.RetryableHTTPClientConfig, verifier *indexVerifier, selector *indexSelector) error {
 	var retErr error
 	c.fetchOnce.Do(func() {
 		defer func() {
@@ -239,7 +249,7 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 			return
 		}
 
-		remoteStore, err := newRemoteStore(refspec, httpConfig)
+		remoteStore, err := NewRemoteStore(refspec, httpConfig)
 		if err != nil {
 			retErr = err
 			return
@@ -250,6 +260,15 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 			Digest: digest.Digest(indexDigest),
 		}
 
+		var fetcher Fetcher
+		if verifier != nil {
+			fetcher, err = newArtifactFetcher(refspec, store, remoteStore)
+			if err != nil {
+				retErr = err
+				return
+			}
+		}
+
 		if indexDigest == "" {
 			log.G(ctx).Info("index digest not provided, making a Referrers API call to fetch list of indices")
 			imgDigest, err := digest.Parse(imageManifestDigest)
@@ -257,12 +276,22 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 				retErr = fmt.Errorf("unable to parse image digest: %w", err)
 			}
 
-			desc, err := client.SelectReferrer(ctx, ocispec.Descriptor{Digest: imgDigest}, defaultIndexSelectionPolicy)
+			policy := selector.Policy(ctx)
+			if verifier != nil {
+				// only the indices with a valid signature can be selected.
+				policy = verifier.Policy(ctx, remoteStore, fetcher, policy)
+			}
+			desc, err := client.SelectReferrer(ctx, ocispec.Descriptor{Digest: imgDigest}, policy)
 			if err != nil {
 				retErr = fmt.Errorf("cannot fetch list of referrers: %w", err)
 				return
 			}
 			indexDesc = desc
+		} else if verifier != nil {
+			if err := verifier.Verify(ctx, indexDesc, remoteStore, fetcher); err != nil {
+				retErr = fmt.Errorf("cannot verify SOCI index signature: %w", err)
+				return
+			}
 		}
 
 		log.G(ctx).WithField("digest", indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
@@ -310,6 +339,8 @@ type filesystem struct {
 	httpConfig                  config.RetryableHTTPClientConfig
 	sociContexts                sync.Map
 	orasStore                   orascontent.Storage
+	indexVerifier               *indexVerifier
+	indexSelector               *indexSelector
 	bgFetcher                   *bf.BackgroundFetcher
 	mountTimeout                time.Duration
 	fuseMetricsEmitWaitDuration time.Duration
@@ -334,7 +365,7 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	if err != nil {
 		return fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
 	}
-	remoteStore, err := newRemoteStore(refspec, fs.httpConfig)
+	remoteStore, err := NewRemoteStore(refspec, fs.httpConfig)
 	if err != nil {
 		return fmt.Errorf("cannot create remote store: %w", err)
 	}
@@ -358,7 +389,7 @@ func (fs *filesystem) getSociContext(ctx context.Context, imageRef, indexDigest,
 	if !ok {
 		return nil, fmt.Errorf("could not load index: fs soci context is invalid type for %s", indexDigest)
 	}
-	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.orasStore, fs.fuseMetricsEmitWaitDuration, fs.httpConfig)
+	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.orasStore, fs.fuseMetricsEmitWaitDuration, fs.httpConfig, fs.indexVerifier, fs.indexSelector)
 	return c, err
 }
 
@@ -0,0 +1,170 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// IndexSelectionFirst selects the first index returned by the registry.
+	IndexSelectionFirst = "first"
+	// IndexSelectionNewest selects the most recently created index.
+	IndexSelectionNewest = "newest"
+)
+
+var (
+	// ErrNoMatchingIndex is returned if none of the indices of an image has the required annotations.
+	ErrNoMatchingIndex = errors.New("no SOCI index has the required annotations")
+)
+
+// SelectNewestPolicy selects the index with the most recent creation annotation.
+// Indices without a valid creation annotation (e.g., built without `soci create --created`)
+// are considered older than all others.
+func SelectNewestPolicy(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	newest := 0
+	newestTime, _ := createdAt(descs[0])
+	for i, desc := range descs[1:] {
+		if t, ok := createdAt(desc); ok && t.After(newestTime) {
+			newest, newestTime = i+1, t
+		}
+	}
+	return descs[newest], nil
+}
+
+// createdAt returns the creation time of an index from its annotations.
+func createdAt(desc ocispec.Descriptor) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, desc.Annotations[ocispec.AnnotationCreated])
+	return t, err == nil
+}
+
+// anyCreated returns whether any of the indices has a valid creation annotation.
+func anyCreated(descs []ocispec.Descriptor) bool {
+	for _, desc := range descs {
+		if _, ok := createdAt(desc); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// indexSelector selects the SOCI index of an image among the indices discovered with the Referrers API.
+type indexSelector struct {
+	cfg    config.IndexSelectionConfig
+	policy IndexSelectionPolicy
+}
+
+// newIndexSelector creates an indexSelector from the config.
+func newIndexSelector(cfg config.IndexSelectionConfig) (*indexSelector, error) {
+	var policy IndexSelectionPolicy
+	switch cfg.Policy {
+	case "", IndexSelectionFirst:
+		policy = SelectFirstPolicy
+	case IndexSelectionNewest:
+		policy = SelectNewestPolicy
+	default:
+		return nil, fmt.Errorf("unknown index selection policy %q, must be %q or %q", cfg.Policy, IndexSelectionFirst, IndexSelectionNewest)
+	}
+	if cfg.PreferredSpanSize < 0 {
+		return nil, fmt.Errorf("preferred span size must be non-negative, got %d", cfg.PreferredSpanSize)
+	}
+	return &indexSelector{cfg: cfg, policy: policy}, nil
+}
+
+// Policy returns an IndexSelectionPolicy that discards the indices without the required annotations,
+// narrows the remaining ones down to those built by the preferred build tool and with the preferred
+// span size (if any of them is), and selects one of them with the configured policy.
+// The selected index and the reason it was selected are logged with `ctx`.
+func (s *indexSelector) Policy(ctx context.Context) IndexSelectionPolicy {
+	return func(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
+		var reasons []string
+		if len(s.cfg.RequiredAnnotations) != 0 {
+			descs = filterIndices(descs, func(desc ocispec.Descriptor) bool {
+				for k, v := range s.cfg.RequiredAnnotations {
+					if desc.Annotations[k] != v {
+						return false
+					}
+				}
+				return true
+			})
+			if len(descs) == 0 {
+				return ocispec.Descriptor{}, ErrNoMatchingIndex
+			}
+			reasons = append(reasons, "has the required annotations")
+		}
+		if s.cfg.PreferredBuildTool != "" {
+			if preferred := filterIndices(descs, func(desc ocispec.Descriptor) bool {
+				return desc.Annotations[soci.IndexAnnotationBuildToolIdentifier] == s.cfg.PreferredBuildTool
+			}); len(preferred) != 0 {
+				descs = preferred
+				reasons = append(reasons, fmt.Sprintf("built by the preferred build tool %q", s.cfg.PreferredBuildTool))
+			}
+		}
+		if s.cfg.PreferredSpanSize != 0 {
+			spanSize := strconv.FormatInt(s.cfg.PreferredSpanSize, 10)
+			if preferred := filterIndices(descs, func(desc ocispec.Descriptor) bool {
+				return desc.Annotations[soci.IndexAnnotationSpanSize] == spanSize
+			}); len(preferred) != 0 {
+				descs = preferred
+				reasons = append(reasons, fmt.Sprintf("built with the preferred span size %s", spanSize))
+			}
+		}
+
+		desc, err := s.policy(descs)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if len(descs) > 1 {
+			policy := s.cfg.Policy
+			if policy == "" {
+				policy = IndexSelectionFirst
+			}
+			if policy == IndexSelectionNewest && !anyCreated(descs) {
+				// SelectNewestPolicy has nothing to compare, so it keeps the first of the preferred candidates.
+				log.G(ctx).Warnf("none of the %d candidate SOCI indices has a creation annotation, selecting the first one", len(descs))
+				policy = IndexSelectionFirst + " (no creation annotation)"
+			}
+			reasons = append(reasons, fmt.Sprintf("%s of %d candidates", policy, len(descs)))
+		} else {
+			reasons = append(reasons, "only candidate")
+		}
+		log.G(ctx).WithField("digest", desc.Digest.String()).WithField("reason", strings.Join(reasons, ", ")).
+			Info("selected SOCI index")
+		return desc, nil
+	}
+}
+
+// filterIndices returns the descriptors for which `keep` returns true, in their original order.
+func filterIndices(descs []ocispec.Descriptor, keep func(ocispec.Descriptor) bool) []ocispec.Descriptor {
+	var filtered []ocispec.Descriptor
+	for _, desc := range descs {
+		if keep(desc) {
+			filtered = append(filtered, desc)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,167 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIndexSelector(t *testing.T) {
+	index := func(name, created, tool, spanSize string, annotations ...string) ocispec.Descriptor {
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(name),
+			Size:      int64(len(name)),
+			Annotations: map[string]string{
+				ocispec.AnnotationCreated:               created,
+				soci.IndexAnnotationBuildToolIdentifier: tool,
+				soci.IndexAnnotationSpanSize:            spanSize,
+			},
+		}
+		for i := 0; i+1 < len(annotations); i += 2 {
+			desc.Annotations[annotations[i]] = annotations[i+1]
+		}
+		return desc
+	}
+	old := index("old", "2023-01-01T00:00:00Z", "AWS SOCI CLI v0.3.0", "4194304", "team", "a")
+	newest := index("newest", "2023-03-01T00:00:00Z", "other tool", "4194304", "team", "b")
+	small := index("small", "2023-02-01T00:00:00Z", "AWS SOCI CLI v0.3.0", "1048576")
+	undated := index("undated", "", "other tool", "1048576")
+	// built with the defaults of `soci create`, i.e., without creation and span size annotations.
+	plain := index("plain", "", "AWS SOCI CLI v0.3.0", "")
+	descs := []ocispec.Descriptor{old, newest, small, undated}
+
+	testCases := []struct {
+		name          string
+		cfg           config.IndexSelectionConfig
+		descs         []ocispec.Descriptor
+		expected      ocispec.Descriptor
+		expectedError error
+	}{
+		{
+			name:     "default selects the first index",
+			descs:    descs,
+			expected: old,
+		},
+		{
+			name:     "newest",
+			cfg:      config.IndexSelectionConfig{Policy: IndexSelectionNewest},
+			descs:    descs,
+			expected: newest,
+		},
+		{
+			name:     "newest ignores undated indices",
+			cfg:      config.IndexSelectionConfig{Policy: IndexSelectionNewest},
+			descs:    []ocispec.Descriptor{undated, small},
+			expected: small,
+		},
+		{
+			name:     "newest without creation annotations selects the first index",
+			cfg:      config.IndexSelectionConfig{Policy: IndexSelectionNewest},
+			descs:    []ocispec.Descriptor{undated, plain},
+			expected: undated,
+		},
+		{
+			name:     "newest without creation annotations keeps the preferences",
+			cfg:      config.IndexSelectionConfig{Policy: IndexSelectionNewest, PreferredBuildTool: "AWS SOCI CLI v0.3.0"},
+			descs:    []ocispec.Descriptor{undated, plain},
+			expected: plain,
+		},
+		{
+			name:     "preferred span size doesn't match indices without the annotation",
+			cfg:      config.IndexSelectionConfig{PreferredSpanSize: 1 << 22},
+			descs:    []ocispec.Descriptor{plain, old},
+			expected: old,
+		},
+		{
+			name:     "preferred build tool",
+			cfg:      config.IndexSelectionConfig{Policy: IndexSelectionNewest, PreferredBuildTool: "AWS SOCI CLI v0.3.0"},
+			descs:    descs,
+			expected: small,
+		},
+		{
+			name:     "missing preferred build tool falls back to all indices",
+			cfg:      config.IndexSelectionConfig{PreferredBuildTool: "unknown"},
+			descs:    descs,
+			expected: old,
+		},
+		{
+			name:     "preferred span size",
+			cfg:      config.IndexSelectionConfig{PreferredSpanSize: 1 << 20},
+			descs:    descs,
+			expected: small,
+		},
+		{
+			name:     "preferred build tool and span size",
+			cfg:      config.IndexSelectionConfig{PreferredBuildTool: "other tool", PreferredSpanSize: 1 << 20},
+			descs:    descs,
+			expected: undated,
+		},
+		{
+			name:     "required annotations",
+			cfg:      config.IndexSelectionConfig{RequiredAnnotations: map[string]string{"team": "b"}},
+			descs:    descs,
+			expected: newest,
+		},
+		{
+			name:     "required annotations take precedence over preferences",
+			cfg:      config.IndexSelectionConfig{PreferredSpanSize: 1 << 20, RequiredAnnotations: map[string]string{"team": "a"}},
+			descs:    descs,
+			expected: old,
+		},
+		{
+			name:          "no index with the required annotations",
+			cfg:           config.IndexSelectionConfig{RequiredAnnotations: map[string]string{"team": "c"}},
+			descs:         descs,
+			expectedError: ErrNoMatchingIndex,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			selector, err := newIndexSelector(tc.cfg)
+			if err != nil {
+				t.Fatalf("can't create index selector: %v", err)
+			}
+			desc, err := selector.Policy(context.Background())(tc.descs)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expectedError, err)
+			}
+			if tc.expectedError == nil && desc.Digest != tc.expected.Digest {
+				t.Fatalf("unexpected index. expect: %v, actual: %v", tc.expected.Digest, desc.Digest)
+			}
+		})
+	}
+}
+
+func TestNewIndexSelectorInvalidConfig(t *testing.T) {
+	for _, cfg := range []config.IndexSelectionConfig{
+		{Policy: "oldest"},
+		{PreferredSpanSize: -1},
+	} {
+		if _, err := newIndexSelector(cfg); err == nil {
+			t.Fatalf("expected error creating index selector from %+v, but got nil", cfg)
+		}
+	}
+}
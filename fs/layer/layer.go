@@ -301,6 +301,10 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		return nil, fmt.Errorf("download and unpack this layer in container runtime for now")
 	}
 
+	if err := ztoc.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid ztoc %v of layer %v: %w", sociDesc.Digest, desc.Digest, err)
+	}
+
 	// log ztoc info
 	log.G(context.Background()).WithFields(logrus.Fields{
 		"layer_sha":      desc.Digest,
@@ -334,7 +338,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		bgLayerResolver = backgroundfetcher.NewSequentialResolver(desc.Digest, spanManager)
 		r.bgFetcher.Add(bgLayerResolver)
 	}
-	vr, err := reader.NewReader(meta, desc.Digest, spanManager)
+	vr, err := reader.NewReader(meta, desc.Digest, spanManager, reader.WithFileVerification(!r.config.DisableVerification && !r.config.DisableFileVerification))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read layer: %w", err)
 	}
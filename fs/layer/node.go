@@ -819,7 +819,14 @@ func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr
 		out.Blocks++
 	}
 	mtime := e.ModTime
-	out.SetTimes(nil, &mtime, nil)
+	var atime, ctime *time.Time
+	if !e.AccessTime.IsZero() {
+		atime = &e.AccessTime
+	}
+	if !e.ChangeTime.IsZero() {
+		ctime = &e.ChangeTime
+	}
+	out.SetTimes(atime, &mtime, ctime)
 	out.Mode = fileModeToSystemMode(e.Mode)
 	out.Owner = fuse.Owner{Uid: uint32(e.UID), Gid: uint32(e.GID)}
 	out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
@@ -80,6 +80,12 @@ const (
 var testStateLayerDigest = digest.FromString("dummy")
 var spanSizeCond = [3]int64{64, 128, 256}
 
+var (
+	sampleModTime    = time.Date(2021, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	sampleAccessTime = time.Date(2022, 3, 4, 5, 6, 7, 1, time.UTC)
+	sampleChangeTime = time.Date(2023, 4, 5, 6, 7, 8, 999999999, time.UTC)
+)
+
 func testNodeRead(t *testing.T, factory metadata.Store) {
 	sizeCond := map[string]int64{
 		"single_span": sampleSpanSize - sampleMiddleOffset,
@@ -315,6 +321,26 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 				hasSize("test", len("target")),
 			},
 		},
+		{
+			name: "file_pax_times",
+			in: []testutil.TarEntry{
+				testutil.File("test", "test", testutil.WithFileModTime(sampleModTime),
+					testutil.WithFileAccessTime(sampleAccessTime), testutil.WithFileChangeTime(sampleChangeTime)),
+			},
+			want: []check{
+				hasTimes("test", sampleModTime, sampleAccessTime, sampleChangeTime),
+			},
+		},
+		{
+			name: "sparse_file",
+			in: []testutil.TarEntry{
+				testutil.SparseFile("test", 1000, []testutil.SparseFragment{{Offset: 100, Data: "test"}}, testutil.SparseGNU),
+			},
+			want: []check{
+				hasSize("test", 1000),
+				hasFileDigest("test", digestFor(string(make([]byte, 100))+"test"+string(make([]byte, 896)))),
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -362,6 +388,22 @@ func hasSize(name string, size int) check {
 	}
 }
 
+func hasTimes(name string, mtime, atime, ctime time.Time) check {
+	return func(t *testing.T, root *node) {
+		_, n, err := getDirentAndNode(t, root, name)
+		if err != nil {
+			t.Fatalf("failed to get node %q: %v", name, err)
+		}
+		var ao fuse.AttrOut
+		if errno := n.Operations().(fusefs.NodeGetattrer).Getattr(context.Background(), nil, &ao); errno != 0 {
+			t.Fatalf("failed to get attributes of node %q: %v", name, errno)
+		}
+		if !ao.Attr.ModTime().Equal(mtime) || !ao.Attr.AccessTime().Equal(atime) || !ao.Attr.ChangeTime().Equal(ctime) {
+			t.Fatalf("got times = %v, %v, %v, want %v, %v, %v", ao.Attr.ModTime(), ao.Attr.AccessTime(), ao.Attr.ChangeTime(), mtime, atime, ctime)
+		}
+	}
+}
+
 func getRootNode(t *testing.T, r reader.Reader, opaque OverlayOpaqueType) *node {
 	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque, false, nil)
 	if err != nil {
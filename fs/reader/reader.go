@@ -49,6 +49,7 @@ import (
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/hashicorp/go-multierror"
 	digest "github.com/opencontainers/go-digest"
@@ -121,13 +122,33 @@ func (vr *VerifiableReader) isClosed() bool {
 	return closed
 }
 
+// ReaderOption is an option of NewReader.
+type ReaderOption func(*reader)
+
+// WithFileVerification enables or disables the verification of file contents against
+// the digests recorded in the ztoc. It is enabled by default and independent of SkipVerify.
+// Only files read sequentially to the end are verified, so verification never fetches
+// more of the layer than what is read.
+func WithFileVerification(enable bool) ReaderOption {
+	return func(gr *reader) {
+		gr.verifyFiles = enable
+	}
+}
+
 // NewReader creates a Reader based on the given soci blob and Span Manager.
-func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, opts ...ReaderOption) (*VerifiableReader, error) {
 	vr := &reader{
 		spanManager: spanManager,
 		r:           r,
 		layerSha:    layerSha,
 		verifier:    digestVerifier,
+		verifyFiles: true,
+
+		pendingFiles:  make(map[uint32]*pendingFile),
+		verifiedFiles: make(map[uint32]error),
+	}
+	for _, o := range opts {
+		o(vr)
 	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
@@ -145,6 +166,22 @@ type reader struct {
 
 	verify   bool
 	verifier func(uint32, string) (digest.Verifier, error)
+
+	// verifyFiles enables the verification of file contents against the
+	// digests recorded in the ztoc (available since ztoc version 1.0).
+	// pendingFiles holds the files being read sequentially, which are verified once read
+	// to the end, and verifiedFiles holds the result of each verified file (nil if the
+	// content matches its digest).
+	verifyFiles     bool
+	pendingFiles    map[uint32]*pendingFile
+	verifiedFiles   map[uint32]error
+	verifiedFilesMu sync.Mutex
+}
+
+// pendingFile is the verification of a file being read sequentially, up to offset `next`.
+type pendingFile struct {
+	v    digest.Verifier
+	next int64
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -187,6 +224,10 @@ func (gr *reader) Close() (retErr error) {
 		return nil
 	}
 	gr.closed = true
+	// drops the verifications of the files that weren't read to the end.
+	gr.verifiedFilesMu.Lock()
+	gr.pendingFiles = make(map[uint32]*pendingFile)
+	gr.verifiedFilesMu.Unlock()
 	if err := gr.r.Close(); err != nil {
 		retErr = multierror.Append(retErr, err)
 	}
@@ -215,30 +256,125 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	if compression.Offset(offset) >= uncompFileSize {
 		return 0, io.EOF
 	}
+	if sf.gr.verifyFiles {
+		if verified, err := sf.gr.fileVerification(sf.id); verified && err != nil {
+			return 0, err
+		}
+	}
 	expectedSize := uncompFileSize - compression.Offset(offset)
 	if expectedSize > compression.Offset(len(p)) {
 		expectedSize = compression.Offset(len(p))
 	}
-	fileOffsetStart := sf.fr.GetUncompressedOffset() + compression.Offset(offset)
-	fileOffsetEnd := fileOffsetStart + expectedSize
-	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read the file: %w", err)
-	}
 
 	// TODO this is not the right place for this metric to be. It needs to go down the BlobReader, when the HTTP request is issued
 	commonmetrics.IncOperationCount(commonmetrics.SynchronousReadRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
 	sf.gr.setLastReadTime(time.Now())
 
-	n, err := io.ReadFull(r, p[0:expectedSize])
-	if err != nil {
+	n, err := sf.content().ReadAt(p[0:expectedSize], offset)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read the file: %w", err)
+	}
+	if n != int(expectedSize) {
 		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, expectedSize)
 	}
 	commonmetrics.AddBytesCount(commonmetrics.SynchronousBytesServed, sf.gr.layerSha, int64(n)) // measure the number of bytes served synchronously
 
+	if sf.gr.verifyFiles {
+		if err := sf.verifyRead(p[:n], offset); err != nil {
+			return 0, err
+		}
+	}
 	return n, nil
 }
 
+// content returns a reader of the content of the file, which expands the holes of sparse files.
+func (sf *file) content() io.ReaderAt {
+	data := storedReaderAt{sf}
+	if sparseMap := sf.fr.GetSparseMap(); sparseMap != nil {
+		return ztoc.NewSparseReaderAt(data, sparseMap, sf.fr.GetUncompressedFileSize())
+	}
+	return data
+}
+
+// storedReaderAt reads the data of a file stored in the uncompressed layer, which is only
+// the data fragments of sparse files.
+type storedReaderAt struct {
+	sf *file
+}
+
+func (r storedReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	start := r.sf.fr.GetUncompressedOffset() + compression.Offset(offset)
+	rd, err := r.sf.gr.spanManager.GetContents(start, start+compression.Offset(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return io.ReadFull(rd, p)
+}
+
+// verifyRead feeds `p`, read at `offset`, to the verification of the file. Files are verified
+// as they are read sequentially from the beginning to the end, so that verification doesn't
+// fetch more than what is read: the read that reaches the end of the file fails if the file
+// doesn't match its digest, and so do the reads after it. Files read in another order and files
+// without a digest (e.g., from a 0.9 ztoc) are not verified.
+func (sf *file) verifyRead(p []byte, offset int64) error {
+	dgst := sf.fr.GetDigest()
+	if dgst == "" {
+		return nil
+	}
+	gr := sf.gr
+	gr.verifiedFilesMu.Lock()
+	defer gr.verifiedFilesMu.Unlock()
+	if err, verified := gr.verifiedFiles[sf.id]; verified {
+		return err
+	}
+	pending, ok := gr.pendingFiles[sf.id]
+	if !ok {
+		if offset != 0 {
+			return nil
+		}
+		v, err := gr.verifier(sf.id, dgst.String())
+		if err != nil {
+			return fmt.Errorf("invalid digest of file %d: %w", sf.id, err)
+		}
+		pending = &pendingFile{v: v}
+		gr.pendingFiles[sf.id] = pending
+	}
+	end := offset + int64(len(p))
+	if offset > pending.next {
+		// the file isn't read sequentially, so it can't be verified without fetching the skipped data.
+		delete(gr.pendingFiles, sf.id)
+		return nil
+	}
+	if end <= pending.next {
+		// data that was already verified is read again.
+		return nil
+	}
+	pending.v.Write(p[pending.next-offset:])
+	pending.next = end
+	if end < int64(sf.fr.GetUncompressedFileSize()) {
+		return nil
+	}
+	delete(gr.pendingFiles, sf.id)
+	err := sf.checkVerified(pending.v)
+	gr.verifiedFiles[sf.id] = err
+	return err
+}
+
+func (sf *file) checkVerified(v digest.Verifier) error {
+	if !v.Verified() {
+		return fmt.Errorf("invalid content of file %d: digest mismatch, expected %s", sf.id, sf.fr.GetDigest())
+	}
+	return nil
+}
+
+// fileVerification returns the result of the verification of file `id`, if it was verified.
+func (gr *reader) fileVerification(id uint32) (bool, error) {
+	gr.verifiedFilesMu.Lock()
+	defer gr.verifiedFilesMu.Unlock()
+	err, verified := gr.verifiedFiles[id]
+	return verified, err
+}
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
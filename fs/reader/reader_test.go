@@ -66,6 +66,8 @@ var spanSizeCond = [3]int64{64, 128, 256}
 func TestFsReader(t *testing.T) {
 	testFileReadAt(t, metadata.NewTempDbStore)
 	testFailReader(t, metadata.NewTempDbStore)
+	testFileDigestVerification(t, metadata.NewTempDbStore)
+	testSparseFileReadAt(t, metadata.NewTempDbStore)
 }
 
 func testFileReadAt(t *testing.T, factory metadata.Store) {
@@ -243,3 +245,221 @@ func testFailReader(t *testing.T, factory metadata.Store) {
 		})
 	}
 }
+
+func testSparseFileReadAt(t *testing.T, factory metadata.Store) {
+	testFileName := "sparse"
+	fragments := []testutil.SparseFragment{
+		{Offset: 100, Data: sampleData1},
+		{Offset: 300, Data: sampleData1 + sampleData1},
+		{Offset: 1000, Data: sampleData1},
+	}
+	expected := make([]byte, 2000)
+	for _, f := range fragments {
+		copy(expected[f.Offset:], f.Data)
+	}
+	formats := map[string]testutil.SparseFormat{
+		"gnu":    testutil.SparseGNU,
+		"pax0.1": testutil.SparsePAX01,
+		"pax1.0": testutil.SparsePAX10,
+	}
+	for fn, format := range formats {
+		for _, spanSize := range spanSizeCond {
+			t.Run(fmt.Sprintf("reading_sparse_%s_spansize_%d", fn, spanSize), func(t *testing.T) {
+				tarEntry := []testutil.TarEntry{
+					testutil.File("before", sampleData1),
+					testutil.SparseFile(testFileName, int64(len(expected)), fragments, format),
+					testutil.File("after", sampleData1),
+				}
+				ztoc, sr, err := ztoc.BuildZtocReader(t, tarEntry, gzip.DefaultCompression, spanSize)
+				if err != nil {
+					t.Fatalf("failed to build sample ztoc: %v", err)
+				}
+				mr, err := factory(sr, ztoc.TOC)
+				if err != nil {
+					t.Fatalf("failed to prepare metadata reader")
+				}
+				spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache(), 0)
+				vr, err := NewReader(mr, digest.FromString(""), spanManager)
+				if err != nil {
+					mr.Close()
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				defer vr.Close()
+				tid, attr, err := mr.GetChild(mr.RootID(), testFileName)
+				if err != nil {
+					t.Fatalf("failed to get %q: %v", testFileName, err)
+				}
+				if attr.Size != int64(len(expected)) {
+					t.Fatalf("unexpected size of sparse file. expect: %d, actual: %d", len(expected), attr.Size)
+				}
+				fr, err := vr.GetReader().OpenFile(tid)
+				if err != nil {
+					t.Fatalf("failed to open file but wanted to succeed: %v", err)
+				}
+
+				// reads across holes and fragments, including the verification of the whole file.
+				for _, window := range []struct{ offset, size int64 }{
+					{0, int64(len(expected))},
+					{95, 20},
+					{150, 100},
+					{305, 800},
+					{1990, 100},
+				} {
+					p := make([]byte, window.size)
+					n, err := fr.ReadAt(p, window.offset)
+					if err != nil && err != io.EOF {
+						t.Fatalf("failed to read %d bytes at %d: %v", window.size, window.offset, err)
+					}
+					end := window.offset + window.size
+					if end > int64(len(expected)) {
+						end = int64(len(expected))
+					}
+					if !bytes.Equal(p[:n], expected[window.offset:end]) {
+						t.Fatalf("unexpected content at %d: %q", window.offset, p[:n])
+					}
+				}
+			})
+		}
+	}
+}
+
+func testFileDigestVerification(t *testing.T, factory metadata.Store) {
+	testFileName := "test"
+	tarEntry := []testutil.TarEntry{
+		testutil.File(testFileName, sampleData1),
+	}
+	testCases := []struct {
+		name                    string
+		digest                  digest.Digest
+		skipVerify              bool
+		disableFileVerification bool
+		expectError             bool
+	}{
+		{
+			name:        "file with matching digest is read",
+			digest:      digest.FromString(sampleData1),
+			expectError: false,
+		},
+		{
+			name:        "file without digest is read",
+			digest:      "",
+			expectError: false,
+		},
+		{
+			name:        "file with mismatching digest is not read",
+			digest:      digest.FromString("foobar"),
+			expectError: true,
+		},
+		{
+			name:        "file with mismatching digest is not read if layer verification is skipped",
+			digest:      digest.FromString("foobar"),
+			skipVerify:  true,
+			expectError: true,
+		},
+		{
+			name:                    "file with mismatching digest is read if file verification is disabled",
+			digest:                  digest.FromString("foobar"),
+			disableFileVerification: true,
+			expectError:             false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, sr, err := ztoc.BuildZtocReader(t, tarEntry, gzip.DefaultCompression, sampleSpanSize)
+			if err != nil {
+				t.Fatalf("failed to build sample ztoc: %v", err)
+			}
+			for i := range ztoc.FileMetadata {
+				if ztoc.FileMetadata[i].Name == testFileName {
+					ztoc.FileMetadata[i].Digest = tc.digest
+				}
+			}
+
+			mr, err := factory(sr, ztoc.TOC)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader")
+			}
+			spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache(), 0)
+			vr, err := NewReader(mr, digest.FromString(""), spanManager, WithFileVerification(!tc.disableFileVerification))
+			if err != nil {
+				mr.Close()
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r := Reader(vr.GetReader())
+			if tc.skipVerify {
+				r = vr.SkipVerify()
+			}
+
+			tid, _, err := mr.GetChild(mr.RootID(), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			open := func() io.ReaderAt {
+				fr, err := r.OpenFile(tid)
+				if err != nil {
+					t.Fatalf("failed to open file but wanted to succeed: %v", err)
+				}
+				return fr
+			}
+			checkError := func(err error) {
+				t.Helper()
+				if tc.expectError != (err != nil && err != io.EOF) {
+					t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+				}
+			}
+
+			gr := vr.GetReader()
+			resetVerification := func() {
+				gr.verifiedFilesMu.Lock()
+				gr.verifiedFiles = make(map[uint32]error)
+				gr.verifiedFilesMu.Unlock()
+			}
+			readAt := func(fr io.ReaderAt, size int, offset int64) error {
+				_, err := fr.ReadAt(make([]byte, size), offset)
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+
+			// reads out of order are served without verifying the file.
+			fr := open()
+			if err := readAt(fr, 1, int64(len(sampleData1)-1)); err != nil {
+				t.Fatalf("failed to read the end of the file: %v", err)
+			}
+			if err := readAt(fr, 2, 0); err != nil {
+				t.Fatalf("failed to read the beginning of the file: %v", err)
+			}
+			if err := readAt(fr, 2, 4); err != nil {
+				t.Fatalf("failed to read the file out of order: %v", err)
+			}
+
+			// the file is verified by the read that reaches its end when it is read sequentially,
+			// including overlapping reads, and the reads after it fail if it doesn't match its digest.
+			fr = open()
+			if err := readAt(fr, 4, 0); err != nil {
+				t.Fatalf("failed to read the beginning of the file: %v", err)
+			}
+			if err := readAt(fr, 4, 2); err != nil {
+				t.Fatalf("failed to read the file sequentially: %v", err)
+			}
+			checkError(readAt(fr, len(sampleData1)-6, 6))
+			checkError(readAt(fr, 1, 0))
+
+			// a read of the whole file is verified before it is served.
+			resetVerification()
+			checkError(readAt(open(), len(sampleData1), 0))
+
+			// pending verifications are dropped when the reader is closed.
+			resetVerification()
+			if err := readAt(open(), 1, 0); err != nil {
+				t.Fatalf("failed to read the beginning of the file: %v", err)
+			}
+			vr.Close()
+			if len(gr.pendingFiles) != 0 {
+				t.Fatalf("pending verifications are not dropped on close: %d", len(gr.pendingFiles))
+			}
+		})
+	}
+}
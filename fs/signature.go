@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+var (
+	// ErrNoTrustedSignature is returned if signature verification is required
+	// and a SOCI index has no valid signature from a trusted key.
+	ErrNoTrustedSignature = errors.New("no valid signature from a trusted key")
+)
+
+// indexVerifier verifies that SOCI indices are signed by trusted keys before they are used.
+type indexVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// newIndexVerifier creates an indexVerifier from the config.
+// It returns nil if signature verification is not required.
+func newIndexVerifier(cfg config.SignatureVerificationConfig) (*indexVerifier, error) {
+	if !cfg.Require {
+		return nil, nil
+	}
+	if len(cfg.TrustedPublicKeys) == 0 {
+		return nil, errors.New("signature verification is required, but no trusted public keys are configured")
+	}
+	keys, err := soci.LoadVerificationKeys(cfg.TrustedPublicKeys)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load trusted public keys: %w", err)
+	}
+	return &indexVerifier{keys: keys}, nil
+}
+
+// Verify lists the signatures referring to the index with `referrers`, fetches them with `fetcher`,
+// and returns nil if at least one of them is a valid signature from a trusted key.
+func (v *indexVerifier) Verify(ctx context.Context, indexDesc ocispec.Descriptor, referrers ReferrersCaller, fetcher Fetcher) error {
+	var descs []ocispec.Descriptor
+	err := referrers.Referrers(ctx, ocispec.Descriptor{Digest: indexDesc.Digest}, soci.SociSignatureArtifactType, func(r []ocispec.Descriptor) error {
+		descs = append(descs, r...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to fetch signatures of index %v: %w", indexDesc.Digest, err)
+	}
+
+	for _, desc := range descs {
+		err := v.verifySignature(ctx, indexDesc, desc, fetcher)
+		if err == nil {
+			log.G(ctx).WithField("digest", indexDesc.Digest.String()).WithField("signature", desc.Digest.String()).
+				Info("verified SOCI index signature")
+			return nil
+		}
+		log.G(ctx).WithError(err).WithField("signature", desc.Digest.String()).Warn("invalid SOCI index signature")
+	}
+	return fmt.Errorf("%w: index %v has %d signatures", ErrNoTrustedSignature, indexDesc.Digest, len(descs))
+}
+
+// Policy returns an IndexSelectionPolicy that discards the indices without a valid signature from
+// a trusted key and selects one of the remaining ones with `policy`, so that an index without a
+// valid signature is never selected over a signed one.
+func (v *indexVerifier) Policy(ctx context.Context, referrers ReferrersCaller, fetcher Fetcher, policy IndexSelectionPolicy) IndexSelectionPolicy {
+	return func(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
+		signed := filterIndices(descs, func(desc ocispec.Descriptor) bool {
+			if err := v.Verify(ctx, desc, referrers, fetcher); err != nil {
+				log.G(ctx).WithError(err).WithField("digest", desc.Digest.String()).Warn("skipping SOCI index without a trusted signature")
+				return false
+			}
+			return true
+		})
+		if len(signed) == 0 {
+			return ocispec.Descriptor{}, fmt.Errorf("%w: none of the %d indices is signed", ErrNoTrustedSignature, len(descs))
+		}
+		return policy(signed)
+	}
+}
+
+func (v *indexVerifier) verifySignature(ctx context.Context, indexDesc, desc ocispec.Descriptor, fetcher Fetcher) error {
+	rc, _, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	b, err := content.ReadAll(rc, desc)
+	if err != nil {
+		return err
+	}
+	return soci.VerifyIndexSignature(indexDesc.Digest, b, v.keys)
+}
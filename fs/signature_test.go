@@ -0,0 +1,201 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// newTestIndexVerifier creates an indexVerifier trusting the public key of the returned private key.
+func newTestIndexVerifier(t *testing.T) (*indexVerifier, ed25519.PrivateKey) {
+	trustedPublic, trustedKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(trustedPublic)
+	if err != nil {
+		t.Fatalf("can't marshal public key: %v", err)
+	}
+	publicPath := filepath.Join(t.TempDir(), "key.pub")
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("can't write public key: %v", err)
+	}
+	verifier, err := newIndexVerifier(config.SignatureVerificationConfig{Require: true, TrustedPublicKeys: []string{publicPath}})
+	if err != nil {
+		t.Fatalf("can't create index verifier: %v", err)
+	}
+	return verifier, trustedKey
+}
+
+// pushTestSignature signs the index `desc` with `key` and pushes the signature to `store`.
+func pushTestSignature(t *testing.T, store *memory.Store, desc ocispec.Descriptor, key ed25519.PrivateKey) ocispec.Descriptor {
+	b, err := soci.SignIndex(desc, key)
+	if err != nil {
+		t.Fatalf("can't sign index: %v", err)
+	}
+	sigDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	if err := store.Push(context.Background(), sigDesc, bytes.NewReader(b)); err != nil {
+		t.Fatalf("can't store signature: %v", err)
+	}
+	return sigDesc
+}
+
+func TestIndexVerifier(t *testing.T) {
+	verifier, trustedKey := newTestIndexVerifier(t)
+	_, untrustedKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+
+	indexDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("index"), Size: 5}
+	otherIndexDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("other"), Size: 5}
+	store := memory.New()
+	sign := func(desc ocispec.Descriptor, key ed25519.PrivateKey) ocispec.Descriptor {
+		return pushTestSignature(t, store, desc, key)
+	}
+	trusted := sign(indexDesc, trustedKey)
+	untrusted := sign(indexDesc, untrustedKey)
+	otherIndex := sign(otherIndexDesc, trustedKey)
+
+	testCases := []struct {
+		name        string
+		signatures  []ocispec.Descriptor
+		expectedErr error
+	}{
+		{
+			name:       "trusted signature",
+			signatures: []ocispec.Descriptor{trusted},
+		},
+		{
+			name:       "trusted signature among untrusted signatures",
+			signatures: []ocispec.Descriptor{untrusted, otherIndex, trusted},
+		},
+		{
+			name:        "no signatures",
+			expectedErr: ErrNoTrustedSignature,
+		},
+		{
+			name:        "untrusted signature",
+			signatures:  []ocispec.Descriptor{untrusted},
+			expectedErr: ErrNoTrustedSignature,
+		},
+		{
+			name:        "signature of another index",
+			signatures:  []ocispec.Descriptor{otherIndex},
+			expectedErr: ErrNoTrustedSignature,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			refspec, err := reference.Parse(imageRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fetcher, err := newArtifactFetcher(refspec, store, &fakeRemoteStore{})
+			if err != nil {
+				t.Fatalf("could not create artifact fetcher: %v", err)
+			}
+			err = verifier.Verify(context.Background(), indexDesc, newFakeInner(tc.signatures), fetcher)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestIndexVerifierPolicy(t *testing.T) {
+	verifier, trustedKey := newTestIndexVerifier(t)
+	index := func(name, created string) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Digest:      digest.FromString(name),
+			Size:        int64(len(name)),
+			Annotations: map[string]string{ocispec.AnnotationCreated: created},
+		}
+	}
+	signedIndex := index("signed", "2023-01-01T00:00:00Z")
+	newerIndex := index("newer", "2023-06-01T00:00:00Z")
+	store := memory.New()
+	signature := pushTestSignature(t, store, signedIndex, trustedKey)
+
+	testCases := []struct {
+		name         string
+		indices      []ocispec.Descriptor
+		expectedDesc ocispec.Descriptor
+		expectedErr  error
+	}{
+		{
+			name:         "signed index is selected over a newer unsigned index",
+			indices:      []ocispec.Descriptor{newerIndex, signedIndex},
+			expectedDesc: signedIndex,
+		},
+		{
+			name:        "no signed index",
+			indices:     []ocispec.Descriptor{newerIndex},
+			expectedErr: ErrNoTrustedSignature,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			refspec, err := reference.Parse(imageRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fetcher, err := newArtifactFetcher(refspec, store, &fakeRemoteStore{})
+			if err != nil {
+				t.Fatalf("could not create artifact fetcher: %v", err)
+			}
+			// the registry returns the signature of the signed index for every index.
+			policy := verifier.Policy(context.Background(), newFakeInner([]ocispec.Descriptor{signature}), fetcher, SelectNewestPolicy)
+			desc, err := policy(tc.indices)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expectedErr, err)
+			}
+			if err == nil && desc.Digest != tc.expectedDesc.Digest {
+				t.Fatalf("unexpected index selected. expect: %v, actual: %v", tc.expectedDesc.Digest, desc.Digest)
+			}
+		})
+	}
+}
+
+func TestNewIndexVerifier(t *testing.T) {
+	verifier, err := newIndexVerifier(config.SignatureVerificationConfig{})
+	if err != nil || verifier != nil {
+		t.Fatalf("expected no verifier when signatures are not required, got %v, %v", verifier, err)
+	}
+	if _, err := newIndexVerifier(config.SignatureVerificationConfig{Require: true}); err == nil {
+		t.Fatalf("expected error when signatures are required without trusted keys, but got nil")
+	}
+}
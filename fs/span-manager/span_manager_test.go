@@ -123,6 +123,83 @@ func TestSpanManager(t *testing.T) {
 	}
 }
 
+func TestSpanManagerZstd(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	fileName := "span-manager-test"
+	fileContent := testutil.RandomByteData(int64(spanSize) * 10)
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(fileContent)),
+	}
+
+	toc, r, err := ztoc.BuildZtocReaderZstd(t, tarEntries, 3, int64(spanSize), testutil.WithZstdFrameSize(int(spanSize)))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if toc.MaxSpanID == 0 {
+		t.Fatalf("expected multiple spans for a multi-frame zstd layer")
+	}
+
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+
+	fileContentFromSpans, err := getFileContentFromSpans(m, toc, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileContent, fileContentFromSpans) {
+		t.Fatalf("file contents are not the same as span contents")
+	}
+
+	var i compression.SpanID
+	for i = 0; i <= toc.MaxSpanID; i++ {
+		if err := m.resolveSpan(i); err != nil {
+			t.Fatalf("error resolving span %d. error: %v", i, err)
+		}
+	}
+}
+
+func TestSpanManagerEStargz(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	fileName := "span-manager-test"
+	fileContent := testutil.RandomByteData(int64(spanSize) * 10)
+	smallContent := testutil.RandomByteData(1000)
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", string(smallContent)),
+		testutil.File(fileName, string(fileContent)),
+	}
+
+	toc, r, err := ztoc.BuildZtocReaderEStargz(t, tarEntries, int(spanSize)/2, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if toc.MaxSpanID == 0 {
+		t.Fatalf("expected multiple spans for a chunked eStargz layer")
+	}
+
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+
+	for name, expected := range map[string][]byte{fileName: fileContent, "dir/small": smallContent} {
+		fileContentFromSpans, err := getFileContentFromSpans(m, toc, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, fileContentFromSpans) {
+			t.Fatalf("contents of %s are not the same as span contents", name)
+		}
+	}
+
+	var i compression.SpanID
+	for i = 0; i <= toc.MaxSpanID; i++ {
+		if err := m.resolveSpan(i); err != nil {
+			t.Fatalf("error resolving span %d. error: %v", i, err)
+		}
+	}
+}
+
 func TestSpanManagerCache(t *testing.T) {
 	var spanSize compression.Offset = 65536 // 64 KiB
 	content := testutil.RandomByteData(int64(spanSize))
@@ -19,6 +19,7 @@ package integration
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/soci"
@@ -85,9 +86,12 @@ func TestSociCreateSparseIndex(t *testing.T) {
 			}
 
 			includedLayers := make(map[string]struct{})
+			skippedLayers := make(map[string]string)
 			for _, layer := range imageManifest.Layers {
 				if layer.Size >= tt.minLayerSize {
 					includedLayers[layer.Digest.String()] = struct{}{}
+				} else {
+					skippedLayers[layer.Digest.String()] = fmt.Sprintf("size %d is less than min-layer-size %d", layer.Size, tt.minLayerSize)
 				}
 			}
 
@@ -96,7 +100,7 @@ func TestSociCreateSparseIndex(t *testing.T) {
 					t.Fatalf("failed to validate soci index: unexpected layer count; expected=%v, got=0", len(includedLayers))
 				}
 			} else {
-				if err := validateSociIndex(sh, index, manifestDigest, includedLayers); err != nil {
+				if err := validateSociIndex(sh, index, manifestDigest, includedLayers, skippedLayers); err != nil {
 					t.Fatalf("failed to validate soci index: %v", err)
 				}
 			}
@@ -171,7 +175,7 @@ func TestSociCreate(t *testing.T) {
 				t.Fatalf("failed to get manifest digest: %v", err)
 			}
 
-			if err := validateSociIndex(sh, sociIndex, m, nil); err != nil {
+			if err := validateSociIndex(sh, sociIndex, m, nil, nil); err != nil {
 				t.Fatalf("failed to validate soci index: %v", err)
 			}
 		})
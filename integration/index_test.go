@@ -131,7 +131,7 @@ func TestSociIndexInfo(t *testing.T) {
 						t.Fatalf("failed to get manifest digest: %v", err)
 					}
 
-					if err := validateSociIndex(sh, sociIndex, m, nil); err != nil {
+					if err := validateSociIndex(sh, sociIndex, m, nil, nil); err != nil {
 						t.Fatalf("failed to validate soci index: %v", err)
 					}
 				} else if err == nil {
@@ -34,6 +34,7 @@ package integration
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -124,7 +125,10 @@ func buildIndex(sh *shell.Shell, src imageInfo, opt ...indexBuildOption) string
 	return strings.Trim(string(indexDigest), "\n")
 }
 
-func validateSociIndex(sh *shell.Shell, sociIndex soci.Index, imgManifestDigest string, includedLayers map[string]struct{}) error {
+// validateSociIndex validates `sociIndex` of the image manifest `imgManifestDigest`. If `includedLayers` isn't nil,
+// the index must have a ztoc for each of them and for no other layer. If `skippedLayers` isn't nil, the index
+// must record exactly these layers and reasons in its skipped layers annotation.
+func validateSociIndex(sh *shell.Shell, sociIndex soci.Index, imgManifestDigest string, includedLayers map[string]struct{}, skippedLayers map[string]string) error {
 	if sociIndex.MediaType != ocispec.MediaTypeImageManifest {
 		return fmt.Errorf("unexpected index media type; expected types: [%v], got: %v", ocispec.MediaTypeImageManifest, sociIndex.MediaType)
 	}
@@ -132,14 +136,34 @@ func validateSociIndex(sh *shell.Shell, sociIndex soci.Index, imgManifestDigest
 		return fmt.Errorf("unexpected index artifact type; expected = %v, got = %v", soci.SociIndexArtifactType, sociIndex.ArtifactType)
 	}
 
+	// indices are built without a creation time and span size annotation, so that their digests are reproducible.
 	expectedAnnotations := map[string]string{
 		soci.IndexAnnotationBuildToolIdentifier: "AWS SOCI CLI v0.1",
 	}
+	annotations := make(map[string]string)
+	for k, v := range sociIndex.Annotations {
+		annotations[k] = v
+	}
+	// the skipped layers annotation depends on the image, so it's validated on its own.
+	skipped, hasSkipped := annotations[soci.IndexAnnotationSkippedLayers]
+	delete(annotations, soci.IndexAnnotationSkippedLayers)
 
-	if diff := cmp.Diff(sociIndex.Annotations, expectedAnnotations); diff != "" {
+	if diff := cmp.Diff(annotations, expectedAnnotations); diff != "" {
 		return fmt.Errorf("unexpected index annotations; diff = %v", diff)
 	}
 
+	if skippedLayers != nil {
+		actualSkipped := make(map[string]string)
+		if hasSkipped {
+			if err := json.Unmarshal([]byte(skipped), &actualSkipped); err != nil {
+				return fmt.Errorf("invalid skipped layers annotation %q: %w", skipped, err)
+			}
+		}
+		if diff := cmp.Diff(skippedLayers, actualSkipped); diff != "" {
+			return fmt.Errorf("unexpected skipped layers; diff = %v", diff)
+		}
+	}
+
 	if imgManifestDigest != sociIndex.Subject.Digest.String() {
 		return fmt.Errorf("unexpected subject digest; expected = %v, got = %v", imgManifestDigest, sociIndex.Subject.Digest.String())
 	}
@@ -36,9 +36,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	digest "github.com/opencontainers/go-digest"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -50,6 +53,8 @@ import (
 //       - *node id*                        : bucket for each node keyed by a uniqe uint64.
 //         - size : <varint>                : size of the regular node.
 //         - modtime : <varint>             : modification time of the node.
+//         - atime : <varint>               : access time of the node, if recorded in the layer.
+//         - ctime : <varint>               : status change time of the node, if recorded in the layer.
 //         - linkName : <string>            : link target of symlink
 //         - mode : <uvarint>               : permission and mode bits (os.FileMode).
 //         - uid : <varint>                 : uid of the owner.
@@ -68,6 +73,8 @@ import (
 //         - childrenExtra                  : 2nd and following child nodes of directory.
 //           - *basename* : <node id>       : map of basename string to the child node id
 //         - uncompressedOffset : <varint>  : the offset in the uncompressed data, where the node is stored.
+//         - digest : <string>              : the digest of the content of the node, if recorded in the ztoc.
+//         - sparseMap : <varints>          : offsets and lengths of the data fragments of a sparse file.
 
 var (
 	bucketKeyFilesystems = []byte("filesystems")
@@ -75,6 +82,8 @@ var (
 	bucketKeyNodes       = []byte("nodes")
 	bucketKeySize        = []byte("size")
 	bucketKeyModTime     = []byte("modtime")
+	bucketKeyAccessTime  = []byte("atime")
+	bucketKeyChangeTime  = []byte("ctime")
 	bucketKeyLinkName    = []byte("linkName")
 	bucketKeyMode        = []byte("mode")
 	bucketKeyUID         = []byte("uid")
@@ -92,6 +101,8 @@ var (
 	bucketKeyChildrenExtra = []byte("childrenExtra")
 
 	bucketKeyUncompressedOffset = []byte("uncompressedOffset")
+	bucketKeyDigest             = []byte("digest")
+	bucketKeySparseMap          = []byte("sparseMap")
 )
 
 type childEntry struct {
@@ -103,6 +114,8 @@ type metadataEntry struct {
 	children           map[string]childEntry
 	UncompressedOffset compression.Offset
 	UncompressedSize   compression.Offset
+	Digest             digest.Digest
+	SparseMap          []ztoc.SparseEntry
 }
 
 func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
@@ -175,13 +188,22 @@ func writeAttr(b *bolt.Bucket, attr *Attr) error {
 			}
 		}
 	}
-	if !attr.ModTime.IsZero() {
-		te, err := attr.ModTime.GobEncode()
-		if err != nil {
-			return err
-		}
-		if err := b.Put(bucketKeyModTime, te); err != nil {
-			return err
+	for _, v := range []struct {
+		key []byte
+		val time.Time
+	}{
+		{bucketKeyModTime, attr.ModTime},
+		{bucketKeyAccessTime, attr.AccessTime},
+		{bucketKeyChangeTime, attr.ChangeTime},
+	} {
+		if !v.val.IsZero() {
+			te, err := v.val.GobEncode()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(v.key, te); err != nil {
+				return err
+			}
 		}
 	}
 	if len(attr.LinkName) > 0 {
@@ -247,6 +269,14 @@ func readAttr(b *bolt.Bucket, attr *Attr) error {
 			if err := (&attr.ModTime).GobDecode(v); err != nil {
 				return err
 			}
+		case string(bucketKeyAccessTime):
+			if err := (&attr.AccessTime).GobDecode(v); err != nil {
+				return err
+			}
+		case string(bucketKeyChangeTime):
+			if err := (&attr.ChangeTime).GobDecode(v); err != nil {
+				return err
+			}
 		case string(bucketKeyLinkName):
 			attr.LinkName = string(v)
 		case string(bucketKeyMode):
@@ -350,6 +380,16 @@ func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 	if err := putFileSize(md, bucketKeyUncompressedOffset, m.UncompressedOffset); err != nil {
 		return fmt.Errorf("failed to set UncompressedOffset value %d: %w", m.UncompressedOffset, err)
 	}
+	if m.Digest != "" {
+		if err := md.Put(bucketKeyDigest, []byte(m.Digest)); err != nil {
+			return fmt.Errorf("failed to set Digest value %s: %w", m.Digest, err)
+		}
+	}
+	if m.SparseMap != nil {
+		if err := md.Put(bucketKeySparseMap, encodeSparseMap(m.SparseMap)); err != nil {
+			return fmt.Errorf("failed to set SparseMap value: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -366,6 +406,33 @@ func putInt(b *bolt.Bucket, k []byte, v int64) error {
 	return b.Put(k, i)
 }
 
+func encodeSparseMap(sparseMap []ztoc.SparseEntry) []byte {
+	b := make([]byte, len(sparseMap)*2*binary.MaxVarintLen64)
+	n := 0
+	for _, e := range sparseMap {
+		n += binary.PutVarint(b[n:], int64(e.Offset))
+		n += binary.PutVarint(b[n:], int64(e.Length))
+	}
+	return b[:n]
+}
+
+func decodeSparseMap(b []byte) []ztoc.SparseEntry {
+	var sparseMap []ztoc.SparseEntry
+	for len(b) > 0 {
+		offset, n := binary.Varint(b)
+		if n <= 0 {
+			break
+		}
+		length, m := binary.Varint(b[n:])
+		if m <= 0 {
+			break
+		}
+		sparseMap = append(sparseMap, ztoc.SparseEntry{Offset: compression.Offset(offset), Length: compression.Offset(length)})
+		b = b[n+m:]
+	}
+	return sparseMap
+}
+
 func encodeID(id uint32) []byte {
 	b := [4]byte{}
 	binary.BigEndian.PutUint32(b[:], id)
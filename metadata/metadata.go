@@ -39,6 +39,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	digest "github.com/opencontainers/go-digest"
 )
 
 // Attr reprensents the attributes of a node.
@@ -49,6 +50,12 @@ type Attr struct {
 	// ModTime is the modification time of the node.
 	ModTime time.Time
 
+	// AccessTime is the access time of the node, if recorded in the layer.
+	AccessTime time.Time
+
+	// ChangeTime is the status change time of the node, if recorded in the layer.
+	ChangeTime time.Time
+
 	// LinkName, for symlinks, is the link target.
 	LinkName string
 
@@ -93,6 +100,12 @@ type Reader interface {
 type File interface {
 	GetUncompressedFileSize() compression.Offset
 	GetUncompressedOffset() compression.Offset
+	// GetDigest returns the digest of the file content, or an empty digest
+	// if it is not recorded in the ztoc (e.g., ztoc version 0.9).
+	GetDigest() digest.Digest
+	// GetSparseMap returns the data fragments of a sparse file, which are stored
+	// back to back at the uncompressed offset, or nil if the file is not sparse.
+	GetSparseMap() []ztoc.SparseEntry
 }
 
 type Options struct {
@@ -49,6 +49,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/rs/xid"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/sync/errgroup"
@@ -255,6 +256,8 @@ func (r *reader) initNodes(toc ztoc.TOC) error {
 					md[id] = &metadataEntry{}
 				}
 				md[id].UncompressedOffset = ent.UncompressedOffset
+				md[id].Digest = ent.Digest
+				md[id].SparseMap = ent.SparseMap
 			}
 		}
 		return nil
@@ -508,6 +511,8 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 func (r *reader) OpenFile(id uint32) (File, error) {
 	var size int64
 	var uncompressedOffset compression.Offset
+	var dgst digest.Digest
+	var sparseMap []ztoc.SparseEntry
 
 	if err := r.view(func(tx *bolt.Tx) error {
 		nodes, err := getNodes(tx, r.fsID)
@@ -529,12 +534,16 @@ func (r *reader) OpenFile(id uint32) (File, error) {
 		}
 		if md, err := getMetadataBucketByID(metadataEntries, id); err == nil {
 			uncompressedOffset = getUncompressedOffset(md)
+			dgst = digest.Digest(md.Get(bucketKeyDigest))
+			if b := md.Get(bucketKeySparseMap); b != nil {
+				sparseMap = decodeSparseMap(b)
+			}
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	return &file{uncompressedOffset, compression.Offset(size)}, nil
+	return &file{uncompressedOffset, compression.Offset(size), dgst, sparseMap}, nil
 }
 
 func getUncompressedOffset(md *bolt.Bucket) compression.Offset {
@@ -545,6 +554,8 @@ func getUncompressedOffset(md *bolt.Bucket) compression.Offset {
 type file struct {
 	uncompressedOffset compression.Offset
 	uncompressedSize   compression.Offset
+	digest             digest.Digest
+	sparseMap          []ztoc.SparseEntry
 }
 
 func (fr *file) GetUncompressedFileSize() compression.Offset {
@@ -555,9 +566,19 @@ func (fr *file) GetUncompressedOffset() compression.Offset {
 	return fr.uncompressedOffset
 }
 
+func (fr *file) GetDigest() digest.Digest {
+	return fr.digest
+}
+
+func (fr *file) GetSparseMap() []ztoc.SparseEntry {
+	return fr.sparseMap
+}
+
 func attrFromZtocEntry(src *ztoc.FileMetadata, dst *Attr) *Attr {
 	dst.Size = int64(src.UncompressedSize)
 	dst.ModTime = src.ModTime
+	dst.AccessTime = src.AccessTime
+	dst.ChangeTime = src.ChangeTime
 	dst.LinkName = src.Linkname
 	dst.Mode = src.FileMode()
 	dst.UID = src.UID
@@ -39,6 +39,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -46,6 +47,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/util/testutil"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/hashicorp/go-multierror"
+	digest "github.com/opencontainers/go-digest"
 )
 
 var allowedPrefix = [4]string{"", "./", "/", "../"}
@@ -68,6 +70,7 @@ type testableReader interface {
 // testReader tests Reader returns correct file metadata.
 func testReader(t *testing.T, factory readerFactory) {
 	sampleTime := time.Now().Truncate(time.Second)
+	sampleNanoTime := time.Date(2021, 2, 3, 4, 5, 6, 123456789, time.UTC)
 	tests := []struct {
 		name string
 		in   []testutil.TarEntry
@@ -85,6 +88,7 @@ func testReader(t *testing.T, factory readerFactory) {
 			want: []check{
 				numOfNodes(6), // root dir + 1 dir + 4 files
 				hasFile("foo", 6),
+				hasDigest("foo", "foofoo"),
 				hasMode("foo", 0644|os.ModeSetuid),
 				hasFile("bar/baz.txt", 9),
 				hasOwner("bar/baz.txt", 1000, 1000),
@@ -142,6 +146,7 @@ func testReader(t *testing.T, factory readerFactory) {
 				hasFile("bar/foolink", 6),
 				hasOwner("bar/foolink", 1000, 1000),
 				hasFile("bar/foolink2", 6),
+				hasDigest("bar/foolink2", "foofoo"),
 				hasOwner("bar/foolink2", 1000, 1000),
 				hasFile("bar/1/baz.txt", 8),
 				hasFile("barlink", 8),
@@ -172,6 +177,21 @@ func testReader(t *testing.T, factory readerFactory) {
 				hasFifo("bar/fifo"),
 			},
 		},
+		{
+			name: "pax times and sparse files",
+			in: []testutil.TarEntry{
+				testutil.File("times", "foo", testutil.WithFileModTime(sampleNanoTime),
+					testutil.WithFileAccessTime(sampleNanoTime.Add(time.Nanosecond)), testutil.WithFileChangeTime(sampleNanoTime.Add(time.Hour))),
+				testutil.SparseFile("sparse", 100, []testutil.SparseFragment{{Offset: 10, Data: "foo"}, {Offset: 50, Data: "bar"}}, testutil.SparsePAX10),
+			},
+			want: []check{
+				numOfNodes(3), // root dir + 2 files
+				hasTimes("times", sampleNanoTime, sampleNanoTime.Add(time.Nanosecond), sampleNanoTime.Add(time.Hour)),
+				hasFile("sparse", 100),
+				hasSparseMap("sparse", []ztoc.SparseEntry{{Offset: 10, Length: 3}, {Offset: 50, Length: 3}, {Offset: 100, Length: 0}}),
+				hasSparseMap("times", nil),
+			},
+		},
 	}
 	for _, tt := range tests {
 		for _, prefix := range allowedPrefix {
@@ -445,6 +465,25 @@ func hasFile(name string, size int64) check {
 	}
 }
 
+func hasDigest(name string, content string) check {
+	return func(t *testing.T, r testableReader) {
+		id, err := lookup(r, name)
+		if err != nil {
+			t.Errorf("cannot find file %q: %v", name, err)
+			return
+		}
+		f, err := r.OpenFile(id)
+		if err != nil {
+			t.Errorf("cannot open file %q: %v", name, err)
+			return
+		}
+		if want := digest.FromString(content); f.GetDigest() != want {
+			t.Errorf("unexpected digest of file %q: %s want %s", name, f.GetDigest(), want)
+			return
+		}
+	}
+}
+
 func hasMode(name string, mode os.FileMode) check {
 	return func(t *testing.T, r testableReader) {
 		id, err := lookup(r, name)
@@ -503,6 +542,45 @@ func hasModTime(name string, modTime time.Time) check {
 	}
 }
 
+func hasTimes(name string, modTime, accessTime, changeTime time.Time) check {
+	return func(t *testing.T, r testableReader) {
+		id, err := lookup(r, name)
+		if err != nil {
+			t.Errorf("cannot find file %q: %v", name, err)
+			return
+		}
+		attr, err := r.GetAttr(id)
+		if err != nil {
+			t.Errorf("cannot get attr of file %q: %v", name, err)
+			return
+		}
+		if !attr.ModTime.Equal(modTime) || !attr.AccessTime.Equal(accessTime) || !attr.ChangeTime.Equal(changeTime) {
+			t.Errorf("unexpected times of %q: %v, %v, %v; want %v, %v, %v", name,
+				attr.ModTime, attr.AccessTime, attr.ChangeTime, modTime, accessTime, changeTime)
+			return
+		}
+	}
+}
+
+func hasSparseMap(name string, sparseMap []ztoc.SparseEntry) check {
+	return func(t *testing.T, r testableReader) {
+		id, err := lookup(r, name)
+		if err != nil {
+			t.Errorf("cannot find file %q: %v", name, err)
+			return
+		}
+		f, err := r.OpenFile(id)
+		if err != nil {
+			t.Errorf("cannot open file %q: %v", name, err)
+			return
+		}
+		if !reflect.DeepEqual(f.GetSparseMap(), sparseMap) {
+			t.Errorf("unexpected sparse map of %q: %v want %v", name, f.GetSparseMap(), sparseMap)
+			return
+		}
+	}
+}
+
 func hasXattrs(name string, xattrs map[string]string) check {
 	return func(t *testing.T, r testableReader) {
 		id, err := lookup(r, name)
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path"
@@ -49,7 +50,8 @@ import (
 //         - imageDigest: <string>      : the digest of the image index
 //         - platform: <string>         : the platform for the index
 //         - location: <string>         : the location of the artifact
-//         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
+//         - type: <string>             : the type of the artifact (can be either "soci_index", "soci_layer" or "soci_signature")
+//         - spanAlignment: <varint>    : the span alignment the ztoc was built with (soci_layer only)
 
 // ArtifactsDB is a store for SOCI artifact metadata
 type ArtifactsDb struct {
@@ -73,11 +75,14 @@ var (
 	bucketKeyType           = []byte("type")
 	bucketKeyMediaType      = []byte("media_type")
 	bucketKeyCreatedAt      = []byte("created_at")
+	bucketKeySpanAlignment  = []byte("span_alignment")
 
 	// ArtifactEntryTypeIndex indicates that an ArtifactEntry is a SOCI index artifact
 	ArtifactEntryTypeIndex ArtifactEntryType = "soci_index"
 	// ArtifactEntryTypeLayer indicates that an ArtifactEntry is a SOCI layer artifact
 	ArtifactEntryTypeLayer ArtifactEntryType = "soci_layer"
+	// ArtifactEntryTypeSignature indicates that an ArtifactEntry is a SOCI index signature artifact
+	ArtifactEntryTypeSignature ArtifactEntryType = "soci_signature"
 
 	db   *ArtifactsDb
 	once sync.Once
@@ -114,6 +119,9 @@ type ArtifactEntry struct {
 	MediaType string
 	// Creation time of SOCI artifact.
 	CreatedAt time.Time
+	// SpanAlignment is the maximum size of the files the spans of a ztoc were aligned to,
+	// or 0 if the spans weren't aligned. It's only set for SOCI layer artifacts.
+	SpanAlignment int64
 }
 
 // NewDB returns an instance of an ArtifactsDB
@@ -153,6 +161,22 @@ func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEn
 
 }
 
+// GetZtocArtifactEntriesByLayer returns the artifact entries of the ztocs built for any of the
+// layers `layerDigests`, keyed by layer digest. The DB is walked only once for all of the layers.
+func (db *ArtifactsDb) GetZtocArtifactEntriesByLayer(layerDigests []string) (map[string][]ArtifactEntry, error) {
+	artifactEntries := make(map[string][]ArtifactEntry, len(layerDigests))
+	for _, layerDigest := range layerDigests {
+		artifactEntries[layerDigest] = nil
+	}
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if _, ok := artifactEntries[ae.OriginalDigest]; ok && ae.Type == ArtifactEntryTypeLayer {
+			artifactEntries[ae.OriginalDigest] = append(artifactEntries[ae.OriginalDigest], *ae)
+		}
+		return nil
+	})
+	return artifactEntries, err
+}
+
 // Walk applys a function to all ArtifactEntries in the ArtifactsDB
 func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
 	err := db.db.View(func(tx *bolt.Tx) error {
@@ -251,8 +275,16 @@ func (db *ArtifactsDb) addNewArtifacts(ctx context.Context, blobStorePath string
 			return err
 		}
 		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if IsIndexSignature(b) {
+			// skip: entry is an index signature, which is only discovered through its index
+			return nil
+		}
 		var sociIndex Index
-		if err = DecodeIndex(f, &sociIndex); err != nil {
+		if err = UnmarshalIndex(b, &sociIndex); err != nil {
 			// skip: entry is a ztoc
 			return nil
 		}
@@ -347,10 +379,15 @@ func (db *ArtifactsDb) RemoveArtifactEntryByIndexDigest(digest string) error {
 			return fmt.Errorf("the index of the digest %v doesn't exist", digest)
 		}
 
-		if indexBucket(dgstBucket) {
-			return bucket.DeleteBucket([]byte(digest))
+		if !indexBucket(dgstBucket) {
+			return fmt.Errorf("the digest %v does not correspond to an index", digest)
+		}
+		if err := bucket.DeleteBucket([]byte(digest)); err != nil {
+			return err
 		}
-		return fmt.Errorf("the digest %v does not correspond to an index", digest)
+		return deleteBuckets(bucket, func(b *bolt.Bucket) bool {
+			return signatureBucket(b) && string(b.Get(bucketKeyOriginalDigest)) == digest
+		})
 	})
 }
 
@@ -362,21 +399,50 @@ func (db *ArtifactsDb) RemoveArtifactEntryByImageDigest(digest string) error {
 			return err
 		}
 
-		c := bucket.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			artifactBucket := bucket.Bucket(k)
-			if indexBucket(artifactBucket) && hasImageDigest(artifactBucket, digest) {
-				bucket.DeleteBucket(k)
-			}
+		return deleteBuckets(bucket, func(b *bolt.Bucket) bool {
+			return (indexBucket(b) || signatureBucket(b)) && hasImageDigest(b, digest)
+		})
+	})
+}
+
+// GetIndexSignatures returns the artifact entries of the signatures of an index
+func (db *ArtifactsDb) GetIndexSignatures(indexDigest string) ([]ArtifactEntry, error) {
+	var entries []ArtifactEntry
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type == ArtifactEntryTypeSignature && ae.OriginalDigest == indexDigest {
+			entries = append(entries, *ae)
 		}
 		return nil
 	})
+	return entries, err
+}
+
+// deleteBuckets deletes the artifact buckets for which `match` returns true
+func deleteBuckets(artifacts *bolt.Bucket, match func(*bolt.Bucket) bool) error {
+	var keys [][]byte
+	c := artifacts.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if b := artifacts.Bucket(k); b != nil && match(b) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if err := artifacts.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Determines whether a bucket represents an index, as opposed to a zTOC
+// Determines whether a bucket represents an index, as opposed to a zTOC or an index signature
 func indexBucket(b *bolt.Bucket) bool {
 	mt := string(b.Get(bucketKeyMediaType))
-	return mt == ocispec.MediaTypeImageManifest
+	return mt == ocispec.MediaTypeImageManifest && !signatureBucket(b)
+}
+
+// Determines whether a bucket represents an index signature
+func signatureBucket(b *bolt.Bucket) bool {
+	return ArtifactEntryType(b.Get(bucketKeyType)) == ArtifactEntryTypeSignature
 }
 
 // Determines whether a bucket's image digest is the same as digest
@@ -443,6 +509,13 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
 	ae.MediaType = string(artifactBkt.Get(bucketKeyMediaType))
 	ae.CreatedAt = createdAt
+	if encodedSpanAlignment := artifactBkt.Get(bucketKeySpanAlignment); encodedSpanAlignment != nil {
+		spanAlignment, err := dbutil.DecodeInt(encodedSpanAlignment)
+		if err != nil {
+			return nil, err
+		}
+		ae.SpanAlignment = spanAlignment
+	}
 	return &ae, nil
 }
 
@@ -466,6 +539,11 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		return err
 	}
 
+	spanAlignment, err := dbutil.EncodeInt(ae.SpanAlignment)
+	if err != nil {
+		return err
+	}
+
 	updates := []struct {
 		key []byte
 		val []byte
@@ -478,6 +556,7 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		{bucketKeyType, []byte(ae.Type)},
 		{bucketKeyMediaType, []byte(ae.MediaType)},
 		{bucketKeyCreatedAt, createdAt},
+		{bucketKeySpanAlignment, spanAlignment},
 	}
 
 	for _, update := range updates {
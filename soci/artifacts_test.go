@@ -97,6 +97,71 @@ func TestGetIndexArtifactEntries(t *testing.T) {
 	}
 }
 
+func TestGetZtocArtifactEntriesByLayer(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	const (
+		dgst1     = "sha256:10d6aec48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		dgst2     = "sha256:20d6a9c48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		dgst3     = "sha256:80d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		dgst4     = "sha256:99d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+		layerDgst = "sha256:1236aec48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+		otherDgst = "sha256:bbbbbbb48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+		noneDgst  = "sha256:ccccccc48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+	)
+	entries := []ArtifactEntry{
+		{
+			Size:           10,
+			Digest:         dgst1,
+			OriginalDigest: layerDgst,
+			Location:       layerDgst,
+			Type:           ArtifactEntryTypeLayer,
+		},
+		{
+			Size:           20,
+			Digest:         dgst2,
+			OriginalDigest: layerDgst,
+			Location:       layerDgst,
+			Type:           ArtifactEntryTypeLayer,
+			SpanAlignment:  1 << 20,
+		},
+		{
+			Size:           15,
+			Digest:         dgst3,
+			OriginalDigest: otherDgst,
+			Location:       otherDgst,
+			Type:           ArtifactEntryTypeLayer,
+		},
+		{
+			Size:           10,
+			Digest:         dgst4,
+			OriginalDigest: layerDgst,
+			Location:       "/var/soci-snapshotter/test1",
+			Type:           ArtifactEntryTypeIndex,
+		},
+	}
+	for _, entry := range entries {
+		err = db.WriteArtifactEntry(&entry)
+		if err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+	}
+
+	retrievedEntries, err := db.GetZtocArtifactEntriesByLayer([]string{layerDgst, noneDgst})
+	if err != nil {
+		t.Fatalf("could not retrieve ztoc artifact entries: %v", err)
+	}
+	if len(retrievedEntries) != 2 || len(retrievedEntries[noneDgst]) != 0 {
+		t.Fatalf("unexpected retrieved entries: %v", retrievedEntries)
+	}
+	layerEntries := retrievedEntries[layerDgst]
+	if len(layerEntries) != 2 || layerEntries[0] != entries[0] || layerEntries[1] != entries[1] {
+		t.Fatalf("the retrieved content should match to the original content")
+	}
+}
+
 func TestArtifactDB_DoesNotExist(t *testing.T) {
 	_, err := NewDB(ArtifactsDbPath())
 	if err == nil {
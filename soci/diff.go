@@ -0,0 +1,289 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// LayerDiffStatus is the status of a layer in the difference between two SOCI indices.
+type LayerDiffStatus string
+
+const (
+	// LayerDiffAdded is the status of a layer that only has a ztoc in the second index.
+	LayerDiffAdded LayerDiffStatus = "added"
+	// LayerDiffRemoved is the status of a layer that only has a ztoc in the first index.
+	LayerDiffRemoved LayerDiffStatus = "removed"
+	// LayerDiffChanged is the status of a layer whose ztoc differs between the indices.
+	LayerDiffChanged LayerDiffStatus = "changed"
+	// LayerDiffUnchanged is the status of a layer with the same ztoc in both indices.
+	LayerDiffUnchanged LayerDiffStatus = "unchanged"
+)
+
+// Change is a value that differs between two SOCI indices or ztocs.
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// IndexDiff is the difference between two SOCI indices.
+type IndexDiff struct {
+	From      digest.Digest `json:"from"`
+	To        digest.Digest `json:"to"`
+	Subject   *Change       `json:"subject,omitempty"`
+	BuildTool *Change       `json:"buildTool,omitempty"`
+	Layers    []LayerDiff   `json:"layers"`
+}
+
+// LayerDiff is the difference between the ztocs of a layer in two SOCI indices.
+//
+// The files of changed layers are compared by metadata and, if both ztocs have file digests
+// (i.e. ztocs since version 1.0 built from layers that aren't eStargz layers without digests),
+// by content. `ContentCompared` is false if the content wasn't compared, in which case a file
+// whose content changed without changing its metadata (e.g., its size) isn't in `ChangedFiles`.
+type LayerDiff struct {
+	Status               LayerDiffStatus `json:"status"`
+	FromLayer            string          `json:"fromLayer,omitempty"`
+	ToLayer              string          `json:"toLayer,omitempty"`
+	FromZtoc             string          `json:"fromZtoc,omitempty"`
+	ToZtoc               string          `json:"toZtoc,omitempty"`
+	BuildTool            *Change         `json:"buildTool,omitempty"`
+	SpanSize             *Change         `json:"spanSize,omitempty"`
+	CompressionAlgorithm *Change         `json:"compressionAlgorithm,omitempty"`
+	AddedFiles           []string        `json:"addedFiles,omitempty"`
+	RemovedFiles         []string        `json:"removedFiles,omitempty"`
+	ChangedFiles         []string        `json:"changedFiles,omitempty"`
+	ContentCompared      bool            `json:"contentCompared"`
+}
+
+// HasChanges returns true if the indices differ.
+func (d *IndexDiff) HasChanges() bool {
+	if d.Subject != nil || d.BuildTool != nil {
+		return true
+	}
+	for _, layer := range d.Layers {
+		if layer.Status != LayerDiffUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffIndices compares the SOCI indices `from` and `to` of the artifacts db. The layers of the indices
+// are matched by digest. The layers that are only in one of the indices are then paired in layer order,
+// so that the files of a rebuilt layer are compared with those of the layer it replaces.
+func DiffIndices(ctx context.Context, blobStore orascontent.Fetcher, artifactsDb *ArtifactsDb, from, to digest.Digest) (*IndexDiff, error) {
+	fromIndex, err := loadIndex(ctx, blobStore, artifactsDb, from)
+	if err != nil {
+		return nil, err
+	}
+	toIndex, err := loadIndex(ctx, blobStore, artifactsDb, to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &IndexDiff{From: from, To: to}
+	if fromIndex.Subject != nil && toIndex.Subject != nil {
+		diff.Subject = change(fromIndex.Subject.Digest.String(), toIndex.Subject.Digest.String())
+	}
+	diff.BuildTool = change(fromIndex.Annotations[IndexAnnotationBuildToolIdentifier], toIndex.Annotations[IndexAnnotationBuildToolIdentifier])
+
+	toBlobs := make(map[string]ocispec.Descriptor)
+	for _, blob := range toIndex.Blobs {
+		toBlobs[blob.Annotations[IndexAnnotationImageLayerDigest]] = blob
+	}
+	matched := make(map[string]bool)
+	var removed, added []ocispec.Descriptor
+	var pairs [][2]ocispec.Descriptor
+	for _, blob := range fromIndex.Blobs {
+		layer := blob.Annotations[IndexAnnotationImageLayerDigest]
+		if toBlob, ok := toBlobs[layer]; ok {
+			matched[layer] = true
+			pairs = append(pairs, [2]ocispec.Descriptor{blob, toBlob})
+		} else {
+			removed = append(removed, blob)
+		}
+	}
+	for _, blob := range toIndex.Blobs {
+		if !matched[blob.Annotations[IndexAnnotationImageLayerDigest]] {
+			added = append(added, blob)
+		}
+	}
+	for len(removed) > 0 && len(added) > 0 {
+		pairs = append(pairs, [2]ocispec.Descriptor{removed[0], added[0]})
+		removed, added = removed[1:], added[1:]
+	}
+
+	for _, pair := range pairs {
+		layerDiff, err := diffZtocs(ctx, blobStore, pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		diff.Layers = append(diff.Layers, *layerDiff)
+	}
+	for _, blob := range removed {
+		diff.Layers = append(diff.Layers, LayerDiff{
+			Status:    LayerDiffRemoved,
+			FromLayer: blob.Annotations[IndexAnnotationImageLayerDigest],
+			FromZtoc:  blob.Digest.String(),
+		})
+	}
+	for _, blob := range added {
+		diff.Layers = append(diff.Layers, LayerDiff{
+			Status:  LayerDiffAdded,
+			ToLayer: blob.Annotations[IndexAnnotationImageLayerDigest],
+			ToZtoc:  blob.Digest.String(),
+		})
+	}
+	return diff, nil
+}
+
+func loadIndex(ctx context.Context, blobStore orascontent.Fetcher, artifactsDb *ArtifactsDb, indexDigest digest.Digest) (*Index, error) {
+	entry, err := artifactsDb.GetArtifactEntry(indexDigest.String())
+	if err != nil {
+		return nil, err
+	}
+	if entry.Type != ArtifactEntryTypeIndex {
+		return nil, fmt.Errorf("%v is not a SOCI index", indexDigest)
+	}
+	b, err := orascontent.FetchAll(ctx, blobStore, ocispec.Descriptor{Digest: indexDigest, Size: entry.Size})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index %v: %w", indexDigest, err)
+	}
+	var index Index
+	if err := UnmarshalIndex(b, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func loadZtoc(ctx context.Context, blobStore orascontent.Fetcher, desc ocispec.Descriptor) (*ztoc.Ztoc, error) {
+	b, err := orascontent.FetchAll(ctx, blobStore, ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read ztoc %v: %w", desc.Digest, err)
+	}
+	return ztoc.Unmarshal(bytes.NewReader(b))
+}
+
+// diffZtocs compares the ztocs `from` and `to` of a layer.
+func diffZtocs(ctx context.Context, blobStore orascontent.Fetcher, from, to ocispec.Descriptor) (*LayerDiff, error) {
+	diff := &LayerDiff{
+		Status:    LayerDiffUnchanged,
+		FromLayer: from.Annotations[IndexAnnotationImageLayerDigest],
+		ToLayer:   to.Annotations[IndexAnnotationImageLayerDigest],
+		FromZtoc:  from.Digest.String(),
+		ToZtoc:    to.Digest.String(),
+	}
+	if from.Digest == to.Digest {
+		// identical ztocs have the same span digests, so the content of the layers is the same.
+		diff.ContentCompared = true
+		return diff, nil
+	}
+	diff.Status = LayerDiffChanged
+
+	fromZtoc, err := loadZtoc(ctx, blobStore, from)
+	if err != nil {
+		return nil, err
+	}
+	toZtoc, err := loadZtoc(ctx, blobStore, to)
+	if err != nil {
+		return nil, err
+	}
+	diff.BuildTool = change(fromZtoc.BuildToolIdentifier, toZtoc.BuildToolIdentifier)
+	diff.CompressionAlgorithm = change(fromZtoc.CompressionAlgorithm, toZtoc.CompressionAlgorithm)
+	fromSpanSize, err := spanSize(fromZtoc)
+	if err != nil {
+		return nil, err
+	}
+	toSpanSize, err := spanSize(toZtoc)
+	if err != nil {
+		return nil, err
+	}
+	diff.SpanSize = change(fromSpanSize, toSpanSize)
+	diff.ContentCompared = hasFileDigests(fromZtoc) && hasFileDigests(toZtoc)
+
+	// files are matched by their cleaned path (e.g., "./etc/x" and "etc/x" are the same file) and
+	// only the last entry of a path counts, like in the layer once it's extracted.
+	for _, file := range fromZtoc.ListPrefix("") {
+		toFile, ok := toZtoc.Lookup(file.Name)
+		if !ok {
+			diff.RemovedFiles = append(diff.RemovedFiles, file.Name)
+			continue
+		}
+		if fileChanged(file, toFile) {
+			diff.ChangedFiles = append(diff.ChangedFiles, file.Name)
+		}
+	}
+	for _, file := range toZtoc.ListPrefix("") {
+		if _, ok := fromZtoc.Lookup(file.Name); !ok {
+			diff.AddedFiles = append(diff.AddedFiles, file.Name)
+		}
+	}
+	sort.Strings(diff.AddedFiles)
+	sort.Strings(diff.RemovedFiles)
+	sort.Strings(diff.ChangedFiles)
+	return diff, nil
+}
+
+func spanSize(toc *ztoc.Ztoc) (string, error) {
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return "", err
+	}
+	defer zinfo.Close()
+	return strconv.FormatInt(int64(zinfo.SpanSize()), 10), nil
+}
+
+// hasFileDigests returns true if the ztoc has the digest of each regular file.
+func hasFileDigests(toc *ztoc.Ztoc) bool {
+	for _, file := range toc.FileMetadata {
+		if file.Type == "reg" && file.Digest == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// fileChanged returns true if the metadata of a file differ, or its content if both ztocs have the
+// digest of the file. The offsets of the file in the layers are ignored, since they change whenever
+// a file before it changes, and so are the names, which only differ if they aren't clean.
+func fileChanged(from, to ztoc.FileMetadata) bool {
+	if from.Digest != "" && to.Digest != "" && from.Digest != to.Digest {
+		return true
+	}
+	from.Name, to.Name = "", ""
+	from.UncompressedOffset, to.UncompressedOffset = 0, 0
+	from.Digest, to.Digest = "", ""
+	return !reflect.DeepEqual(from, to)
+}
+
+func change(from, to string) *Change {
+	if from == to {
+		return nil
+	}
+	return &Change{From: from, To: to}
+}
@@ -0,0 +1,266 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/images"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestDiffIndices(t *testing.T) {
+	ctx := context.Background()
+	buildLayer := func(entries ...testutil.TarEntry) []byte {
+		layer, err := io.ReadAll(testutil.BuildTarGz(entries, gzip.DefaultCompression))
+		if err != nil {
+			t.Fatalf("can't build layer: %v", err)
+		}
+		return layer
+	}
+	data := string(testutil.RandomByteData(50000))
+	base := buildLayer(testutil.File("base", data))
+	app := buildLayer(
+		testutil.File("app/kept", data),
+		testutil.File("app/changed", "version 1"),
+		testutil.File("app/removed", data),
+	)
+	rebuiltApp := buildLayer(
+		testutil.File("app/kept", data),
+		testutil.File("app/changed", "version 2"),
+		testutil.File("app/added", data),
+	)
+	extra := buildLayer(testutil.File("extra", data))
+
+	store := memory.New()
+	blobStore, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("can't create OCI store: %v", err)
+	}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	buildIndex := func(spanSize int64, layers ...[]byte) (digest.Digest, []ocispec.Descriptor) {
+		manifestDesc, layerDescs := pushTestImageLayers(t, store, layers...)
+		builder, err := NewIndexBuilder(NewRemoteProvider(store), blobStore, artifactsDb,
+			WithSpanSize(spanSize), WithMinLayerSize(0), WithForceRebuild(true))
+		if err != nil {
+			t.Fatalf("can't create index builder: %v", err)
+		}
+		index, err := builder.Build(ctx, images.Image{Name: "test", Target: manifestDesc})
+		if err != nil {
+			t.Fatalf("can't build index: %v", err)
+		}
+		if err := WriteSociIndex(ctx, index, blobStore, artifactsDb); err != nil {
+			t.Fatalf("can't write index: %v", err)
+		}
+		b, err := MarshalIndex(index.Index)
+		if err != nil {
+			t.Fatalf("can't marshal index: %v", err)
+		}
+		return digest.FromBytes(b), layerDescs
+	}
+
+	from, fromLayers := buildIndex(20000, base, app)
+	to, toLayers := buildIndex(20000, base, rebuiltApp, extra)
+	resized, _ := buildIndex(30000, base, app)
+
+	t.Run("rebuilt image", func(t *testing.T) {
+		diff, err := DiffIndices(ctx, blobStore, artifactsDb, from, to)
+		if err != nil {
+			t.Fatalf("can't diff indices: %v", err)
+		}
+		if !diff.HasChanges() || diff.Subject == nil || diff.BuildTool != nil {
+			t.Fatalf("unexpected index changes: %+v", diff)
+		}
+		var statuses []LayerDiffStatus
+		for _, layer := range diff.Layers {
+			statuses = append(statuses, layer.Status)
+		}
+		if diff := cmp.Diff([]LayerDiffStatus{LayerDiffUnchanged, LayerDiffChanged, LayerDiffAdded}, statuses); diff != "" {
+			t.Fatalf("unexpected layer statuses, diff = %v", diff)
+		}
+		changed := diff.Layers[1]
+		if changed.FromLayer != fromLayers[1].Digest.String() || changed.ToLayer != toLayers[1].Digest.String() {
+			t.Fatalf("unexpected paired layers: %+v", changed)
+		}
+		if changed.SpanSize != nil || changed.BuildTool != nil || changed.CompressionAlgorithm != nil || !changed.ContentCompared {
+			t.Fatalf("unexpected ztoc changes: %+v", changed)
+		}
+		if diff := cmp.Diff([]string{"app/added"}, changed.AddedFiles); diff != "" {
+			t.Fatalf("unexpected added files, diff = %v", diff)
+		}
+		if diff := cmp.Diff([]string{"app/removed"}, changed.RemovedFiles); diff != "" {
+			t.Fatalf("unexpected removed files, diff = %v", diff)
+		}
+		if diff := cmp.Diff([]string{"app/changed"}, changed.ChangedFiles); diff != "" {
+			t.Fatalf("unexpected changed files, diff = %v", diff)
+		}
+		if diff.Layers[2].ToLayer != toLayers[2].Digest.String() {
+			t.Fatalf("unexpected added layer: %+v", diff.Layers[2])
+		}
+	})
+
+	t.Run("different span size", func(t *testing.T) {
+		diff, err := DiffIndices(ctx, blobStore, artifactsDb, from, resized)
+		if err != nil {
+			t.Fatalf("can't diff indices: %v", err)
+		}
+		if diff.Subject != nil {
+			t.Fatalf("unexpected subject change: %v", diff.Subject)
+		}
+		for _, layer := range diff.Layers {
+			if layer.Status != LayerDiffChanged {
+				t.Fatalf("unexpected layer status: %v", layer.Status)
+			}
+			if diff := cmp.Diff(&Change{From: "20000", To: "30000"}, layer.SpanSize); diff != "" {
+				t.Fatalf("unexpected span size change, diff = %v", diff)
+			}
+			if len(layer.AddedFiles)+len(layer.RemovedFiles)+len(layer.ChangedFiles) != 0 {
+				t.Fatalf("unexpected file changes: %+v", layer)
+			}
+		}
+	})
+
+	t.Run("ztoc without file digests", func(t *testing.T) {
+		diff, err := DiffIndices(ctx, blobStore, artifactsDb, from, to)
+		if err != nil {
+			t.Fatalf("can't diff indices: %v", err)
+		}
+		ztocDesc := func(ztocDigest, layerDigest string) ocispec.Descriptor {
+			entry, err := artifactsDb.GetArtifactEntry(ztocDigest)
+			if err != nil {
+				t.Fatalf("can't get ztoc entry: %v", err)
+			}
+			return ocispec.Descriptor{
+				Digest:      digest.Digest(ztocDigest),
+				Size:        entry.Size,
+				Annotations: map[string]string{IndexAnnotationImageLayerDigest: layerDigest},
+			}
+		}
+		fromZtoc := ztocDesc(diff.Layers[1].FromZtoc, diff.Layers[1].FromLayer)
+		toZtoc := ztocDesc(diff.Layers[1].ToZtoc, diff.Layers[1].ToLayer)
+
+		// a version 0.9 ztoc of the rebuilt layer has no file digests.
+		toc, err := loadZtoc(ctx, blobStore, toZtoc)
+		if err != nil {
+			t.Fatalf("can't load ztoc: %v", err)
+		}
+		toc.Version = ztoc.Version09
+		for i := range toc.FileMetadata {
+			toc.FileMetadata[i].Digest = ""
+		}
+		r, legacyZtoc, err := ztoc.Marshal(toc)
+		if err != nil {
+			t.Fatalf("can't marshal ztoc: %v", err)
+		}
+		if err := blobStore.Push(ctx, legacyZtoc, r); err != nil {
+			t.Fatalf("can't push ztoc: %v", err)
+		}
+		legacyZtoc.Annotations = toZtoc.Annotations
+
+		layerDiff, err := diffZtocs(ctx, blobStore, fromZtoc, legacyZtoc)
+		if err != nil {
+			t.Fatalf("can't diff ztocs: %v", err)
+		}
+		if layerDiff.ContentCompared {
+			t.Fatalf("content compared without file digests: %+v", layerDiff)
+		}
+		// "app/changed" has the same metadata in both layers, so its change isn't detected.
+		if len(layerDiff.ChangedFiles) != 0 {
+			t.Fatalf("unexpected changed files: %v", layerDiff.ChangedFiles)
+		}
+	})
+
+	t.Run("same index", func(t *testing.T) {
+		diff, err := DiffIndices(ctx, blobStore, artifactsDb, from, from)
+		if err != nil {
+			t.Fatalf("can't diff indices: %v", err)
+		}
+		if diff.HasChanges() {
+			t.Fatalf("unexpected changes: %+v", diff)
+		}
+	})
+}
+
+func TestDiffZtocsMatchesCleanPaths(t *testing.T) {
+	ctx := context.Background()
+	data := string(testutil.RandomByteData(50000))
+	store := memory.New()
+	pushZtoc := func(name string, layer io.Reader, build func(*ztoc.Builder, string) (*ztoc.Ztoc, error)) ocispec.Descriptor {
+		layerPath, _, err := testutil.WriteTarToTempFile(name, layer)
+		if err != nil {
+			t.Fatalf("can't write layer: %v", err)
+		}
+		defer os.Remove(layerPath)
+		toc, err := build(ztoc.NewBuilder("test"), layerPath)
+		if err != nil {
+			t.Fatalf("can't build ztoc: %v", err)
+		}
+		r, desc, err := ztoc.Marshal(toc)
+		if err != nil {
+			t.Fatalf("can't marshal ztoc: %v", err)
+		}
+		if err := store.Push(ctx, desc, r); err != nil {
+			t.Fatalf("can't push ztoc: %v", err)
+		}
+		return desc
+	}
+
+	// the tar layer has "./" prefixed names and an older version of a file before the one that is extracted.
+	tarZtoc := pushZtoc("layer.tar.gz", testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.Dir("./etc/"),
+		testutil.File("./etc/config", "old config"),
+		testutil.File("./etc/data", data),
+		testutil.File("./etc/config", "config"),
+	}, gzip.DefaultCompression), func(b *ztoc.Builder, path string) (*ztoc.Ztoc, error) {
+		return b.BuildZtoc(path, 20000)
+	})
+	estargzZtoc := pushZtoc("layer.estargz", testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("etc/"),
+		testutil.File("etc/config", "config"),
+		testutil.File("etc/data", data),
+	}, 8192), func(b *ztoc.Builder, path string) (*ztoc.Ztoc, error) {
+		return b.BuildZtocFromEStargz(path, 20000)
+	})
+
+	diff, err := diffZtocs(ctx, store, tarZtoc, estargzZtoc)
+	if err != nil {
+		t.Fatalf("can't diff ztocs: %v", err)
+	}
+	if !diff.ContentCompared {
+		t.Fatalf("file contents were not compared")
+	}
+	// the TOC of the eStargz layer is stored as a file of the layer.
+	if diff := cmp.Diff([]string{"stargz.index.json"}, diff.AddedFiles); diff != "" {
+		t.Fatalf("unexpected added files, diff = %v", diff)
+	}
+	if len(diff.RemovedFiles) != 0 || len(diff.ChangedFiles) != 0 {
+		t.Fatalf("unexpected file changes. removed: %v, changed: %v", diff.RemovedFiles, diff.ChangedFiles)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	bolt "go.etcd.io/bbolt"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// GarbageCollectionResult describes the artifacts removed (or that would be removed) by `CollectGarbage`.
+type GarbageCollectionResult struct {
+	// RemovedBlobs are the blobs removed from the local store.
+	RemovedBlobs []ocispec.Descriptor
+	// RemovedEntries are the digests of the entries removed from the artifacts db.
+	RemovedEntries []string
+	// ReclaimedBytes is the total size of the removed blobs.
+	ReclaimedBytes int64
+}
+
+// CollectGarbage removes the artifacts of the local store at `blobStorePath` (i.e. the `blobs` directory
+// of the OCI layout) that are not reachable from an index, along with their artifacts db entries.
+// The indices are those of the artifacts db and the index manifests of the local store, since the
+// snapshotter fetches indices into the local store without adding them to the artifacts db.
+// An artifact is reachable if it is an index, one of its ztocs, its config or one of its signatures.
+// Indices are removed with `RemoveIndices`. With `dryRun`, nothing is removed.
+//
+// The ztocs of an index are written before the index itself, by `soci create` and `soci index import`
+// as well as by the snapshotter, which doesn't use the artifacts db. So that the ztocs of an index being
+// written are not removed, blobs modified less than `gracePeriod` ago are kept along with their entries.
+func CollectGarbage(ctx context.Context, blobStore orascontent.Fetcher, blobStorePath string, artifactsDb *ArtifactsDb, gracePeriod time.Duration, dryRun bool) (*GarbageCollectionResult, error) {
+	live, err := reachableArtifacts(ctx, blobStore, blobStorePath, artifactsDb)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GarbageCollectionResult{}
+	cutoff := time.Now().Add(-gracePeriod)
+	err = filepath.WalkDir(blobStorePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), d.Name())
+		if dgst.Validate() != nil || live[dgst] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			live[dgst] = true
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		result.RemovedBlobs = append(result.RemovedBlobs, ocispec.Descriptor{Digest: dgst, Size: info.Size()})
+		result.ReclaimedBytes += info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	err = artifactsDb.Walk(func(ae *ArtifactEntry) error {
+		dgst := digest.Digest(ae.Digest)
+		if live[dgst] {
+			return nil
+		}
+		// the blob of the entry may have been written since the blobs were walked.
+		if dgst.Validate() == nil {
+			info, err := os.Stat(filepath.Join(blobStorePath, dgst.Algorithm().String(), dgst.Encoded()))
+			if err == nil && info.ModTime().After(cutoff) {
+				return nil
+			}
+		}
+		result.RemovedEntries = append(result.RemovedEntries, ae.Digest)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := artifactsDb.removeArtifactEntries(result.RemovedEntries); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// reachableArtifacts returns the digests of the artifacts reachable from the indices of the artifacts db
+// and of the local store at `blobStorePath`.
+func reachableArtifacts(ctx context.Context, blobStore orascontent.Fetcher, blobStorePath string, artifactsDb *ArtifactsDb) (map[digest.Digest]bool, error) {
+	live := make(map[digest.Digest]bool)
+	addIndex := func(dgst digest.Digest, index *Index) {
+		live[dgst] = true
+		for _, blob := range index.Blobs {
+			live[blob.Digest] = true
+		}
+		if index.MediaType == ocispec.MediaTypeImageManifest {
+			live[defaultConfigDescriptor.Digest] = true
+		}
+	}
+	// signatures maps the digest of each signature to the digest of its index.
+	signatures := make(map[digest.Digest]digest.Digest)
+	err := artifactsDb.Walk(func(ae *ArtifactEntry) error {
+		switch ae.Type {
+		case ArtifactEntryTypeIndex:
+			desc := ocispec.Descriptor{Digest: digest.Digest(ae.Digest), Size: ae.Size}
+			b, err := orascontent.FetchAll(ctx, blobStore, desc)
+			if err != nil {
+				return fmt.Errorf("cannot read index %v, run \"soci rebuild-db\" to sync the artifacts db with the local store: %w", ae.Digest, err)
+			}
+			var index Index
+			if err := UnmarshalIndex(b, &index); err != nil {
+				return fmt.Errorf("cannot decode index %v: %w", ae.Digest, err)
+			}
+			addIndex(desc.Digest, &index)
+		case ArtifactEntryTypeSignature:
+			signatures[digest.Digest(ae.Digest)] = digest.Digest(ae.OriginalDigest)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkStoreManifests(blobStorePath, func(dgst digest.Digest, b []byte) error {
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil
+		}
+		switch {
+		case manifest.Config.MediaType == SociSignatureArtifactType:
+			if manifest.Subject != nil {
+				signatures[dgst] = manifest.Subject.Digest
+			}
+		case manifest.Config.MediaType == SociIndexArtifactType || manifest.ArtifactType == SociIndexArtifactType:
+			var index Index
+			if err := UnmarshalIndex(b, &index); err != nil {
+				return nil
+			}
+			addIndex(dgst, &index)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for signature, index := range signatures {
+		if live[index] {
+			live[signature] = true
+			live[signatureConfigDescriptor.Digest] = true
+		}
+	}
+	return live, nil
+}
+
+// maxManifestSize is the size of the largest blob of the local store that may be an index or signature
+// manifest. Larger blobs (i.e. ztocs) aren't read to look for indices.
+const maxManifestSize = 4 << 20
+
+// walkStoreManifests calls `f` with the digest and content of each blob of the local store at
+// `blobStorePath` that may be a JSON manifest.
+func walkStoreManifests(blobStorePath string, f func(digest.Digest, []byte) error) error {
+	err := filepath.WalkDir(blobStorePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), d.Name())
+		if dgst.Validate() != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > maxManifestSize {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// ztocs are flatbuffers, so they are told apart from JSON manifests by their first byte.
+		if len(b) == 0 || b[0] != '{' {
+			return nil
+		}
+		return f(dgst, b)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// RemoveIndices removes the indices `indexDigests` and their signatures from the artifacts db, and their
+// manifests from the local store at `blobStorePath`. The ztocs of the indices are left to `CollectGarbage`,
+// since they may be shared with other indices.
+func RemoveIndices(artifactsDb *ArtifactsDb, blobStorePath string, indexDigests []string) error {
+	for _, indexDigest := range indexDigests {
+		signatures, err := artifactsDb.GetIndexSignatures(indexDigest)
+		if err != nil {
+			return err
+		}
+		if err := artifactsDb.RemoveArtifactEntryByIndexDigest(indexDigest); err != nil {
+			return err
+		}
+		blobs := []string{indexDigest}
+		for _, signature := range signatures {
+			blobs = append(blobs, signature.Digest)
+		}
+		for _, blob := range blobs {
+			dgst, err := digest.Parse(blob)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(filepath.Join(blobStorePath, dgst.Algorithm().String(), dgst.Encoded()))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeArtifactEntries removes the artifact entries of `digests`.
+func (db *ArtifactsDb) removeArtifactEntries(digests []string) error {
+	if len(digests) == 0 {
+		return nil
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return err
+		}
+		for _, d := range digests {
+			if bucket.Bucket([]byte(d)) == nil {
+				continue
+			}
+			if err := bucket.DeleteBucket([]byte(d)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
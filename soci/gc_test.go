@@ -0,0 +1,272 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := oci.New(root)
+	if err != nil {
+		t.Fatalf("can't create OCI store: %v", err)
+	}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+
+	pushBlob := func(content string) ocispec.Descriptor {
+		desc := ocispec.Descriptor{Digest: digest.FromString(content), Size: int64(len(content))}
+		if err := store.Push(ctx, desc, bytes.NewReader([]byte(content))); err != nil {
+			t.Fatalf("can't push blob: %v", err)
+		}
+		return desc
+	}
+	pushZtoc := func(content string) ocispec.Descriptor {
+		desc := pushBlob(content)
+		layerDigest := digest.FromString("layer " + content)
+		err := artifactsDb.WriteArtifactEntry(&ArtifactEntry{
+			Size:           desc.Size,
+			Digest:         desc.Digest.String(),
+			OriginalDigest: layerDigest.String(),
+			Type:           ArtifactEntryTypeLayer,
+			Location:       layerDigest.String(),
+			MediaType:      SociLayerMediaType,
+			CreatedAt:      time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("can't write ztoc entry: %v", err)
+		}
+		desc.MediaType = SociLayerMediaType
+		return desc
+	}
+	platform := platforms.DefaultSpec()
+	writeIndex := func(image string, ztocs ...ocispec.Descriptor) *ArtifactEntry {
+		subject := &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(image), Size: 10}
+		index := NewIndex(ztocs, subject, nil)
+		err := WriteSociIndex(ctx, &IndexWithMetadata{Index: index, Platform: &platform, ImageDigest: subject.Digest, CreatedAt: time.Now()}, store, artifactsDb)
+		if err != nil {
+			t.Fatalf("can't write index: %v", err)
+		}
+		b, err := MarshalIndex(index)
+		if err != nil {
+			t.Fatalf("can't marshal index: %v", err)
+		}
+		entry, err := artifactsDb.GetArtifactEntry(digest.FromBytes(b).String())
+		if err != nil {
+			t.Fatalf("can't get index entry: %v", err)
+		}
+		return entry
+	}
+
+	shared, kept, orphaned := pushZtoc("shared ztoc"), pushZtoc("kept ztoc"), pushZtoc("orphaned ztoc")
+	keptIndex := writeIndex("kept image", shared, kept)
+	removedIndex := writeIndex("removed image", shared, orphaned)
+	unknown := pushBlob("unknown blob")
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	sign := func(entry *ArtifactEntry) ocispec.Descriptor {
+		signature, err := SignIndex(ocispec.Descriptor{Digest: digest.Digest(entry.Digest), Size: entry.Size}, key)
+		if err != nil {
+			t.Fatalf("can't sign index: %v", err)
+		}
+		desc, err := WriteIndexSignature(ctx, signature, entry, store, artifactsDb)
+		if err != nil {
+			t.Fatalf("can't write signature: %v", err)
+		}
+		return desc
+	}
+	keptSignature := sign(keptIndex)
+	removedSignature := sign(removedIndex)
+
+	// an index fetched by the snapshotter is only in the store.
+	fetched := pushBlob("fetched ztoc")
+	fetched.MediaType = SociLayerMediaType
+	fetchedManifest, err := MarshalIndex(NewIndex([]ocispec.Descriptor{shared, fetched},
+		&ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("fetched image"), Size: 10}, nil))
+	if err != nil {
+		t.Fatalf("can't marshal index: %v", err)
+	}
+	fetchedIndex := pushBlob(string(fetchedManifest))
+	fetchedSignatureManifest, err := SignIndex(fetchedIndex, key)
+	if err != nil {
+		t.Fatalf("can't sign index: %v", err)
+	}
+	fetchedSignature := pushBlob(string(fetchedSignatureManifest))
+
+	if err := RemoveIndices(artifactsDb, filepath.Join(root, "blobs"), []string{removedIndex.Digest}); err != nil {
+		t.Fatalf("can't remove index: %v", err)
+	}
+	for _, desc := range []ocispec.Descriptor{{Digest: digest.Digest(removedIndex.Digest), Size: removedIndex.Size}, removedSignature} {
+		if exists, err := store.Exists(ctx, desc); err != nil || exists {
+			t.Fatalf("manifest %v of the removed index is still in the store: %v", desc.Digest, err)
+		}
+	}
+
+	expectedBlobs := []string{orphaned.Digest.String(), unknown.Digest.String()}
+	sort.Strings(expectedBlobs)
+	expectedEntries := []string{orphaned.Digest.String()}
+	for _, dryRun := range []bool{true, false} {
+		result, err := CollectGarbage(ctx, store, filepath.Join(root, "blobs"), artifactsDb, 0, dryRun)
+		if err != nil {
+			t.Fatalf("can't collect garbage (dry run: %v): %v", dryRun, err)
+		}
+		var blobs []string
+		var reclaimed int64
+		for _, desc := range result.RemovedBlobs {
+			blobs = append(blobs, desc.Digest.String())
+			reclaimed += desc.Size
+		}
+		sort.Strings(blobs)
+		if diff := cmp.Diff(expectedBlobs, blobs); diff != "" {
+			t.Fatalf("unexpected removed blobs (dry run: %v), diff = %v", dryRun, diff)
+		}
+		if diff := cmp.Diff(expectedEntries, result.RemovedEntries); diff != "" {
+			t.Fatalf("unexpected removed entries (dry run: %v), diff = %v", dryRun, diff)
+		}
+		if reclaimed != result.ReclaimedBytes {
+			t.Fatalf("unexpected reclaimed bytes (dry run: %v). expect: %d, actual: %d", dryRun, reclaimed, result.ReclaimedBytes)
+		}
+
+		exists, err := store.Exists(ctx, orphaned)
+		if err != nil {
+			t.Fatalf("can't check ztoc: %v", err)
+		}
+		if exists != dryRun {
+			t.Fatalf("unexpected presence of the orphaned ztoc (dry run: %v): %v", dryRun, exists)
+		}
+	}
+
+	for _, desc := range []ocispec.Descriptor{fetched, fetchedIndex, fetchedSignature, defaultConfigDescriptor, signatureConfigDescriptor} {
+		if exists, err := store.Exists(ctx, desc); err != nil || !exists {
+			t.Fatalf("artifact %v reachable from the fetched index was removed: %v", desc.Digest, err)
+		}
+	}
+	for _, desc := range []ocispec.Descriptor{shared, kept, keptSignature, {Digest: digest.Digest(keptIndex.Digest), Size: keptIndex.Size}} {
+		if exists, err := store.Exists(ctx, desc); err != nil || !exists {
+			t.Fatalf("reachable artifact %v was removed: %v", desc.Digest, err)
+		}
+		if _, err := artifactsDb.GetArtifactEntry(desc.Digest.String()); err != nil {
+			t.Fatalf("entry of reachable artifact %v was removed: %v", desc.Digest, err)
+		}
+	}
+	if _, err := artifactsDb.GetArtifactEntry(orphaned.Digest.String()); err == nil {
+		t.Fatalf("entry of the orphaned ztoc was not removed")
+	}
+}
+
+func TestCollectGarbageGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	blobStorePath := filepath.Join(root, "blobs")
+	store, err := oci.New(root)
+	if err != nil {
+		t.Fatalf("can't create OCI store: %v", err)
+	}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	pushZtoc := func(content string) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: SociLayerMediaType, Digest: digest.FromString(content), Size: int64(len(content))}
+		if err := store.Push(ctx, desc, bytes.NewReader([]byte(content))); err != nil {
+			t.Errorf("can't push ztoc: %v", err)
+		}
+		err := artifactsDb.WriteArtifactEntry(&ArtifactEntry{
+			Size:      desc.Size,
+			Digest:    desc.Digest.String(),
+			Type:      ArtifactEntryTypeLayer,
+			MediaType: SociLayerMediaType,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Errorf("can't write ztoc entry: %v", err)
+		}
+		return desc
+	}
+
+	oldOrphan, recentOrphan := pushZtoc("old orphaned ztoc"), pushZtoc("recent orphaned ztoc")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(blobStorePath, "sha256", oldOrphan.Digest.Encoded()), old, old); err != nil {
+		t.Fatalf("can't change the modification time of the ztoc: %v", err)
+	}
+
+	// indices are written (ztocs first) while garbage is collected.
+	var ztocs []ocispec.Descriptor
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		platform := platforms.DefaultSpec()
+		for i := 0; i < 20; i++ {
+			ztoc := pushZtoc(fmt.Sprintf("ztoc %d", i))
+			ztocs = append(ztocs, ztoc)
+			subject := &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(fmt.Sprintf("image %d", i)), Size: 10}
+			index := NewIndex([]ocispec.Descriptor{ztoc}, subject, nil)
+			err := WriteSociIndex(ctx, &IndexWithMetadata{Index: index, Platform: &platform, ImageDigest: subject.Digest, CreatedAt: time.Now()}, store, artifactsDb)
+			if err != nil {
+				t.Errorf("can't write index: %v", err)
+			}
+		}
+	}()
+	collect := func() {
+		if _, err := CollectGarbage(ctx, store, blobStorePath, artifactsDb, time.Hour, false); err != nil {
+			t.Fatalf("can't collect garbage: %v", err)
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			collect()
+		}
+	}
+	collect()
+
+	for _, desc := range append(ztocs, recentOrphan) {
+		if exists, err := store.Exists(ctx, desc); err != nil || !exists {
+			t.Fatalf("ztoc %v modified during the grace period was removed: %v", desc.Digest, err)
+		}
+		if _, err := artifactsDb.GetArtifactEntry(desc.Digest.String()); err != nil {
+			t.Fatalf("entry of ztoc %v modified during the grace period was removed: %v", desc.Digest, err)
+		}
+	}
+	if exists, err := store.Exists(ctx, oldOrphan); err != nil || exists {
+		t.Fatalf("orphaned ztoc modified before the grace period was not removed: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pelletier/go-toml"
+)
+
+// LayerPolicy selects the layers of an image that get a ztoc. A layer is skipped if any rule excludes it.
+// The zero value includes every layer.
+type LayerPolicy struct {
+	// IncludeDigests, if not empty, is the allowlist of the layers to index.
+	IncludeDigests []string `toml:"include_digests"`
+	// ExcludeDigests is the denylist of layers not to index (e.g., base OS layers cached on every node).
+	ExcludeDigests []string `toml:"exclude_digests"`
+	// IncludeMediaTypes, if not empty, is the allowlist of the media types of the layers to index.
+	IncludeMediaTypes []string `toml:"include_media_types"`
+	// ExcludeMediaTypes is the denylist of the media types of the layers not to index.
+	ExcludeMediaTypes []string `toml:"exclude_media_types"`
+	// TopLayers, if not 0, is the number of top-most layers to index.
+	TopLayers int `toml:"top_layers"`
+	// SkipBottomLayers is the number of bottom-most layers not to index.
+	SkipBottomLayers int `toml:"skip_bottom_layers"`
+	// MaxLayerSize, if not 0, is the size of the largest layer to index.
+	MaxLayerSize int64 `toml:"max_layer_size"`
+}
+
+// LoadLayerPolicy loads a `LayerPolicy` from a TOML file.
+func LoadLayerPolicy(path string) (LayerPolicy, error) {
+	var policy LayerPolicy
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return policy, fmt.Errorf("failed to load layer policy %q: %w", path, err)
+	}
+	if err := tree.Unmarshal(&policy); err != nil {
+		return policy, fmt.Errorf("failed to unmarshal layer policy %q: %w", path, err)
+	}
+	return policy, policy.Validate()
+}
+
+// Validate returns an error if the policy is invalid.
+func (p LayerPolicy) Validate() error {
+	for _, dgsts := range [][]string{p.IncludeDigests, p.ExcludeDigests} {
+		for _, dgst := range dgsts {
+			if _, err := digest.Parse(dgst); err != nil {
+				return fmt.Errorf("invalid layer digest %q in layer policy: %w", dgst, err)
+			}
+		}
+	}
+	if p.TopLayers < 0 || p.SkipBottomLayers < 0 || p.MaxLayerSize < 0 {
+		return fmt.Errorf("invalid layer policy: top layers, skipped bottom layers and max layer size can't be negative")
+	}
+	return nil
+}
+
+// skip returns whether the policy skips `desc`, the layer at `position` (from the bottom) of `numLayers` layers,
+// and why.
+func (p LayerPolicy) skip(desc ocispec.Descriptor, position, numLayers int) (bool, string) {
+	if len(p.IncludeDigests) > 0 && !contains(p.IncludeDigests, desc.Digest.String()) {
+		return true, "digest is not in the included digests"
+	}
+	if contains(p.ExcludeDigests, desc.Digest.String()) {
+		return true, "digest is in the excluded digests"
+	}
+	if len(p.IncludeMediaTypes) > 0 && !contains(p.IncludeMediaTypes, desc.MediaType) {
+		return true, fmt.Sprintf("media type %s is not in the included media types", desc.MediaType)
+	}
+	if contains(p.ExcludeMediaTypes, desc.MediaType) {
+		return true, fmt.Sprintf("media type %s is in the excluded media types", desc.MediaType)
+	}
+	if position < p.SkipBottomLayers {
+		return true, fmt.Sprintf("layer is one of the %d bottom layers", p.SkipBottomLayers)
+	}
+	if p.TopLayers > 0 && position < numLayers-p.TopLayers {
+		return true, fmt.Sprintf("layer is not one of the %d top layers", p.TopLayers)
+	}
+	if p.MaxLayerSize > 0 && desc.Size > p.MaxLayerSize {
+		return true, fmt.Sprintf("size %d is greater than max-layer-size %d", desc.Size, p.MaxLayerSize)
+	}
+	return false, ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/images"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestLayerPolicySkip(t *testing.T) {
+	layer := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+		Size:      1000,
+	}
+	other := digest.FromString("other layer").String()
+
+	testCases := []struct {
+		name      string
+		policy    LayerPolicy
+		position  int
+		numLayers int
+		skip      bool
+	}{
+		{
+			name:      "empty policy",
+			numLayers: 1,
+		},
+		{
+			name:      "included digest",
+			policy:    LayerPolicy{IncludeDigests: []string{layer.Digest.String()}},
+			numLayers: 1,
+		},
+		{
+			name:      "not included digest",
+			policy:    LayerPolicy{IncludeDigests: []string{other}},
+			numLayers: 1,
+			skip:      true,
+		},
+		{
+			name:      "excluded digest",
+			policy:    LayerPolicy{ExcludeDigests: []string{other, layer.Digest.String()}},
+			numLayers: 1,
+			skip:      true,
+		},
+		{
+			name:      "not included media type",
+			policy:    LayerPolicy{IncludeMediaTypes: []string{ocispec.MediaTypeImageLayerZstd}},
+			numLayers: 1,
+			skip:      true,
+		},
+		{
+			name:      "excluded media type",
+			policy:    LayerPolicy{ExcludeMediaTypes: []string{ocispec.MediaTypeImageLayerGzip}},
+			numLayers: 1,
+			skip:      true,
+		},
+		{
+			name:      "bottom layer",
+			policy:    LayerPolicy{SkipBottomLayers: 2},
+			position:  1,
+			numLayers: 5,
+			skip:      true,
+		},
+		{
+			name:      "above bottom layers",
+			policy:    LayerPolicy{SkipBottomLayers: 2},
+			position:  2,
+			numLayers: 5,
+		},
+		{
+			name:      "top layer",
+			policy:    LayerPolicy{TopLayers: 2},
+			position:  3,
+			numLayers: 5,
+		},
+		{
+			name:      "below top layers",
+			policy:    LayerPolicy{TopLayers: 2},
+			position:  2,
+			numLayers: 5,
+			skip:      true,
+		},
+		{
+			name:      "size=maxLayerSize",
+			policy:    LayerPolicy{MaxLayerSize: 1000},
+			numLayers: 1,
+		},
+		{
+			name:      "size>maxLayerSize",
+			policy:    LayerPolicy{MaxLayerSize: 999},
+			numLayers: 1,
+			skip:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			skip, reason := tc.policy.skip(layer, tc.position, tc.numLayers)
+			if skip != tc.skip {
+				t.Fatalf("unexpected skip. expect: %v, actual: %v (%s)", tc.skip, skip, reason)
+			}
+			if skip && reason == "" {
+				t.Fatalf("skipped layer without a reason")
+			}
+		})
+	}
+}
+
+func TestLoadLayerPolicy(t *testing.T) {
+	layerDigest := digest.FromString("layer").String()
+	testCases := []struct {
+		name        string
+		content     string
+		expected    LayerPolicy
+		expectError bool
+	}{
+		{
+			name: "valid policy",
+			content: `exclude_digests = ["` + layerDigest + `"]
+include_media_types = ["application/vnd.oci.image.layer.v1.tar+gzip"]
+top_layers = 3
+max_layer_size = 1048576
+`,
+			expected: LayerPolicy{
+				ExcludeDigests:    []string{layerDigest},
+				IncludeMediaTypes: []string{ocispec.MediaTypeImageLayerGzip},
+				TopLayers:         3,
+				MaxLayerSize:      1 << 20,
+			},
+		},
+		{
+			name:        "invalid digest",
+			content:     `include_digests = ["sha256:abc"]`,
+			expectError: true,
+		},
+		{
+			name:        "negative top layers",
+			content:     `top_layers = -1`,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.toml")
+			if err := os.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("can't write policy: %v", err)
+			}
+			policy, err := LoadLayerPolicy(path)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("can't load policy: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, policy); diff != "" {
+				t.Fatalf("unexpected policy, diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestBuildRecordsSkippedLayers(t *testing.T) {
+	var layers [][]byte
+	for i := 0; i < 3; i++ {
+		layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+			testutil.File("file", string(testutil.RandomByteData(50000))),
+		}, gzip.DefaultCompression))
+		if err != nil {
+			t.Fatalf("can't build layer: %v", err)
+		}
+		layers = append(layers, layer)
+	}
+	store := memory.New()
+	manifestDesc, layerDescs := pushTestImageLayers(t, store, layers...)
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	policy := LayerPolicy{SkipBottomLayers: 1, ExcludeDigests: []string{layerDescs[2].Digest.String()}}
+	builder, err := NewIndexBuilder(NewRemoteProvider(store), memory.New(), artifactsDb,
+		WithSpanSize(20000), WithMinLayerSize(0), WithLayerPolicy(policy))
+	if err != nil {
+		t.Fatalf("can't create index builder: %v", err)
+	}
+	index, err := builder.Build(context.Background(), images.Image{Name: "test", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("can't build index: %v", err)
+	}
+
+	if len(index.Index.Blobs) != 1 || index.Index.Blobs[0].Annotations[IndexAnnotationImageLayerDigest] != layerDescs[1].Digest.String() {
+		t.Fatalf("unexpected index blobs: %v", index.Index.Blobs)
+	}
+	var skipped map[string]string
+	if err := json.Unmarshal([]byte(index.Index.Annotations[IndexAnnotationSkippedLayers]), &skipped); err != nil {
+		t.Fatalf("can't decode skipped layers: %v", err)
+	}
+	expected := map[string]string{
+		layerDescs[0].Digest.String(): "layer is one of the 1 bottom layers",
+		layerDescs[2].Digest.String(): "digest is in the excluded digests",
+	}
+	if diff := cmp.Diff(expected, skipped); diff != "" {
+		t.Fatalf("unexpected skipped layers, diff = %v", diff)
+	}
+}
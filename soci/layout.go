@@ -0,0 +1,350 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// The indices exported by `ExportIndices` are listed in the `index.json` of the OCI image layout
+// along with their signatures. The descriptors of the indices carry the metadata of their artifacts
+// db entries: the platform in `Platform` and the image digest and creation time in annotations.
+const (
+	// LayoutAnnotationImageDigest is the annotation of an exported index for the digest of its image
+	LayoutAnnotationImageDigest = "com.amazon.soci.image-digest"
+
+	ociLayoutFile  = "oci-layout"
+	ociIndexFile   = "index.json"
+	ociBlobsPrefix = "blobs/"
+)
+
+// ErrInvalidLayout is returned if an archive imported by `ImportIndices` is not a valid OCI image layout.
+var ErrInvalidLayout = errors.New("invalid OCI image layout")
+
+// ExportIndices writes the indices `indexDigests` of the artifacts db with their ztocs and signatures
+// to `w` as a tar archive of an OCI image layout, so that they can be imported with `ImportIndices`
+// where the local store isn't reachable (e.g., in air-gapped environments).
+func ExportIndices(ctx context.Context, w io.Writer, blobStore orascontent.Fetcher, artifactsDb *ArtifactsDb, indexDigests []digest.Digest) error {
+	tw := tar.NewWriter(w)
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ociLayoutFile, layout); err != nil {
+		return err
+	}
+
+	written := make(map[digest.Digest]bool)
+	writeBlob := func(desc ocispec.Descriptor) error {
+		if written[desc.Digest] {
+			return nil
+		}
+		written[desc.Digest] = true
+		return exportBlob(ctx, tw, blobStore, desc)
+	}
+
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	for _, indexDigest := range indexDigests {
+		entry, err := artifactsDb.GetArtifactEntry(indexDigest.String())
+		if err != nil {
+			return err
+		}
+		if entry.Type != ArtifactEntryTypeIndex {
+			return fmt.Errorf("%v is not a SOCI index", indexDigest)
+		}
+		indexDesc := ocispec.Descriptor{
+			MediaType:    entry.MediaType,
+			ArtifactType: SociIndexArtifactType,
+			Digest:       indexDigest,
+			Size:         entry.Size,
+			Annotations: map[string]string{
+				LayoutAnnotationImageDigest: entry.ImageDigest,
+				ocispec.AnnotationCreated:   entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+			},
+		}
+		if entry.Platform != "" {
+			platform, err := platforms.Parse(entry.Platform)
+			if err != nil {
+				return err
+			}
+			indexDesc.Platform = &platform
+		}
+
+		b, err := orascontent.FetchAll(ctx, blobStore, ocispec.Descriptor{Digest: indexDigest, Size: entry.Size})
+		if err != nil {
+			return fmt.Errorf("cannot read index %v: %w", indexDigest, err)
+		}
+		var sociIndex Index
+		if err := UnmarshalIndex(b, &sociIndex); err != nil {
+			return err
+		}
+		if sociIndex.MediaType == ocispec.MediaTypeImageManifest {
+			if err := writeBlob(defaultConfigDescriptor); err != nil {
+				return err
+			}
+		}
+		for _, blob := range sociIndex.Blobs {
+			if err := writeBlob(blob); err != nil {
+				return err
+			}
+		}
+		if err := writeBlob(indexDesc); err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, indexDesc)
+
+		signatures, err := artifactsDb.GetIndexSignatures(indexDigest.String())
+		if err != nil {
+			return err
+		}
+		for _, signature := range signatures {
+			signatureDesc := ocispec.Descriptor{
+				MediaType:    signature.MediaType,
+				ArtifactType: SociSignatureArtifactType,
+				Digest:       digest.Digest(signature.Digest),
+				Size:         signature.Size,
+			}
+			if err := writeBlob(signatureConfigDescriptor); err != nil {
+				return err
+			}
+			if err := writeBlob(signatureDesc); err != nil {
+				return err
+			}
+			index.Manifests = append(index.Manifests, signatureDesc)
+		}
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ociIndexFile, b); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ImportIndices loads the indices, ztocs and signatures of a tar archive of an OCI image layout
+// written by `ExportIndices` into the local store and the artifacts db, and returns the descriptors
+// of the imported indices. The digest of every blob is verified before it is stored.
+func ImportIndices(ctx context.Context, r io.Reader, blobStore orascontent.Storage, artifactsDb *ArtifactsDb) ([]ocispec.Descriptor, error) {
+	var index *ocispec.Index
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch {
+		case name == ociIndexFile:
+			index = &ocispec.Index{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, fmt.Errorf("%w: cannot decode %s: %v", ErrInvalidLayout, ociIndexFile, err)
+			}
+		case strings.HasPrefix(name, ociBlobsPrefix):
+			parts := strings.Split(strings.TrimPrefix(name, ociBlobsPrefix), "/")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%w: unexpected blob %s", ErrInvalidLayout, hdr.Name)
+			}
+			desc := ocispec.Descriptor{Digest: digest.NewDigestFromEncoded(digest.Algorithm(parts[0]), parts[1]), Size: hdr.Size}
+			if err := desc.Digest.Validate(); err != nil {
+				return nil, fmt.Errorf("%w: unexpected blob %s: %v", ErrInvalidLayout, hdr.Name, err)
+			}
+			// Push verifies the size and digest of the blob.
+			if err := blobStore.Push(ctx, desc, tr); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+				return nil, fmt.Errorf("cannot import blob %v: %w", desc.Digest, err)
+			}
+		}
+	}
+	if index == nil {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidLayout, ociIndexFile)
+	}
+
+	var indexDescs []ocispec.Descriptor
+	entries := make(map[digest.Digest]*ArtifactEntry)
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType != SociIndexArtifactType {
+			continue
+		}
+		entry, err := importIndex(ctx, desc, blobStore, artifactsDb)
+		if err != nil {
+			return nil, err
+		}
+		entries[desc.Digest] = entry
+		indexDescs = append(indexDescs, desc)
+	}
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType != SociSignatureArtifactType {
+			continue
+		}
+		if err := importSignature(ctx, desc, entries, blobStore, artifactsDb); err != nil {
+			return nil, err
+		}
+	}
+	return indexDescs, nil
+}
+
+// importIndex writes the artifacts db entries of an imported index and its ztocs.
+func importIndex(ctx context.Context, desc ocispec.Descriptor, blobStore orascontent.ReadOnlyStorage, artifactsDb *ArtifactsDb) (*ArtifactEntry, error) {
+	b, err := orascontent.FetchAll(ctx, blobStore, ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size})
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read index %v: %v", ErrInvalidLayout, desc.Digest, err)
+	}
+	var sociIndex Index
+	if err := UnmarshalIndex(b, &sociIndex); err != nil {
+		return nil, err
+	}
+	if sociIndex.Subject == nil {
+		return nil, fmt.Errorf("%w: index %v has no subject", ErrInvalidLayout, desc.Digest)
+	}
+	for _, blob := range sociIndex.Blobs {
+		if exists, err := blobStore.Exists(ctx, ocispec.Descriptor{Digest: blob.Digest, Size: blob.Size}); err != nil || !exists {
+			return nil, fmt.Errorf("%w: missing ztoc %v of index %v", ErrInvalidLayout, blob.Digest, desc.Digest)
+		}
+	}
+
+	createdAt := time.Now()
+	if created, ok := desc.Annotations[ocispec.AnnotationCreated]; ok {
+		if createdAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, fmt.Errorf("%w: invalid creation time of index %v: %v", ErrInvalidLayout, desc.Digest, err)
+		}
+	}
+	imageDigest := desc.Annotations[LayoutAnnotationImageDigest]
+	if imageDigest == "" {
+		imageDigest = sociIndex.Subject.Digest.String()
+	}
+	var platform string
+	if desc.Platform != nil {
+		platform = platforms.Format(*desc.Platform)
+	}
+
+	for _, blob := range sociIndex.Blobs {
+		ztocEntry := &ArtifactEntry{
+			Size:           blob.Size,
+			Digest:         blob.Digest.String(),
+			OriginalDigest: blob.Annotations[IndexAnnotationImageLayerDigest],
+			Type:           ArtifactEntryTypeLayer,
+			Location:       blob.Annotations[IndexAnnotationImageLayerDigest],
+			MediaType:      SociLayerMediaType,
+			CreatedAt:      createdAt,
+		}
+		if err := artifactsDb.WriteArtifactEntry(ztocEntry); err != nil {
+			return nil, err
+		}
+	}
+	entry := &ArtifactEntry{
+		Size:           int64(len(b)),
+		Digest:         desc.Digest.String(),
+		OriginalDigest: sociIndex.Subject.Digest.String(),
+		ImageDigest:    imageDigest,
+		Platform:       platform,
+		Type:           ArtifactEntryTypeIndex,
+		Location:       sociIndex.Subject.Digest.String(),
+		MediaType:      sociIndex.MediaType,
+		CreatedAt:      createdAt,
+	}
+	return entry, artifactsDb.WriteArtifactEntry(entry)
+}
+
+// importSignature writes the artifacts db entry of an imported signature of one of the imported indices `entries`.
+func importSignature(ctx context.Context, desc ocispec.Descriptor, entries map[digest.Digest]*ArtifactEntry, blobStore orascontent.Fetcher, artifactsDb *ArtifactsDb) error {
+	b, err := orascontent.FetchAll(ctx, blobStore, ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size})
+	if err != nil {
+		return fmt.Errorf("%w: cannot read signature %v: %v", ErrInvalidLayout, desc.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return err
+	}
+	if manifest.Subject == nil || entries[manifest.Subject.Digest] == nil {
+		return fmt.Errorf("%w: signature %v doesn't refer to an imported index", ErrInvalidLayout, desc.Digest)
+	}
+	indexEntry := entries[manifest.Subject.Digest]
+	return artifactsDb.WriteArtifactEntry(&ArtifactEntry{
+		Digest:         desc.Digest.String(),
+		OriginalDigest: indexEntry.Digest,
+		ImageDigest:    indexEntry.ImageDigest,
+		Platform:       indexEntry.Platform,
+		Type:           ArtifactEntryTypeSignature,
+		Location:       indexEntry.Digest,
+		Size:           desc.Size,
+		MediaType:      ocispec.MediaTypeImageManifest,
+		CreatedAt:      indexEntry.CreatedAt,
+	})
+}
+
+// exportBlob writes the blob `desc` of the local store to the OCI image layout, verifying its digest.
+func exportBlob(ctx context.Context, tw *tar.Writer, blobStore orascontent.Fetcher, desc ocispec.Descriptor) error {
+	rc, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size})
+	if err != nil {
+		return fmt.Errorf("cannot read blob %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()),
+		Mode:     0444,
+		Size:     desc.Size,
+	})
+	if err != nil {
+		return err
+	}
+	vr := orascontent.NewVerifyReader(rc, desc)
+	if _, err := io.Copy(tw, vr); err != nil {
+		return fmt.Errorf("cannot export blob %v: %w", desc.Digest, err)
+	}
+	return vr.Verify()
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0444,
+		Size:     int64(len(b)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
@@ -0,0 +1,207 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestExportImportIndices(t *testing.T) {
+	ctx := context.Background()
+	newStore := func() *oci.Store {
+		store, err := oci.New(t.TempDir())
+		if err != nil {
+			t.Fatalf("can't create OCI store: %v", err)
+		}
+		return store
+	}
+	store := newStore()
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+
+	var ztocs []ocispec.Descriptor
+	for _, content := range []string{"ztoc 1", "ztoc 2"} {
+		desc := ocispec.Descriptor{Digest: digest.FromString(content), Size: int64(len(content))}
+		if err := store.Push(ctx, desc, bytes.NewReader([]byte(content))); err != nil {
+			t.Fatalf("can't push ztoc: %v", err)
+		}
+		layerDigest := digest.FromString("layer " + content)
+		err := artifactsDb.WriteArtifactEntry(&ArtifactEntry{
+			Size:           desc.Size,
+			Digest:         desc.Digest.String(),
+			OriginalDigest: layerDigest.String(),
+			Type:           ArtifactEntryTypeLayer,
+			Location:       layerDigest.String(),
+			MediaType:      SociLayerMediaType,
+			CreatedAt:      time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("can't write ztoc entry: %v", err)
+		}
+		desc.MediaType = SociLayerMediaType
+		desc.Annotations = map[string]string{IndexAnnotationImageLayerDigest: layerDigest.String()}
+		ztocs = append(ztocs, desc)
+	}
+	platform := platforms.MustParse("linux/arm64")
+	subject := &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image manifest"), Size: 10}
+	imageDigest := digest.FromString("image index")
+	createdAt := time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC)
+	index := NewIndex(ztocs, subject, nil)
+	err = WriteSociIndex(ctx, &IndexWithMetadata{Index: index, Platform: &platform, ImageDigest: imageDigest, CreatedAt: createdAt}, store, artifactsDb)
+	if err != nil {
+		t.Fatalf("can't write index: %v", err)
+	}
+	b, err := MarshalIndex(index)
+	if err != nil {
+		t.Fatalf("can't marshal index: %v", err)
+	}
+	indexDigest := digest.FromBytes(b)
+	indexEntry, err := artifactsDb.GetArtifactEntry(indexDigest.String())
+	if err != nil {
+		t.Fatalf("can't get index entry: %v", err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	signature, err := SignIndex(ocispec.Descriptor{Digest: indexDigest, Size: indexEntry.Size}, key)
+	if err != nil {
+		t.Fatalf("can't sign index: %v", err)
+	}
+	signatureDesc, err := WriteIndexSignature(ctx, signature, indexEntry, store, artifactsDb)
+	if err != nil {
+		t.Fatalf("can't write signature: %v", err)
+	}
+
+	var archive bytes.Buffer
+	if err := ExportIndices(ctx, &archive, store, artifactsDb, []digest.Digest{indexDigest}); err != nil {
+		t.Fatalf("can't export indices: %v", err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		dstStore := newStore()
+		dstDb, err := newTestableDb()
+		if err != nil {
+			t.Fatalf("can't create a test db")
+		}
+		imported, err := ImportIndices(ctx, bytes.NewReader(archive.Bytes()), dstStore, dstDb)
+		if err != nil {
+			t.Fatalf("can't import indices: %v", err)
+		}
+		if len(imported) != 1 || imported[0].Digest != indexDigest {
+			t.Fatalf("unexpected imported indices: %v", imported)
+		}
+
+		for _, digest := range []digest.Digest{indexDigest, ztocs[0].Digest, ztocs[1].Digest, signatureDesc.Digest} {
+			expected, err := artifactsDb.GetArtifactEntry(digest.String())
+			if err != nil {
+				t.Fatalf("can't get exported entry %v: %v", digest, err)
+			}
+			actual, err := dstDb.GetArtifactEntry(digest.String())
+			if err != nil {
+				t.Fatalf("can't get imported entry %v: %v", digest, err)
+			}
+			if expected.Type != ArtifactEntryTypeIndex {
+				// only the creation time of an index is exported
+				actual.CreatedAt = expected.CreatedAt
+			}
+			if diff := cmp.Diff(expected, actual); diff != "" {
+				t.Fatalf("unexpected imported entry %v, diff = %v", digest, diff)
+			}
+			if exists, err := dstStore.Exists(ctx, ocispec.Descriptor{Digest: digest, Size: expected.Size}); err != nil || !exists {
+				t.Fatalf("blob %v wasn't imported: %v", digest, err)
+			}
+		}
+		signatures, err := dstDb.GetIndexSignatures(indexDigest.String())
+		if err != nil || len(signatures) != 1 {
+			t.Fatalf("unexpected imported signatures: %v, %v", signatures, err)
+		}
+	})
+
+	t.Run("corrupted blob", func(t *testing.T) {
+		var corrupted bytes.Buffer
+		tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+		tw := tar.NewWriter(&corrupted)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("can't read archive: %v", err)
+			}
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("can't read archive: %v", err)
+			}
+			if hdr.Name == "blobs/sha256/"+ztocs[0].Digest.Encoded() {
+				b = []byte("ztoc 3")
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("can't write archive: %v", err)
+			}
+			if _, err := tw.Write(b); err != nil {
+				t.Fatalf("can't write archive: %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("can't write archive: %v", err)
+		}
+
+		dstDb, err := newTestableDb()
+		if err != nil {
+			t.Fatalf("can't create a test db")
+		}
+		if _, err := ImportIndices(ctx, &corrupted, newStore(), dstDb); err == nil {
+			t.Fatalf("expected the import of a corrupted blob to fail")
+		}
+		if _, err := dstDb.GetArtifactEntry(indexDigest.String()); err == nil {
+			t.Fatalf("index of a corrupted archive was imported")
+		}
+	})
+
+	t.Run("missing index.json", func(t *testing.T) {
+		var empty bytes.Buffer
+		if err := tar.NewWriter(&empty).Close(); err != nil {
+			t.Fatalf("can't write archive: %v", err)
+		}
+		dstDb, err := newTestableDb()
+		if err != nil {
+			t.Fatalf("can't create a test db")
+		}
+		if _, err := ImportIndices(ctx, &empty, newStore(), dstDb); !errors.Is(err, ErrInvalidLayout) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
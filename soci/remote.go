@@ -0,0 +1,146 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oras "oras.land/oras-go/v2"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// PushArtifact copies a SOCI index or index signature, and the content it refers to, from `src` to `dst`.
+//
+// If `dst` is a registry that doesn't support the Referrers API, the artifact is added to the
+// image index tagged with the referrers tag schema of its subject (`<alg>-<digest>`), so that it
+// can be discovered without the Referrers API. Such registries often don't allow deleting manifests,
+// so failing to delete the replaced referrers index is logged rather than returned.
+func PushArtifact(ctx context.Context, src orascontent.ReadOnlyStorage, dst oras.Target, desc ocispec.Descriptor, opts oras.CopyGraphOptions) error {
+	err := oras.CopyGraph(ctx, src, dst, desc, opts)
+	var referrersErr *remote.ReferrersError
+	if errors.As(err, &referrersErr) && referrersErr.IsReferrersIndexDelete() {
+		log.G(ctx).WithError(err).WithField("digest", desc.Digest.String()).Warn("cannot delete the replaced referrers index")
+		return nil
+	}
+	return err
+}
+
+// NewRemoteProvider returns a `content.Provider` that streams content from a remote repository
+// (e.g., an oras `remote.Repository`). It lets an `IndexBuilder` build an index for an image
+// without pulling the image into the containerd content store.
+func NewRemoteProvider(fetcher orascontent.Fetcher) content.Provider {
+	return &remoteProvider{fetcher: fetcher}
+}
+
+type remoteProvider struct {
+	fetcher orascontent.Fetcher
+}
+
+func (p *remoteProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return &remoteReaderAt{ctx: ctx, fetcher: p.fetcher, desc: desc}, nil
+}
+
+// remoteReaderAt reads content with a single request as long as it is read sequentially,
+// which is how layers are read to build ztocs. Reading at any other offset starts a new request.
+// Content read sequentially from the start is verified against its digest.
+type remoteReaderAt struct {
+	ctx      context.Context
+	fetcher  orascontent.Fetcher
+	desc     ocispec.Descriptor
+	rc       io.ReadCloser
+	offset   int64
+	verifier digest.Verifier
+}
+
+func (r *remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %d", off)
+	}
+	if off >= r.desc.Size {
+		return 0, io.EOF
+	}
+	if r.rc == nil || off != r.offset {
+		if err := r.open(off); err != nil {
+			return 0, err
+		}
+	}
+
+	var eof error
+	if remaining := r.desc.Size - off; int64(len(p)) > remaining {
+		p, eof = p[:remaining], io.EOF
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.offset += int64(n)
+	if r.verifier != nil {
+		r.verifier.Write(p[:n])
+	}
+	if err != nil {
+		return n, fmt.Errorf("cannot read %v at offset %d: %w", r.desc.Digest, off, err)
+	}
+	if r.offset == r.desc.Size && r.verifier != nil && !r.verifier.Verified() {
+		return n, fmt.Errorf("content of %v doesn't match its digest", r.desc.Digest)
+	}
+	return n, eof
+}
+
+// open starts reading the content at `off`.
+func (r *remoteReaderAt) open(off int64) error {
+	if err := r.Close(); err != nil {
+		return err
+	}
+	rc, err := r.fetcher.Fetch(r.ctx, r.desc)
+	if err != nil {
+		return fmt.Errorf("cannot fetch %v: %w", r.desc.Digest, err)
+	}
+	r.rc, r.offset, r.verifier = rc, 0, nil
+	if off == 0 {
+		if r.desc.Digest.Validate() == nil {
+			r.verifier = r.desc.Digest.Verifier()
+		}
+		return nil
+	}
+	if s, ok := rc.(io.Seeker); ok {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(io.Discard, rc, off); err != nil {
+		return err
+	}
+	r.offset = off
+	return nil
+}
+
+func (r *remoteReaderAt) Size() int64 {
+	return r.desc.Size
+}
+
+func (r *remoteReaderAt) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
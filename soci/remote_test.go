@@ -0,0 +1,388 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oras "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// fetcherFunc serves content from a function, like a registry that may return unexpected content.
+type fetcherFunc func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+
+func (f fetcherFunc) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return f(ctx, desc)
+}
+
+func TestRemoteProviderReaderAt(t *testing.T) {
+	ctx := context.Background()
+	data := testutil.RandomByteData(100000)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	store := memory.New()
+	if err := store.Push(ctx, desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("can't push blob: %v", err)
+	}
+
+	ra, err := NewRemoteProvider(store).ReaderAt(ctx, desc)
+	if err != nil {
+		t.Fatalf("can't create reader: %v", err)
+	}
+	defer ra.Close()
+	if ra.Size() != desc.Size {
+		t.Fatalf("unexpected size. expect: %d, actual: %d", desc.Size, ra.Size())
+	}
+	actual, err := io.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+	if err != nil {
+		t.Fatalf("can't read blob sequentially: %v", err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Fatalf("unexpected content read sequentially")
+	}
+
+	p := make([]byte, 100)
+	if n, err := ra.ReadAt(p, 5000); err != nil || n != len(p) || !bytes.Equal(p, data[5000:5100]) {
+		t.Fatalf("unexpected content read at offset 5000: %d bytes, %v", n, err)
+	}
+	if n, err := ra.ReadAt(p, desc.Size-10); err != io.EOF || n != 10 || !bytes.Equal(p[:n], data[desc.Size-10:]) {
+		t.Fatalf("unexpected content read at the end of the blob: %d bytes, %v", n, err)
+	}
+	if _, err := ra.ReadAt(p, desc.Size); err != io.EOF {
+		t.Fatalf("unexpected error reading past the end of the blob: %v", err)
+	}
+}
+
+func TestRemoteProviderDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	data := testutil.RandomByteData(1000)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("other"), Size: int64(len(data))}
+	fetcher := fetcherFunc(func(context.Context, ocispec.Descriptor) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	ra, err := NewRemoteProvider(fetcher).ReaderAt(ctx, desc)
+	if err != nil {
+		t.Fatalf("can't create reader: %v", err)
+	}
+	defer ra.Close()
+	if _, err := io.ReadAll(io.NewSectionReader(ra, 0, ra.Size())); err == nil {
+		t.Fatalf("expected error reading content that doesn't match its digest, but got nil")
+	}
+}
+
+// pushTestImage pushes an image with a single gzip layer for the default platform to `store`
+// and returns the descriptors of its manifest and layer.
+func pushTestImage(t *testing.T, store *memory.Store) (ocispec.Descriptor, ocispec.Descriptor) {
+	layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.File("file", string(testutil.RandomByteData(100000))),
+	}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("can't build layer: %v", err)
+	}
+	manifestDesc, layerDescs := pushTestImageLayers(t, store, layer)
+	return manifestDesc, layerDescs[0]
+}
+
+// pushTestImageLayers pushes an image with the gzip layers `layers` for the default platform
+// to `store` and returns the descriptors of its manifest and layers.
+func pushTestImageLayers(t *testing.T, store *memory.Store, layers ...[]byte) (ocispec.Descriptor, []ocispec.Descriptor) {
+	ctx := context.Background()
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		// images may share layers and configs.
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			t.Fatalf("can't push %s: %v", mediaType, err)
+		}
+		return desc
+	}
+
+	var layerDescs []ocispec.Descriptor
+	for _, layer := range layers {
+		layerDescs = append(layerDescs, push(ocispec.MediaTypeImageLayerGzip, layer))
+	}
+	config, err := json.Marshal(ocispec.Image{Platform: platforms.DefaultSpec()})
+	if err != nil {
+		t.Fatalf("can't marshal image config: %v", err)
+	}
+	configDesc := push(ocispec.MediaTypeImageConfig, config)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    layerDescs,
+	})
+	if err != nil {
+		t.Fatalf("can't marshal image manifest: %v", err)
+	}
+	return push(ocispec.MediaTypeImageManifest, manifest), layerDescs
+}
+
+func TestBuildSociIndexFromRemote(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	manifestDesc, layerDesc := pushTestImage(t, store)
+
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := memory.New()
+	builder, err := NewIndexBuilder(NewRemoteProvider(store), blobStore, artifactsDb, WithSpanSize(20000), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("can't create index builder: %v", err)
+	}
+	index, err := builder.Build(ctx, images.Image{Name: "remote", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("can't build index: %v", err)
+	}
+	if index.Index.Subject == nil || index.Index.Subject.Digest != manifestDesc.Digest {
+		t.Fatalf("unexpected index subject: %v", index.Index.Subject)
+	}
+	if _, ok := index.Index.Annotations[ocispec.AnnotationCreated]; ok {
+		t.Fatalf("unexpected index annotations: %v", index.Index.Annotations)
+	}
+	if _, ok := index.Index.Annotations[IndexAnnotationSpanSize]; ok {
+		t.Fatalf("unexpected index annotations: %v", index.Index.Annotations)
+	}
+	if len(index.Index.Blobs) != 1 || index.Index.Blobs[0].Annotations[IndexAnnotationImageLayerDigest] != layerDesc.Digest.String() {
+		t.Fatalf("unexpected index blobs: %v", index.Index.Blobs)
+	}
+	// the ztoc is pushed to the blob store before its media type is set.
+	ztocDesc := ocispec.Descriptor{Digest: index.Index.Blobs[0].Digest, Size: index.Index.Blobs[0].Size}
+	if exists, err := blobStore.Exists(ctx, ztocDesc); err != nil || !exists {
+		t.Fatalf("ztoc is not in the blob store: %v", err)
+	}
+
+	// without a creation time, an index built again with the same config has the same digest.
+	indexDigest := func(index *IndexWithMetadata) digest.Digest {
+		b, err := MarshalIndex(index.Index)
+		if err != nil {
+			t.Fatalf("can't marshal index: %v", err)
+		}
+		return digest.FromBytes(b)
+	}
+	rebuilt, err := builder.Build(ctx, images.Image{Name: "remote", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("can't build index: %v", err)
+	}
+	if indexDigest(rebuilt) != indexDigest(index) {
+		t.Fatalf("unexpected digest of the rebuilt index. expect: %v, actual: %v", indexDigest(index), indexDigest(rebuilt))
+	}
+
+	created := time.Date(2023, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	builder, err = NewIndexBuilder(NewRemoteProvider(store), blobStore, artifactsDb, WithSpanSize(20000), WithMinLayerSize(0), WithCreatedAnnotation(created), WithSpanSizeAnnotation())
+	if err != nil {
+		t.Fatalf("can't create index builder: %v", err)
+	}
+	index, err = builder.Build(ctx, images.Image{Name: "remote", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("can't build index: %v", err)
+	}
+	if actual := index.Index.Annotations[ocispec.AnnotationCreated]; actual != "2023-03-01T11:00:00Z" {
+		t.Fatalf("unexpected created annotation: %q", actual)
+	}
+	if actual := index.Index.Annotations[IndexAnnotationSpanSize]; actual != "20000" {
+		t.Fatalf("unexpected span size annotation: %q", actual)
+	}
+}
+
+func TestBuildSociIndexFromRemoteStream(t *testing.T) {
+	testCases := []struct {
+		name         string
+		opts         []BuildOption
+		expectStream bool
+	}{
+		{
+			name:         "layer is streamed",
+			expectStream: true,
+		},
+		{
+			name: "span alignment copies the layer to a temp file",
+			opts: []BuildOption{WithSpanAlignment(1 << 20)},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			manifestDesc, layerDesc := pushTestImage(t, store)
+			layer, err := content.FetchAll(ctx, store, layerDesc)
+			if err != nil {
+				t.Fatalf("can't fetch layer: %v", err)
+			}
+			layerFile := filepath.Join(t.TempDir(), "layer")
+			if err := os.WriteFile(layerFile, layer, 0600); err != nil {
+				t.Fatalf("can't write layer: %v", err)
+			}
+			expected, err := ztoc.NewBuilder("test").BuildZtoc(layerFile, 20000, ztoc.WithCompression(compression.Gzip))
+			if err != nil {
+				t.Fatalf("can't build ztoc from file: %v", err)
+			}
+
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			// creating a temp file fails, so only a streamed layer can be built.
+			t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+			blobStore := memory.New()
+			opts := append([]BuildOption{WithSpanSize(20000), WithMinLayerSize(0), WithBuildToolIdentifier("test")}, tc.opts...)
+			builder, err := NewIndexBuilder(NewRemoteProvider(store), blobStore, artifactsDb, opts...)
+			if err != nil {
+				t.Fatalf("can't create index builder: %v", err)
+			}
+			index, err := builder.Build(ctx, images.Image{Name: "remote", Target: manifestDesc})
+			if !tc.expectStream {
+				if err == nil {
+					t.Fatalf("expected error creating a temp file, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("can't build index: %v", err)
+			}
+			_, expectedDesc, err := ztoc.Marshal(expected)
+			if err != nil {
+				t.Fatalf("can't marshal ztoc: %v", err)
+			}
+			if len(index.Index.Blobs) != 1 || index.Index.Blobs[0].Digest != expectedDesc.Digest {
+				t.Fatalf("unexpected index blobs. expect ztoc %v, actual: %v", expectedDesc.Digest, index.Index.Blobs)
+			}
+		})
+	}
+}
+
+func TestPushArtifactReferrersTagSchema(t *testing.T) {
+	testCases := []struct {
+		name          string
+		referrersAPI  bool
+		deleteEnabled bool
+	}{
+		{
+			name:          "registry with referrers API",
+			referrersAPI:  true,
+			deleteEnabled: true,
+		},
+		{
+			name:          "registry without referrers API",
+			deleteEnabled: true,
+		},
+		{
+			name: "registry without referrers API or deletes",
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := testutil.NewRegistry(tc.referrersAPI, tc.deleteEnabled)
+			defer registry.Close()
+			newRepository := func() *remote.Repository {
+				repo, err := remote.NewRepository(registry.Host + "/test/image")
+				if err != nil {
+					t.Fatalf("can't create repository: %v", err)
+				}
+				repo.PlainHTTP = true
+				return repo
+			}
+
+			imageStore := memory.New()
+			manifestDesc, _ := pushTestImage(t, imageStore)
+			if err := oras.CopyGraph(ctx, imageStore, newRepository(), manifestDesc, oras.DefaultCopyGraphOptions); err != nil {
+				t.Fatalf("can't push image: %v", err)
+			}
+
+			blobStore, err := oci.New(t.TempDir())
+			if err != nil {
+				t.Fatalf("can't create blob store: %v", err)
+			}
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			// each index is pushed with a new repository, like separate "soci push" invocations.
+			var pushed []digest.Digest
+			for _, spanSize := range []int64{20000, 30000} {
+				builder, err := NewIndexBuilder(NewRemoteProvider(imageStore), blobStore, artifactsDb, WithSpanSize(spanSize), WithMinLayerSize(0))
+				if err != nil {
+					t.Fatalf("can't create index builder: %v", err)
+				}
+				index, err := builder.Build(ctx, images.Image{Name: "remote", Target: manifestDesc})
+				if err != nil {
+					t.Fatalf("can't build index: %v", err)
+				}
+				if err := WriteSociIndex(ctx, index, blobStore, artifactsDb); err != nil {
+					t.Fatalf("can't write index: %v", err)
+				}
+				b, err := MarshalIndex(index.Index)
+				if err != nil {
+					t.Fatalf("can't marshal index: %v", err)
+				}
+				indexDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+				if err := PushArtifact(ctx, blobStore, newRepository(), indexDesc, oras.DefaultCopyGraphOptions); err != nil {
+					t.Fatalf("can't push index: %v", err)
+				}
+				pushed = append(pushed, indexDesc.Digest)
+			}
+
+			referrersTag := strings.Replace(manifestDesc.Digest.String(), ":", "-", 1)
+			if _, ok := registry.Tags()[referrersTag]; ok == tc.referrersAPI {
+				t.Fatalf("unexpected presence of the referrers tag %s: %v", referrersTag, ok)
+			}
+			var found []digest.Digest
+			err = newRepository().Referrers(ctx, manifestDesc, SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
+				for _, desc := range referrers {
+					found = append(found, desc.Digest)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("can't list referrers: %v", err)
+			}
+			sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+			sort.Slice(pushed, func(i, j int) bool { return pushed[i] < pushed[j] })
+			if diff := cmp.Diff(pushed, found); diff != "" {
+				t.Fatalf("unexpected referrers, diff = %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// ztocEntries returns the artifact entries of the ztocs already built for the layers `layers`,
+// keyed by layer digest, or nil if ztocs aren't reused. It's called once per build, so that
+// the artifacts db isn't walked for each layer.
+func (b *IndexBuilder) ztocEntries(layers []ocispec.Descriptor) (map[string][]ArtifactEntry, error) {
+	if b.ArtifactsDb == nil || b.config.forceRebuild {
+		return nil, nil
+	}
+	layerDigests := make([]string, 0, len(layers))
+	for _, l := range layers {
+		layerDigests = append(layerDigests, l.Digest.String())
+	}
+	return b.ArtifactsDb.GetZtocArtifactEntriesByLayer(layerDigests)
+}
+
+// findReusableZtoc looks up a ztoc that was built for the layer `desc` (e.g., for another image
+// sharing the layer) with the same build config among `entries`, and returns its descriptor,
+// or nil if there is none. The ztoc is only reused if it passes an integrity check, so a corrupted
+// ztoc is rebuilt instead.
+func (b *IndexBuilder) findReusableZtoc(ctx context.Context, desc ocispec.Descriptor, compressionAlgo string, entries []ArtifactEntry) *ocispec.Descriptor {
+	for _, entry := range entries {
+		ztocDesc := ocispec.Descriptor{
+			Digest: digest.Digest(entry.Digest),
+			Size:   entry.Size,
+		}
+		if err := b.checkReusableZtoc(ctx, ztocDesc, desc, compressionAlgo, entry.SpanAlignment); err != nil {
+			log.G(ctx).WithError(err).WithField("ztoc", entry.Digest).WithField("layer", desc.Digest).
+				Debug("existing ztoc can't be reused")
+			continue
+		}
+		return &ztocDesc
+	}
+	return nil
+}
+
+// checkReusableZtoc checks the integrity of the ztoc `ztocDesc` and that it was built for the layer `desc`
+// with the build config of the builder. `spanAlignment` is the span alignment the ztoc was built with,
+// which can't be told from the ztoc itself.
+func (b *IndexBuilder) checkReusableZtoc(ctx context.Context, ztocDesc, desc ocispec.Descriptor, compressionAlgo string, spanAlignment int64) error {
+	if spanAlignment != b.config.spanAlignment {
+		return fmt.Errorf("span alignment %d doesn't match %d", spanAlignment, b.config.spanAlignment)
+	}
+	// FetchAll verifies the size and digest of the ztoc.
+	data, err := orascontent.FetchAll(ctx, b.blobStore, ztocDesc)
+	if err != nil {
+		return err
+	}
+	toc, err := ztoc.Unmarshal(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := toc.Validate(); err != nil {
+		return err
+	}
+
+	if !toc.Version.HasFileDigests() {
+		return fmt.Errorf("ztoc version %s doesn't record file digests", toc.Version)
+	}
+	if toc.BuildToolIdentifier != b.config.buildToolIdentifier {
+		return fmt.Errorf("built by %q", toc.BuildToolIdentifier)
+	}
+	if toc.CompressionAlgorithm != compressionAlgo {
+		return fmt.Errorf("compression algorithm %q doesn't match the layer's %q", toc.CompressionAlgorithm, compressionAlgo)
+	}
+	if toc.CompressedArchiveSize != compression.Offset(desc.Size) {
+		return fmt.Errorf("compressed archive size %d doesn't match the layer size %d", toc.CompressedArchiveSize, desc.Size)
+	}
+	encoding := compression.CheckpointsEncodingRaw
+	if b.config.compactCheckpoints && compressionAlgo == compression.Gzip {
+		encoding = compression.CheckpointsEncodingCompact
+	}
+	if actual := compression.GetCheckpointsEncoding(toc.CompressionAlgorithm, toc.Checkpoints); actual != encoding {
+		return fmt.Errorf("checkpoints encoding %q doesn't match %q", actual, encoding)
+	}
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return err
+	}
+	defer zinfo.Close()
+	if int64(zinfo.SpanSize()) != b.config.spanSize {
+		return fmt.Errorf("span size %d doesn't match %d", zinfo.SpanSize(), b.config.spanSize)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestReuseZtoc(t *testing.T) {
+	layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.File("file", string(testutil.RandomByteData(100000))),
+	}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("can't build layer: %v", err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	defaultOpts := []BuildOption{WithSpanSize(20000), WithMinLayerSize(0)}
+
+	testCases := []struct {
+		name         string
+		firstOpts    []BuildOption
+		opts         []BuildOption
+		corrupt      bool
+		legacy       bool
+		expectReused bool
+	}{
+		{
+			name:         "same build config",
+			expectReused: true,
+		},
+		{
+			name: "force rebuild",
+			opts: []BuildOption{WithForceRebuild(true)},
+		},
+		{
+			name: "different span size",
+			opts: []BuildOption{WithSpanSize(30000)},
+		},
+		{
+			name: "different build tool",
+			opts: []BuildOption{WithBuildToolIdentifier("other")},
+		},
+		{
+			name: "different checkpoints encoding",
+			opts: []BuildOption{WithCompactCheckpoints(true)},
+		},
+		{
+			name: "different span alignment",
+			opts: []BuildOption{WithSpanAlignment(1 << 20)},
+		},
+		{
+			name:      "ztoc built with span alignment",
+			firstOpts: []BuildOption{WithSpanAlignment(1 << 20)},
+		},
+		{
+			name:         "same span alignment",
+			firstOpts:    []BuildOption{WithSpanAlignment(1 << 20)},
+			opts:         []BuildOption{WithSpanAlignment(1 << 20)},
+			expectReused: true,
+		},
+		{
+			name:    "missing ztoc",
+			corrupt: true,
+		},
+		{
+			name:   "version 0.9 ztoc",
+			legacy: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			cs, err := local.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("can't create content store: %v", err)
+			}
+			if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(layer), desc); err != nil {
+				t.Fatalf("can't write layer to content store: %v", err)
+			}
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			blobStore := memory.New()
+
+			buildOrReuse := func(opts ...BuildOption) (*ocispec.Descriptor, bool) {
+				builder, err := NewIndexBuilder(cs, blobStore, artifactsDb, append(defaultOpts, opts...)...)
+				if err != nil {
+					t.Fatalf("can't create index builder: %v", err)
+				}
+				ztocEntries, err := builder.ztocEntries([]ocispec.Descriptor{desc})
+				if err != nil {
+					t.Fatalf("can't get ztoc entries: %v", err)
+				}
+				ztocDesc, reused, err := builder.buildOrReuseSociLayer(ctx, desc, ztocEntries)
+				if err != nil {
+					t.Fatalf("can't build ztoc: %v", err)
+				}
+				return ztocDesc, reused
+			}
+			first, reused := buildOrReuse(tc.firstOpts...)
+			if reused {
+				t.Fatalf("unexpected reuse of a ztoc on the first build")
+			}
+			if tc.corrupt {
+				// the artifacts db refers to a ztoc that is not in the blob store.
+				blobStore = memory.New()
+			}
+			if tc.legacy {
+				// the artifacts db only refers to a version 0.9 ztoc of the layer, without file digests.
+				toc, err := loadZtoc(ctx, blobStore, *first)
+				if err != nil {
+					t.Fatalf("can't load ztoc: %v", err)
+				}
+				toc.Version = ztoc.Version09
+				for i := range toc.FileMetadata {
+					toc.FileMetadata[i].Digest = ""
+				}
+				r, legacyZtoc, err := ztoc.Marshal(toc)
+				if err != nil {
+					t.Fatalf("can't marshal ztoc: %v", err)
+				}
+				blobStore = memory.New()
+				if err := blobStore.Push(ctx, legacyZtoc, r); err != nil {
+					t.Fatalf("can't push ztoc: %v", err)
+				}
+				entry, err := artifactsDb.GetArtifactEntry(first.Digest.String())
+				if err != nil {
+					t.Fatalf("can't get ztoc entry: %v", err)
+				}
+				entry.Digest, entry.Size = legacyZtoc.Digest.String(), legacyZtoc.Size
+				if err := artifactsDb.WriteArtifactEntry(entry); err != nil {
+					t.Fatalf("can't write ztoc entry: %v", err)
+				}
+			}
+
+			second, reused := buildOrReuse(tc.opts...)
+			if reused != tc.expectReused {
+				t.Fatalf("unexpected reuse. expect: %v, actual: %v", tc.expectReused, reused)
+			}
+			if tc.expectReused && (second.Digest != first.Digest || second.MediaType != SociLayerMediaType ||
+				second.Annotations[IndexAnnotationImageLayerDigest] != desc.Digest.String()) {
+				t.Fatalf("unexpected descriptor of the reused ztoc. expect: %v, actual: %v", first, second)
+			}
+		})
+	}
+}
+
+func TestBuildReportsReusedZtocs(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	manifestDesc, _ := pushTestImage(t, store)
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	blobStore := memory.New()
+	builder, err := NewIndexBuilder(NewRemoteProvider(store), blobStore, artifactsDb, WithSpanSize(20000), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("can't create index builder: %v", err)
+	}
+
+	for i, expected := range []int{0, 1} {
+		index, err := builder.Build(ctx, images.Image{Name: "remote", Target: manifestDesc})
+		if err != nil {
+			t.Fatalf("can't build index: %v", err)
+		}
+		if index.ReusedZtocs != expected {
+			t.Fatalf("unexpected number of reused ztocs in build %d. expect: %d, actual: %d", i, expected, index.ReusedZtocs)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// A SOCI index signature is an OCI 1.0 Manifest whose subject is the signed SOCI index,
+// so that it can be discovered with the Referrers API, and whose annotations hold the
+// signature of the index digest and the ID of the signing key.
+const (
+	// SociSignatureArtifactType is the artifactType of a SOCI index signature
+	SociSignatureArtifactType = "application/vnd.amazon.soci.signature.v1+json"
+	// SignatureAnnotationSignature is the signature annotation for the base64 encoded signature
+	SignatureAnnotationSignature = "com.amazon.soci.signature"
+	// SignatureAnnotationKeyID is the signature annotation for the ID of the signing key
+	SignatureAnnotationKeyID = "com.amazon.soci.signature.key-id"
+
+	// signaturePayloadPrefix is prepended to the index digest to build the signed payload,
+	// so that a signature of a SOCI index can't be mistaken for a signature of anything else.
+	signaturePayloadPrefix = "soci-index-signature-v1:"
+)
+
+var (
+	// ErrInvalidSignature is returned if a SOCI index signature is malformed or can't be verified.
+	ErrInvalidSignature = errors.New("invalid SOCI index signature")
+	// ErrUntrustedSignature is returned if a SOCI index signature is not signed by a trusted key.
+	ErrUntrustedSignature = errors.New("SOCI index signature is not signed by a trusted key")
+
+	// signatureConfigDescriptor is the descriptor of the config object of a SOCI index signature.
+	// Like `defaultConfigDescriptor`, its media type lets registries and oras-go filter signatures.
+	signatureConfigDescriptor = ocispec.Descriptor{
+		MediaType: SociSignatureArtifactType,
+		Digest:    emptyJSONObjectDigest,
+		Size:      2,
+	}
+)
+
+// LoadSigningKey loads a PEM encoded private key (PKCS #8, SEC 1 EC or PKCS #1 RSA)
+// used to sign SOCI indices.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key %s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, path)
+	}
+}
+
+// LoadVerificationKeys loads PEM encoded public keys (PKIX) used to verify the signatures of SOCI indices.
+func LoadVerificationKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in %s", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key %s: %w", path, err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T in %s", key, path)
+		}
+	}
+	return keys, nil
+}
+
+// KeyID returns the ID of a public key, which is the digest of its PKIX encoding.
+func KeyID(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(der).String(), nil
+}
+
+// SignIndex signs the SOCI index described by `indexDesc` with `key` and returns
+// the serialized signature manifest.
+func SignIndex(indexDesc ocispec.Descriptor, key crypto.Signer) ([]byte, error) {
+	if err := indexDesc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid index digest: %w", err)
+	}
+	keyID, err := KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	payload := signaturePayload(indexDesc.Digest)
+	var sig []byte
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign index %v: %w", indexDesc.Digest, err)
+	}
+
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    indexDesc.Digest,
+		Size:      indexDesc.Size,
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    signatureConfigDescriptor,
+		Layers:    []ocispec.Descriptor{ocispec.DescriptorEmptyJSON},
+		Subject:   &subject,
+		Annotations: map[string]string{
+			SignatureAnnotationSignature: base64.StdEncoding.EncodeToString(sig),
+			SignatureAnnotationKeyID:     keyID,
+		},
+	}
+	return json.Marshal(manifest)
+}
+
+// VerifyIndexSignature verifies that the serialized signature manifest `signature` is a valid
+// signature of the SOCI index `indexDigest` by one of `keys`.
+func VerifyIndexSignature(indexDigest digest.Digest, signature []byte, keys []crypto.PublicKey) error {
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(signature, &manifest); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if manifest.Config.MediaType != SociSignatureArtifactType {
+		return fmt.Errorf("%w: unexpected config media type %s", ErrInvalidSignature, manifest.Config.MediaType)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != indexDigest {
+		return fmt.Errorf("%w: subject is not index %v", ErrInvalidSignature, indexDigest)
+	}
+	sig, err := base64.StdEncoding.DecodeString(manifest.Annotations[SignatureAnnotationSignature])
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("%w: missing or malformed signature annotation", ErrInvalidSignature)
+	}
+
+	keyID := manifest.Annotations[SignatureAnnotationKeyID]
+	payload := signaturePayload(indexDigest)
+	for _, key := range keys {
+		id, err := KeyID(key)
+		if err != nil {
+			return err
+		}
+		if id != keyID {
+			continue
+		}
+		if !verify(key, payload, sig) {
+			return fmt.Errorf("%w: signature of index %v doesn't match key %s", ErrInvalidSignature, indexDigest, keyID)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: key %s", ErrUntrustedSignature, keyID)
+}
+
+// IsIndexSignature returns true if the serialized manifest `b` is a SOCI index signature.
+func IsIndexSignature(b []byte) bool {
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return false
+	}
+	return manifest.Config.MediaType == SociSignatureArtifactType
+}
+
+// WriteIndexSignature writes the serialized signature manifest `signature` of the SOCI index
+// `indexEntry` to oras `store` and records it in the artifacts db, so that it is pushed with the index.
+func WriteIndexSignature(ctx context.Context, signature []byte, indexEntry *ArtifactEntry, store orascontent.Storage, artifactsDb *ArtifactsDb) (ocispec.Descriptor, error) {
+	err := store.Push(ctx, signatureConfigDescriptor, bytes.NewReader(defaultConfigContent))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, fmt.Errorf("error creating signature config: %w", err)
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(signature),
+		Size:      int64(len(signature)),
+	}
+	err = store.Push(ctx, desc, bytes.NewReader(signature))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write SOCI index signature to local store: %w", err)
+	}
+
+	log.G(ctx).WithField("digest", desc.Digest.String()).Debugf("soci index signature has been written")
+
+	entry := &ArtifactEntry{
+		Digest:         desc.Digest.String(),
+		OriginalDigest: indexEntry.Digest,
+		ImageDigest:    indexEntry.ImageDigest,
+		Platform:       indexEntry.Platform,
+		Type:           ArtifactEntryTypeSignature,
+		Location:       indexEntry.Digest,
+		Size:           desc.Size,
+		MediaType:      desc.MediaType,
+		CreatedAt:      time.Now(),
+	}
+	return desc, artifactsDb.WriteArtifactEntry(entry)
+}
+
+func signaturePayload(indexDigest digest.Digest) []byte {
+	return []byte(signaturePayloadPrefix + indexDigest.String())
+}
+
+func verify(key crypto.PublicKey, payload, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	default:
+		return false
+	}
+}
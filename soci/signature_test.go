@@ -0,0 +1,261 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+var testIndexDesc = ocispec.Descriptor{
+	MediaType: ocispec.MediaTypeImageManifest,
+	Digest:    digest.FromString("index"),
+	Size:      5,
+}
+
+// writeTestKeys generates a key pair with `generate` and writes it as PEM files,
+// returning the paths of the private and public keys.
+func writeTestKeys(t *testing.T, generate func() (crypto.Signer, error)) (string, string) {
+	key, err := generate()
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("can't marshal private key: %v", err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("can't marshal public key: %v", err)
+	}
+	dir := t.TempDir()
+	privatePath, publicPath := filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600); err != nil {
+		t.Fatalf("can't write private key: %v", err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+		t.Fatalf("can't write public key: %v", err)
+	}
+	return privatePath, publicPath
+}
+
+func generateECDSA() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func generateEd25519() (crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func generateRSA() (crypto.Signer, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func TestSignAndVerifyIndex(t *testing.T) {
+	testCases := []struct {
+		name     string
+		generate func() (crypto.Signer, error)
+	}{
+		{name: "ecdsa", generate: generateECDSA},
+		{name: "ed25519", generate: generateEd25519},
+		{name: "rsa", generate: generateRSA},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			privatePath, publicPath := writeTestKeys(t, tc.generate)
+			_, otherPublicPath := writeTestKeys(t, generateECDSA)
+			key, err := LoadSigningKey(privatePath)
+			if err != nil {
+				t.Fatalf("can't load signing key: %v", err)
+			}
+			keys, err := LoadVerificationKeys([]string{otherPublicPath, publicPath})
+			if err != nil {
+				t.Fatalf("can't load verification keys: %v", err)
+			}
+
+			signature, err := SignIndex(testIndexDesc, key)
+			if err != nil {
+				t.Fatalf("can't sign index: %v", err)
+			}
+			if !IsIndexSignature(signature) {
+				t.Fatalf("signature is not recognized as an index signature")
+			}
+			if err := VerifyIndexSignature(testIndexDesc.Digest, signature, keys); err != nil {
+				t.Fatalf("can't verify signature: %v", err)
+			}
+			if err := VerifyIndexSignature(digest.FromString("other"), signature, keys); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("unexpected error verifying the signature of another index: %v", err)
+			}
+			if err := VerifyIndexSignature(testIndexDesc.Digest, signature, keys[:1]); !errors.Is(err, ErrUntrustedSignature) {
+				t.Fatalf("unexpected error verifying the signature with an untrusted key: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyInvalidIndexSignature(t *testing.T) {
+	privatePath, publicPath := writeTestKeys(t, generateECDSA)
+	key, err := LoadSigningKey(privatePath)
+	if err != nil {
+		t.Fatalf("can't load signing key: %v", err)
+	}
+	keys, err := LoadVerificationKeys([]string{publicPath})
+	if err != nil {
+		t.Fatalf("can't load verification keys: %v", err)
+	}
+	signature, err := SignIndex(testIndexDesc, key)
+	if err != nil {
+		t.Fatalf("can't sign index: %v", err)
+	}
+	otherSignature, err := SignIndex(ocispec.Descriptor{Digest: digest.FromString("other")}, key)
+	if err != nil {
+		t.Fatalf("can't sign index: %v", err)
+	}
+	var other ocispec.Manifest
+	if err := json.Unmarshal(otherSignature, &other); err != nil {
+		t.Fatalf("can't unmarshal signature: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		modify   func(m *ocispec.Manifest)
+		expected error
+	}{
+		{
+			name:     "missing signature",
+			modify:   func(m *ocispec.Manifest) { delete(m.Annotations, SignatureAnnotationSignature) },
+			expected: ErrInvalidSignature,
+		},
+		{
+			name:     "malformed signature",
+			modify:   func(m *ocispec.Manifest) { m.Annotations[SignatureAnnotationSignature] = "not base64" },
+			expected: ErrInvalidSignature,
+		},
+		{
+			name: "signature of another index",
+			modify: func(m *ocispec.Manifest) {
+				m.Annotations[SignatureAnnotationSignature] = other.Annotations[SignatureAnnotationSignature]
+			},
+			expected: ErrInvalidSignature,
+		},
+		{
+			name:     "missing subject",
+			modify:   func(m *ocispec.Manifest) { m.Subject = nil },
+			expected: ErrInvalidSignature,
+		},
+		{
+			name:     "not a signature",
+			modify:   func(m *ocispec.Manifest) { m.Config.MediaType = SociIndexArtifactType },
+			expected: ErrInvalidSignature,
+		},
+		{
+			name:     "unknown key",
+			modify:   func(m *ocispec.Manifest) { m.Annotations[SignatureAnnotationKeyID] = digest.FromString("key").String() },
+			expected: ErrUntrustedSignature,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var m ocispec.Manifest
+			if err := json.Unmarshal(signature, &m); err != nil {
+				t.Fatalf("can't unmarshal signature: %v", err)
+			}
+			tc.modify(&m)
+			b, err := json.Marshal(m)
+			if err != nil {
+				t.Fatalf("can't marshal signature: %v", err)
+			}
+			if err := VerifyIndexSignature(testIndexDesc.Digest, b, keys); !errors.Is(err, tc.expected) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestWriteIndexSignature(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	indexEntry := &ArtifactEntry{
+		Size:           testIndexDesc.Size,
+		Digest:         testIndexDesc.Digest.String(),
+		OriginalDigest: digest.FromString("manifest").String(),
+		ImageDigest:    digest.FromString("image").String(),
+		Platform:       "linux/amd64",
+		Type:           ArtifactEntryTypeIndex,
+		MediaType:      ocispec.MediaTypeImageManifest,
+	}
+	if err := db.WriteArtifactEntry(indexEntry); err != nil {
+		t.Fatalf("can't write index entry: %v", err)
+	}
+
+	privatePath, _ := writeTestKeys(t, generateEd25519)
+	key, err := LoadSigningKey(privatePath)
+	if err != nil {
+		t.Fatalf("can't load signing key: %v", err)
+	}
+	signature, err := SignIndex(testIndexDesc, key)
+	if err != nil {
+		t.Fatalf("can't sign index: %v", err)
+	}
+	store := memory.New()
+	desc, err := WriteIndexSignature(context.Background(), signature, indexEntry, store, db)
+	if err != nil {
+		t.Fatalf("can't write signature: %v", err)
+	}
+	if exists, err := store.Exists(context.Background(), desc); err != nil || !exists {
+		t.Fatalf("signature is not in the store: %v", err)
+	}
+
+	signatures, err := db.GetIndexSignatures(indexEntry.Digest)
+	if err != nil {
+		t.Fatalf("can't get index signatures: %v", err)
+	}
+	if len(signatures) != 1 || signatures[0].Digest != desc.Digest.String() || signatures[0].ImageDigest != indexEntry.ImageDigest {
+		t.Fatalf("unexpected index signatures: %v", signatures)
+	}
+
+	if err := db.RemoveArtifactEntryByIndexDigest(desc.Digest.String()); err == nil {
+		t.Fatalf("expected error removing a signature as an index, but got nil")
+	}
+	if err := db.RemoveArtifactEntryByIndexDigest(indexEntry.Digest); err != nil {
+		t.Fatalf("can't remove index: %v", err)
+	}
+	if _, err := db.GetArtifactEntry(desc.Digest.String()); err == nil {
+		t.Fatalf("signature was not removed with its index")
+	}
+}
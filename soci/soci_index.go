@@ -24,7 +24,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
@@ -36,6 +39,7 @@ import (
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
+	"golang.org/x/sync/errgroup"
 	orascontent "oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/errdef"
 )
@@ -51,6 +55,11 @@ const (
 	IndexAnnotationImageLayerDigest = "com.amazon.soci.image-layer-digest"
 	// IndexAnnotationBuildToolIdentifier is the index annotation for build tool identifier
 	IndexAnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
+	// IndexAnnotationSkippedLayers is the index annotation for the layers without a ztoc,
+	// as a JSON object mapping their digests to the reasons they were skipped.
+	IndexAnnotationSkippedLayers = "com.amazon.soci.skipped-layers"
+	// IndexAnnotationSpanSize is the index annotation for the span size of the ztocs built for the index
+	IndexAnnotationSpanSize = "com.amazon.soci.span-size"
 
 	defaultSpanSize            = int64(1 << 22) // 4MiB
 	defaultMinLayerSize        = 10 << 20       // 10MiB
@@ -102,6 +111,8 @@ type IndexWithMetadata struct {
 	Platform    *ocispec.Platform
 	ImageDigest digest.Digest
 	CreatedAt   time.Time
+	// ReusedZtocs is the number of ztocs of the index that were reused instead of built.
+	ReusedZtocs int
 }
 
 // IndexDescriptorInfo has a soci index descriptor and additional metadata.
@@ -203,6 +214,57 @@ type buildConfig struct {
 	buildToolIdentifier string
 	artifactsDb         *ArtifactsDb
 	platform            ocispec.Platform
+	ztocConcurrency     int
+	spanAlignment       int64
+	compactCheckpoints  bool
+	forceRebuild        bool
+	parallelism         int
+	progress            func(LayerProgress)
+	layerPolicy         LayerPolicy
+	created             *time.Time
+	spanSizeAnnotation  bool
+}
+
+// LayerStatus is the status of a layer reported to the progress callback of an `IndexBuilder`.
+type LayerStatus string
+
+const (
+	// LayerStarted is reported when the builder starts processing a layer.
+	LayerStarted LayerStatus = "started"
+	// LayerBuilt is reported when a ztoc was built for a layer.
+	LayerBuilt LayerStatus = "built"
+	// LayerReused is reported when an existing ztoc was reused for a layer.
+	LayerReused LayerStatus = "reused"
+	// LayerSkipped is reported when no ztoc is built for a layer (e.g., a small layer).
+	LayerSkipped LayerStatus = "skipped"
+	// LayerFailed is reported when the ztoc of a layer couldn't be built.
+	LayerFailed LayerStatus = "failed"
+)
+
+// LayerProgress describes the progress of building the ztoc of an image layer.
+type LayerProgress struct {
+	// Layer is the descriptor of the image layer.
+	Layer ocispec.Descriptor
+	// Status is the status of the layer.
+	Status LayerStatus
+	// Ztoc is the descriptor of the ztoc of the layer if it was built or reused.
+	Ztoc *ocispec.Descriptor
+	// Err is the error of a failed layer.
+	Err error
+}
+
+// LayerError is returned by `IndexBuilder.Build` when the ztoc of an image layer couldn't be built.
+type LayerError struct {
+	Layer ocispec.Descriptor
+	Err   error
+}
+
+func (e *LayerError) Error() string {
+	return fmt.Sprintf("cannot build ztoc for layer %s: %v", e.Layer.Digest, e.Err)
+}
+
+func (e *LayerError) Unwrap() error {
+	return e.Err
 }
 
 // BuildOption specifies a config change to build soci indices.
@@ -240,6 +302,103 @@ func WithPlatform(platform ocispec.Platform) BuildOption {
 	}
 }
 
+// WithZtocConcurrency specifies how many span digests can be computed at the same
+// time while a layer is being decompressed to build its ztoc. By default the layer
+// is decompressed first, and the span digests are computed sequentially afterwards.
+func WithZtocConcurrency(concurrency int) BuildOption {
+	return func(c *buildConfig) error {
+		if concurrency < 0 {
+			return fmt.Errorf("invalid ztoc concurrency: %d", concurrency)
+		}
+		c.ztocConcurrency = concurrency
+		return nil
+	}
+}
+
+// WithSpanAlignment aligns the spans of the ztocs to the files of the layers, so that
+// files up to `maxFileSize` bytes don't cross a span boundary. It only applies to gzip
+// layers and can't be combined with `WithZtocConcurrency`. 0 disables the alignment.
+func WithSpanAlignment(maxFileSize int64) BuildOption {
+	return func(c *buildConfig) error {
+		if maxFileSize < 0 {
+			return fmt.Errorf("invalid span alignment max file size: %d", maxFileSize)
+		}
+		c.spanAlignment = maxFileSize
+		return nil
+	}
+}
+
+// WithCompactCheckpoints specifies whether the checkpoints of gzip ztocs are compressed,
+// which makes the ztocs smaller at the cost of decompressing them before use.
+func WithCompactCheckpoints(compact bool) BuildOption {
+	return func(c *buildConfig) error {
+		c.compactCheckpoints = compact
+		return nil
+	}
+}
+
+// WithForceRebuild specifies whether ztocs are always built. By default, a ztoc that was already
+// built for a layer with the same span size and build tool (e.g., for another image sharing
+// the layer) is reused after an integrity check.
+func WithForceRebuild(forceRebuild bool) BuildOption {
+	return func(c *buildConfig) error {
+		c.forceRebuild = forceRebuild
+		return nil
+	}
+}
+
+// WithParallelism specifies how many layers are processed at the same time. 0 processes
+// as many layers at the same time as there are CPUs.
+func WithParallelism(parallelism int) BuildOption {
+	return func(c *buildConfig) error {
+		if parallelism < 0 {
+			return fmt.Errorf("invalid parallelism: %d", parallelism)
+		}
+		c.parallelism = parallelism
+		return nil
+	}
+}
+
+// WithProgress specifies a callback that is called when the builder starts and finishes processing
+// each layer. Calls are serialized, so the callback doesn't need to be safe for concurrent use.
+func WithProgress(progress func(LayerProgress)) BuildOption {
+	return func(c *buildConfig) error {
+		c.progress = progress
+		return nil
+	}
+}
+
+// WithLayerPolicy specifies which layers of the image get a ztoc, in addition to `WithMinLayerSize`.
+func WithLayerPolicy(policy LayerPolicy) BuildOption {
+	return func(c *buildConfig) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		c.layerPolicy = policy
+		return nil
+	}
+}
+
+// WithCreatedAnnotation specifies the creation time recorded in the `org.opencontainers.image.created`
+// annotation of the index, which lets the snapshotter select the newest index of an image. Without it,
+// the index has no creation annotation, so that indices built with the same config have the same digest.
+func WithCreatedAnnotation(created time.Time) BuildOption {
+	return func(c *buildConfig) error {
+		c.created = &created
+		return nil
+	}
+}
+
+// WithSpanSizeAnnotation records the span size in the `com.amazon.soci.span-size` annotation of the index,
+// which lets the snapshotter prefer indices built with a given span size. It's opt-in, so that indices
+// built without it keep the digests they had before the annotation existed.
+func WithSpanSizeAnnotation() BuildOption {
+	return func(c *buildConfig) error {
+		c.spanSizeAnnotation = true
+		return nil
+	}
+}
+
 // WithArtifactsDb speicifies the artifacts database
 func WithArtifactsDb(db *ArtifactsDb) BuildOption {
 	return func(c *buildConfig) error {
@@ -250,7 +409,7 @@ func WithArtifactsDb(db *ArtifactsDb) BuildOption {
 
 // IndexBuilder creates soci indices.
 type IndexBuilder struct {
-	contentStore content.Store
+	contentStore content.Provider
 	blobStore    orascontent.Storage
 	ArtifactsDb  *ArtifactsDb
 	config       *buildConfig
@@ -258,7 +417,7 @@ type IndexBuilder struct {
 }
 
 // NewIndexBuilder returns an `IndexBuilder` that is used to create soci indices.
-func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage, artifactsDb *ArtifactsDb, opts ...BuildOption) (*IndexBuilder, error) {
+func NewIndexBuilder(contentStore content.Provider, blobStore orascontent.Storage, artifactsDb *ArtifactsDb, opts ...BuildOption) (*IndexBuilder, error) {
 	defaultPlatform := platforms.DefaultSpec()
 	config := &buildConfig{
 		spanSize:            defaultSpanSize,
@@ -272,6 +431,9 @@ func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage,
 			return nil, err
 		}
 	}
+	if config.parallelism == 0 {
+		config.parallelism = runtime.NumCPU()
+	}
 
 	return &IndexBuilder{
 		contentStore: contentStore,
@@ -296,46 +458,70 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 		return nil, err
 	}
 
-	// attempt to build a ztoc for each layer
-	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
-	errChan := make(chan error)
-	go func() {
-		var wg sync.WaitGroup
-		for i, l := range manifest.Layers {
-			wg.Add(1)
-			go func(i int, l ocispec.Descriptor) {
-				defer wg.Done()
-				desc, err := b.buildSociLayer(ctx, l)
-				if err != nil {
-					if err != errUnsupportedLayerFormat {
-						errChan <- err
-					}
-					return
-				}
-				if desc != nil {
-					// index layers must be in some deterministic order
-					// actual layer order used for historic consistency
-					sociLayersDesc[i] = desc
-				}
-			}(i, l)
-		}
-		wg.Wait()
-		close(errChan)
-	}()
-
-	errs := make([]error, 0, len(manifest.Layers))
-
-	for err := range errChan {
-		errs = append(errs, err)
+	ztocEntries, err := b.ztocEntries(manifest.Layers)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(errs) > 0 {
-		errWrap := errors.New("errors encountered while building soci layers")
-		for _, err := range errs {
-			errWrap = fmt.Errorf("%w; %v", errWrap, err)
+	// attempt to build a ztoc for each layer. The first layer that fails cancels the others.
+	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
+	var reusedZtocs int32
+	skippedLayers := make(map[string]string)
+	var mu sync.Mutex
+	report := func(p LayerProgress) {
+		if b.config.progress == nil {
+			return
 		}
-
-		return nil, errWrap
+		mu.Lock()
+		defer mu.Unlock()
+		b.config.progress(p)
+	}
+	skip := func(l ocispec.Descriptor, reason string) {
+		mu.Lock()
+		skippedLayers[l.Digest.String()] = reason
+		mu.Unlock()
+		report(LayerProgress{Layer: l, Status: LayerSkipped})
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(b.config.parallelism)
+	for i, l := range manifest.Layers {
+		i, l := i, l
+		eg.Go(func() error {
+			if err := egCtx.Err(); err != nil {
+				return err
+			}
+			report(LayerProgress{Layer: l, Status: LayerStarted})
+			if skipped, reason := b.skipLayer(l, i, len(manifest.Layers)); skipped {
+				fmt.Printf("ztoc skipped - layer %s (%s) %s\n", l.Digest, l.MediaType, reason)
+				skip(l, reason)
+				return nil
+			}
+			desc, reused, err := b.buildOrReuseSociLayer(egCtx, l, ztocEntries)
+			if err != nil {
+				if err == errUnsupportedLayerFormat {
+					skip(l, "compressed in an unsupported format")
+					return nil
+				}
+				report(LayerProgress{Layer: l, Status: LayerFailed, Err: err})
+				return &LayerError{Layer: l, Err: err}
+			}
+			switch {
+			case desc == nil:
+				skip(l, "no ztoc was built")
+			case reused:
+				atomic.AddInt32(&reusedZtocs, 1)
+				report(LayerProgress{Layer: l, Status: LayerReused, Ztoc: desc})
+			default:
+				report(LayerProgress{Layer: l, Status: LayerBuilt, Ztoc: desc})
+			}
+			// index layers must be in some deterministic order
+			// actual layer order used for historic consistency
+			sociLayersDesc[i] = desc
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
 	}
 
 	ztocsDesc := make([]ocispec.Descriptor, 0, len(sociLayersDesc))
@@ -349,9 +535,23 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 		return nil, errors.New("no ztocs created, all layers either skipped or produced errors")
 	}
 
+	createdAt := time.Now()
 	annotations := map[string]string{
 		IndexAnnotationBuildToolIdentifier: b.config.buildToolIdentifier,
 	}
+	if b.config.spanSizeAnnotation {
+		annotations[IndexAnnotationSpanSize] = strconv.FormatInt(b.config.spanSize, 10)
+	}
+	if b.config.created != nil {
+		annotations[ocispec.AnnotationCreated] = b.config.created.UTC().Format(time.RFC3339)
+	}
+	if len(skippedLayers) > 0 {
+		skipped, err := json.Marshal(skippedLayers)
+		if err != nil {
+			return nil, err
+		}
+		annotations[IndexAnnotationSkippedLayers] = string(skipped)
+	}
 
 	refers := &ocispec.Descriptor{
 		MediaType: imgManifestDesc.MediaType,
@@ -364,25 +564,51 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 		Index:       index,
 		Platform:    &b.config.platform,
 		ImageDigest: img.Target.Digest,
-		CreatedAt:   time.Now(),
+		CreatedAt:   createdAt,
+		ReusedZtocs: int(reusedZtocs),
 	}, nil
 }
 
+// contextReader is an `io.Reader` that stops reading once `ctx` is done,
+// so that a layer being copied doesn't outlive a canceled build.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 // buildSociLayer builds a ztoc for an image layer (`desc`) and returns ztoc descriptor.
 // It may skip building ztoc (e.g., if layer size < `minLayerSize`) and return nil.
 func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	ztocEntries, err := b.ztocEntries([]ocispec.Descriptor{desc})
+	if err != nil {
+		return nil, err
+	}
+	ztocDesc, _, err := b.buildOrReuseSociLayer(ctx, desc, ztocEntries)
+	return ztocDesc, err
+}
+
+// buildOrReuseSociLayer is like `buildSociLayer`, but it reuses an existing ztoc for the layer
+// among `ztocEntries` (see `ztocEntries`) if there is one. It also returns whether the ztoc was reused.
+func (b *IndexBuilder) buildOrReuseSociLayer(ctx context.Context, desc ocispec.Descriptor, ztocEntries map[string][]ArtifactEntry) (*ocispec.Descriptor, bool, error) {
 	if !images.IsLayerType(desc.MediaType) {
-		return nil, errNotLayerType
+		return nil, false, errNotLayerType
 	}
 	// check if we need to skip building the zTOC
 	if skip, reason := skipBuildingZtoc(desc, b.config); skip {
 		fmt.Printf("ztoc skipped - layer %s (%s) %s\n", desc.Digest, desc.MediaType, reason)
-		return nil, nil
+		return nil, false, nil
 	}
 
 	compressionAlgo, err := images.DiffCompression(ctx, desc.MediaType)
 	if err != nil {
-		return nil, fmt.Errorf("could not determine layer compression: %w", err)
+		return nil, false, fmt.Errorf("could not determine layer compression: %w", err)
 	}
 
 	if compressionAlgo == "" {
@@ -394,44 +620,72 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 	}
 
 	if !b.ztocBuilder.CheckCompressionAlgorithm(compressionAlgo) {
-		fmt.Printf("ztoc skipped - layer %s (%s) is compressed in an unsupported format. expect: [tar, gzip, unknown] but got %q\n",
+		fmt.Printf("ztoc skipped - layer %s (%s) is compressed in an unsupported format. expect: [tar, gzip, zstd, unknown] but got %q\n",
 			desc.Digest, desc.MediaType, compressionAlgo)
-		return nil, errUnsupportedLayerFormat
+		return nil, false, errUnsupportedLayerFormat
+	}
+
+	if ztocDesc := b.findReusableZtoc(ctx, desc, compressionAlgo, ztocEntries[desc.Digest.String()]); ztocDesc != nil {
+		fmt.Printf("layer %s -> ztoc %s (reused)\n", desc.Digest, ztocDesc.Digest)
+		return sociLayerDescriptor(*ztocDesc, desc), true, nil
+	}
+
+	ztocOpts := []ztoc.BuildOption{ztoc.WithCompression(compressionAlgo)}
+	if b.config.ztocConcurrency > 0 {
+		ztocOpts = append(ztocOpts, ztoc.WithConcurrency(b.config.ztocConcurrency))
+	}
+	if b.config.compactCheckpoints {
+		ztocOpts = append(ztocOpts, ztoc.WithCompactCheckpoints())
+	}
+	var alignmentReport ztoc.SpanAlignmentReport
+	if b.config.spanAlignment > 0 {
+		ztocOpts = append(ztocOpts, ztoc.WithSpanAlignment(b.config.spanAlignment, &alignmentReport))
 	}
 
 	ra, err := b.contentStore.ReaderAt(ctx, desc)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer ra.Close()
-	sr := io.NewSectionReader(ra, 0, desc.Size)
+	sr := &contextReader{ctx: ctx, r: io.NewSectionReader(ra, 0, desc.Size)}
 
-	tmpFile, err := os.CreateTemp("", "tmp.*")
-	if err != nil {
-		return nil, err
+	var (
+		toc       *ztoc.Ztoc
+		isEStargz bool
+	)
+	if b.streamLayer(desc, compressionAlgo) {
+		toc, err = b.buildZtocFromStream(sr, desc, ztocOpts)
+	} else {
+		toc, isEStargz, err = b.buildZtocFromTempFile(sr, desc, compressionAlgo, ztocOpts)
 	}
-	defer os.Remove(tmpFile.Name())
-	n, err := io.Copy(tmpFile, sr)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	if n != desc.Size {
-		return nil, errors.New("the size of the temp file doesn't match that of the layer")
+	if b.config.spanAlignment > 0 && !isEStargz {
+		fmt.Printf("span alignment - layer %s: %d multi-span files avoided, %d remaining\n",
+			desc.Digest, alignmentReport.AvoidedMultiSpanFiles(), alignmentReport.MultiSpanFiles)
 	}
-
-	toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.spanSize, ztoc.WithCompression(compressionAlgo))
-	if err != nil {
-		return nil, err
+	if compressionAlgo == compression.Zstd {
+		singleSpan, err := isSingleOversizedSpan(toc, b.config.spanSize)
+		if err != nil {
+			return nil, false, err
+		}
+		if singleSpan {
+			fmt.Printf("warning - layer %s is a single zstd frame, so its ztoc has a single span of %d bytes and the layer "+
+				"is fetched in full to read any file. Compress the layer in multiple frames (e.g., zstd --seekable) to lazily load it\n",
+				desc.Digest, toc.UncompressedArchiveSize)
+			log.G(ctx).WithField("layer", desc.Digest).Warn("zstd layer has a single span larger than the span size")
+		}
 	}
 
 	ztocReader, ztocDesc, err := ztoc.Marshal(toc)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	err = b.blobStore.Push(ctx, ztocDesc, ztocReader)
 	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
-		return nil, fmt.Errorf("cannot push ztoc to local store: %w", err)
+		return nil, false, fmt.Errorf("cannot push ztoc to local store: %w", err)
 	}
 
 	// write the artifact entry for soci layer
@@ -444,20 +698,122 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 		Location:       desc.Digest.String(),
 		MediaType:      SociLayerMediaType,
 		CreatedAt:      time.Now(),
+		SpanAlignment:  b.config.spanAlignment,
 	}
 	err = b.ArtifactsDb.WriteArtifactEntry(entry)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	fmt.Printf("layer %s -> ztoc %s\n", desc.Digest, ztocDesc.Digest)
 
+	return sociLayerDescriptor(ztocDesc, desc), false, nil
+}
+
+// streamLayer returns whether the ztoc of the layer `desc` is built in a single pass over
+// the layer rather than from a temp copy of it. Layers read from a remote repository are
+// streamed if their compression algorithm supports it, unless building the ztoc needs random
+// access to the layer: span alignment builds the TOC before the zinfo, and eStargz layers are
+// parsed from their footer. Since finding the footer of a remote layer may take another
+// download, remote eStargz layers are only recognized by their TOC digest annotation.
+func (b *IndexBuilder) streamLayer(desc ocispec.Descriptor, compressionAlgo string) bool {
+	if _, ok := b.contentStore.(*remoteProvider); !ok || !b.ztocBuilder.CheckStreamCompressionAlgorithm(compressionAlgo) {
+		return false
+	}
+	if _, ok := desc.Annotations[ztoc.EStargzTOCDigestAnnotation]; ok {
+		return false
+	}
+	return b.config.spanAlignment == 0
+}
+
+// buildZtocFromStream builds the ztoc of the layer `desc` in a single pass over `r`.
+// The rest of the layer is read after the ztoc is built, so that a remote layer is verified
+// against its digest.
+func (b *IndexBuilder) buildZtocFromStream(r io.Reader, desc ocispec.Descriptor, opts []ztoc.BuildOption) (*ztoc.Ztoc, error) {
+	cr := &countingReader{r: r}
+	toc, err := b.ztocBuilder.BuildZtocFromReader(cr, b.config.spanSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return nil, err
+	}
+	if cr.n != desc.Size {
+		return nil, errors.New("the size of the layer stream doesn't match that of the layer")
+	}
+	return toc, nil
+}
+
+// countingReader is an `io.Reader` that counts the bytes read from `r`.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// buildZtocFromTempFile builds the ztoc of the layer `desc` from a temp copy of `r`.
+// It also returns whether the layer is an eStargz layer.
+func (b *IndexBuilder) buildZtocFromTempFile(r io.Reader, desc ocispec.Descriptor, compressionAlgo string, opts []ztoc.BuildOption) (*ztoc.Ztoc, bool, error) {
+	tmpFile, err := os.CreateTemp("", "tmp.*")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	n, err := io.Copy(tmpFile, r)
+	if err != nil {
+		return nil, false, err
+	}
+	if n != desc.Size {
+		return nil, false, errors.New("the size of the temp file doesn't match that of the layer")
+	}
+
+	// eStargz layers embed a TOC, so the ztoc can be built without decompressing the layer.
+	var isEStargz bool
+	if compressionAlgo == compression.Gzip {
+		isEStargz = ztoc.IsEStargz(tmpFile, desc.Size)
+		if _, ok := desc.Annotations[ztoc.EStargzTOCDigestAnnotation]; ok && !isEStargz {
+			return nil, false, fmt.Errorf("layer %s has annotation %s but no eStargz footer", desc.Digest, ztoc.EStargzTOCDigestAnnotation)
+		}
+	}
+	if !isEStargz {
+		toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.spanSize, opts...)
+		return toc, false, err
+	}
+
+	fmt.Printf("layer %s is an eStargz layer, building ztoc from its embedded TOC\n", desc.Digest)
+	if tocDigest, ok := desc.Annotations[ztoc.EStargzTOCDigestAnnotation]; ok {
+		opts = append(opts, ztoc.WithEStargzTOCDigest(digest.Digest(tocDigest)))
+	}
+	toc, err := b.ztocBuilder.BuildZtocFromEStargz(tmpFile.Name(), b.config.spanSize, opts...)
+	return toc, true, err
+}
+
+// isSingleOversizedSpan returns true if `toc` has a single span larger than the span size.
+// zstd spans can only start at frame boundaries, so a zstd layer compressed as a single frame
+// (the default of zstd and containerd) has a single span however large it is.
+func isSingleOversizedSpan(toc *ztoc.Ztoc, spanSize int64) (bool, error) {
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return false, err
+	}
+	defer zinfo.Close()
+	return zinfo.MaxSpanID() == 0 && int64(toc.UncompressedArchiveSize) > spanSize, nil
+}
+
+// sociLayerDescriptor returns the descriptor of the ztoc `ztocDesc` of the layer `desc` in an index.
+func sociLayerDescriptor(ztocDesc, desc ocispec.Descriptor) *ocispec.Descriptor {
 	ztocDesc.MediaType = SociLayerMediaType
 	ztocDesc.Annotations = map[string]string{
 		IndexAnnotationImageLayerMediaType: desc.MediaType,
 		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
 	}
-	return &ztocDesc, err
+	return &ztocDesc
 }
 
 // NewIndex returns a new index.
@@ -480,6 +836,15 @@ func NewIndexFromReader(reader io.Reader) (*Index, error) {
 	return index, nil
 }
 
+// skipLayer returns whether `desc`, the layer at `position` of `numLayers` layers, is skipped by
+// the layer policy or the min layer size, and why.
+func (b *IndexBuilder) skipLayer(desc ocispec.Descriptor, position, numLayers int) (bool, string) {
+	if skip, reason := b.config.layerPolicy.skip(desc, position, numLayers); skip {
+		return true, reason
+	}
+	return skipBuildingZtoc(desc, b.config)
+}
+
 func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) (bool, string) {
 	if cfg == nil {
 		return false, ""
@@ -492,7 +857,7 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) (bool, string)
 }
 
 // GetImageManifestDescriptor gets the descriptor of image manifest
-func GetImageManifestDescriptor(ctx context.Context, cs content.Store, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
+func GetImageManifestDescriptor(ctx context.Context, cs content.Provider, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
 	if images.IsIndexType(imageTarget.MediaType) {
 		manifests, err := images.Children(ctx, cs, imageTarget)
 		if err != nil {
@@ -17,12 +17,20 @@
 package soci
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/images"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
@@ -229,6 +237,168 @@ func TestBuildSociIndexWithLimits(t *testing.T) {
 	}
 }
 
+func TestBuildSociLayerEStargz(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(testutil.RandomByteData(100000))),
+		testutil.File("file2", "foo"),
+	}
+	estargz, err := io.ReadAll(testutil.BuildEStargz(tarEntries, 10000))
+	if err != nil {
+		t.Fatalf("can't build eStargz layer: %v", err)
+	}
+	tarGz, err := io.ReadAll(testutil.BuildTarGz(tarEntries, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("can't build gzip layer: %v", err)
+	}
+	// the TOC is the last file of the layer.
+	zr, err := gzip.NewReader(bytes.NewReader(estargz))
+	if err != nil {
+		t.Fatalf("can't read eStargz layer: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	var tocDigest digest.Digest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("can't read eStargz layer: %v", err)
+		}
+		if hdr.Name == "stargz.index.json" {
+			if tocDigest, err = digest.FromReader(tr); err != nil {
+				t.Fatalf("can't read eStargz TOC: %v", err)
+			}
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		layer       []byte
+		annotations map[string]string
+		expectErr   bool
+	}{
+		{
+			name:  "eStargz layer detected by footer",
+			layer: estargz,
+		},
+		{
+			name:        "eStargz layer with annotation",
+			layer:       estargz,
+			annotations: map[string]string{ztoc.EStargzTOCDigestAnnotation: tocDigest.String()},
+		},
+		{
+			name:        "eStargz layer with mismatching annotation",
+			layer:       estargz,
+			annotations: map[string]string{ztoc.EStargzTOCDigestAnnotation: digest.FromString("other").String()},
+			expectErr:   true,
+		},
+		{
+			name:        "gzip layer with eStargz annotation",
+			layer:       tarGz,
+			annotations: map[string]string{ztoc.EStargzTOCDigestAnnotation: tocDigest.String()},
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			cs, err := local.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("can't create content store: %v", err)
+			}
+			desc := ocispec.Descriptor{
+				MediaType:   ocispec.MediaTypeImageLayerGzip,
+				Digest:      digest.FromBytes(tc.layer),
+				Size:        int64(len(tc.layer)),
+				Annotations: tc.annotations,
+			}
+			if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(tc.layer), desc); err != nil {
+				t.Fatalf("can't write layer to content store: %v", err)
+			}
+			blobStore := memory.New()
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			builder, _ := NewIndexBuilder(cs, blobStore, artifactsDb, WithSpanSize(20000), WithMinLayerSize(0))
+			ztocDesc, err := builder.buildSociLayer(ctx, desc)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expect error, actual: nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			// the ztoc is pushed to the blob store before its media type is set.
+			r, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: ztocDesc.Digest, Size: ztocDesc.Size})
+			if err != nil {
+				t.Fatalf("can't fetch ztoc: %v", err)
+			}
+			defer r.Close()
+			toc, err := ztoc.Unmarshal(r)
+			if err != nil {
+				t.Fatalf("can't unmarshal ztoc: %v", err)
+			}
+			// the TOC embedded in the eStargz layer is part of the ztoc.
+			if _, ok := toc.Lookup("stargz.index.json"); !ok {
+				t.Fatalf("ztoc was not built from the eStargz TOC")
+			}
+			if toc.MaxSpanID == 0 {
+				t.Fatalf("expected multiple spans for a chunked eStargz layer")
+			}
+		})
+	}
+}
+
+func TestIsSingleOversizedSpan(t *testing.T) {
+	entries := []testutil.TarEntry{
+		testutil.File("file", string(testutil.RandomByteData(100000))),
+	}
+	testCases := []struct {
+		name     string
+		spanSize int64
+		opts     []testutil.BuildTarOption
+		expected bool
+	}{
+		{
+			name:     "single frame larger than the span size",
+			spanSize: 20000,
+			expected: true,
+		},
+		{
+			name:     "single frame smaller than the span size",
+			spanSize: 1 << 20,
+		},
+		{
+			name:     "multiple frames",
+			spanSize: 20000,
+			opts:     []testutil.BuildTarOption{testutil.WithZstdFrameSize(20000)},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			toc, err := ztoc.NewBuilder("test").BuildZtocFromReader(testutil.BuildTarZstd(entries, 3, tc.opts...),
+				tc.spanSize, ztoc.WithCompression(compression.Zstd))
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			actual, err := isSingleOversizedSpan(toc, tc.spanSize)
+			if err != nil {
+				t.Fatalf("can't check spans: %v", err)
+			}
+			if actual != tc.expected {
+				t.Fatalf("unexpected result. expect: %v, actual: %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
 func TestNewIndex(t *testing.T) {
 	testcases := []struct {
 		name        string
@@ -372,3 +542,114 @@ func TestMarshalIndex(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildParallelism(t *testing.T) {
+	var layers [][]byte
+	for i := 0; i < 6; i++ {
+		layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+			testutil.File("file", string(testutil.RandomByteData(50000))),
+		}, gzip.DefaultCompression))
+		if err != nil {
+			t.Fatalf("can't build layer: %v", err)
+		}
+		layers = append(layers, layer)
+	}
+	corrupted := []byte("not a gzip layer")
+
+	testCases := []struct {
+		name             string
+		layers           [][]byte
+		parallelism      int
+		expectFailed     int
+		expectNotStarted int
+	}{
+		{
+			name:        "all layers with parallelism 2",
+			layers:      layers,
+			parallelism: 2,
+		},
+		{
+			name:        "all layers with parallelism 1",
+			layers:      layers,
+			parallelism: 1,
+		},
+		{
+			name:             "corrupted layer cancels the remaining layers",
+			layers:           [][]byte{layers[0], corrupted, layers[1], layers[2]},
+			parallelism:      1,
+			expectFailed:     1,
+			expectNotStarted: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			manifestDesc, layerDescs := pushTestImageLayers(t, store, tc.layers...)
+			artifactsDb, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+
+			var inFlight, maxInFlight int
+			statuses := make(map[digest.Digest]LayerStatus)
+			progress := func(p LayerProgress) {
+				statuses[p.Layer.Digest] = p.Status
+				if p.Status == LayerStarted {
+					inFlight++
+				} else {
+					inFlight--
+				}
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+			}
+			builder, err := NewIndexBuilder(NewRemoteProvider(store), memory.New(), artifactsDb,
+				WithSpanSize(20000), WithMinLayerSize(0), WithParallelism(tc.parallelism), WithProgress(progress))
+			if err != nil {
+				t.Fatalf("can't create index builder: %v", err)
+			}
+			index, err := builder.Build(ctx, images.Image{Name: "test", Target: manifestDesc})
+
+			if maxInFlight > tc.parallelism {
+				t.Fatalf("too many layers processed at the same time. expect: <= %d, actual: %d", tc.parallelism, maxInFlight)
+			}
+			var failed, notStarted int
+			for _, desc := range layerDescs {
+				switch statuses[desc.Digest] {
+				case LayerFailed:
+					failed++
+				case "":
+					notStarted++
+				}
+			}
+			if failed != tc.expectFailed || notStarted != tc.expectNotStarted {
+				t.Fatalf("unexpected layer statuses. expect: %d failed, %d not started, actual: %v", tc.expectFailed, tc.expectNotStarted, statuses)
+			}
+
+			if tc.expectFailed == 0 {
+				if err != nil {
+					t.Fatalf("can't build index: %v", err)
+				}
+				if len(index.Index.Blobs) != len(layerDescs) {
+					t.Fatalf("unexpected number of ztocs. expect: %d, actual: %d", len(layerDescs), len(index.Index.Blobs))
+				}
+				for i, blob := range index.Index.Blobs {
+					if blob.Annotations[IndexAnnotationImageLayerDigest] != layerDescs[i].Digest.String() {
+						t.Fatalf("ztocs are not in layer order")
+					}
+				}
+				return
+			}
+			var layerErr *LayerError
+			if !errors.As(err, &layerErr) {
+				t.Fatalf("expected a layer error, got: %v", err)
+			}
+			if layerErr.Layer.Digest != digest.FromBytes(corrupted) {
+				t.Fatalf("unexpected failed layer. expect: %v, actual: %v", digest.FromBytes(corrupted), layerErr.Layer.Digest)
+			}
+		})
+	}
+}
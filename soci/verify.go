@@ -0,0 +1,229 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// Errors reported by `VerifyIndex` for the layers that don't match their ztocs. They are wrapped
+// with the details of the mismatch, so they must be checked with `errors.Is`.
+var (
+	// ErrLayerNotInImage is reported if a ztoc refers to a layer that isn't in the image manifest.
+	ErrLayerNotInImage = errors.New("layer is not in the image manifest")
+	// ErrLayerSizeMismatch is reported if the compressed size of a ztoc doesn't match the size of its layer.
+	ErrLayerSizeMismatch = errors.New("ztoc doesn't match the size of the layer")
+	// ErrSpanDigestMismatch is reported if a span digest of a ztoc doesn't match the bytes of the layer.
+	ErrSpanDigestMismatch = errors.New("span digest doesn't match the layer")
+)
+
+// IndexVerification is the result of the verification of a SOCI index against its image.
+type IndexVerification struct {
+	Layers []LayerVerification
+}
+
+// LayerVerification is the result of the verification of a ztoc against its image layer.
+type LayerVerification struct {
+	Layer digest.Digest
+	Ztoc  digest.Digest
+	// Errors are the mismatches between the ztoc and the layer, empty if the ztoc matches the layer.
+	Errors []error
+}
+
+// OK returns true if every ztoc of the index matches its layer.
+func (v *IndexVerification) OK() bool {
+	for _, layer := range v.Layers {
+		if len(layer.Errors) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyIndex verifies the SOCI index `index` against its image: every ztoc, fetched from `ztocs`, must refer
+// to a layer of the subject manifest, its span digests must match the compressed bytes of the layer and its TOC
+// must match the files of the layer. The manifest and layers are read from `layers`, which can be the containerd
+// content store or a registry (see `NewRemoteProvider`). Each layer is read once, sequentially and in full:
+// every span digest covers a range of the compressed layer and the TOC can only be checked by decompressing
+// the layer from the start, so range requests wouldn't download less.
+//
+// Mismatches are reported in the returned `IndexVerification`; an error is only returned if the verification
+// can't be done (e.g., the image manifest can't be read).
+func VerifyIndex(ctx context.Context, index *Index, ztocs orascontent.Fetcher, layers content.Provider) (*IndexVerification, error) {
+	if index.Subject == nil {
+		return nil, errors.New("the index has no subject")
+	}
+	b, err := content.ReadBlob(ctx, layers, *index.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image manifest %v: %w", index.Subject.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode image manifest %v: %w", index.Subject.Digest, err)
+	}
+	manifestLayers := make(map[digest.Digest]ocispec.Descriptor)
+	for _, l := range manifest.Layers {
+		manifestLayers[l.Digest] = l
+	}
+
+	result := &IndexVerification{}
+	for _, blob := range index.Blobs {
+		layer := LayerVerification{
+			Layer: digest.Digest(blob.Annotations[IndexAnnotationImageLayerDigest]),
+			Ztoc:  blob.Digest,
+		}
+		layerDesc, ok := manifestLayers[layer.Layer]
+		if !ok {
+			layer.Errors = append(layer.Errors, fmt.Errorf("%w: %s", ErrLayerNotInImage, layer.Layer))
+		} else if err := ctx.Err(); err != nil {
+			return nil, err
+		} else {
+			layer.Errors = verifyZtoc(ctx, blob, layerDesc, ztocs, layers)
+		}
+		result.Layers = append(result.Layers, layer)
+	}
+	return result, nil
+}
+
+// verifyZtoc verifies the ztoc `ztocDesc` against the layer `layerDesc` and returns the mismatches.
+func verifyZtoc(ctx context.Context, ztocDesc, layerDesc ocispec.Descriptor, ztocs orascontent.Fetcher, layers content.Provider) []error {
+	// FetchAll verifies the size and digest of the ztoc.
+	data, err := orascontent.FetchAll(ctx, ztocs, ocispec.Descriptor{Digest: ztocDesc.Digest, Size: ztocDesc.Size})
+	if err != nil {
+		return []error{fmt.Errorf("cannot read ztoc: %w", err)}
+	}
+	toc, err := ztoc.Unmarshal(bytes.NewReader(data))
+	if err != nil {
+		return []error{fmt.Errorf("cannot decode ztoc: %w", err)}
+	}
+	if err := toc.Validate(); err != nil {
+		return []error{err}
+	}
+	if toc.CompressedArchiveSize != compression.Offset(layerDesc.Size) {
+		return []error{fmt.Errorf("%w: compressed archive size %d, layer size %d", ErrLayerSizeMismatch, toc.CompressedArchiveSize, layerDesc.Size)}
+	}
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return []error{err}
+	}
+	hasher := &spanHasher{}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		hasher.spans = append(hasher.spans, spanRange{
+			start:    int64(zinfo.StartCompressedOffset(id)),
+			end:      int64(zinfo.EndCompressedOffset(id, toc.CompressedArchiveSize)),
+			digester: digest.Canonical.Digester(),
+		})
+	}
+	zinfo.Close()
+
+	ra, err := layers.ReaderAt(ctx, layerDesc)
+	if err != nil {
+		return []error{fmt.Errorf("cannot read layer: %w", err)}
+	}
+	defer ra.Close()
+	r := io.TeeReader(io.NewSectionReader(ra, 0, layerDesc.Size), hasher)
+
+	var errs []error
+	if err := verifyTOC(toc, r); err != nil {
+		errs = append(errs, err)
+	}
+	// the TOC is read up to the end of the tar archive, but the spans cover the whole layer.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return append(errs, fmt.Errorf("cannot read layer: %w", err))
+	}
+	for id, span := range hasher.spans {
+		if actual := span.digester.Digest(); actual != toc.SpanDigests[id] {
+			errs = append(errs, fmt.Errorf("%w: span %d (compressed bytes %d-%d): expected %v, actual %v",
+				ErrSpanDigestMismatch, id, span.start, span.end, toc.SpanDigests[id], actual))
+		}
+	}
+	return errs
+}
+
+// verifyTOC verifies the TOC of `toc` against `r`, the compressed layer.
+func verifyTOC(toc *ztoc.Ztoc, r io.Reader) error {
+	var tr io.Reader
+	switch toc.CompressionAlgorithm {
+	case compression.Gzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ztoc.ErrTOCMismatch, err)
+		}
+		defer gr.Close()
+		tr = gr
+	case compression.Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ztoc.ErrTOCMismatch, err)
+		}
+		defer zr.Close()
+		tr = zr
+	default:
+		tr = r
+	}
+	return toc.VerifyTOC(tr)
+}
+
+// spanRange is the range of compressed bytes of a span.
+type spanRange struct {
+	start, end int64
+	digester   digest.Digester
+}
+
+// spanHasher is an `io.Writer` that computes the digests of the spans of a layer written to it sequentially.
+// Spans may overlap (e.g., a gzip span ends with the first byte of the next span).
+type spanHasher struct {
+	spans  []spanRange
+	offset int64
+	next   int
+}
+
+func (h *spanHasher) Write(p []byte) (int, error) {
+	start, end := h.offset, h.offset+int64(len(p))
+	for i := h.next; i < len(h.spans) && h.spans[i].start < end; i++ {
+		s := h.spans[i]
+		lo, hi := s.start, s.end
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo < hi {
+			s.digester.Hash().Write(p[lo-start : hi-start])
+		}
+	}
+	for h.next < len(h.spans) && h.spans[h.next].end <= end {
+		h.next++
+	}
+	h.offset = end
+	return len(p), nil
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// bytesProvider is a `content.Provider` serving blobs from memory without verifying them.
+type bytesProvider map[digest.Digest][]byte
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error {
+	return nil
+}
+
+func (p bytesProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	b, ok := p[desc.Digest]
+	if !ok {
+		return nil, errdefs.ErrNotFound
+	}
+	return bytesReaderAt{bytes.NewReader(b)}, nil
+}
+
+func TestVerifyIndex(t *testing.T) {
+	ctx := context.Background()
+	layer, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file", string(testutil.RandomByteData(100000))),
+		testutil.File("other", "content"),
+	}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("can't build layer: %v", err)
+	}
+	store := memory.New()
+	manifestDesc, layerDescs := pushTestImageLayers(t, store, layer)
+	manifest, err := orascontent.FetchAll(ctx, store, manifestDesc)
+	if err != nil {
+		t.Fatalf("can't read manifest: %v", err)
+	}
+
+	blobStore, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("can't create OCI store: %v", err)
+	}
+	artifactsDb, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	builder, err := NewIndexBuilder(NewRemoteProvider(store), blobStore, artifactsDb, WithSpanSize(20000), WithMinLayerSize(0))
+	if err != nil {
+		t.Fatalf("can't create index builder: %v", err)
+	}
+	built, err := builder.Build(ctx, images.Image{Name: "test", Target: manifestDesc})
+	if err != nil {
+		t.Fatalf("can't build index: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		mutate    func(t *testing.T, index *Index, layers bytesProvider)
+		expectErr error
+	}{
+		{
+			name: "matching index",
+		},
+		{
+			name: "layer not in image",
+			mutate: func(t *testing.T, index *Index, layers bytesProvider) {
+				index.Blobs[0].Annotations = map[string]string{IndexAnnotationImageLayerDigest: digest.FromString("other layer").String()}
+			},
+			expectErr: ErrLayerNotInImage,
+		},
+		{
+			name: "corrupted span",
+			mutate: func(t *testing.T, index *Index, layers bytesProvider) {
+				corrupted := append([]byte{}, layer...)
+				corrupted[len(corrupted)/2] ^= 0xff
+				layers[layerDescs[0].Digest] = corrupted
+			},
+			expectErr: ErrSpanDigestMismatch,
+		},
+		{
+			name: "modified TOC",
+			mutate: func(t *testing.T, index *Index, layers bytesProvider) {
+				b, err := orascontent.FetchAll(ctx, blobStore, ocispec.Descriptor{Digest: index.Blobs[0].Digest, Size: index.Blobs[0].Size})
+				if err != nil {
+					t.Fatalf("can't read ztoc: %v", err)
+				}
+				toc, err := ztoc.Unmarshal(bytes.NewReader(b))
+				if err != nil {
+					t.Fatalf("can't decode ztoc: %v", err)
+				}
+				toc.FileMetadata[1].Mode = 0777
+				r, desc, err := ztoc.Marshal(toc)
+				if err != nil {
+					t.Fatalf("can't marshal ztoc: %v", err)
+				}
+				if err := blobStore.Push(ctx, desc, r); err != nil {
+					t.Fatalf("can't push ztoc: %v", err)
+				}
+				index.Blobs[0].Digest, index.Blobs[0].Size = desc.Digest, desc.Size
+			},
+			expectErr: ztoc.ErrTOCMismatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			index := *built.Index
+			index.Blobs = append([]ocispec.Descriptor{}, built.Index.Blobs...)
+			layers := bytesProvider{manifestDesc.Digest: manifest, layerDescs[0].Digest: layer}
+			if tc.mutate != nil {
+				tc.mutate(t, &index, layers)
+			}
+
+			result, err := VerifyIndex(ctx, &index, blobStore, layers)
+			if err != nil {
+				t.Fatalf("can't verify index: %v", err)
+			}
+			if len(result.Layers) != 1 {
+				t.Fatalf("unexpected number of verified layers: %d", len(result.Layers))
+			}
+			errs := result.Layers[0].Errors
+			if tc.expectErr == nil {
+				if !result.OK() {
+					t.Fatalf("unexpected mismatches: %v", errs)
+				}
+				return
+			}
+			if result.OK() {
+				t.Fatalf("expected a mismatch")
+			}
+			for _, err := range errs {
+				if errors.Is(err, tc.expectErr) {
+					return
+				}
+			}
+			t.Fatalf("unexpected mismatches. expect: %v, actual: %v", tc.expectErr, errs)
+		})
+	}
+}
+
+func TestSpanHasher(t *testing.T) {
+	data := testutil.RandomByteData(100)
+	spans := []spanRange{{start: 0, end: 40}, {start: 39, end: 80}, {start: 80, end: 100}}
+	for _, chunkSize := range []int{1, 7, 39, 100} {
+		hasher := &spanHasher{}
+		for _, s := range spans {
+			hasher.spans = append(hasher.spans, spanRange{start: s.start, end: s.end, digester: digest.Canonical.Digester()})
+		}
+		for i := 0; i < len(data); i += chunkSize {
+			end := i + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			hasher.Write(data[i:end])
+		}
+		for i, s := range hasher.spans {
+			if expected := digest.FromBytes(data[s.start:s.end]); s.digester.Digest() != expected {
+				t.Fatalf("unexpected digest of span %d with chunk size %d", i, chunkSize)
+			}
+		}
+	}
+}
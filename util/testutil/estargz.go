@@ -0,0 +1,232 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// BuildEStargz builds an eStargz blob given a list of tar entries and returns an io.Reader.
+// Like the eStargz writer, every `chunkSize` bytes of a regular file start a new gzip member,
+// and the blob ends with a gzip member containing the TOC ("stargz.index.json") followed by
+// the eStargz footer.
+func BuildEStargz(ents []TarEntry, chunkSize int, opts ...BuildTarOption) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeEStargz(pw, tar.NewReader(BuildTar(ents, opts...)), int64(chunkSize)))
+	}()
+	return pr
+}
+
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+}
+
+// estargzWriter writes to the current gzip member of an eStargz blob.
+type estargzWriter struct {
+	w  io.Writer
+	n  int64 // bytes written to `w`
+	gz *gzip.Writer
+}
+
+func (ew *estargzWriter) Write(p []byte) (int, error) {
+	if ew.gz == nil {
+		ew.gz = gzip.NewWriter(countingWriter{ew})
+	}
+	return ew.gz.Write(p)
+}
+
+// closeMember closes the current gzip member, so the next write starts a new member.
+func (ew *estargzWriter) closeMember() error {
+	if ew.gz == nil {
+		return nil
+	}
+	err := ew.gz.Close()
+	ew.gz = nil
+	return err
+}
+
+type countingWriter struct {
+	ew *estargzWriter
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ew.w.Write(p)
+	cw.ew.n += int64(n)
+	return n, err
+}
+
+func writeEStargz(w io.Writer, tr *tar.Reader, chunkSize int64) error {
+	ew := &estargzWriter{w: w}
+	tw := tar.NewWriter(ew)
+	var entries []estargzEntry
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ent := estargzEntry{
+			Name:     strings.TrimPrefix(path.Clean("/"+h.Name), "/"),
+			Mode:     h.Mode,
+			UID:      h.Uid,
+			GID:      h.Gid,
+			Uname:    h.Uname,
+			Gname:    h.Gname,
+			LinkName: h.Linkname,
+			DevMajor: h.Devmajor,
+			DevMinor: h.Devminor,
+		}
+		if !h.ModTime.IsZero() {
+			ent.ModTime3339 = h.ModTime.UTC().Round(time.Second).Format(time.RFC3339)
+		}
+		for k, v := range h.PAXRecords {
+			if name := strings.TrimPrefix(k, "SCHILY.xattr."); name != k {
+				if ent.Xattrs == nil {
+					ent.Xattrs = make(map[string][]byte)
+				}
+				ent.Xattrs[name] = []byte(v)
+			}
+		}
+		switch h.Typeflag {
+		case tar.TypeLink:
+			ent.Type = "hardlink"
+			ent.LinkName = strings.TrimPrefix(path.Clean("/"+h.Linkname), "/")
+		case tar.TypeSymlink:
+			ent.Type = "symlink"
+		case tar.TypeDir:
+			ent.Type = "dir"
+		case tar.TypeReg:
+			ent.Type = "reg"
+			ent.Size = h.Size
+		case tar.TypeChar:
+			ent.Type = "char"
+		case tar.TypeBlock:
+			ent.Type = "block"
+		case tar.TypeFifo:
+			ent.Type = "fifo"
+		default:
+			return fmt.Errorf("unsupported tar entry %q", h.Typeflag)
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+
+		if ent.Type != "reg" || ent.Size == 0 {
+			entries = append(entries, ent)
+			continue
+		}
+		digester := digest.Canonical.Digester()
+		content := io.TeeReader(tr, digester.Hash())
+		regEntry := len(entries)
+		for written := int64(0); written < h.Size; {
+			size := chunkSize
+			if remaining := h.Size - written; size <= 0 || size > remaining {
+				size = remaining
+			}
+			if err := ew.closeMember(); err != nil {
+				return err
+			}
+			ent.Offset = ew.n
+			ent.ChunkOffset = written
+			if size < h.Size {
+				ent.ChunkSize = size
+			}
+			if _, err := io.CopyN(tw, content, size); err != nil {
+				return err
+			}
+			entries = append(entries, ent)
+			written += size
+			ent = estargzEntry{Name: ent.Name, Type: "chunk"}
+		}
+		entries[regEntry].Digest = digester.Digest().String()
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := ew.closeMember(); err != nil {
+		return err
+	}
+
+	// the TOC, in its own gzip member.
+	tocOffset := ew.n
+	tocJSON, err := json.Marshal(struct {
+		Version int            `json:"version"`
+		Entries []estargzEntry `json:"entries"`
+	}{Version: 1, Entries: entries})
+	if err != nil {
+		return err
+	}
+	tw = tar.NewWriter(ew)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "stargz.index.json",
+		Mode:     0444,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := ew.closeMember(); err != nil {
+		return err
+	}
+
+	// the footer: an empty gzip member whose extra field points to the TOC. It is written
+	// by hand because the size of an empty deflate stream depends on the Go version, while
+	// the footer must be exactly 51 bytes.
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, []byte(fmt.Sprintf("%016xSTARGZ", tocOffset))...)
+	// an empty final stored block, followed by the crc32 and size of the empty content.
+	footer = append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	_, err = countingWriter{ew}.Write(footer)
+	return err
+}
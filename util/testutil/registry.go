@@ -0,0 +1,240 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry is an in-memory stand-in for an OCI distribution registry, serving
+// a single repository over plain HTTP. It implements only what is needed to push
+// and pull artifacts: blobs, manifests, tags and, optionally, the Referrers API.
+type Registry struct {
+	// Host is the host (and port) of the registry.
+	Host string
+
+	referrersAPI  bool
+	deleteEnabled bool
+	server        *httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[digest.Digest]registryManifest
+	tags      map[string]digest.Digest
+}
+
+type registryManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// NewRegistry starts a Registry. If `referrersAPI` is false, the Referrers API returns 404
+// like registries that don't support it. If `deleteEnabled` is false, manifests can't be deleted.
+// The registry must be closed with `Close`.
+func NewRegistry(referrersAPI, deleteEnabled bool) *Registry {
+	r := &Registry{
+		referrersAPI:  referrersAPI,
+		deleteEnabled: deleteEnabled,
+		blobs:         make(map[digest.Digest][]byte),
+		manifests:     make(map[digest.Digest]registryManifest),
+		tags:          make(map[string]digest.Digest),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	r.Host = strings.TrimPrefix(r.server.URL, "http://")
+	return r
+}
+
+// Close shuts the registry down.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Tags returns the manifest digest of each tag of the repository.
+func (r *Registry) Tags() map[string]digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tags := make(map[string]digest.Digest, len(r.tags))
+	for tag, dgst := range r.tags {
+		tags[tag] = dgst
+	}
+	return tags
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "" || path == "/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req)
+	case strings.Contains(path, "/blobs/"):
+		r.serveBlob(w, req, path[strings.LastIndex(path, "/")+1:])
+	case strings.Contains(path, "/manifests/"):
+		r.serveManifest(w, req, path[strings.LastIndex(path, "/")+1:])
+	case strings.Contains(path, "/referrers/"):
+		r.serveReferrers(w, req, path[strings.LastIndex(path, "/")+1:])
+	default:
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND")
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		w.Header().Set("Location", req.URL.Path+"session")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID")
+			return
+		}
+		dgst, err := digest.Parse(req.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(b) != dgst {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		r.blobs[dgst] = b
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, ref string) {
+	b, ok := r.blobs[digest.Digest(ref)]
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("Docker-Content-Digest", ref)
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write(b)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, ref string) {
+	dgst := digest.Digest(ref)
+	if tagged, ok := r.tags[ref]; ok {
+		dgst = tagged
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.manifests[dgst]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(m.content)
+		}
+	case http.MethodPut:
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID")
+			return
+		}
+		dgst = digest.FromBytes(b)
+		r.manifests[dgst] = registryManifest{mediaType: req.Header.Get("Content-Type"), content: b}
+		if digest.Digest(ref).Validate() != nil {
+			r.tags[ref] = dgst
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if !r.deleteEnabled {
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+			return
+		}
+		if _, ok := r.manifests[dgst]; !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		delete(r.manifests, dgst)
+		for tag, tagged := range r.tags {
+			if tagged == dgst {
+				delete(r.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+	}
+}
+
+func (r *Registry) serveReferrers(w http.ResponseWriter, req *http.Request, ref string) {
+	if !r.referrersAPI {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	artifactType := req.URL.Query().Get("artifactType")
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{}}
+	index.SchemaVersion = 2
+	for dgst, m := range r.manifests {
+		var manifest ocispec.Manifest
+		if json.Unmarshal(m.content, &manifest) != nil || manifest.Subject == nil || manifest.Subject.Digest.String() != ref {
+			continue
+		}
+		if artifactType != "" && manifest.Config.MediaType != artifactType {
+			continue
+		}
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType:    m.mediaType,
+			ArtifactType: manifest.Config.MediaType,
+			Digest:       dgst,
+			Size:         int64(len(m.content)),
+			Annotations:  manifest.Annotations,
+		})
+	}
+	if artifactType != "" {
+		index.Annotations = map[string]string{"org.opencontainers.referrers.filtersApplied": "artifactType"}
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN")
+		return
+	}
+	w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, strings.ToLower(code))
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tarBlockSize = 512
+
+// rawTarEntry is a tar entry written as raw tar blocks, for entries that
+// `archive/tar` can't write (e.g., sparse files).
+type rawTarEntry func(w io.Writer, opts BuildTarOptions) error
+
+// AppendTar fails since raw entries can only be written by the tar builders of this package.
+func (f rawTarEntry) AppendTar(tw *tar.Writer, opts BuildTarOptions) error {
+	return fmt.Errorf("raw tar entries can't be written with a tar writer")
+}
+
+// SparseFormat is the format of a sparse file in a tar archive.
+type SparseFormat int
+
+const (
+	// SparseGNU is the old GNU format, where the sparse map is in the header
+	// of type "S" and its extension blocks.
+	SparseGNU SparseFormat = iota
+	// SparsePAX01 is the PAX 0.1 format, where the sparse map is in the
+	// "GNU.sparse.map" PAX record.
+	SparsePAX01
+	// SparsePAX10 is the PAX 1.0 format, where the sparse map is at the start of
+	// the data of the file.
+	SparsePAX10
+)
+
+// SparseFragment is a fragment of data of a sparse file.
+type SparseFragment struct {
+	Offset int64
+	Data   string
+}
+
+// SparseFile is a sparse regular file entry of `size` bytes, whose data is `fragments`,
+// sorted by offset. The rest of the file is a hole.
+func SparseFile(name string, size int64, fragments []SparseFragment, format SparseFormat) TarEntry {
+	return rawTarEntry(func(w io.Writer, opts BuildTarOptions) error {
+		name := opts.Prefix + name
+		var data strings.Builder
+		for _, f := range fragments {
+			data.WriteString(f.Data)
+		}
+		// like GNU tar, the sparse map ends with an empty fragment at the end of the file.
+		sparseMap := append([]SparseFragment{}, fragments...)
+		sparseMap = append(sparseMap, SparseFragment{Offset: size})
+
+		var blocks []byte
+		switch format {
+		case SparseGNU:
+			hdr := rawTarHeader(name, tar.TypeGNUSparse, int64(data.Len()), true)
+			writeTarNumeric(hdr[483:495], size)
+			var ext [][]byte
+			entries, isExtended := hdr[386:482], hdr[482:483]
+			for i, f := range sparseMap {
+				if i < 4 {
+					writeSparseEntry(entries[i*24:], f)
+					continue
+				}
+				j := (i - 4) % 21
+				if j == 0 {
+					isExtended[0] = 1
+					ext = append(ext, make([]byte, tarBlockSize))
+					isExtended = ext[len(ext)-1][504:505]
+				}
+				writeSparseEntry(ext[len(ext)-1][j*24:], f)
+			}
+			blocks = append(setTarChecksum(hdr), concat(ext)...)
+		case SparsePAX01:
+			var mapValues []string
+			for _, f := range sparseMap {
+				mapValues = append(mapValues, strconv.FormatInt(f.Offset, 10), strconv.Itoa(len(f.Data)))
+			}
+			blocks = paxHeader(name, map[string]string{
+				"GNU.sparse.size":      strconv.FormatInt(size, 10),
+				"GNU.sparse.numblocks": strconv.Itoa(len(sparseMap)),
+				"GNU.sparse.map":       strings.Join(mapValues, ","),
+			})
+			blocks = append(blocks, setTarChecksum(rawTarHeader(name, tar.TypeReg, int64(data.Len()), false))...)
+		case SparsePAX10:
+			mapData := []string{strconv.Itoa(len(sparseMap))}
+			for _, f := range sparseMap {
+				mapData = append(mapData, strconv.FormatInt(f.Offset, 10), strconv.Itoa(len(f.Data)))
+			}
+			mapBlocks := pad(strings.Join(mapData, "\n") + "\n")
+			blocks = paxHeader(name, map[string]string{
+				"GNU.sparse.major":    "1",
+				"GNU.sparse.minor":    "0",
+				"GNU.sparse.name":     name,
+				"GNU.sparse.realsize": strconv.FormatInt(size, 10),
+			})
+			hdr := rawTarHeader("GNUSparseFile.0/"+name, tar.TypeReg, int64(len(mapBlocks)+data.Len()), false)
+			blocks = append(blocks, setTarChecksum(hdr)...)
+			blocks = append(blocks, mapBlocks...)
+		default:
+			return fmt.Errorf("unknown sparse format %d", format)
+		}
+		blocks = append(blocks, pad(data.String())...)
+		_, err := w.Write(blocks)
+		return err
+	})
+}
+
+// paxHeader returns the blocks of a PAX header with `records`.
+func paxHeader(name string, records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var data strings.Builder
+	for _, k := range keys {
+		data.WriteString(paxRecord(k, records[k]))
+	}
+	hdr := rawTarHeader("PaxHeaders.0/"+name, tar.TypeXHeader, int64(data.Len()), false)
+	return append(setTarChecksum(hdr), pad(data.String())...)
+}
+
+// paxRecord formats a PAX record, prefixed by its length.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + 3 // space, equal sign and newline
+	size += len(strconv.Itoa(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, k, v)
+	if len(record) != size {
+		// the length gained a digit.
+		record = fmt.Sprintf("%d %s=%s\n", len(record), k, v)
+	}
+	return record
+}
+
+// rawTarHeader returns a header block with the GNU or USTAR magic, without its checksum.
+func rawTarHeader(name string, typeflag byte, size int64, gnu bool) []byte {
+	blk := make([]byte, tarBlockSize)
+	copy(blk[0:100], name)
+	writeTarNumeric(blk[100:108], 0644)
+	writeTarNumeric(blk[108:116], 0)
+	writeTarNumeric(blk[116:124], 0)
+	writeTarNumeric(blk[124:136], size)
+	writeTarNumeric(blk[136:148], 0)
+	blk[156] = typeflag
+	if gnu {
+		copy(blk[257:265], "ustar  \x00")
+	} else {
+		copy(blk[257:265], "ustar\x0000")
+	}
+	return blk
+}
+
+// setTarChecksum sets the checksum of the header block `blk` and returns it.
+func setTarChecksum(blk []byte) []byte {
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+func writeSparseEntry(b []byte, f SparseFragment) {
+	writeTarNumeric(b[0:12], f.Offset)
+	writeTarNumeric(b[12:24], int64(len(f.Data)))
+}
+
+// writeTarNumeric writes `v` as a NUL terminated octal number filling `b`.
+func writeTarNumeric(b []byte, v int64) {
+	copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, v))
+}
+
+// pad returns `s` padded with zeros to a multiple of the tar block size.
+func pad(s string) []byte {
+	b := make([]byte, (len(s)+tarBlockSize-1)/tarBlockSize*tarBlockSize)
+	copy(b, s)
+	return b
+}
+
+func concat(blocks [][]byte) []byte {
+	var b []byte
+	for _, blk := range blocks {
+		b = append(b, blk...)
+	}
+	return b
+}
@@ -61,6 +61,10 @@ type BuildTarOptions struct {
 	GzipComment  string
 	GzipFilename string
 	GzipExtra    []byte
+
+	// ZstdFrameSize is the max uncompressed size of each zstd frame. If it's 0,
+	// the whole tar is compressed as a single frame.
+	ZstdFrameSize int
 }
 
 // BuildTarOption is an option used during building blob.
@@ -91,6 +95,14 @@ func WithGzipExtra(extra []byte) BuildTarOption {
 	}
 }
 
+// WithZstdFrameSize is an option to split a zstd blob into frames of at most
+// `size` uncompressed bytes each.
+func WithZstdFrameSize(size int) BuildTarOption {
+	return func(o *BuildTarOptions) {
+		o.ZstdFrameSize = size
+	}
+}
+
 // BuildTar builds a tar given a list of tar entries and returns an io.Reader
 func BuildTar(ents []TarEntry, opts ...BuildTarOption) io.Reader {
 	var bo BuildTarOptions
@@ -101,7 +113,7 @@ func BuildTar(ents []TarEntry, opts ...BuildTarOption) io.Reader {
 	go func() {
 		tw := tar.NewWriter(pw)
 		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
+			if err := appendTar(tw, pw, ent, bo); err != nil {
 				pw.CloseWithError(err)
 				return
 			}
@@ -134,7 +146,7 @@ func BuildTarGz(ents []TarEntry, compressionLevel int, opts ...BuildTarOption) i
 		tw := tar.NewWriter(gw)
 
 		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
+			if err := appendTar(tw, gw, ent, bo); err != nil {
 				pw.CloseWithError(err)
 				return
 			}
@@ -166,9 +178,13 @@ func BuildTarZstd(ents []TarEntry, compressionLevel int, opts ...BuildTarOption)
 			pw.CloseWithError(err)
 			return
 		}
-		tw := tar.NewWriter(zw)
+		var w io.WriteCloser = zw
+		if bo.ZstdFrameSize > 0 {
+			w = &zstdFrameWriter{w: pw, zw: zw, frameSize: bo.ZstdFrameSize}
+		}
+		tw := tar.NewWriter(w)
 		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
+			if err := appendTar(tw, w, ent, bo); err != nil {
 				pw.CloseWithError(err)
 				return
 			}
@@ -177,7 +193,7 @@ func BuildTarZstd(ents []TarEntry, compressionLevel int, opts ...BuildTarOption)
 			pw.CloseWithError(err)
 			return
 		}
-		if err := zw.Close(); err != nil {
+		if err := w.Close(); err != nil {
 			pw.CloseWithError(err)
 			return
 		}
@@ -186,6 +202,44 @@ func BuildTarZstd(ents []TarEntry, compressionLevel int, opts ...BuildTarOption)
 	return pr
 }
 
+// zstdFrameWriter compresses every `frameSize` bytes written to it as a
+// separate zstd frame.
+type zstdFrameWriter struct {
+	w         io.Writer
+	zw        *zstd.Encoder
+	frameSize int
+	written   int
+}
+
+func (fw *zstdFrameWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if fw.written == fw.frameSize {
+			if err := fw.zw.Close(); err != nil {
+				return n, err
+			}
+			fw.zw.Reset(fw.w)
+			fw.written = 0
+		}
+		chunk := p
+		if len(chunk) > fw.frameSize-fw.written {
+			chunk = chunk[:fw.frameSize-fw.written]
+		}
+		m, err := fw.zw.Write(chunk)
+		n += m
+		fw.written += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (fw *zstdFrameWriter) Close() error {
+	return fw.zw.Close()
+}
+
 // WriteTarToTempFile writes the contents of a tar archive to a specified path and
 // return the temp filename and the tar data (as []byte).
 //
@@ -223,6 +277,23 @@ func GetFilesAndContentsWithinTarGz(tarGz string) (map[string][]byte, []string,
 	return getFilesAndContentsFromTarReader(tr)
 }
 
+// GetFilesAndContentsWithinTarZstd takes a path to a zstd compressed tar archive and returns a list of its files and their contents
+func GetFilesAndContentsWithinTarZstd(tarZstd string) (map[string][]byte, []string, error) {
+	f, err := os.Open(tarZstd)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	return getFilesAndContentsFromTarReader(tr)
+}
+
 // GetFilesAndContentsWithinTar takes a path to a tar archive and returns a list of its files and their contents
 func GetFilesAndContentsWithinTar(tarFile string) (map[string][]byte, []string, error) {
 	f, err := os.Open(tarFile)
@@ -244,7 +315,7 @@ func getFilesAndContentsFromTarReader(tr *tar.Reader) (map[string][]byte, []stri
 		if err == io.EOF {
 			break
 		}
-		if header.Typeflag == tar.TypeReg {
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse {
 			files = append(files, header.Name)
 			contents, err := io.ReadAll(tr)
 			if err != nil {
@@ -257,6 +328,19 @@ func getFilesAndContentsFromTarReader(tr *tar.Reader) (map[string][]byte, []stri
 	return m, files, nil
 }
 
+// appendTar appends `ent` to the tar writer `tw`, which writes to `w`.
+func appendTar(tw *tar.Writer, w io.Writer, ent TarEntry, opts BuildTarOptions) error {
+	raw, ok := ent.(rawTarEntry)
+	if !ok {
+		return ent.AppendTar(tw, opts)
+	}
+	// write the padding of the previous entry before writing the raw blocks.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return raw(w, opts)
+}
+
 type tarEntryFunc func(*tar.Writer, BuildTarOptions) error
 
 // AppendTar appends a file to a tar writer
@@ -332,11 +416,13 @@ func Dir(name string, opts ...DirectoryBuildTarOption) TarEntry {
 type FileBuildTarOption func(o *fileOpts)
 
 type fileOpts struct {
-	uid     int
-	gid     int
-	xattrs  map[string]string
-	mode    *os.FileMode
-	modTime time.Time
+	uid        int
+	gid        int
+	xattrs     map[string]string
+	mode       *os.FileMode
+	modTime    time.Time
+	accessTime time.Time
+	changeTime time.Time
 }
 
 // WithFileOwner specifies the owner of the file.
@@ -361,6 +447,22 @@ func WithFileModTime(modTime time.Time) FileBuildTarOption {
 	}
 }
 
+// WithFileAccessTime specifies the access time of the file. The file is written
+// in the PAX format, which keeps the sub-second precision of its times.
+func WithFileAccessTime(accessTime time.Time) FileBuildTarOption {
+	return func(o *fileOpts) {
+		o.accessTime = accessTime
+	}
+}
+
+// WithFileChangeTime specifies the status change time of the file. The file is
+// written in the PAX format, which keeps the sub-second precision of its times.
+func WithFileChangeTime(changeTime time.Time) FileBuildTarOption {
+	return func(o *fileOpts) {
+		o.changeTime = changeTime
+	}
+}
+
 // WithFileMode specifies the mode of the file.
 func WithFileMode(mode os.FileMode) FileBuildTarOption {
 	return func(o *fileOpts) {
@@ -382,15 +484,23 @@ func File(name, contents string, opts ...FileBuildTarOption) TarEntry {
 		if fOpts.mode != nil {
 			mode = permAndExtraMode2TarMode(*fOpts.mode)
 		}
+		format := tar.FormatUnknown
+		if !fOpts.accessTime.IsZero() || !fOpts.changeTime.IsZero() {
+			// access and change times are ignored unless the format is specified.
+			format = tar.FormatPAX
+		}
 		if err := tw.WriteHeader(&tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     buildOpts.Prefix + name,
-			Mode:     mode,
-			ModTime:  fOpts.modTime,
-			Xattrs:   fOpts.xattrs,
-			Size:     int64(len(contents)),
-			Uid:      fOpts.uid,
-			Gid:      fOpts.gid,
+			Typeflag:   tar.TypeReg,
+			Name:       buildOpts.Prefix + name,
+			Mode:       mode,
+			ModTime:    fOpts.modTime,
+			AccessTime: fOpts.accessTime,
+			ChangeTime: fOpts.changeTime,
+			Format:     format,
+			Xattrs:     fOpts.xattrs,
+			Size:       int64(len(contents)),
+			Uid:        fOpts.uid,
+			Gid:        fOpts.gid,
 		}); err != nil {
 			return err
 		}
@@ -0,0 +1,122 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CheckpointsEncoding is the encoding of serialized zinfo checkpoints.
+type CheckpointsEncoding string
+
+const (
+	// CheckpointsEncodingRaw is the encoding produced by `Zinfo.Bytes`.
+	CheckpointsEncodingRaw CheckpointsEncoding = ""
+	// CheckpointsEncodingCompact compresses the gzip checkpoints, which are dominated by
+	// the 32 KiB dictionary window stored with every checkpoint.
+	CheckpointsEncodingCompact CheckpointsEncoding = "compact"
+)
+
+// compactCheckpointsMagic starts the compact gzip checkpoints. In the raw layout, these
+// bytes would be the number of checkpoints, which could never match the size of the data.
+var compactCheckpointsMagic = []byte{'S', 'C', 'P', 0x01}
+
+// compactCheckpointsHeaderSize is the size of the header of the compact gzip checkpoints:
+// magic (4 bytes) and size of the raw checkpoints (8 bytes).
+const compactCheckpointsHeaderSize = 4 + 8
+
+// maxCompactCheckpoints is the maximum number of compact gzip checkpoints (i.e., 2 GiB
+// of raw checkpoints), which is enough for a 256 GiB layer with 4 MiB spans.
+const maxCompactCheckpoints = 1 << 16
+
+// EncodeCheckpoints encodes the raw checkpoints of a zinfo (i.e. `Zinfo.Bytes`) with `encoding`.
+// Only gzip checkpoints can be encoded compactly.
+func EncodeCheckpoints(compressionAlgo string, checkpoints []byte, encoding CheckpointsEncoding) ([]byte, error) {
+	switch encoding {
+	case CheckpointsEncodingRaw:
+		return checkpoints, nil
+	case CheckpointsEncodingCompact:
+		if compressionAlgo != Gzip {
+			return nil, fmt.Errorf("compact checkpoints are not supported for compression algorithm: %s", compressionAlgo)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		buf := make([]byte, compactCheckpointsHeaderSize, compactCheckpointsHeaderSize+len(checkpoints)/4)
+		copy(buf, compactCheckpointsMagic)
+		binary.LittleEndian.PutUint64(buf[len(compactCheckpointsMagic):], uint64(len(checkpoints)))
+		return enc.EncodeAll(checkpoints, buf), nil
+	default:
+		return nil, fmt.Errorf("unknown checkpoints encoding: %s", encoding)
+	}
+}
+
+// GetCheckpointsEncoding returns the encoding of serialized zinfo checkpoints.
+func GetCheckpointsEncoding(compressionAlgo string, checkpoints []byte) CheckpointsEncoding {
+	if compressionAlgo == Gzip && bytes.HasPrefix(checkpoints, compactCheckpointsMagic) {
+		return CheckpointsEncodingCompact
+	}
+	return CheckpointsEncodingRaw
+}
+
+// decodeCheckpoints returns the raw checkpoints given checkpoints in any encoding.
+// The size of compact checkpoints must match the number of checkpoints in their raw
+// header, which is bounded, so that corrupted checkpoints can't use up memory.
+func decodeCheckpoints(compressionAlgo string, checkpoints []byte) ([]byte, error) {
+	if GetCheckpointsEncoding(compressionAlgo, checkpoints) == CheckpointsEncodingRaw {
+		return checkpoints, nil
+	}
+	if len(checkpoints) < compactCheckpointsHeaderSize {
+		return nil, fmt.Errorf("truncated compact checkpoints")
+	}
+	size := binary.LittleEndian.Uint64(checkpoints[len(compactCheckpointsMagic):])
+	if size < blobHeaderSize || size > blobHeaderSize+maxCompactCheckpoints*packedCheckpointSize {
+		return nil, fmt.Errorf("invalid size of compact checkpoints: %d", size)
+	}
+	dec, err := zstd.NewReader(bytes.NewReader(checkpoints[compactCheckpointsHeaderSize:]), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	header := make([]byte, blobHeaderSize)
+	if _, err := io.ReadFull(dec, header); err != nil {
+		return nil, fmt.Errorf("cannot decode compact checkpoints: %w", err)
+	}
+	// v2 checkpoints contain all checkpoints, v1 checkpoints skip the first one.
+	numCheckpoints := uint64(binary.LittleEndian.Uint32(header[0:4]))
+	if numCheckpoints == 0 || numCheckpoints > maxCompactCheckpoints ||
+		(size != blobHeaderSize+numCheckpoints*packedCheckpointSize && size != blobHeaderSize+(numCheckpoints-1)*packedCheckpointSize) {
+		return nil, fmt.Errorf("invalid size of compact checkpoints: %d bytes for %d checkpoints", size, numCheckpoints)
+	}
+	// the buffer grows with the decoded data, which can't be larger than the validated size.
+	checkpointsData, err := io.ReadAll(io.LimitReader(dec, int64(size-blobHeaderSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode compact checkpoints: %w", err)
+	}
+	raw := append(header, checkpointsData...)
+	if uint64(len(raw)) != size {
+		return nil, fmt.Errorf("cannot decode compact checkpoints: expected %d bytes, got %d", size, len(raw))
+	}
+	return raw, nil
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCompactCheckpoints(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(1<<20, true)
+	input := gzipTestInput{
+		name:         "compressible data",
+		compressed:   gzipCompress(t, data, gzip.DefaultCompression, nil, 0),
+		uncompressed: data,
+	}
+	filename := writeTempFile(t, input.compressed)
+	zinfo, err := newGoGzipZinfoFromFile(filename, 65535)
+	if err != nil {
+		t.Fatalf("failed to build gzip zinfo: %v", err)
+	}
+	raw, err := zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize gzip zinfo: %v", err)
+	}
+
+	compact, err := EncodeCheckpoints(Gzip, raw, CheckpointsEncodingCompact)
+	if err != nil {
+		t.Fatalf("failed to encode checkpoints: %v", err)
+	}
+	if len(compact) >= len(raw) {
+		t.Fatalf("compact checkpoints are not smaller than raw checkpoints: %d >= %d", len(compact), len(raw))
+	}
+	if encoding := GetCheckpointsEncoding(Gzip, raw); encoding != CheckpointsEncodingRaw {
+		t.Fatalf("unexpected encoding of raw checkpoints: %q", encoding)
+	}
+	if encoding := GetCheckpointsEncoding(Gzip, compact); encoding != CheckpointsEncodingCompact {
+		t.Fatalf("unexpected encoding of compact checkpoints: %q", encoding)
+	}
+
+	decoded, err := NewZinfo(Gzip, compact)
+	if err != nil {
+		t.Fatalf("failed to create zinfo from compact checkpoints: %v", err)
+	}
+	defer decoded.Close()
+	b, err := decoded.Bytes()
+	if err != nil {
+		t.Fatalf("failed to serialize gzip zinfo: %v", err)
+	}
+	if !bytes.Equal(b, raw) {
+		t.Fatalf("zinfo decoded from compact checkpoints differs from the original")
+	}
+	verifyGzipZinfo(t, decoded, filename, input)
+}
+
+func TestEncodeCheckpointsWithUnsupportedEncoding(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name      string
+		algorithm string
+		encoding  CheckpointsEncoding
+	}{
+		{
+			name:      "compact zstd checkpoints",
+			algorithm: Zstd,
+			encoding:  CheckpointsEncodingCompact,
+		},
+		{
+			name:      "compact tar checkpoints",
+			algorithm: Uncompressed,
+			encoding:  CheckpointsEncodingCompact,
+		},
+		{
+			name:      "unknown encoding",
+			algorithm: Gzip,
+			encoding:  "foo",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := EncodeCheckpoints(tc.algorithm, []byte("foobar"), tc.encoding); err == nil {
+				t.Fatalf("expect error, actual: nil")
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidCompactCheckpoints(t *testing.T) {
+	t.Parallel()
+	encode := func(numCheckpoints uint32, size int) []byte {
+		raw := make([]byte, size)
+		binary.LittleEndian.PutUint32(raw[0:4], numCheckpoints)
+		checkpoints, err := EncodeCheckpoints(Gzip, raw, CheckpointsEncodingCompact)
+		if err != nil {
+			t.Fatalf("failed to encode checkpoints: %v", err)
+		}
+		return checkpoints
+	}
+	withSize := func(checkpoints []byte, size uint64) []byte {
+		checkpoints = append([]byte{}, checkpoints...)
+		binary.LittleEndian.PutUint64(checkpoints[len(compactCheckpointsMagic):], size)
+		return checkpoints
+	}
+	valid := encode(2, blobHeaderSize+2*packedCheckpointSize)
+	if _, err := decodeCheckpoints(Gzip, valid); err != nil {
+		t.Fatalf("failed to decode valid checkpoints: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		checkpoints []byte
+	}{
+		{
+			name:        "truncated header",
+			checkpoints: valid[:compactCheckpointsHeaderSize-1],
+		},
+		{
+			name:        "truncated data",
+			checkpoints: valid[:len(valid)-4],
+		},
+		{
+			name:        "zero size",
+			checkpoints: append(append([]byte{}, valid[:len(compactCheckpointsMagic)]...), append(make([]byte, 8), valid[compactCheckpointsHeaderSize:]...)...),
+		},
+		{
+			name:        "size smaller than the data",
+			checkpoints: withSize(valid, blobHeaderSize+packedCheckpointSize),
+		},
+		{
+			name:        "size larger than the data",
+			checkpoints: withSize(encode(3, blobHeaderSize+2*packedCheckpointSize), blobHeaderSize+3*packedCheckpointSize),
+		},
+		{
+			name:        "size not matching the number of checkpoints",
+			checkpoints: withSize(valid, blobHeaderSize+10*packedCheckpointSize),
+		},
+		{
+			name:        "huge size",
+			checkpoints: withSize(valid, 1<<40),
+		},
+		{
+			name:        "negative size",
+			checkpoints: withSize(valid, 1<<63),
+		},
+		{
+			name:        "too many checkpoints",
+			checkpoints: withSize(encode(maxCompactCheckpoints+1, blobHeaderSize), blobHeaderSize+(maxCompactCheckpoints+1)*packedCheckpointSize),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decodeCheckpoints(Gzip, tc.checkpoints); err == nil {
+				t.Fatalf("expect error, actual: nil")
+			}
+		})
+	}
+}
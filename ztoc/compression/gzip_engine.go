@@ -0,0 +1,74 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"fmt"
+)
+
+// GzipEngine is an implementation of the gzip zinfo. All engines generate and
+// consume the same checkpoint format, so they can be used interchangeably.
+type GzipEngine string
+
+const (
+	// GzipEngineCgo is the zlib based C implementation (`GzipZinfo`).
+	// It is only available when built with cgo.
+	GzipEngineCgo GzipEngine = "cgo"
+	// GzipEngineGo is the pure Go implementation (`GoGzipZinfo`).
+	GzipEngineGo GzipEngine = "go"
+)
+
+// gzipEngine is the engine used by `NewZinfo` and `NewZinfoFromFile`.
+// It defaults to the C implementation if built with cgo, and to the
+// pure Go implementation otherwise.
+var gzipEngine = defaultGzipEngine
+
+// SetGzipEngine sets the engine used to build and read gzip zinfo. It's
+// not safe to call it concurrently with other functions of this package,
+// so it should be called during initialization.
+func SetGzipEngine(engine GzipEngine) error {
+	switch engine {
+	case GzipEngineCgo:
+		if !cgoGzipEngineAvailable {
+			return fmt.Errorf("gzip engine %q is not available: built without cgo", engine)
+		}
+	case GzipEngineGo:
+	default:
+		return fmt.Errorf("unknown gzip engine: %q", engine)
+	}
+	gzipEngine = engine
+	return nil
+}
+
+// CurrentGzipEngine returns the engine used to build and read gzip zinfo.
+func CurrentGzipEngine() GzipEngine {
+	return gzipEngine
+}
+
+func newGzipZinfoWithEngine(engine GzipEngine, zinfoBytes []byte) (Zinfo, error) {
+	if engine == GzipEngineGo {
+		return newGoGzipZinfo(zinfoBytes)
+	}
+	return newGzipZinfo(zinfoBytes)
+}
+
+func newGzipZinfoFromFileWithEngine(engine GzipEngine, gzipFile string, spanSize int64) (Zinfo, error) {
+	if engine == GzipEngineGo {
+		return newGoGzipZinfoFromFile(gzipFile, spanSize)
+	}
+	return newGzipZinfoFromFile(gzipFile, spanSize)
+}
@@ -0,0 +1,662 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+// This file contains a DEFLATE (RFC 1951) decoder used by `GoGzipZinfo`.
+// `compress/flate` can't be used since we need to stop at every block boundary,
+// know the exact bit position in the compressed stream and resume decompression
+// from the middle of a stream given a 32 KiB dictionary, the same way
+// gzip_zinfo.c uses zlib's `inflate(Z_BLOCK)`, `inflatePrime` and `inflateSetDictionary`.
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// winSize is the size of the deflate history window.
+	winSize = 32768
+	// maxCodeBits is the max length of a deflate huffman code.
+	maxCodeBits = 15
+
+	gzipID1      = 0x1f
+	gzipID2      = 0x8b
+	gzipDeflate  = 8
+	gzipFlagHcrc = 1 << 1
+	gzipFlagExtr = 1 << 2
+	gzipFlagName = 1 << 3
+	gzipFlagComm = 1 << 4
+)
+
+var (
+	errInflateStop = errors.New("inflate stopped")
+
+	// codeLengthOrder is the order of code length code lengths in a dynamic block header.
+	codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	lengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	fixedLiteral, fixedDistance = fixedHuffman()
+)
+
+// byteReader is the compressed input of `inflater`.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// bitReader reads a deflate stream LSB first and keeps track of how many bytes
+// have been read from the underlying reader.
+type bitReader struct {
+	r     byteReader
+	n     int64  // number of bytes read from `r`
+	hold  uint64 // bits read from `r` but not consumed yet
+	nbits uint   // number of bits in `hold`
+}
+
+// offset returns the offset of the first byte that hasn't been (even partially)
+// consumed and the number of unconsumed bits in the byte before it.
+func (b *bitReader) offset() (Offset, uint8) {
+	return Offset(b.n - int64(b.nbits/8)), uint8(b.nbits % 8)
+}
+
+// prime inserts `n` bits in `value` as the next bits to consume.
+func (b *bitReader) prime(n uint, value uint64) {
+	b.hold = value & (1<<n - 1)
+	b.nbits = n
+}
+
+func (b *bitReader) need(n uint) error {
+	for b.nbits < n {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		b.hold |= uint64(c) << b.nbits
+		b.nbits += 8
+		b.n++
+	}
+	return nil
+}
+
+// tryNeed is like `need` but doesn't fail if the input ends.
+func (b *bitReader) tryNeed(n uint) error {
+	err := b.need(n)
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+func (b *bitReader) bits(n uint) (int, error) {
+	if err := b.need(n); err != nil {
+		return 0, err
+	}
+	v := int(b.hold & (1<<n - 1))
+	b.hold >>= n
+	b.nbits -= n
+	return v, nil
+}
+
+// alignToByte drops the bits left in a partially consumed byte.
+func (b *bitReader) alignToByte() {
+	b.hold >>= b.nbits % 8
+	b.nbits -= b.nbits % 8
+}
+
+// readFull fills `p` with the next bytes, which must start at a byte boundary.
+func (b *bitReader) readFull(p []byte) error {
+	i := 0
+	for ; i < len(p) && b.nbits > 0; i++ {
+		p[i] = byte(b.hold)
+		b.hold >>= 8
+		b.nbits -= 8
+	}
+	n, err := io.ReadFull(b.r, p[i:])
+	b.n += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// huffman is a canonical huffman decoding table indexed by the next `maxLen`
+// bits of input. Each entry is `symbol<<4 | length`; 0 marks an invalid code.
+type huffman struct {
+	table  []uint16
+	maxLen uint
+}
+
+// init builds the table from code lengths. Like zlib, an incomplete code is only
+// accepted if `allowIncomplete` is true and the code has a single symbol of length 1.
+func (h *huffman) init(lengths []uint8, allowIncomplete bool) error {
+	var count [maxCodeBits + 1]int
+	h.maxLen = 0
+	for _, l := range lengths {
+		count[l]++
+		if uint(l) > h.maxLen {
+			h.maxLen = uint(l)
+		}
+	}
+	count[0] = 0
+
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= count[l]
+		if left < 0 {
+			return errors.New("over-subscribed huffman code")
+		}
+	}
+	if h.maxLen > 0 && left > 0 && (!allowIncomplete || h.maxLen != 1) {
+		return errors.New("incomplete huffman code")
+	}
+
+	size := 1 << h.maxLen
+	if cap(h.table) < size {
+		h.table = make([]uint16, size)
+	}
+	h.table = h.table[:size]
+	for i := range h.table {
+		h.table[i] = 0
+	}
+
+	var nextCode [maxCodeBits + 2]int
+	code := 0
+	for l := 1; l <= maxCodeBits; l++ {
+		code = (code + count[l-1]) << 1
+		nextCode[l] = code
+	}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := nextCode[l]
+		nextCode[l]++
+		// deflate codes are packed MSB first, so reverse them to index by the LSB first input.
+		rev := 0
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | (c>>i)&1
+		}
+		for i := rev; i < size; i += 1 << l {
+			h.table[i] = uint16(sym<<4) | uint16(l)
+		}
+	}
+	return nil
+}
+
+func fixedHuffman() (*huffman, *huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	literal := new(huffman)
+	if err := literal.init(lengths[:], false); err != nil {
+		panic(err)
+	}
+
+	var distLengths [32]uint8
+	for i := range distLengths {
+		distLengths[i] = 5
+	}
+	distance := new(huffman)
+	if err := distance.init(distLengths[:], false); err != nil {
+		panic(err)
+	}
+	return literal, distance
+}
+
+func (b *bitReader) decode(h *huffman) (int, error) {
+	if h.maxLen == 0 {
+		return 0, errors.New("invalid code")
+	}
+	if err := b.tryNeed(h.maxLen); err != nil {
+		return 0, err
+	}
+	e := h.table[b.hold&(1<<h.maxLen-1)]
+	l := uint(e & 15)
+	if l > b.nbits {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if l == 0 {
+		return 0, errors.New("invalid code")
+	}
+	b.hold >>= l
+	b.nbits -= l
+	return int(e >> 4), nil
+}
+
+// inflater decompresses a raw deflate stream one block at a time. The last 32 KiB
+// of uncompressed data is kept in a circular `window` (the same way zran.c does),
+// so that it can be saved in a checkpoint. Uncompressed data is passed to `sink`
+// as it is produced.
+type inflater struct {
+	br bitReader
+
+	window [winSize]byte
+	wpos   int   // next write position in `window`
+	flushd int   // start of the part of `window` not passed to `sink` yet
+	have   int   // number of valid bytes of history in `window`
+	out    int64 // total number of uncompressed bytes
+
+	// sink receives the uncompressed data. It may return `errInflateStop` to stop inflating.
+	sink func([]byte) error
+
+	literal, distance huffman
+	lengths           [286 + 30]uint8
+}
+
+func newInflater(r byteReader, sink func([]byte) error) *inflater {
+	return &inflater{
+		br:   bitReader{r: r},
+		sink: sink,
+	}
+}
+
+// setDictionary sets the 32 KiB of uncompressed data preceding the current position.
+func (f *inflater) setDictionary(dict []byte) {
+	copy(f.window[:], dict)
+	f.wpos = 0
+	f.flushd = 0
+	f.have = winSize
+}
+
+// checkpointWindow returns the last 32 KiB of uncompressed data, oldest first.
+// If less than 32 KiB has been produced, it's padded with leading zeros.
+func (f *inflater) checkpointWindow() []byte {
+	window := make([]byte, winSize)
+	n := copy(window, f.window[f.wpos:])
+	copy(window[n:], f.window[:f.wpos])
+	return window
+}
+
+func (f *inflater) flush() error {
+	if f.flushd == f.wpos {
+		return nil
+	}
+	p := f.window[f.flushd:f.wpos]
+	f.flushd = f.wpos
+	if f.sink == nil {
+		return nil
+	}
+	return f.sink(p)
+}
+
+func (f *inflater) put(c byte) error {
+	f.window[f.wpos] = c
+	f.wpos++
+	f.out++
+	if f.have < winSize {
+		f.have++
+	}
+	if f.wpos == winSize {
+		if err := f.flush(); err != nil {
+			return err
+		}
+		f.wpos = 0
+		f.flushd = 0
+	}
+	return nil
+}
+
+// block decodes the next deflate block and returns whether it was the final one.
+func (f *inflater) block() (bool, error) {
+	header, err := f.br.bits(3)
+	if err != nil {
+		return false, err
+	}
+	final := header&1 != 0
+
+	switch header >> 1 {
+	case 0:
+		err = f.stored()
+	case 1:
+		err = f.huffmanBlock(fixedLiteral, fixedDistance)
+	case 2:
+		if err = f.dynamicTables(); err == nil {
+			err = f.huffmanBlock(&f.literal, &f.distance)
+		}
+	default:
+		err = errors.New("invalid block type")
+	}
+	if err != nil {
+		return false, err
+	}
+	return final, f.flush()
+}
+
+func (f *inflater) stored() error {
+	f.br.alignToByte()
+	length, err := f.br.bits(16)
+	if err != nil {
+		return err
+	}
+	nlength, err := f.br.bits(16)
+	if err != nil {
+		return err
+	}
+	if length != ^nlength&0xffff {
+		return errors.New("invalid stored block lengths")
+	}
+	for length > 0 {
+		n := winSize - f.wpos
+		if n > length {
+			n = length
+		}
+		if err := f.br.readFull(f.window[f.wpos : f.wpos+n]); err != nil {
+			return err
+		}
+		length -= n
+		f.wpos += n
+		f.out += int64(n)
+		if f.have += n; f.have > winSize {
+			f.have = winSize
+		}
+		if f.wpos == winSize {
+			if err := f.flush(); err != nil {
+				return err
+			}
+			f.wpos = 0
+			f.flushd = 0
+		}
+	}
+	return nil
+}
+
+func (f *inflater) dynamicTables() error {
+	nlen, err := f.br.bits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := f.br.bits(5)
+	if err != nil {
+		return err
+	}
+	ncode, err := f.br.bits(4)
+	if err != nil {
+		return err
+	}
+	nlen += 257
+	ndist++
+	ncode += 4
+	if nlen > 286 || ndist > 30 {
+		return errors.New("too many length or distance symbols")
+	}
+
+	var codeLengths [19]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := f.br.bits(3)
+		if err != nil {
+			return err
+		}
+		codeLengths[codeLengthOrder[i]] = uint8(l)
+	}
+	var codes huffman
+	if err := codes.init(codeLengths[:], false); err != nil {
+		return fmt.Errorf("invalid code lengths set: %w", err)
+	}
+
+	lengths := f.lengths[:nlen+ndist]
+	for i := 0; i < len(lengths); {
+		sym, err := f.br.decode(&codes)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var value uint8
+		var repeat int
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errors.New("invalid bit length repeat")
+			}
+			value = lengths[i-1]
+			repeat, err = f.br.bits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.br.bits(3)
+			repeat += 3
+		default:
+			repeat, err = f.br.bits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+repeat > len(lengths) {
+			return errors.New("invalid bit length repeat")
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return errors.New("invalid code -- missing end-of-block")
+	}
+	if err := f.literal.init(lengths[:nlen], true); err != nil {
+		return fmt.Errorf("invalid literal/lengths set: %w", err)
+	}
+	if err := f.distance.init(lengths[nlen:], true); err != nil {
+		return fmt.Errorf("invalid distances set: %w", err)
+	}
+	return nil
+}
+
+func (f *inflater) huffmanBlock(literal, distance *huffman) error {
+	for {
+		sym, err := f.br.decode(literal)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			if err := f.put(byte(sym)); err != nil {
+				return err
+			}
+			continue
+		}
+		if sym == 256 {
+			return nil
+		}
+
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errors.New("invalid literal/length code")
+		}
+		extra, err := f.br.bits(lengthExtra[sym])
+		if err != nil {
+			return err
+		}
+		length := lengthBase[sym] + extra
+
+		dsym, err := f.br.decode(distance)
+		if err != nil {
+			return err
+		}
+		if dsym >= len(distBase) {
+			return errors.New("invalid distance code")
+		}
+		extra, err = f.br.bits(distExtra[dsym])
+		if err != nil {
+			return err
+		}
+		dist := distBase[dsym] + extra
+		if dist > f.have {
+			return errors.New("invalid distance too far back")
+		}
+
+		src := (f.wpos - dist + winSize) % winSize
+		for ; length > 0; length-- {
+			if err := f.put(f.window[src]); err != nil {
+				return err
+			}
+			src = (src + 1) % winSize
+		}
+	}
+}
+
+// readGzipHeader reads and validates a gzip member header (RFC 1952).
+func readGzipHeader(br *bitReader) error {
+	crc := crc32.NewIEEE()
+	readByte := func() (byte, error) {
+		c, err := br.bits(8)
+		crc.Write([]byte{byte(c)})
+		return byte(c), err
+	}
+	readBytes := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := readByte(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	readZeroTerminated := func() error {
+		for {
+			c, err := readByte()
+			if err != nil {
+				return err
+			}
+			if c == 0 {
+				return nil
+			}
+		}
+	}
+
+	var fixed [10]byte
+	for i := range fixed {
+		c, err := readByte()
+		if err != nil {
+			return err
+		}
+		fixed[i] = c
+	}
+	if fixed[0] != gzipID1 || fixed[1] != gzipID2 {
+		return errors.New("incorrect header check")
+	}
+	if fixed[2] != gzipDeflate {
+		return errors.New("unknown compression method")
+	}
+	flags := fixed[3]
+	if flags&0xe0 != 0 {
+		return errors.New("unknown header flags set")
+	}
+
+	if flags&gzipFlagExtr != 0 {
+		lo, err := readByte()
+		if err != nil {
+			return err
+		}
+		hi, err := readByte()
+		if err != nil {
+			return err
+		}
+		if err := readBytes(int(lo) | int(hi)<<8); err != nil {
+			return err
+		}
+	}
+	if flags&gzipFlagName != 0 {
+		if err := readZeroTerminated(); err != nil {
+			return err
+		}
+	}
+	if flags&gzipFlagComm != 0 {
+		if err := readZeroTerminated(); err != nil {
+			return err
+		}
+	}
+	if flags&gzipFlagHcrc != 0 {
+		expected := crc.Sum32() & 0xffff
+		hcrc, err := br.bits(16)
+		if err != nil {
+			return err
+		}
+		if uint32(hcrc) != expected {
+			return errors.New("header crc mismatch")
+		}
+	}
+	return nil
+}
+
+// nextGzipMember skips the trailer of the current gzip member and reads the header
+// of the next one, so that a stream made of several gzip members (e.g. an eStargz
+// layer) can be inflated as a whole. It returns false if the stream ends instead.
+func nextGzipMember(br *bitReader) (bool, error) {
+	br.alignToByte()
+	for i := 0; i < 2; i++ {
+		if _, err := br.bits(32); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	if err := br.tryNeed(8); err != nil {
+		return false, err
+	}
+	if br.nbits == 0 {
+		return false, nil
+	}
+	if err := readGzipHeader(br); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readGzipTrailer reads the gzip member trailer and validates it against
+// the crc32 and size of the uncompressed data.
+func readGzipTrailer(br *bitReader, crc uint32, size int64) error {
+	br.alignToByte()
+	check, err := br.bits(32)
+	if err != nil {
+		return err
+	}
+	if uint32(check) != crc {
+		return errors.New("incorrect data check")
+	}
+	length, err := br.bits(32)
+	if err != nil {
+		return err
+	}
+	if uint32(length) != uint32(size) {
+		return errors.New("incorrect length check")
+	}
+	return nil
+}
@@ -1,3 +1,5 @@
+//go:build cgo
+
 /*
    Copyright The Soci Snapshotter Authors.
 
@@ -306,8 +308,24 @@ int generate_zinfo_from_file(const char *filepath, offset_t span, struct gzip_zi
     return ret;
 }
 
+/* next_member is called once inflate reaches the end of a gzip member while extracting
+   data, so that a stream made of several gzip members (e.g. an eStargz layer) can be
+   inflated as a whole. `*trailer` is the number of bytes of the trailer of the first
+   member that are left to skip, since inflate doesn't consume it in raw mode. Returns 1
+   once the next member can be inflated, or 0 if more input is needed first. */
+static int next_member(z_stream *strm, int *trailer) {
+    unsigned n = strm->avail_in < (unsigned)*trailer ? strm->avail_in : (unsigned)*trailer;
+    strm->next_in += n;
+    strm->avail_in -= n;
+    *trailer -= n;
+    if (*trailer > 0)
+        return 0;
+    (void)inflateReset2(strm, 31); /* gzip decoding, which consumes the trailers */
+    return 1;
+}
+
 int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, void *buffer, int len) {
-    int ret, skip;
+    int ret, skip, member_end = 0, trailer = 8;
     z_stream strm;
     struct gzip_checkpoint *here;
     unsigned char input[CHUNK], discard[WINSIZE];
@@ -369,18 +387,29 @@ int extract_data_from_fp(FILE *in, struct gzip_zinfo *index, offset_t offset, vo
                     goto extract_ret;
                 }
                 if (strm.avail_in == 0) {
+                    if (member_end) {       /* the last member has ended */
+                        ret = Z_STREAM_END;
+                        break;
+                    }
                     ret = Z_DATA_ERROR;
                     goto extract_ret;
                 }
                 strm.next_in = input;
             }
+            if (member_end) {
+                if (!next_member(&strm, &trailer))
+                    continue;
+                member_end = 0;
+            }
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {      /* the data may continue in another member */
+                member_end = 1;
+                ret = Z_OK;
+            }
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -413,7 +442,7 @@ int extract_data_from_file(const char* file, struct gzip_zinfo* index, offset_t
 int extract_data_from_buffer(void *d, offset_t datalen,
                              struct gzip_zinfo *index, offset_t offset,
                              void *buffer, offset_t len, int first_checkpoint) {
-    int ret, skip;
+    int ret, skip, member_end = 0, trailer = 8;
     z_stream strm;
     unsigned char input[CHUNK], discard[WINSIZE];
     uchar *buf = buffer;
@@ -460,19 +489,30 @@ int extract_data_from_buffer(void *d, offset_t datalen,
         do {
             if (strm.avail_in == 0) {
                 int read = min(remaining, CHUNK);
+                if (read == 0 && member_end) { /* the last member has ended */
+                    ret = Z_STREAM_END;
+                    break;
+                }
                 remaining -= read;
                 memcpy(input, data, read);
                 data += read;
                 strm.avail_in = read;
                 strm.next_in = input;
             }
+            if (member_end) {
+                if (!next_member(&strm, &trailer))
+                    continue;
+                member_end = 0;
+            }
             ret = inflate(&strm, Z_NO_FLUSH); /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) { /* the data may continue in another member */
+                member_end = 1;
+                ret = Z_OK;
+            }
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -1,3 +1,5 @@
+//go:build cgo
+
 /*
    Copyright The Soci Snapshotter Authors.
 
@@ -28,6 +30,11 @@ import (
 	"unsafe"
 )
 
+const (
+	defaultGzipEngine      = GzipEngineCgo
+	cgoGzipEngineAvailable = true
+)
+
 // GzipZinfo is a go struct wrapper of the gzip zinfo's C implementation.
 type GzipZinfo struct {
 	cZinfo *C.struct_gzip_zinfo
@@ -0,0 +1,216 @@
+//go:build cgo
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+)
+
+// TestGzipEnginesCompatibility verifies that the C and Go gzip engines generate
+// byte-identical zinfo and that each engine can extract data using the zinfo
+// generated by the other one.
+func TestGzipEnginesCompatibility(t *testing.T) {
+	t.Parallel()
+	for _, input := range gzipTestInputs(t) {
+		for _, spanSize := range []int64{1, 10000, 65535, 1 << 20} {
+			input, spanSize := input, spanSize
+			t.Run(fmt.Sprintf("%s/span size %d", input.name, spanSize), func(t *testing.T) {
+				filename := writeTempFile(t, input.compressed)
+				cZinfo, err := newGzipZinfoFromFile(filename, spanSize)
+				if err != nil {
+					t.Fatalf("failed to build gzip zinfo with the C engine: %v", err)
+				}
+				defer cZinfo.Close()
+				goZinfo, err := newGoGzipZinfoFromFile(filename, spanSize)
+				if err != nil {
+					t.Fatalf("failed to build gzip zinfo with the Go engine: %v", err)
+				}
+
+				cBytes, err := cZinfo.Bytes()
+				if err != nil {
+					t.Fatalf("failed to serialize C zinfo: %v", err)
+				}
+				goBytes, err := goZinfo.Bytes()
+				if err != nil {
+					t.Fatalf("failed to serialize Go zinfo: %v", err)
+				}
+				if !bytes.Equal(cBytes, goBytes) {
+					t.Fatalf("zinfo generated by the engines differ. C: %d bytes, %d spans; Go: %d bytes, %d spans",
+						len(cBytes), cZinfo.MaxSpanID()+1, len(goBytes), goZinfo.MaxSpanID()+1)
+				}
+
+				fromC, err := newGoGzipZinfo(cBytes)
+				if err != nil {
+					t.Fatalf("failed to load C zinfo with the Go engine: %v", err)
+				}
+				verifyGzipZinfo(t, fromC, filename, input)
+
+				fromGo, err := newGzipZinfo(goBytes)
+				if err != nil {
+					t.Fatalf("failed to load Go zinfo with the C engine: %v", err)
+				}
+				defer fromGo.Close()
+				verifyGzipZinfo(t, fromGo, filename, input)
+				compareGzipSpanOffsets(t, fromC, fromGo, Offset(len(input.compressed)), Offset(len(input.uncompressed)))
+			})
+		}
+	}
+}
+
+// TestGzipEnginesCompatibilityV1 verifies that both engines read and write
+// v1 zinfo, which doesn't serialize the first checkpoint, the same way.
+func TestGzipEnginesCompatibilityV1(t *testing.T) {
+	t.Parallel()
+	for _, input := range gzipTestInputs(t) {
+		input := input
+		t.Run(input.name, func(t *testing.T) {
+			filename := writeTempFile(t, input.compressed)
+			goZinfo, err := newGoGzipZinfoFromFile(filename, 65535)
+			if err != nil {
+				t.Fatalf("failed to build gzip zinfo: %v", err)
+			}
+			if goZinfo.checkpoints[0].in != 10 {
+				t.Skip("v1 zinfo requires a 10 bytes gzip header")
+			}
+			goZinfo.version = gzipZinfoVersionOne
+			v1Bytes, err := goZinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize v1 zinfo: %v", err)
+			}
+
+			cZinfo, err := newGzipZinfo(v1Bytes)
+			if err != nil {
+				t.Fatalf("failed to load v1 zinfo with the C engine: %v", err)
+			}
+			defer cZinfo.Close()
+			cBytes, err := cZinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize v1 zinfo with the C engine: %v", err)
+			}
+			if !bytes.Equal(v1Bytes, cBytes) {
+				t.Fatalf("v1 zinfo is not preserved by the C engine")
+			}
+
+			fromV1, err := newGoGzipZinfo(v1Bytes)
+			if err != nil {
+				t.Fatalf("failed to load v1 zinfo with the Go engine: %v", err)
+			}
+			compareGzipSpanOffsets(t, cZinfo, fromV1, Offset(len(input.compressed)), Offset(len(input.uncompressed)))
+			verifyGzipZinfo(t, fromV1, filename, input)
+		})
+	}
+}
+
+// TestGzipZinfoFromMembers verifies that both engines extract data using the zinfo
+// of a stream made of several gzip members, whose spans start at the members.
+func TestGzipZinfoFromMembers(t *testing.T) {
+	t.Parallel()
+	chunks := [][]byte{gzipTestData(50000, true), gzipTestData(70000, false), nil, gzipTestData(1000, true), gzipTestData(200000, true)}
+	header := &gzip.Header{Name: "foo", Extra: []byte("bar")}
+	var (
+		input   = gzipTestInput{name: "members"}
+		members []GzipMember
+	)
+	for i, chunk := range chunks {
+		members = append(members, GzipMember{
+			CompressedOffset:   Offset(len(input.compressed)),
+			UncompressedOffset: Offset(len(input.uncompressed)),
+		})
+		h := header
+		if i%2 == 0 {
+			h = nil
+		}
+		input.compressed = append(input.compressed, gzipCompress(t, chunk, gzip.DefaultCompression, h, 0)...)
+		input.uncompressed = append(input.uncompressed, chunk...)
+	}
+	filename := writeTempFile(t, input.compressed)
+
+	for _, spanSize := range []int64{1, 60000, 1 << 20} {
+		spanSize := spanSize
+		t.Run(fmt.Sprintf("span size %d", spanSize), func(t *testing.T) {
+			zinfo, err := NewGzipZinfoFromMembers(bytes.NewReader(input.compressed), spanSize, members)
+			if err != nil {
+				t.Fatalf("failed to build gzip zinfo from members: %v", err)
+			}
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize zinfo: %v", err)
+			}
+			for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+				start := zinfo.StartUncompressedOffset(id)
+				found := false
+				for _, m := range members {
+					found = found || m.UncompressedOffset == start
+				}
+				if !found {
+					t.Fatalf("span %d starts at %d, which is not the start of a member", id, start)
+				}
+			}
+
+			goZinfo, err := newGoGzipZinfo(b)
+			if err != nil {
+				t.Fatalf("failed to load zinfo with the Go engine: %v", err)
+			}
+			verifyGzipZinfo(t, goZinfo, filename, input)
+			cZinfo, err := newGzipZinfo(b)
+			if err != nil {
+				t.Fatalf("failed to load zinfo with the C engine: %v", err)
+			}
+			defer cZinfo.Close()
+			verifyGzipZinfo(t, cZinfo, filename, input)
+		})
+	}
+
+	t.Run("invalid members", func(t *testing.T) {
+		for _, invalid := range [][]GzipMember{
+			nil,
+			{{CompressedOffset: 0, UncompressedOffset: 10}},
+			{members[0], members[2], members[1]},
+			{members[0], {CompressedOffset: members[1].CompressedOffset + 1, UncompressedOffset: members[1].UncompressedOffset}},
+		} {
+			if _, err := NewGzipZinfoFromMembers(bytes.NewReader(input.compressed), 1, invalid); err == nil {
+				t.Fatalf("expect error for members %v, actual: nil", invalid)
+			}
+		}
+	})
+}
+
+func compareGzipSpanOffsets(t *testing.T, expected, actual Zinfo, compressedSize, uncompressedSize Offset) {
+	if expected.MaxSpanID() != actual.MaxSpanID() {
+		t.Fatalf("unexpected max span id. expect: %d, actual: %d", expected.MaxSpanID(), actual.MaxSpanID())
+	}
+	if expected.SpanSize() != actual.SpanSize() {
+		t.Fatalf("unexpected span size. expect: %d, actual: %d", expected.SpanSize(), actual.SpanSize())
+	}
+	for id := SpanID(0); id <= expected.MaxSpanID(); id++ {
+		if expected.StartCompressedOffset(id) != actual.StartCompressedOffset(id) ||
+			expected.EndCompressedOffset(id, compressedSize) != actual.EndCompressedOffset(id, compressedSize) ||
+			expected.StartUncompressedOffset(id) != actual.StartUncompressedOffset(id) ||
+			expected.EndUncompressedOffset(id, uncompressedSize) != actual.EndUncompressedOffset(id, uncompressedSize) {
+			t.Fatalf("span %d offsets differ between engines", id)
+		}
+		offset := expected.StartUncompressedOffset(id)
+		if expected.UncompressedOffsetToSpanID(offset) != actual.UncompressedOffsetToSpanID(offset) {
+			t.Fatalf("offset %d is mapped to different spans", offset)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	gzipZinfoVersionOne = 1
+
+	// packedCheckpointSize is the size of a serialized checkpoint:
+	// compressed offset (8 bytes), uncompressed offset (8 bytes), bits (1 byte) and window.
+	packedCheckpointSize = 8 + 8 + 1 + winSize
+	// blobHeaderSize is the size of the serialized zinfo header:
+	// number of checkpoints (4 bytes) and span size (8 bytes).
+	blobHeaderSize = 4 + 8
+
+	// gzipReadBufferSize is the size of the buffer used to read gzip files.
+	gzipReadBufferSize = 1 << 16
+)
+
+// gzipCheckpoint is the state of the decompressor at the start of a span.
+type gzipCheckpoint struct {
+	in     Offset // offset in the compressed stream of the first full byte of the span
+	out    Offset // offset in the uncompressed stream
+	bits   uint8  // number of bits (1-7) of the span in the byte at `in - 1`, or 0
+	window []byte // preceding 32 KiB of uncompressed data
+}
+
+// GoGzipZinfo is a pure Go implementation of the gzip zinfo. It generates and
+// consumes exactly the same checkpoint format as the C implementation (`GzipZinfo`),
+// so zinfo created by either of them can be used by the other.
+type GoGzipZinfo struct {
+	version     int32
+	spanSize    int64
+	checkpoints []gzipCheckpoint
+}
+
+// newGoGzipZinfo creates a new instance of `GoGzipZinfo` from a serialized zinfo,
+// following the same rules as `blob_to_zinfo` in gzip_zinfo.c.
+func newGoGzipZinfo(zinfoBytes []byte) (*GoGzipZinfo, error) {
+	if len(zinfoBytes) == 0 {
+		return nil, fmt.Errorf("empty checkpoints")
+	}
+	if len(zinfoBytes) < blobHeaderSize {
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	numCheckpoints := int32(binary.LittleEndian.Uint32(zinfoBytes[0:4]))
+	spanSize := int64(binary.LittleEndian.Uint64(zinfoBytes[4:12]))
+
+	// the number of checkpoints in the header determines the version: v2 blobs
+	// contain all checkpoints, v1 blobs skip the first one.
+	claimedSize := int64(packedCheckpointSize)*int64(numCheckpoints) + blobHeaderSize
+	var version int32
+	switch int64(len(zinfoBytes)) {
+	case claimedSize:
+		version = zinfoVersion
+	case claimedSize - packedCheckpointSize:
+		version = gzipZinfoVersionOne
+	default:
+		return nil, fmt.Errorf("cannot convert blob to gzip_zinfo")
+	}
+
+	zinfo := &GoGzipZinfo{
+		version:     version,
+		spanSize:    spanSize,
+		checkpoints: make([]gzipCheckpoint, numCheckpoints),
+	}
+	first := 0
+	if version == gzipZinfoVersionOne {
+		// v1 assumed the first checkpoint is always right after a 10 bytes gzip header.
+		zinfo.checkpoints[0] = gzipCheckpoint{in: 10, window: make([]byte, winSize)}
+		first = 1
+	}
+
+	cur := zinfoBytes[blobHeaderSize:]
+	for i := first; i < len(zinfo.checkpoints); i++ {
+		zinfo.checkpoints[i] = gzipCheckpoint{
+			in:     Offset(binary.LittleEndian.Uint64(cur[0:8])),
+			out:    Offset(binary.LittleEndian.Uint64(cur[8:16])),
+			bits:   cur[16],
+			window: cur[17:packedCheckpointSize],
+		}
+		cur = cur[packedCheckpointSize:]
+	}
+	return zinfo, nil
+}
+
+// newGoGzipZinfoFromFile creates a new instance of `GoGzipZinfo` given gzip file name and span size.
+func newGoGzipZinfoFromFile(gzipFile string, spanSize int64) (*GoGzipZinfo, error) {
+	f, err := os.Open(gzipFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate gzip zinfo: %w", err)
+	}
+	defer f.Close()
+	return newGoGzipZinfoFromReader(bufio.NewReaderSize(f, gzipReadBufferSize), io.Discard, spanSize, nil)
+}
+
+// newGoGzipZinfoFromReader creates a new instance of `GoGzipZinfo` from a gzip stream,
+// writing the uncompressed data to `w`. Like zran.c, a checkpoint is created at the end
+// of the gzip header and then at the first deflate block boundary after every `spanSize`
+// bytes of uncompressed data. Only the first gzip member is indexed.
+func newGoGzipZinfoFromReader(r byteReader, w io.Writer, spanSize int64, onSpan SpanFunc) (*GoGzipZinfo, error) {
+	return buildGoGzipZinfo(r, w, spanSize, onSpan, nil)
+}
+
+// newGoGzipZinfoFromFileWithSpanBoundaries creates a new instance of `GoGzipZinfo` given gzip
+// file name and span size, only starting spans at block boundaries allowed by `canSplit`.
+func newGoGzipZinfoFromFileWithSpanBoundaries(gzipFile string, spanSize int64, canSplit SpanBoundaryFunc) (*GoGzipZinfo, error) {
+	f, err := os.Open(gzipFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate gzip zinfo: %w", err)
+	}
+	defer f.Close()
+	return buildGoGzipZinfo(bufio.NewReaderSize(f, gzipReadBufferSize), io.Discard, spanSize, nil, canSplit)
+}
+
+// GzipMember is the start of a gzip member in a stream made of several gzip members.
+type GzipMember struct {
+	CompressedOffset   Offset // offset of the header of the member in the compressed stream
+	UncompressedOffset Offset // offset of the first byte of the member in the uncompressed stream
+}
+
+// NewGzipZinfoFromMembers creates a gzip zinfo for a stream made of several gzip members
+// (e.g. an eStargz layer) without decompressing it. Spans can only start at the start of
+// one of `members`, which must be sorted and begin with the first member of the stream.
+// A span starts at the first member after every `spanSize` bytes of uncompressed data.
+// Since a gzip member doesn't refer to any data before it, the checkpoints have an empty
+// window. The zinfo can be used with any gzip engine.
+func NewGzipZinfoFromMembers(r io.ReaderAt, spanSize int64, members []GzipMember) (Zinfo, error) {
+	if len(members) == 0 || members[0].UncompressedOffset != 0 {
+		return nil, fmt.Errorf("could not generate gzip zinfo: the first member must start the stream")
+	}
+	zinfo := &GoGzipZinfo{
+		version:  zinfoVersion,
+		spanSize: spanSize,
+	}
+	var last Offset
+	for i, m := range members {
+		if i > 0 && (m.CompressedOffset <= members[i-1].CompressedOffset || m.UncompressedOffset < members[i-1].UncompressedOffset) {
+			return nil, fmt.Errorf("could not generate gzip zinfo: members are not sorted")
+		}
+		if i > 0 && int64(m.UncompressedOffset-last) <= spanSize {
+			continue
+		}
+		// the span starts right after the header of the member.
+		br := bitReader{r: bufio.NewReader(io.NewSectionReader(r, int64(m.CompressedOffset), math.MaxInt64-int64(m.CompressedOffset)))}
+		if err := readGzipHeader(&br); err != nil {
+			return nil, fmt.Errorf("could not generate gzip zinfo: invalid gzip member at %d: %w", m.CompressedOffset, err)
+		}
+		zinfo.checkpoints = append(zinfo.checkpoints, gzipCheckpoint{
+			in:     m.CompressedOffset + Offset(br.n),
+			out:    m.UncompressedOffset,
+			window: make([]byte, winSize),
+		})
+		last = m.UncompressedOffset
+	}
+	return zinfo, nil
+}
+
+// buildGoGzipZinfo scans a gzip stream and creates its checkpoints. If `canSplit` is nil,
+// a checkpoint is created at the first block boundary after every `spanSize` bytes of
+// uncompressed data. Otherwise, once a span reaches `spanSize`, it's cut at the last block
+// boundary allowed by `canSplit` instead, or at the next allowed one if there was none.
+// Spans can thus grow much larger than `spanSize` if few block boundaries are allowed.
+// `onSpan` must be nil if `canSplit` is not nil, since a span can start in data that
+// has already been read.
+func buildGoGzipZinfo(r byteReader, w io.Writer, spanSize int64, onSpan SpanFunc, canSplit SpanBoundaryFunc) (*GoGzipZinfo, error) {
+	crc := crc32.NewIEEE()
+	f := newInflater(r, func(p []byte) error {
+		crc.Write(p)
+		_, err := w.Write(p)
+		return err
+	})
+
+	if err := readGzipHeader(&f.br); err != nil {
+		return nil, fmt.Errorf("could not generate gzip zinfo: %w", err)
+	}
+
+	zinfo := &GoGzipZinfo{
+		version:  zinfoVersion,
+		spanSize: spanSize,
+	}
+	var (
+		last int64
+		// candidate is the checkpoint at the last allowed block boundary of the current span.
+		candidate *gzipCheckpoint
+	)
+	addCheckpoint := func(cp gzipCheckpoint) {
+		zinfo.checkpoints = append(zinfo.checkpoints, cp)
+		last = int64(cp.out)
+		candidate = nil
+		if onSpan != nil {
+			spanID := SpanID(len(zinfo.checkpoints) - 1)
+			onSpan(zinfo.StartCompressedOffset(spanID), cp.in)
+		}
+	}
+	checkpoint := func() gzipCheckpoint {
+		in, bits := f.br.offset()
+		return gzipCheckpoint{
+			in:     in,
+			out:    Offset(f.out),
+			bits:   bits,
+			window: f.checkpointWindow(),
+		}
+	}
+	for {
+		// we are at a block boundary, either right after the header or after a non-final block.
+		switch {
+		case f.out == 0:
+			addCheckpoint(checkpoint())
+		case canSplit == nil:
+			if f.out-last > spanSize {
+				addCheckpoint(checkpoint())
+			}
+		case canSplit(Offset(f.out)):
+			if f.out-last > spanSize {
+				addCheckpoint(checkpoint())
+			} else {
+				cp := checkpoint()
+				candidate = &cp
+			}
+		case f.out-last > spanSize && candidate != nil:
+			addCheckpoint(*candidate)
+		}
+
+		final, err := f.block()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate gzip zinfo: %w", err)
+		}
+		if final {
+			break
+		}
+	}
+
+	if err := readGzipTrailer(&f.br, crc.Sum32(), f.out); err != nil {
+		return nil, fmt.Errorf("could not generate gzip zinfo: %w", err)
+	}
+	return zinfo, nil
+}
+
+// Close doesn't do anything since there is nothing to close/release.
+func (i *GoGzipZinfo) Close() {}
+
+// Bytes returns the byte slice containing the zinfo, in the same format as `zinfo_to_blob` in gzip_zinfo.c.
+func (i *GoGzipZinfo) Bytes() ([]byte, error) {
+	first := 0
+	if i.version == gzipZinfoVersionOne {
+		// v1 blobs don't contain the first checkpoint. Keep it that way for backwards compatibility.
+		first = 1
+	}
+	n := len(i.checkpoints) - first
+	if n < 0 {
+		n = 0
+	}
+
+	buf := make([]byte, blobHeaderSize, blobHeaderSize+n*packedCheckpointSize)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(i.checkpoints)))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(i.spanSize))
+
+	var header [17]byte
+	for j := first; j < len(i.checkpoints); j++ {
+		cp := i.checkpoints[j]
+		binary.LittleEndian.PutUint64(header[0:8], uint64(cp.in))
+		binary.LittleEndian.PutUint64(header[8:16], uint64(cp.out))
+		header[16] = cp.bits
+		buf = append(buf, header[:]...)
+		buf = append(buf, cp.window...)
+	}
+	return buf, nil
+}
+
+// MaxSpanID returns the max span ID.
+func (i *GoGzipZinfo) MaxSpanID() SpanID {
+	return SpanID(len(i.checkpoints) - 1)
+}
+
+// SpanSize returns the span size of the constructed ztoc.
+func (i *GoGzipZinfo) SpanSize() Offset {
+	return Offset(i.spanSize)
+}
+
+// UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
+func (i *GoGzipZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
+	// the last checkpoint starting at or before `offset`.
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanID(idx - 1)
+}
+
+// ExtractDataFromBuffer takes in the compressed bytes of the spans starting from `spanID`
+// and returns the decompressed bytes.
+func (i *GoGzipZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset Offset, spanID SpanID) ([]byte, error) {
+	if len(compressedBuf) == 0 {
+		return nil, fmt.Errorf("empty compressed buffer")
+	}
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	if spanID < 0 || spanID > i.MaxSpanID() {
+		return nil, fmt.Errorf("invalid span id: %d", spanID)
+	}
+
+	data := make([]byte, uncompressedSize)
+	n, err := i.extract(bytes.NewReader(compressedBuf), i.checkpoints[spanID], uncompressedOffset, data)
+	if err != nil {
+		return data, fmt.Errorf("error extracting data: %w", err)
+	}
+	if n <= 0 {
+		return data, fmt.Errorf("error extracting data; no data extracted")
+	}
+	return data, nil
+}
+
+// ExtractDataFromFile returns the decompressed bytes given the name of the .tar.gz file,
+// offset and the size in uncompressed stream.
+func (i *GoGzipZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset Offset) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	if len(i.checkpoints) == 0 {
+		return nil, fmt.Errorf("unable to extract data; no checkpoints")
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	defer f.Close()
+
+	spanID := i.UncompressedOffsetToSpanID(uncompressedOffset)
+	if _, err := f.Seek(int64(i.StartCompressedOffset(spanID)), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+
+	data := make([]byte, uncompressedSize)
+	n, err := i.extract(bufio.NewReaderSize(f, gzipReadBufferSize), i.checkpoints[spanID], uncompressedOffset, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract data: %w", err)
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("unable to extract data; no data extracted")
+	}
+	return data, nil
+}
+
+// extract decompresses `r`, which starts at checkpoint `cp` (including the partial byte
+// if `cp.bits != 0`), into `buf` starting from `offset` in the uncompressed stream. It
+// returns the number of bytes written to `buf`, which is less than `len(buf)` if the
+// stream ends first. If a gzip member ends, the data continues with the next member.
+func (i *GoGzipZinfo) extract(r byteReader, cp gzipCheckpoint, offset Offset, buf []byte) (int, error) {
+	if cp.bits > 7 {
+		return 0, fmt.Errorf("invalid number of bits in checkpoint: %d", cp.bits)
+	}
+	skip := int64(offset - cp.out)
+	if skip < 0 {
+		return 0, fmt.Errorf("offset %d is before the checkpoint at %d", offset, cp.out)
+	}
+
+	var n int
+	f := newInflater(r, func(p []byte) error {
+		if skip >= int64(len(p)) {
+			skip -= int64(len(p))
+			return nil
+		}
+		p = p[skip:]
+		skip = 0
+		n += copy(buf[n:], p)
+		if n == len(buf) {
+			return errInflateStop
+		}
+		return nil
+	})
+
+	if cp.bits != 0 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		f.br.prime(uint(cp.bits), uint64(c>>(8-cp.bits)))
+	}
+	f.setDictionary(cp.window)
+
+	for {
+		final, err := f.block()
+		if err == errInflateStop {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if final {
+			more, err := nextGzipMember(&f.br)
+			if err != nil || !more {
+				return n, err
+			}
+		}
+	}
+}
+
+// StartCompressedOffset returns the start offset of the span in the compressed stream.
+func (i *GoGzipZinfo) StartCompressedOffset(spanID SpanID) Offset {
+	start := i.checkpoints[spanID].in
+	if i.hasBits(spanID) {
+		start--
+	}
+	return start
+}
+
+// EndCompressedOffset returns the end offset of the span in the compressed stream. If
+// it's the last span, returns the size of the compressed stream.
+func (i *GoGzipZinfo) EndCompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].in
+}
+
+// StartUncompressedOffset returns the start offset of the span in the uncompressed stream.
+func (i *GoGzipZinfo) StartUncompressedOffset(spanID SpanID) Offset {
+	return i.checkpoints[spanID].out
+}
+
+// EndUncompressedOffset returns the end offset of the span in the uncompressed stream. If
+// it's the last span, returns the size of the uncompressed stream.
+func (i *GoGzipZinfo) EndUncompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].out
+}
+
+// hasBits returns true if any data of the span is contained in the previous byte.
+func (i *GoGzipZinfo) hasBits(spanID SpanID) bool {
+	if int(spanID) >= len(i.checkpoints) {
+		return false
+	}
+	return i.checkpoints[spanID].bits != 0
+}
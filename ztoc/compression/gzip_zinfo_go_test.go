@@ -0,0 +1,510 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+)
+
+// gzipTestInput is a gzip stream together with its uncompressed content.
+type gzipTestInput struct {
+	name         string
+	compressed   []byte
+	uncompressed []byte
+}
+
+// gzipTestData returns `size` bytes of data. If `compressible` is true the data
+// is made of repeated words, otherwise it is random.
+func gzipTestData(size int, compressible bool) []byte {
+	data := make([]byte, size)
+	if !compressible {
+		rand.Read(data)
+		return data
+	}
+	words := []string{"soci ", "snapshotter ", "lazy ", "loading ", "ztoc ", "span ", "\n"}
+	for i := 0; i < size; {
+		i += copy(data[i:], words[rand.Intn(len(words))])
+	}
+	return data
+}
+
+func gzipCompress(t *testing.T, data []byte, level int, header *gzip.Header, flushEvery int) []byte {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != nil {
+		w.Header = *header
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if flushEvery > 0 && n > flushEvery {
+			n = flushEvery
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if flushEvery > 0 {
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipTestInputs returns gzip streams exercising different deflate block types,
+// header fields and stream layouts.
+func gzipTestInputs(t *testing.T) []gzipTestInput {
+	random := gzipTestData(300000, false)
+	text := gzipTestData(500000, true)
+	small := gzipTestData(1000, true)
+	header := &gzip.Header{
+		Name:    "foo.tar",
+		Comment: "bar",
+		Extra:   []byte("baz"),
+	}
+	// the second member must be ignored, like the C implementation does.
+	multiMember := append(gzipCompress(t, text, gzip.DefaultCompression, nil, 0),
+		gzipCompress(t, random, gzip.DefaultCompression, nil, 0)...)
+
+	return []gzipTestInput{
+		{"empty", gzipCompress(t, nil, gzip.DefaultCompression, nil, 0), nil},
+		{"small", gzipCompress(t, small, gzip.DefaultCompression, nil, 0), small},
+		{"stored blocks", gzipCompress(t, text, gzip.NoCompression, nil, 0), text},
+		{"best speed", gzipCompress(t, text, gzip.BestSpeed, nil, 0), text},
+		{"best compression", gzipCompress(t, text, gzip.BestCompression, nil, 0), text},
+		{"huffman only", gzipCompress(t, text, gzip.HuffmanOnly, nil, 0), text},
+		{"random data", gzipCompress(t, random, gzip.DefaultCompression, nil, 0), random},
+		{"flushed blocks", gzipCompress(t, text, gzip.DefaultCompression, nil, 7000), text},
+		{"header fields", gzipCompress(t, text, gzip.DefaultCompression, header, 0), text},
+		{"multiple members", multiMember, text},
+	}
+}
+
+func TestNewGoGzipZinfo(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name        string
+		zinfoBytes  []byte
+		expectError bool
+	}{
+		{
+			name:        "nil zinfoBytes should return error",
+			zinfoBytes:  nil,
+			expectError: true,
+		},
+		{
+			name:        "empty zinfoBytes should return error",
+			zinfoBytes:  []byte{},
+			expectError: true,
+		},
+		{
+			name:        "zinfoBytes with less than 'header size' bytes header should return error",
+			zinfoBytes:  []byte{00},
+			expectError: true,
+		},
+		{
+			name: "zinfoBytes with too few checkpoints should return error",
+			zinfoBytes: []byte{
+				0xFF, 00, 00, 00, // 255 checkpoints
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: true,
+		},
+		{
+			name: "zinfoBytes with a negative number of checkpoints should return error",
+			zinfoBytes: []byte{
+				0xFF, 0xFF, 0xFF, 0xFF, // -1 checkpoints
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: true,
+		},
+		{
+			name: "zinfoBytes with zero checkpoints should succeed",
+			zinfoBytes: []byte{
+				00, 00, 00, 00, // 0 checkpoints
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: false,
+		},
+		{
+			name: "zinfoBytes v1 with zero checkpoints should succeed",
+			zinfoBytes: []byte{
+				01, 00, 00, 00, // 1 checkpoint
+				00, 00, 00, 00, 00, 00, 00, 00, // span size 0
+			},
+			expectError: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newGoGzipZinfo(tc.zinfoBytes)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestGoGzipZinfoExtractDataFromBuffer(t *testing.T) {
+	t.Parallel()
+	zinfo := GoGzipZinfo{checkpoints: []gzipCheckpoint{{in: 10, window: make([]byte, winSize)}}}
+	testCases := []struct {
+		name               string
+		zinfo              GoGzipZinfo
+		compressedBuf      []byte
+		uncompressedSize   Offset
+		uncompressedOffset Offset
+		spanID             SpanID
+		expectError        bool
+	}{
+		{
+			name:          "nil buffer should return error",
+			zinfo:         GoGzipZinfo{},
+			compressedBuf: nil,
+			expectError:   true,
+		},
+		{
+			name:          "empty buffer should return error",
+			zinfo:         GoGzipZinfo{},
+			compressedBuf: []byte{},
+			expectError:   true,
+		},
+		{
+			name:             "negative uncompressedSize should return error",
+			zinfo:            GoGzipZinfo{},
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: -1,
+			expectError:      true,
+		},
+		{
+			name:             "zero uncompressedSize should return empty byte slice",
+			zinfo:            GoGzipZinfo{},
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: 0,
+			expectError:      false,
+		},
+		{
+			name:             "out of range span id should return error",
+			zinfo:            zinfo,
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: 1,
+			spanID:           1,
+			expectError:      true,
+		},
+		{
+			name:             "invalid deflate data should return error",
+			zinfo:            zinfo,
+			compressedBuf:    []byte{0xFF, 0xFF, 0xFF},
+			uncompressedSize: 1,
+			expectError:      true,
+		},
+		{
+			name: "invalid checkpoint bits should return error",
+			zinfo: GoGzipZinfo{checkpoints: []gzipCheckpoint{
+				{in: 10, window: make([]byte, winSize)},
+				{in: 20, out: 10, bits: 9, window: make([]byte, winSize)},
+			}},
+			compressedBuf:      []byte("foobar"),
+			uncompressedSize:   1,
+			uncompressedOffset: 10,
+			spanID:             1,
+			expectError:        true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := tc.zinfo.ExtractDataFromBuffer(tc.compressedBuf, tc.uncompressedSize, tc.uncompressedOffset, tc.spanID)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if err == nil && len(data) != int(tc.uncompressedSize) {
+				t.Fatalf("wrong uncompressed size. expect: %d, actual: %d ", tc.uncompressedSize, len(data))
+			}
+		})
+	}
+}
+
+func TestGoGzipZinfoExtractDataFromFile(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name             string
+		zinfo            GoGzipZinfo
+		filename         string
+		uncompressedSize Offset
+		expectError      bool
+	}{
+		{
+			name:             "negative uncompressedSize should return error",
+			filename:         "",
+			uncompressedSize: -1,
+			expectError:      true,
+		},
+		{
+			name:             "zero uncompressedSize should return empty byte slice",
+			filename:         "",
+			uncompressedSize: 0,
+			expectError:      false,
+		},
+		{
+			name:             "zinfo without checkpoints should return error",
+			filename:         "",
+			uncompressedSize: 1,
+			expectError:      true,
+		},
+		{
+			name:             "missing file should return error",
+			zinfo:            GoGzipZinfo{checkpoints: []gzipCheckpoint{{in: 10, window: make([]byte, winSize)}}},
+			filename:         "/does/not/exist",
+			uncompressedSize: 1,
+			expectError:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := tc.zinfo.ExtractDataFromFile(tc.filename, tc.uncompressedSize, 0)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if err == nil && len(data) != int(tc.uncompressedSize) {
+				t.Fatalf("wrong uncompressed size. expect: %d, actual: %d ", tc.uncompressedSize, len(data))
+			}
+		})
+	}
+}
+
+func TestGoGzipZinfoFromFile(t *testing.T) {
+	t.Parallel()
+	for _, input := range gzipTestInputs(t) {
+		input := input
+		t.Run(input.name, func(t *testing.T) {
+			filename := writeTempFile(t, input.compressed)
+			zinfo, err := newGoGzipZinfoFromFile(filename, 65535)
+			if err != nil {
+				t.Fatalf("failed to build gzip zinfo: %v", err)
+			}
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize gzip zinfo: %v", err)
+			}
+			zinfo, err = newGoGzipZinfo(b)
+			if err != nil {
+				t.Fatalf("failed to deserialize gzip zinfo: %v", err)
+			}
+			verifyGzipZinfo(t, zinfo, filename, input)
+		})
+	}
+}
+
+func TestGoGzipZinfoWithSpanBoundaries(t *testing.T) {
+	t.Parallel()
+	data := gzipTestData(1<<20, true)
+	input := gzipTestInput{
+		name:         "flushed blocks",
+		compressed:   gzipCompress(t, data, gzip.DefaultCompression, nil, 1000),
+		uncompressed: data,
+	}
+	filename := writeTempFile(t, input.compressed)
+	const spanSize = 10000
+
+	testCases := []struct {
+		name     string
+		canSplit func(Offset) bool
+		// maxSpanSize is the max uncompressed size of every span but the last one.
+		maxSpanSize Offset
+	}{
+		{
+			name:        "every boundary allowed",
+			canSplit:    func(Offset) bool { return true },
+			maxSpanSize: spanSize + 1000,
+		},
+		{
+			name:        "boundaries allowed every 3000 bytes",
+			canSplit:    func(off Offset) bool { return off%3000 < 1000 },
+			maxSpanSize: spanSize + 3000,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			zinfo, err := newGoGzipZinfoFromFileWithSpanBoundaries(filename, spanSize, tc.canSplit)
+			if err != nil {
+				t.Fatalf("failed to build gzip zinfo: %v", err)
+			}
+			if zinfo.MaxSpanID() == 0 {
+				t.Fatalf("expect multiple spans")
+			}
+			verifyGzipZinfo(t, zinfo, filename, input)
+			for id := SpanID(1); id <= zinfo.MaxSpanID(); id++ {
+				start := zinfo.StartUncompressedOffset(id)
+				if !tc.canSplit(start) {
+					t.Fatalf("span %d starts at a boundary that isn't allowed: %d", id, start)
+				}
+				if size := start - zinfo.StartUncompressedOffset(id-1); size > tc.maxSpanSize {
+					t.Fatalf("span %d is too large: %d", id-1, size)
+				}
+			}
+		})
+	}
+
+	t.Run("no boundary allowed results in a single span", func(t *testing.T) {
+		zinfo, err := newGoGzipZinfoFromFileWithSpanBoundaries(filename, spanSize, func(Offset) bool { return false })
+		if err != nil {
+			t.Fatalf("failed to build gzip zinfo: %v", err)
+		}
+		if zinfo.MaxSpanID() != 0 {
+			t.Fatalf("expect a single span, actual max span id: %d", zinfo.MaxSpanID())
+		}
+		verifyGzipZinfo(t, zinfo, filename, input)
+	})
+
+	t.Run("every boundary allowed matches the default layout", func(t *testing.T) {
+		expected, err := newGoGzipZinfoFromFile(filename, spanSize)
+		if err != nil {
+			t.Fatalf("failed to build gzip zinfo: %v", err)
+		}
+		actual, err := newGoGzipZinfoFromFileWithSpanBoundaries(filename, spanSize, func(Offset) bool { return true })
+		if err != nil {
+			t.Fatalf("failed to build gzip zinfo: %v", err)
+		}
+		expectedBytes, _ := expected.Bytes()
+		actualBytes, _ := actual.Bytes()
+		if !bytes.Equal(expectedBytes, actualBytes) {
+			t.Fatalf("zinfo with every boundary allowed != default zinfo")
+		}
+	})
+}
+
+func TestGoGzipZinfoFromInvalidFile(t *testing.T) {
+	t.Parallel()
+	valid := gzipCompress(t, gzipTestData(100000, true), gzip.DefaultCompression, nil, 0)
+	corruptedCRC := append([]byte{}, valid...)
+	corruptedCRC[len(corruptedCRC)-8] ^= 0xFF
+	corruptedHeader := append([]byte{}, valid...)
+	corruptedHeader[2] = 7
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "empty file",
+			data: []byte{},
+		},
+		{
+			name: "not a gzip file",
+			data: []byte("foobarbaz"),
+		},
+		{
+			name: "unsupported compression method",
+			data: corruptedHeader,
+		},
+		{
+			name: "truncated deflate stream",
+			data: valid[:len(valid)/2],
+		},
+		{
+			name: "missing trailer",
+			data: valid[:len(valid)-4],
+		},
+		{
+			name: "wrong checksum",
+			data: corruptedCRC,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newGoGzipZinfoFromFile(writeTempFile(t, tc.data), 65535); err == nil {
+				t.Fatalf("expect error, actual: nil")
+			}
+		})
+	}
+}
+
+// verifyGzipZinfo checks that every span of `zinfo` can be extracted from both
+// a buffer and a file and that the extracted data matches the original content.
+func verifyGzipZinfo(t *testing.T, zinfo Zinfo, filename string, input gzipTestInput) {
+	compressedSize := Offset(len(input.compressed))
+	uncompressedSize := Offset(len(input.uncompressed))
+	for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+		start := zinfo.StartUncompressedOffset(id)
+		end := zinfo.EndUncompressedOffset(id, uncompressedSize)
+		if start == end {
+			continue
+		}
+		if zinfo.UncompressedOffsetToSpanID(start) != id || zinfo.UncompressedOffsetToSpanID(end-1) != id {
+			t.Fatalf("span %d [%d, %d) is not mapped back to itself", id, start, end)
+		}
+		buf := input.compressed[zinfo.StartCompressedOffset(id):zinfo.EndCompressedOffset(id, compressedSize)]
+		data, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, id)
+		if err != nil {
+			t.Fatalf("failed to extract span %d: %v", id, err)
+		}
+		if !bytes.Equal(data, input.uncompressed[start:end]) {
+			t.Fatalf("span %d extracted bytes != original bytes", id)
+		}
+	}
+
+	if uncompressedSize < 3 {
+		return
+	}
+	// extract a range crossing span boundaries from the file.
+	offset, size := uncompressedSize/3, uncompressedSize/2
+	data, err := zinfo.ExtractDataFromFile(filename, size, offset)
+	if err != nil {
+		t.Fatalf("failed to extract data from file: %v", err)
+	}
+	if !bytes.Equal(data, input.uncompressed[offset:offset+size]) {
+		t.Fatalf("extracted bytes != original bytes")
+	}
+}
+
+func FuzzNewGoGzipZinfo(f *testing.F) {
+	f.Add([]byte{00, 00, 00, 00, 00, 00, 00, 00, 00, 00, 00, 00})
+	f.Add([]byte{01, 00, 00, 00, 00, 00, 00, 00, 00, 00, 00, 00})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 00, 00, 00, 00, 00, 00, 00, 00})
+	f.Fuzz(func(t *testing.T, zinfoBytes []byte) {
+		zinfo, err := newGoGzipZinfo(zinfoBytes)
+		if err != nil {
+			return
+		}
+		b, err := zinfo.Bytes()
+		if err != nil {
+			t.Fatalf("failed to serialize gzip zinfo: %v", err)
+		}
+		if !bytes.Equal(b, zinfoBytes) {
+			t.Fatalf("serialized zinfo != original zinfo")
+		}
+	})
+}
@@ -18,6 +18,7 @@ package compression
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	zinfo_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/compression/fbs/zinfo"
@@ -72,6 +73,43 @@ func newTarZinfoFromFile(tarFile string, spanSize int64) (*TarZinfo, error) {
 	}, nil
 }
 
+// newTarZinfoFromReader creates a new instance of `TarZinfo` given a tar stream and
+// span size, copying the stream to `w`.
+func newTarZinfoFromReader(r io.Reader, w io.Writer, spanSize int64, onSpan SpanFunc) (*TarZinfo, error) {
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size: %d", spanSize)
+	}
+
+	var size int64
+	var nextSpan int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+			size += int64(n)
+			// a span starts at every multiple of span size with data after it.
+			for ; onSpan != nil && nextSpan < size; nextSpan += spanSize {
+				onSpan(Offset(nextSpan), Offset(nextSpan))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tar stream: %w", err)
+		}
+	}
+
+	return &TarZinfo{
+		version:  zinfoVersion,
+		spanSize: spanSize,
+		size:     size,
+	}, nil
+}
+
 // Close doesn't do anything since there is nothing to close/release.
 func (i *TarZinfo) Close() {}
 
@@ -17,7 +17,9 @@
 package compression
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 )
 
 // Zinfo is the interface for dealing with compressed data efficiently. It chunks
@@ -79,12 +81,17 @@ type Zinfo interface {
 
 // NewZinfo deseralizes given zinfo bytes into a zinfo struct.
 // This is often used when you have a serialized zinfo bytes and want to get the zinfo struct.
+// `zinfoBytes` can be in any `CheckpointsEncoding`.
 func NewZinfo(compressionAlgo string, zinfoBytes []byte) (Zinfo, error) {
+	zinfoBytes, err := decodeCheckpoints(compressionAlgo, zinfoBytes)
+	if err != nil {
+		return nil, err
+	}
 	switch compressionAlgo {
 	case Gzip:
-		return newGzipZinfo(zinfoBytes)
+		return newGzipZinfoWithEngine(gzipEngine, zinfoBytes)
 	case Zstd:
-		return nil, fmt.Errorf("not implemented: %s", Zstd)
+		return newZstdZinfo(zinfoBytes)
 	case Uncompressed, Unknown:
 		return newTarZinfo(zinfoBytes)
 	default:
@@ -98,12 +105,56 @@ func NewZinfo(compressionAlgo string, zinfoBytes []byte) (Zinfo, error) {
 func NewZinfoFromFile(compressionAlgo string, filename string, spanSize int64) (Zinfo, error) {
 	switch compressionAlgo {
 	case Gzip:
-		return newGzipZinfoFromFile(filename, spanSize)
+		return newGzipZinfoFromFileWithEngine(gzipEngine, filename, spanSize)
 	case Zstd:
-		return nil, fmt.Errorf("not implemented: %s", Zstd)
+		return newZstdZinfoFromFile(filename, spanSize)
 	case Uncompressed:
 		return newTarZinfoFromFile(filename, spanSize)
 	default:
 		return nil, fmt.Errorf("unexpected compression algorithm: %s", compressionAlgo)
 	}
 }
+
+// SpanBoundaryFunc is called by `NewZinfoFromFileWithSpanBoundaries` at every point of the
+// compressed stream where a span could start, in order, and reports whether a span is
+// allowed to start at `uncompressedOffset`.
+type SpanBoundaryFunc func(uncompressedOffset Offset) bool
+
+// NewZinfoFromFileWithSpanBoundaries creates a zinfo struct given a compressed file and a
+// span size like `NewZinfoFromFile`, but spans only start where `canSplit` allows it, even
+// if that makes them smaller or larger than `spanSize`. Only gzip is supported.
+func NewZinfoFromFileWithSpanBoundaries(compressionAlgo string, filename string, spanSize int64, canSplit SpanBoundaryFunc) (Zinfo, error) {
+	switch compressionAlgo {
+	case Gzip:
+		// both engines use the same format, so the zinfo can be used with any engine afterwards.
+		return newGoGzipZinfoFromFileWithSpanBoundaries(filename, spanSize, canSplit)
+	default:
+		return nil, fmt.Errorf("span boundaries are not supported for compression algorithm: %s", compressionAlgo)
+	}
+}
+
+// SpanFunc is called by `NewZinfoFromReader` every time a span starts at offset
+// `start` of the compressed stream, once the compressed stream has been read up
+// to `prevEnd`, which is where the previous span ends (i.e., `EndCompressedOffset`
+// of the previous span). Spans can overlap, so `prevEnd` may be after `start`.
+// For the first span, `prevEnd` is meaningless.
+type SpanFunc func(start, prevEnd Offset)
+
+// NewZinfoFromReader creates a zinfo struct in a single pass over the compressed stream `r`,
+// writing the uncompressed stream to `w`. `onSpan`, if not nil, is called every time a new
+// span starts. This is used when the compressed data is not available as a file
+// (e.g. it's being downloaded).
+func NewZinfoFromReader(compressionAlgo string, r io.Reader, w io.Writer, spanSize int64, onSpan SpanFunc) (Zinfo, error) {
+	switch compressionAlgo {
+	case Gzip:
+		// only the Go engine can build a zinfo from a stream, but since both engines
+		// use the same format, the zinfo can be used with any engine afterwards.
+		return newGoGzipZinfoFromReader(bufio.NewReaderSize(r, gzipReadBufferSize), w, spanSize, onSpan)
+	case Zstd:
+		return newZstdZinfoFromReader(bufio.NewReader(r), w, spanSize, onSpan)
+	case Uncompressed:
+		return newTarZinfoFromReader(r, w, spanSize, onSpan)
+	default:
+		return nil, fmt.Errorf("unexpected compression algorithm: %s", compressionAlgo)
+	}
+}
@@ -0,0 +1,498 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	zinfo_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/compression/fbs/zinfo"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zstdFrameMagic          = 0xFD2FB528
+	zstdSkippableFrameMagic = 0x184D2A50
+	zstdSkippableFrameMask  = 0xFFFFFFF0
+
+	zstdBlockHeaderSize = 3
+	zstdChecksumSize    = 4
+)
+
+var errZstdReservedBlockType = errors.New("zstd block uses reserved block type")
+
+// zstdCheckpoint records where a zstd frame starts in both the compressed
+// and the uncompressed stream.
+type zstdCheckpoint struct {
+	in  Offset
+	out Offset
+}
+
+// ZstdZinfo implements the `Zinfo` interface for zstd compressed files.
+//
+// Unlike gzip, the state of a zstd decoder in the middle of a frame cannot
+// be captured in a small, fixed size window, so every span starts at a zstd
+// frame boundary. Consecutive frames are grouped together until a span holds
+// at least `spanSize` bytes of uncompressed data. Layers made of many small
+// frames (e.g. seekable zstd) are therefore split into many spans, whereas
+// a layer compressed as a single frame results in a single span.
+type ZstdZinfo struct {
+	version     int32
+	spanSize    int64
+	checkpoints []zstdCheckpoint
+}
+
+// newZstdZinfo creates a new instance of `ZstdZinfo` from serialized bytes.
+func newZstdZinfo(zinfoBytes []byte) (zinfo *ZstdZinfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			zinfo = nil
+			err = fmt.Errorf("cannot unmarshal zstd zinfo: %v", r)
+		}
+	}()
+
+	if len(zinfoBytes) == 0 {
+		return nil, fmt.Errorf("empty checkpoints")
+	}
+
+	zinfoFlatbuf := zinfo_flatbuffers.GetRootAsZstdZinfo(zinfoBytes, 0)
+	zinfo = &ZstdZinfo{
+		version:     zinfoFlatbuf.Version(),
+		spanSize:    zinfoFlatbuf.SpanSize(),
+		checkpoints: make([]zstdCheckpoint, zinfoFlatbuf.CheckpointsLength()),
+	}
+	if len(zinfo.checkpoints) == 0 {
+		return nil, fmt.Errorf("zstd zinfo has no checkpoints")
+	}
+
+	checkpoint := new(zinfo_flatbuffers.ZstdCheckpoint)
+	for i := range zinfo.checkpoints {
+		zinfoFlatbuf.Checkpoints(checkpoint, i)
+		zinfo.checkpoints[i] = zstdCheckpoint{
+			in:  Offset(checkpoint.CompressedOffset()),
+			out: Offset(checkpoint.UncompressedOffset()),
+		}
+		if i > 0 && (zinfo.checkpoints[i].in <= zinfo.checkpoints[i-1].in || zinfo.checkpoints[i].out <= zinfo.checkpoints[i-1].out) {
+			return nil, fmt.Errorf("zstd zinfo checkpoint %d is out of order", i)
+		}
+	}
+	return zinfo, nil
+}
+
+// newZstdZinfoFromFile creates a new instance of `ZstdZinfo` given zstd file name and span size.
+func newZstdZinfoFromFile(zstdFile string, spanSize int64) (*ZstdZinfo, error) {
+	f, err := os.Open(zstdFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer f.Close()
+	return newZstdZinfoFromReader(bufio.NewReader(f), nil, spanSize, nil)
+}
+
+// newZstdZinfoFromReader creates a new instance of `ZstdZinfo` from a zstd stream. If `w`
+// is not nil, every frame is decompressed into it. Otherwise only the frames which don't
+// record their decompressed size are decompressed.
+func newZstdZinfoFromReader(r *bufio.Reader, w io.Writer, spanSize int64, onSpan SpanFunc) (*ZstdZinfo, error) {
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size: %d", spanSize)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	zinfo := &ZstdZinfo{
+		version:     zinfoVersion,
+		spanSize:    spanSize,
+		checkpoints: []zstdCheckpoint{{in: 0, out: 0}},
+	}
+	if onSpan != nil {
+		onSpan(0, 0)
+	}
+
+	var in, out Offset
+	for {
+		frame, err := readZstdFrameHeader(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read zstd frame at offset %d: %w", in, err)
+		}
+
+		// a new span can only start at the beginning of a (non-skippable) frame.
+		last := zinfo.checkpoints[len(zinfo.checkpoints)-1]
+		if !frame.skippable && out-last.out >= Offset(spanSize) {
+			zinfo.checkpoints = append(zinfo.checkpoints, zstdCheckpoint{in: in, out: out})
+			if onSpan != nil {
+				onSpan(in, in)
+			}
+		}
+
+		compressedSize, uncompressedSize, err := frame.consume(r, decoder, w)
+		if err != nil {
+			return nil, fmt.Errorf("could not read zstd frame at offset %d: %w", in, err)
+		}
+		in += compressedSize
+		out += uncompressedSize
+	}
+
+	return zinfo, nil
+}
+
+// Close doesn't do anything since there is nothing to close/release.
+func (i *ZstdZinfo) Close() {}
+
+// Bytes returns the byte slice containing the `ZstdZinfo`.
+func (i *ZstdZinfo) Bytes() (fb []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fb = nil
+			err = fmt.Errorf("failed to generate zstd zinfo flatbuf bytes: %v", r)
+		}
+	}()
+
+	builder := flatbuffers.NewBuilder(0)
+	zinfo_flatbuffers.ZstdZinfoStartCheckpointsVector(builder, len(i.checkpoints))
+	for j := len(i.checkpoints) - 1; j >= 0; j-- {
+		zinfo_flatbuffers.CreateZstdCheckpoint(builder, int64(i.checkpoints[j].in), int64(i.checkpoints[j].out))
+	}
+	checkpoints := builder.EndVector(len(i.checkpoints))
+
+	zinfo_flatbuffers.ZstdZinfoStart(builder)
+	zinfo_flatbuffers.ZstdZinfoAddVersion(builder, i.version)
+	zinfo_flatbuffers.ZstdZinfoAddSpanSize(builder, i.spanSize)
+	zinfo_flatbuffers.ZstdZinfoAddCheckpoints(builder, checkpoints)
+	zstdZinfoFlatbuf := zinfo_flatbuffers.ZstdZinfoEnd(builder)
+	builder.Finish(zstdZinfoFlatbuf)
+	return builder.FinishedBytes(), nil
+}
+
+// MaxSpanID returns the max span ID.
+func (i *ZstdZinfo) MaxSpanID() SpanID {
+	return SpanID(len(i.checkpoints) - 1)
+}
+
+// SpanSize returns the span size of the constructed zinfo.
+func (i *ZstdZinfo) SpanSize() Offset {
+	return Offset(i.spanSize)
+}
+
+// UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
+func (i *ZstdZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
+	// find the first checkpoint that starts after `offset`; the span before it contains `offset`.
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanID(idx - 1)
+}
+
+// ExtractDataFromBuffer decompresses `compressedBuf`, which must start at the beginning
+// of span `spanID`, and returns `uncompressedSize` bytes starting at `uncompressedOffset`.
+func (i *ZstdZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset Offset, spanID SpanID) ([]byte, error) {
+	if len(compressedBuf) == 0 {
+		return nil, fmt.Errorf("empty compressed buffer")
+	}
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	if spanID < 0 || spanID > i.MaxSpanID() {
+		return nil, fmt.Errorf("invalid span id: %d", spanID)
+	}
+	return i.extract(bytes.NewReader(compressedBuf), uncompressedSize, uncompressedOffset-i.StartUncompressedOffset(spanID))
+}
+
+// ExtractDataFromFile decompresses the zstd file starting from the span containing
+// `uncompressedOffset` and returns `uncompressedSize` bytes.
+func (i *ZstdZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset Offset) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", uncompressedSize)
+	}
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	spanID := i.UncompressedOffsetToSpanID(uncompressedOffset)
+	if _, err := f.Seek(int64(i.StartCompressedOffset(spanID)), io.SeekStart); err != nil {
+		return nil, err
+	}
+	return i.extract(f, uncompressedSize, uncompressedOffset-i.StartUncompressedOffset(spanID))
+}
+
+// extract decompresses `r`, which must start at a zstd frame boundary, skips the first
+// `skip` uncompressed bytes and returns the following `size` bytes.
+func (i *ZstdZinfo) extract(r io.Reader, size, skip Offset) ([]byte, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	if _, err := io.CopyN(io.Discard, decoder, int64(skip)); err != nil {
+		return nil, fmt.Errorf("unable to extract data; failed to skip %d bytes: %w", skip, err)
+	}
+	bytes := make([]byte, size)
+	if n, err := io.ReadFull(decoder, bytes); err != nil {
+		return nil, fmt.Errorf("failed to extract data. expect length: %d, actual length: %d: %w", size, n, err)
+	}
+	return bytes, nil
+}
+
+// StartCompressedOffset returns the start offset of the span in the compressed stream.
+func (i *ZstdZinfo) StartCompressedOffset(spanID SpanID) Offset {
+	return i.checkpoints[spanID].in
+}
+
+// EndCompressedOffset returns the end offset of the span in the compressed stream. If
+// it's the last span, returns the size of the compressed stream.
+func (i *ZstdZinfo) EndCompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].in
+}
+
+// StartUncompressedOffset returns the start offset of the span in the uncompressed stream.
+func (i *ZstdZinfo) StartUncompressedOffset(spanID SpanID) Offset {
+	return i.checkpoints[spanID].out
+}
+
+// EndUncompressedOffset returns the end offset of the span in the uncompressed stream. If
+// it's the last span, returns the size of the uncompressed stream.
+func (i *ZstdZinfo) EndUncompressedOffset(spanID SpanID, fileSize Offset) Offset {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].out
+}
+
+// zstdFrame is the parsed header of a zstd frame.
+// See https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frames
+type zstdFrame struct {
+	// header holds the raw bytes of the frame header, including the magic number.
+	header    []byte
+	skippable bool
+	// skippableSize is the size of the user data of a skippable frame.
+	skippableSize int64
+	// contentSize is the decompressed size of the frame, or -1 if not present in the header.
+	contentSize int64
+	checksum    bool
+}
+
+// readZstdFrameHeader reads the header of the next frame from `r`. It returns
+// `io.EOF` if there are no more frames.
+func readZstdFrameHeader(r *bufio.Reader) (*zstdFrame, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated zstd frame magic number")
+		}
+		return nil, err
+	}
+
+	m := binary.LittleEndian.Uint32(magic[:])
+	if m&zstdSkippableFrameMask == zstdSkippableFrameMagic {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, fmt.Errorf("truncated zstd skippable frame header: %w", err)
+		}
+		return &zstdFrame{
+			header:        append(magic[:], size[:]...),
+			skippable:     true,
+			skippableSize: int64(binary.LittleEndian.Uint32(size[:])),
+		}, nil
+	}
+	if m != zstdFrameMagic {
+		return nil, fmt.Errorf("invalid zstd frame magic number: %#x", m)
+	}
+
+	descriptor, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("truncated zstd frame header: %w", err)
+	}
+
+	fcsFlag := descriptor >> 6
+	singleSegment := descriptor&(1<<5) != 0
+	checksum := descriptor&(1<<2) != 0
+	dictIDFlag := descriptor & 3
+
+	headerSize := 0
+	if !singleSegment {
+		headerSize++ // window descriptor
+	}
+	headerSize += []int{0, 1, 2, 4}[dictIDFlag]
+	fcsSize := []int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && singleSegment {
+		fcsSize = 1
+	}
+	headerSize += fcsSize
+
+	rest := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("truncated zstd frame header: %w", err)
+	}
+
+	frame := &zstdFrame{
+		header:      append(append(magic[:], descriptor), rest...),
+		contentSize: -1,
+		checksum:    checksum,
+	}
+	fcs := rest[headerSize-fcsSize:]
+	switch fcsSize {
+	case 1:
+		frame.contentSize = int64(fcs[0])
+	case 2:
+		frame.contentSize = int64(binary.LittleEndian.Uint16(fcs)) + 256
+	case 4:
+		frame.contentSize = int64(binary.LittleEndian.Uint32(fcs))
+	case 8:
+		frame.contentSize = int64(binary.LittleEndian.Uint64(fcs))
+	}
+	return frame, nil
+}
+
+// zstdFrameReader returns the raw bytes of a single zstd frame, starting with its
+// header, and stops at the end of the frame. It walks the block headers so the
+// end of the frame is found without decompressing it.
+type zstdFrameReader struct {
+	r     *bufio.Reader
+	frame *zstdFrame
+
+	pending     []byte // header bytes that haven't been returned yet
+	remaining   int64  // bytes left in the current block (or checksum)
+	lastBlock   bool
+	checksumed  bool
+	blockHeader [zstdBlockHeaderSize]byte
+
+	// n is the number of bytes of the frame returned so far.
+	n int64
+}
+
+func newZstdFrameReader(r *bufio.Reader, frame *zstdFrame) *zstdFrameReader {
+	fr := &zstdFrameReader{
+		r:       r,
+		frame:   frame,
+		pending: frame.header,
+	}
+	if frame.skippable {
+		// a skippable frame is a header followed by opaque user data.
+		fr.remaining = frame.skippableSize
+		fr.lastBlock = true
+		fr.checksumed = true
+	}
+	return fr
+}
+
+func (fr *zstdFrameReader) Read(p []byte) (int, error) {
+	for {
+		if len(fr.pending) > 0 {
+			n := copy(p, fr.pending)
+			fr.pending = fr.pending[n:]
+			fr.n += int64(n)
+			return n, nil
+		}
+		if fr.remaining > 0 {
+			if int64(len(p)) > fr.remaining {
+				p = p[:fr.remaining]
+			}
+			n, err := fr.r.Read(p)
+			fr.remaining -= int64(n)
+			fr.n += int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if fr.lastBlock {
+			if !fr.checksumed {
+				fr.checksumed = true
+				if fr.frame.checksum {
+					fr.remaining = zstdChecksumSize
+					continue
+				}
+			}
+			return 0, io.EOF
+		}
+
+		if _, err := io.ReadFull(fr.r, fr.blockHeader[:]); err != nil {
+			return 0, fmt.Errorf("truncated zstd block header: %w", err)
+		}
+		h := uint32(fr.blockHeader[0]) | uint32(fr.blockHeader[1])<<8 | uint32(fr.blockHeader[2])<<16
+		fr.lastBlock = h&1 != 0
+		fr.remaining = int64(h >> 3)
+		switch (h >> 1) & 3 {
+		case 1: // RLE block, the block size is the regenerated size of a single byte.
+			fr.remaining = 1
+		case 3:
+			return 0, errZstdReservedBlockType
+		}
+		fr.pending = fr.blockHeader[:]
+	}
+}
+
+// consume reads the rest of the frame from `r` and returns the compressed size
+// (including the header) and the decompressed size of the frame. If `w` is not nil
+// or the frame header doesn't record the decompressed size, the frame is decompressed
+// with `decoder` (into `w` if not nil).
+func (f *zstdFrame) consume(r *bufio.Reader, decoder *zstd.Decoder, w io.Writer) (Offset, Offset, error) {
+	fr := newZstdFrameReader(r, f)
+	uncompressedSize := f.contentSize
+	if f.skippable {
+		uncompressedSize = 0
+	}
+
+	if !f.skippable && (uncompressedSize < 0 || w != nil) {
+		if w == nil {
+			w = io.Discard
+		}
+		if err := decoder.Reset(fr); err != nil {
+			return 0, 0, err
+		}
+		n, err := io.Copy(w, decoder)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not decompress zstd frame: %w", err)
+		}
+		uncompressedSize = n
+	}
+
+	// skip whatever the decoder didn't need to read (e.g. the checksum).
+	if _, err := io.Copy(io.Discard, fr); err != nil {
+		return 0, 0, err
+	}
+	return Offset(fr.n), Offset(uncompressedSize), nil
+}
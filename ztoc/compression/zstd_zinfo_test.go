@@ -0,0 +1,325 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdFrames compresses each chunk as a separate zstd frame. If `streaming` is true,
+// the frames don't record their decompressed size in the frame header.
+func zstdFrames(t *testing.T, chunks [][]byte, streaming bool) []byte {
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if !streaming {
+			buf.Write(enc.EncodeAll(chunk, nil))
+			continue
+		}
+		enc.Reset(&buf)
+		if _, err := enc.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func zstdSkippableFrame(data []byte) []byte {
+	frame := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(frame, zstdSkippableFrameMagic|0x7)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func writeTempFile(t *testing.T, data []byte) string {
+	f, err := os.CreateTemp(t.TempDir(), "zstd.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestNewZstdZinfo(t *testing.T) {
+	t.Parallel()
+	valid, err := (&ZstdZinfo{
+		version:     zinfoVersion,
+		spanSize:    10,
+		checkpoints: []zstdCheckpoint{{0, 0}, {20, 100}},
+	}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outOfOrder, err := (&ZstdZinfo{
+		version:     zinfoVersion,
+		spanSize:    10,
+		checkpoints: []zstdCheckpoint{{0, 0}, {20, 100}, {10, 200}},
+	}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCheckpoints, err := (&ZstdZinfo{version: zinfoVersion, spanSize: 10}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		zinfoBytes  []byte
+		expectError bool
+	}{
+		{
+			name:        "nil zinfoBytes should return error",
+			zinfoBytes:  nil,
+			expectError: true,
+		},
+		{
+			name:        "truncated zinfoBytes should return error",
+			zinfoBytes:  []byte{0xFF, 0xFF},
+			expectError: true,
+		},
+		{
+			name:        "zinfoBytes without checkpoints should return error",
+			zinfoBytes:  noCheckpoints,
+			expectError: true,
+		},
+		{
+			name:        "zinfoBytes with out of order checkpoints should return error",
+			zinfoBytes:  outOfOrder,
+			expectError: true,
+		},
+		{
+			name:        "valid zinfoBytes should succeed",
+			zinfoBytes:  valid,
+			expectError: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newZstdZinfo(tc.zinfoBytes)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestZstdZinfoFromFile(t *testing.T) {
+	t.Parallel()
+	chunks := make([][]byte, 8)
+	var uncompressed []byte
+	for i := range chunks {
+		chunks[i] = make([]byte, 1000+rand.Intn(1000))
+		rand.Read(chunks[i])
+		uncompressed = append(uncompressed, chunks[i]...)
+	}
+
+	testCases := []struct {
+		name      string
+		data      []byte
+		spanSize  int64
+		maxSpanID SpanID
+	}{
+		{
+			name:      "frames with content size, one frame per span",
+			data:      zstdFrames(t, chunks, false),
+			spanSize:  1,
+			maxSpanID: 7,
+		},
+		{
+			name:      "frames without content size, one frame per span",
+			data:      zstdFrames(t, chunks, true),
+			spanSize:  1,
+			maxSpanID: 7,
+		},
+		{
+			name:      "frames are grouped until span size is reached",
+			data:      zstdFrames(t, chunks, true),
+			spanSize:  2000,
+			maxSpanID: 3,
+		},
+		{
+			name:      "single frame results in a single span",
+			data:      zstdFrames(t, [][]byte{uncompressed}, true),
+			spanSize:  1,
+			maxSpanID: 0,
+		},
+		{
+			name: "skippable frames are added to the current span",
+			data: append(append(zstdSkippableFrame([]byte("foo")), zstdFrames(t, chunks[:4], false)...),
+				append(zstdSkippableFrame([]byte("bar")), zstdFrames(t, chunks[4:], true)...)...),
+			spanSize:  1,
+			maxSpanID: 7,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			filename := writeTempFile(t, tc.data)
+			zinfo, err := newZstdZinfoFromFile(filename, tc.spanSize)
+			if err != nil {
+				t.Fatalf("failed to build zstd zinfo: %v", err)
+			}
+			if zinfo.MaxSpanID() != tc.maxSpanID {
+				t.Fatalf("unexpected max span id. expect: %d, actual: %d", tc.maxSpanID, zinfo.MaxSpanID())
+			}
+
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("failed to serialize zstd zinfo: %v", err)
+			}
+			zinfo, err = newZstdZinfo(b)
+			if err != nil {
+				t.Fatalf("failed to deserialize zstd zinfo: %v", err)
+			}
+
+			compressedSize := Offset(len(tc.data))
+			uncompressedSize := Offset(len(uncompressed))
+			for id := SpanID(0); id <= zinfo.MaxSpanID(); id++ {
+				start := zinfo.StartUncompressedOffset(id)
+				end := zinfo.EndUncompressedOffset(id, uncompressedSize)
+				if zinfo.UncompressedOffsetToSpanID(start) != id || zinfo.UncompressedOffsetToSpanID(end-1) != id {
+					t.Fatalf("span %d [%d, %d) is not mapped back to itself", id, start, end)
+				}
+
+				buf := tc.data[zinfo.StartCompressedOffset(id):zinfo.EndCompressedOffset(id, compressedSize)]
+				data, err := zinfo.ExtractDataFromBuffer(buf, end-start, start, id)
+				if err != nil {
+					t.Fatalf("failed to extract span %d: %v", id, err)
+				}
+				if !bytes.Equal(data, uncompressed[start:end]) {
+					t.Fatalf("span %d extracted bytes != original bytes", id)
+				}
+			}
+
+			// extract a range crossing span boundaries from the file.
+			offset, size := Offset(500), Offset(len(uncompressed)-1000)
+			data, err := zinfo.ExtractDataFromFile(filename, size, offset)
+			if err != nil {
+				t.Fatalf("failed to extract data from file: %v", err)
+			}
+			if !bytes.Equal(data, uncompressed[offset:offset+size]) {
+				t.Fatalf("extracted bytes != original bytes")
+			}
+		})
+	}
+}
+
+func TestZstdZinfoFromInvalidFile(t *testing.T) {
+	t.Parallel()
+	frames := zstdFrames(t, [][]byte{[]byte("foobar")}, true)
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "not a zstd file",
+			data: []byte("foobarbaz"),
+		},
+		{
+			name: "truncated zstd frame",
+			data: frames[:len(frames)-2],
+		},
+		{
+			name: "truncated skippable frame",
+			data: zstdSkippableFrame([]byte("foobar"))[:10],
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newZstdZinfoFromFile(writeTempFile(t, tc.data), 1); err == nil {
+				t.Fatalf("expect error, actual: nil")
+			}
+		})
+	}
+}
+
+func TestZstdExtractDataFromBuffer(t *testing.T) {
+	t.Parallel()
+	zinfo := ZstdZinfo{checkpoints: []zstdCheckpoint{{0, 0}}}
+	testCases := []struct {
+		name             string
+		compressedBuf    []byte
+		uncompressedSize Offset
+		spanID           SpanID
+		expectError      bool
+	}{
+		{
+			name:          "empty buffer should return error",
+			compressedBuf: []byte{},
+			expectError:   true,
+		},
+		{
+			name:             "negative uncompressedSize should return error",
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: -1,
+			expectError:      true,
+		},
+		{
+			name:             "zero uncompressedSize should return empty byte slice",
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: 0,
+			expectError:      false,
+		},
+		{
+			name:             "out of range span id should return error",
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: 1,
+			spanID:           1,
+			expectError:      true,
+		},
+		{
+			name:             "invalid zstd data should return error",
+			compressedBuf:    []byte("foobar"),
+			uncompressedSize: 1,
+			expectError:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := zinfo.ExtractDataFromBuffer(tc.compressedBuf, tc.uncompressedSize, 0, tc.spanID)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if err == nil && len(data) != int(tc.uncompressedSize) {
+				t.Fatalf("wrong uncompressed size. expect: %d, actual: %d ", tc.uncompressedSize, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// EStargzTOCDigestAnnotation is the annotation of eStargz layers containing the digest
+	// of their embedded TOC.
+	EStargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// estargzTOCName is the name of the tar entry of the embedded TOC.
+	estargzTOCName = "stargz.index.json"
+	// estargzFooterSize is the size of the footer of eStargz layers.
+	estargzFooterSize = 51
+	// legacyStargzFooterSize is the size of the footer of layers built by the original stargz.
+	legacyStargzFooterSize = 47
+)
+
+var (
+	// ErrEStargzTOCDigestMismatch is returned if the TOC embedded in an eStargz layer doesn't
+	// match the digest of the layer's `EStargzTOCDigestAnnotation` annotation.
+	ErrEStargzTOCDigestMismatch = errors.New("eStargz TOC doesn't match its digest")
+)
+
+// maxGzipMemberSizeWithoutFallback is the largest compressed size of a gzip member whose
+// uncompressed size can be read from its trailer. ISIZE holds the uncompressed size modulo 2^32
+// and deflate expands data at most 1032 times, so larger members may have wrapped ISIZE
+// and are decompressed to get their uncompressed size.
+var maxGzipMemberSizeWithoutFallback int64 = (1<<32)/1032 - 1
+
+// estargzTOC is the TOC embedded in eStargz layers.
+type estargzTOC struct {
+	Version int            `json:"version"`
+	Entries []estargzEntry `json:"entries"`
+}
+
+// estargzEntry is an entry of the TOC embedded in eStargz layers. A regular file
+// may be split into several chunks, each of them starting a new gzip member: the
+// "reg" entry describes the file and its first chunk, and the following chunks
+// have their own "chunk" entry.
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+}
+
+// chunkSize returns the uncompressed size of the chunk described by the entry.
+func (e *estargzEntry) chunkSize(fileSize int64) int64 {
+	if e.ChunkSize > 0 {
+		return e.ChunkSize
+	}
+	return fileSize - e.ChunkOffset
+}
+
+// IsEStargz returns true if the layer blob in `r` of `size` bytes ends with an eStargz
+// (or legacy stargz) footer.
+func IsEStargz(r io.ReaderAt, size int64) bool {
+	_, _, err := parseEStargzFooter(r, size)
+	return err == nil
+}
+
+// parseEStargzFooter parses the footer of an eStargz layer and returns the compressed
+// offset of the gzip member containing the TOC and the size of the footer.
+func parseEStargzFooter(r io.ReaderAt, size int64) (tocOffset, footerSize int64, err error) {
+	for _, footerSize := range []int64{estargzFooterSize, legacyStargzFooterSize} {
+		if size < footerSize {
+			continue
+		}
+		footer := make([]byte, footerSize)
+		if _, err := r.ReadAt(footer, size-footerSize); err != nil {
+			return 0, 0, err
+		}
+		tocOffset, err := parseEStargzFooterExtra(footer)
+		if err != nil || tocOffset >= size-footerSize {
+			continue
+		}
+		return tocOffset, footerSize, nil
+	}
+	return 0, 0, fmt.Errorf("no eStargz footer found")
+}
+
+// parseEStargzFooterExtra parses the extra field of the gzip header of the footer,
+// which contains the offset of the TOC as 16 hex digits followed by "STARGZ". eStargz
+// stores it as a subfield with id "SG", while the legacy stargz stores it directly.
+func parseEStargzFooterExtra(footer []byte) (int64, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return 0, err
+	}
+	extra := zr.Header.Extra
+	switch len(footer) {
+	case estargzFooterSize:
+		if len(extra) != 26 || extra[0] != 'S' || extra[1] != 'G' || binary.LittleEndian.Uint16(extra[2:4]) != 22 {
+			return 0, fmt.Errorf("invalid eStargz footer")
+		}
+		extra = extra[4:]
+	case legacyStargzFooterSize:
+		if len(extra) != 22 {
+			return 0, fmt.Errorf("invalid stargz footer")
+		}
+	}
+	if string(extra[16:]) != "STARGZ" {
+		return 0, fmt.Errorf("invalid stargz footer magic")
+	}
+	return strconv.ParseInt(string(extra[:16]), 16, 64)
+}
+
+// BuildZtocFromEStargz builds a `Ztoc` for an eStargz layer given the filename of the
+// layer blob. Instead of decompressing the whole layer, the `TOC` is created from the TOC
+// embedded in the layer, and the spans start at the gzip members that eStargz creates for
+// the chunks of the files. Only `WithCompactCheckpoints` and `WithEStargzTOCDigest` are honored
+// among the options; the latter should always be given when the layer has the annotation, since
+// the file digests of the embedded TOC are recorded in the ztoc.
+//
+// eStargz doesn't record where the tar headers are, so entries without content (e.g.,
+// directories) are given the uncompressed offset of the end of the preceding file.
+func (b *Builder) BuildZtocFromEStargz(filename string, span int64, options ...BuildOption) (*Ztoc, error) {
+	opt := defaultBuildConfig()
+	for _, f := range options {
+		err := f(&opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	tocOffset, footerSize, err := parseEStargzFooter(file, size)
+	if err != nil {
+		return nil, err
+	}
+	footerOffset := size - footerSize
+	toc, tocHeader, tocDataOffset, tocJSON, err := readEStargzTOC(io.NewSectionReader(file, tocOffset, footerOffset-tocOffset))
+	if err != nil {
+		return nil, err
+	}
+	if opt.estargzTOCDigest != "" && digest.FromBytes(tocJSON) != opt.estargzTOCDigest {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrEStargzTOCDigestMismatch, opt.estargzTOCDigest, digest.FromBytes(tocJSON))
+	}
+
+	// every chunk of a regular file starts a new gzip member.
+	compressedOffsets := []int64{0, tocOffset, footerOffset}
+	for _, e := range toc.Entries {
+		if (e.Type == "reg" && e.Size > 0) || e.Type == "chunk" {
+			compressedOffsets = append(compressedOffsets, e.Offset)
+		}
+	}
+	members, err := estargzMembers(file, compressedOffsets, footerOffset)
+	if err != nil {
+		return nil, err
+	}
+	uncompressedOffsets := make(map[int64]compression.Offset, len(members))
+	for _, m := range members {
+		uncompressedOffsets[int64(m.CompressedOffset)] = m.UncompressedOffset
+	}
+
+	var (
+		fm        []FileMetadata
+		pos       compression.Offset
+		lastReg   = -1 // position in `fm` of the last regular file
+		uname     string
+		gname     string
+		hasDigest = true
+	)
+	for _, e := range toc.Entries {
+		if e.Uname != "" {
+			uname = e.Uname
+		}
+		if e.Gname != "" {
+			gname = e.Gname
+		}
+		switch e.Type {
+		case "chunk":
+			if lastReg < 0 || cleanPath(fm[lastReg].Name) != cleanPath(e.Name) {
+				return nil, fmt.Errorf("chunk of %s doesn't follow its file", e.Name)
+			}
+			reg := fm[lastReg]
+			if uncompressedOffsets[e.Offset] != reg.UncompressedOffset+compression.Offset(e.ChunkOffset) {
+				return nil, fmt.Errorf("chunk of %s at offset %d doesn't match its gzip member", e.Name, e.ChunkOffset)
+			}
+			pos = reg.UncompressedOffset + compression.Offset(e.ChunkOffset+e.chunkSize(int64(reg.UncompressedSize)))
+			continue
+		case "reg", "dir", "symlink", "hardlink", "char", "block", "fifo":
+		default:
+			return nil, fmt.Errorf("unsupported eStargz entry type %q of %s", e.Type, e.Name)
+		}
+
+		metadataEntry := FileMetadata{
+			Name:               e.Name,
+			Type:               e.Type,
+			UncompressedOffset: pos,
+			Linkname:           e.LinkName,
+			Mode:               e.Mode,
+			UID:                e.UID,
+			GID:                e.GID,
+			Uname:              uname,
+			Gname:              gname,
+			Devmajor:           e.DevMajor,
+			Devminor:           e.DevMinor,
+		}
+		if e.ModTime3339 != "" {
+			metadataEntry.ModTime, err = time.Parse(time.RFC3339, e.ModTime3339)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modtime of %s: %w", e.Name, err)
+			}
+		}
+		if len(e.Xattrs) > 0 {
+			// the full scan records the PAX records, which is where tar stores xattrs.
+			metadataEntry.Xattrs = make(map[string]string, len(e.Xattrs))
+			for k, v := range e.Xattrs {
+				metadataEntry.Xattrs["SCHILY.xattr."+k] = string(v)
+			}
+		}
+		if e.Type == "reg" {
+			metadataEntry.UncompressedSize = compression.Offset(e.Size)
+			if e.Size > 0 {
+				metadataEntry.UncompressedOffset = uncompressedOffsets[e.Offset]
+				if e.Digest == "" {
+					hasDigest = false
+				} else if metadataEntry.Digest, err = digest.Parse(e.Digest); err != nil {
+					return nil, fmt.Errorf("invalid digest of %s: %w", e.Name, err)
+				}
+				pos = metadataEntry.UncompressedOffset + compression.Offset(e.chunkSize(e.Size))
+			} else {
+				metadataEntry.Digest = digest.FromBytes(nil)
+			}
+		}
+		if e.Type == "reg" {
+			lastReg = len(fm)
+		}
+		fm = append(fm, metadataEntry)
+	}
+
+	// the TOC is a file of the layer too.
+	fm = append(fm, FileMetadata{
+		Name:               tocHeader.Name,
+		Type:               "reg",
+		UncompressedOffset: uncompressedOffsets[tocOffset] + tocDataOffset,
+		UncompressedSize:   compression.Offset(len(tocJSON)),
+		Mode:               tocHeader.Mode,
+		UID:                tocHeader.Uid,
+		GID:                tocHeader.Gid,
+		Uname:              tocHeader.Uname,
+		Gname:              tocHeader.Gname,
+		ModTime:            tocHeader.ModTime,
+		Digest:             digest.FromBytes(tocJSON),
+	})
+
+	version := Version10
+	if !hasDigest {
+		version = Version09
+		for i := range fm {
+			fm[i].Digest = ""
+		}
+	}
+
+	// the footer is an empty gzip member, so it doesn't need its own span.
+	zinfo, err := compression.NewGzipZinfoFromMembers(file, span, members[:len(members)-1])
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+	compressionInfo, fs, err := zinfoFromIndex(compression.Gzip, filename, zinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeCheckpoints(&Ztoc{
+		Version:                 version,
+		TOC:                     NewTOC(fm),
+		CompressedArchiveSize:   fs,
+		UncompressedArchiveSize: members[len(members)-1].UncompressedOffset,
+		BuildToolIdentifier:     b.buildToolIdentifier,
+		CompressionInfo:         compressionInfo,
+	}, opt)
+}
+
+// readEStargzTOC reads the TOC from the gzip member in `r`. It also returns the tar header of
+// the TOC, the offset of its content in the uncompressed member and its raw content.
+func readEStargzTOC(r io.Reader) (*estargzTOC, *tar.Header, compression.Offset, []byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, 0, nil, fmt.Errorf("cannot read eStargz TOC: %w", err)
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	pt := &positionTrackerReader{r: zr}
+	tr := tar.NewReader(pt)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, 0, nil, fmt.Errorf("cannot read eStargz TOC: %w", err)
+	}
+	if hdr.Name != estargzTOCName {
+		return nil, nil, 0, nil, fmt.Errorf("unexpected eStargz TOC entry %q, expect %q", hdr.Name, estargzTOCName)
+	}
+	dataOffset := pt.CurrentPos()
+	tocJSON, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, nil, 0, nil, fmt.Errorf("cannot read eStargz TOC: %w", err)
+	}
+	var toc estargzTOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		return nil, nil, 0, nil, fmt.Errorf("cannot parse eStargz TOC: %w", err)
+	}
+	return &toc, hdr, dataOffset, tocJSON, nil
+}
+
+// estargzMembers returns the gzip members starting at `compressedOffsets`, the last of which
+// must be the footer at `footerOffset`. The uncompressed size of every member is read from its
+// gzip trailer, which ends where the next member starts, unless the member is large enough for
+// the trailer to have wrapped.
+func estargzMembers(r io.ReaderAt, compressedOffsets []int64, footerOffset int64) ([]compression.GzipMember, error) {
+	sort.Slice(compressedOffsets, func(i, j int) bool { return compressedOffsets[i] < compressedOffsets[j] })
+	var offsets []int64
+	for i, off := range compressedOffsets {
+		if i > 0 && off == compressedOffsets[i-1] {
+			continue
+		}
+		if off < 0 || off > footerOffset {
+			return nil, fmt.Errorf("invalid gzip member offset in eStargz TOC: %d", off)
+		}
+		offsets = append(offsets, off)
+	}
+
+	members := make([]compression.GzipMember, len(offsets))
+	buf := make([]byte, 4)
+	for i, off := range offsets {
+		if _, err := r.ReadAt(buf[:2], off); err != nil {
+			return nil, err
+		}
+		if buf[0] != 0x1f || buf[1] != 0x8b {
+			return nil, fmt.Errorf("no gzip member at offset %d of eStargz layer", off)
+		}
+		members[i].CompressedOffset = compression.Offset(off)
+		if i == 0 {
+			continue
+		}
+		// ISIZE, the last 4 bytes of the trailer of the previous member.
+		if off-offsets[i-1] < 18 {
+			return nil, fmt.Errorf("gzip member at offset %d of eStargz layer is too small", offsets[i-1])
+		}
+		if _, err := r.ReadAt(buf, off-4); err != nil {
+			return nil, err
+		}
+		size := int64(binary.LittleEndian.Uint32(buf))
+		if off-offsets[i-1] > maxGzipMemberSizeWithoutFallback {
+			var err error
+			if size, err = gzipMemberSize(io.NewSectionReader(r, offsets[i-1], off-offsets[i-1]), size); err != nil {
+				return nil, fmt.Errorf("cannot decompress gzip member at offset %d of eStargz layer: %w", offsets[i-1], err)
+			}
+		}
+		members[i].UncompressedOffset = members[i-1].UncompressedOffset + compression.Offset(size)
+	}
+	return members, nil
+}
+
+// gzipMemberSize returns the uncompressed size of the gzip member in `r` by decompressing it,
+// and checks it against the ISIZE of its trailer `isize`.
+func gzipMemberSize(r io.Reader, isize int64) (int64, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	size, err := io.Copy(io.Discard, zr)
+	if err != nil {
+		return 0, err
+	}
+	if size%(1<<32) != isize {
+		return 0, fmt.Errorf("uncompressed size %d doesn't match the gzip trailer", size)
+	}
+	return size, nil
+}
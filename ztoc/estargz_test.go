@@ -0,0 +1,329 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+)
+
+// buildEStargz creates a temp eStargz file with the given `tarEntries`.
+// It returns the created filename and entry->content map.
+func buildEStargz(t *testing.T, tarEntries []testutil.TarEntry, chunkSize int) (string, map[string][]byte) {
+	tarFilePath, _, err := testutil.WriteTarToTempFile("estargz.*", testutil.BuildEStargz(tarEntries, chunkSize))
+	if err != nil {
+		t.Fatalf("cannot prepare the eStargz file for testing: %v", err)
+	}
+	m, _, err := testutil.GetFilesAndContentsWithinTarGz(tarFilePath)
+	if err != nil {
+		os.Remove(tarFilePath)
+		t.Fatalf("failed to get contents of the eStargz file: %v", err)
+	}
+	return tarFilePath, m
+}
+
+func TestBuildZtocFromEStargz(t *testing.T) {
+	randomData := func(size int) string {
+		b := make([]byte, size)
+		rand.Read(b)
+		return string(b)
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", "foo"),
+		testutil.File("dir/empty", ""),
+		testutil.File("dir/large", randomData(100000)),
+		testutil.Symlink("symlink", "dir/small"),
+		testutil.Link("hardlink", "dir/large"),
+		testutil.Dir("dir2/"),
+		testutil.File("dir2/xattrs", randomData(3000), testutil.WithFileXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.File("dir2/medium", randomData(30000)),
+	}
+	testCases := []struct {
+		name      string
+		chunkSize int
+		spanSize  int64
+	}{
+		{
+			name:      "unchunked files",
+			chunkSize: 0,
+			spanSize:  1 << 22,
+		},
+		{
+			name:      "chunked files with small spans",
+			chunkSize: 8192,
+			spanSize:  20000,
+		},
+		{
+			name:      "chunked files with spans of every member",
+			chunkSize: 4096,
+			spanSize:  1,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tarFilePath, contents := buildEStargz(t, tarEntries, tc.chunkSize)
+			defer os.Remove(tarFilePath)
+
+			ztocBuilder := NewBuilder("test")
+			expected, err := ztocBuilder.BuildZtoc(tarFilePath, tc.spanSize)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			actual, err := ztocBuilder.BuildZtocFromEStargz(tarFilePath, tc.spanSize)
+			if err != nil {
+				t.Fatalf("can't build ztoc from eStargz: %v", err)
+			}
+
+			if actual.Version != Version10 {
+				t.Fatalf("unexpected ztoc version: %s", actual.Version)
+			}
+			if actual.UncompressedArchiveSize != expected.UncompressedArchiveSize {
+				t.Fatalf("unexpected uncompressed archive size. expect: %d, actual: %d", expected.UncompressedArchiveSize, actual.UncompressedArchiveSize)
+			}
+			if actual.CompressedArchiveSize != expected.CompressedArchiveSize {
+				t.Fatalf("unexpected compressed archive size. expect: %d, actual: %d", expected.CompressedArchiveSize, actual.CompressedArchiveSize)
+			}
+			if len(actual.FileMetadata) != len(expected.FileMetadata) {
+				t.Fatalf("unexpected number of entries. expect: %d, actual: %d", len(expected.FileMetadata), len(actual.FileMetadata))
+			}
+			for _, e := range expected.FileMetadata {
+				a, ok := actual.Lookup(e.Name)
+				if !ok {
+					t.Fatalf("missing entry %s", e.Name)
+				}
+				if a.Type != e.Type || a.Mode != e.Mode || a.Linkname != e.Linkname && cleanPath(a.Linkname) != cleanPath(e.Linkname) {
+					t.Fatalf("unexpected metadata of %s. expect: %+v, actual: %+v", e.Name, e, a)
+				}
+				if e.Type != "reg" || e.UncompressedSize == 0 {
+					// eStargz doesn't record the offset of entries without content.
+					continue
+				}
+				if a.UncompressedOffset != e.UncompressedOffset || a.UncompressedSize != e.UncompressedSize || a.Digest != e.Digest {
+					t.Fatalf("unexpected metadata of %s. expect: %+v, actual: %+v", e.Name, e, a)
+				}
+			}
+			if a, ok := actual.Lookup("dir2/xattrs"); !ok || a.Xattrs["SCHILY.xattr.user.foo"] != "bar" {
+				t.Fatalf("unexpected xattrs of dir2/xattrs: %v", a.Xattrs)
+			}
+
+			file, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't open %s: %v", tarFilePath, err)
+			}
+			defer file.Close()
+			sr := io.NewSectionReader(file, 0, int64(actual.CompressedArchiveSize))
+			for _, f := range actual.FileMetadata {
+				if f.Type != "reg" {
+					continue
+				}
+				data, err := actual.ExtractFile(sr, f.Name)
+				if err != nil {
+					t.Fatalf("can't extract file %s: %v", f.Name, err)
+				}
+				if !bytes.Equal(data, contents[f.Name]) {
+					t.Fatalf("extracted content of file %s differs from the original", f.Name)
+				}
+				if digest.FromBytes(data) != f.Digest {
+					t.Fatalf("unexpected digest of file %s", f.Name)
+				}
+			}
+
+			// the ztoc must survive a round trip through its serialized form.
+			r, _, err := Marshal(actual)
+			if err != nil {
+				t.Fatalf("can't marshal ztoc: %v", err)
+			}
+			unmarshalled, err := Unmarshal(r)
+			if err != nil {
+				t.Fatalf("can't unmarshal ztoc: %v", err)
+			}
+			if unmarshalled.MaxSpanID != actual.MaxSpanID {
+				t.Fatalf("unexpected max span id after round trip. expect: %d, actual: %d", actual.MaxSpanID, unmarshalled.MaxSpanID)
+			}
+		})
+	}
+}
+
+func TestBuildZtocFromEStargzSpans(t *testing.T) {
+	tarFilePath, _ := buildEStargz(t, []testutil.TarEntry{
+		testutil.File("file1", string(make([]byte, 10000))),
+		testutil.File("file2", string(make([]byte, 10000))),
+		testutil.File("file3", string(make([]byte, 10000))),
+	}, 4000)
+	defer os.Remove(tarFilePath)
+
+	ztoc, err := NewBuilder("test").BuildZtocFromEStargz(tarFilePath, 9000)
+	if err != nil {
+		t.Fatalf("can't build ztoc from eStargz: %v", err)
+	}
+	zinfo, err := ztoc.Zinfo()
+	if err != nil {
+		t.Fatalf("can't get zinfo: %v", err)
+	}
+	defer zinfo.Close()
+	// spans can only start where the chunks of the files start, or at the gzip member
+	// of the TOC, which starts with the tar header of the TOC.
+	starts := make(map[compression.Offset]bool)
+	for _, f := range ztoc.FileMetadata {
+		if f.Name == estargzTOCName {
+			starts[f.UncompressedOffset-512] = true
+		}
+		for off := compression.Offset(0); off < f.UncompressedSize; off += 4000 {
+			starts[f.UncompressedOffset+off] = true
+		}
+	}
+	boundaries := spanBoundaries(zinfo)
+	if len(boundaries) == 0 {
+		t.Fatalf("expected more than one span")
+	}
+	for _, b := range boundaries {
+		if !starts[b] {
+			t.Fatalf("span starts at %d, which is not the start of a chunk", b)
+		}
+	}
+}
+
+func TestIsEStargz(t *testing.T) {
+	tarEntries := []testutil.TarEntry{testutil.File("file1", "foo")}
+	estargzFilePath, _ := buildEStargz(t, tarEntries, 0)
+	defer os.Remove(estargzFilePath)
+	tarGzFilePath, _, _ := buildTarGZ(t, "testcase0", tarEntries)
+	defer os.Remove(tarGzFilePath)
+
+	testCases := []struct {
+		name     string
+		filename string
+		expect   bool
+	}{
+		{
+			name:     "eStargz layer",
+			filename: estargzFilePath,
+			expect:   true,
+		},
+		{
+			name:     "gzip layer",
+			filename: tarGzFilePath,
+			expect:   false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.filename)
+			if err != nil {
+				t.Fatalf("can't read %s: %v", tc.filename, err)
+			}
+			if actual := IsEStargz(bytes.NewReader(data), int64(len(data))); actual != tc.expect {
+				t.Fatalf("expect eStargz: %t, actual: %t", tc.expect, actual)
+			}
+			if _, err := NewBuilder("test").BuildZtocFromEStargz(tc.filename, 1<<22); (err == nil) != tc.expect {
+				t.Fatalf("expect successful build: %t, actual error: %v", tc.expect, err)
+			}
+		})
+	}
+}
+
+func TestBuildZtocFromEStargzTOCDigest(t *testing.T) {
+	tarFilePath, contents := buildEStargz(t, []testutil.TarEntry{
+		testutil.File("file1", "foo"),
+	}, 0)
+	defer os.Remove(tarFilePath)
+	tocDigest := digest.FromBytes(contents[estargzTOCName])
+
+	testCases := []struct {
+		name          string
+		tocDigest     digest.Digest
+		expectedError error
+	}{
+		{
+			name:      "matching TOC digest",
+			tocDigest: tocDigest,
+		},
+		{
+			name:          "mismatching TOC digest",
+			tocDigest:     digest.FromString("other"),
+			expectedError: ErrEStargzTOCDigestMismatch,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewBuilder("test").BuildZtocFromEStargz(tarFilePath, 1<<22, WithEStargzTOCDigest(tc.tocDigest))
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestBuildZtocFromEStargzLargeMembers(t *testing.T) {
+	tarFilePath, _ := buildEStargz(t, []testutil.TarEntry{
+		testutil.File("file1", string(make([]byte, 10000))),
+		testutil.File("file2", "foo"),
+	}, 4000)
+	defer os.Remove(tarFilePath)
+	expected, err := NewBuilder("test").BuildZtocFromEStargz(tarFilePath, 9000)
+	if err != nil {
+		t.Fatalf("can't build ztoc from eStargz: %v", err)
+	}
+
+	// every member is decompressed, as if its ISIZE could have wrapped.
+	defer func(size int64) { maxGzipMemberSizeWithoutFallback = size }(maxGzipMemberSizeWithoutFallback)
+	maxGzipMemberSizeWithoutFallback = 0
+	actual, err := NewBuilder("test").BuildZtocFromEStargz(tarFilePath, 9000)
+	if err != nil {
+		t.Fatalf("can't build ztoc from eStargz decompressing its members: %v", err)
+	}
+	if diff := cmp.Diff(expected.FileMetadata, actual.FileMetadata); diff != "" {
+		t.Fatalf("unexpected files, diff = %v", diff)
+	}
+	if expected.UncompressedArchiveSize != actual.UncompressedArchiveSize {
+		t.Fatalf("unexpected uncompressed archive size. expect: %d, actual: %d", expected.UncompressedArchiveSize, actual.UncompressedArchiveSize)
+	}
+
+	// a trailer that doesn't match the decompressed member is rejected.
+	data, err := os.ReadFile(tarFilePath)
+	if err != nil {
+		t.Fatalf("can't read eStargz layer: %v", err)
+	}
+	tocOffset, _, err := parseEStargzFooter(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("can't parse eStargz footer: %v", err)
+	}
+	data[tocOffset-1]++
+	corrupted := filepath.Join(t.TempDir(), "corrupted")
+	if err := os.WriteFile(corrupted, data, 0600); err != nil {
+		t.Fatalf("can't write corrupted eStargz layer: %v", err)
+	}
+	if _, err := NewBuilder("test").BuildZtocFromEStargz(corrupted, 9000); err == nil {
+		t.Fatalf("expected error building ztoc from eStargz with a wrong gzip trailer, but got nil")
+	}
+}
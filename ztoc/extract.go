@@ -0,0 +1,440 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// extractMaxSpanSize is the maximum size of the compressed and uncompressed data of a span.
+// `ExtractTree` holds a single span in memory at a time, so this bounds its memory usage
+// regardless of the size of the files.
+var extractMaxSpanSize compression.Offset = 128 << 20
+
+// xattrPAXPrefix is the prefix of the PAX records containing extended attributes.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// extractEntry is an entry of the layer extracted by `ExtractTree`.
+type extractEntry struct {
+	// name is the cleaned path of the entry in the layer.
+	name string
+	// metadata is the metadata of the entry. A hard link whose target is not
+	// extracted is turned into a regular file with the metadata of its target.
+	metadata FileMetadata
+}
+
+// ExtractTree extracts the entry at `root` of the layer and, if it's a directory, every entry
+// under it to the directory `dest`. An empty `root` or "/" extracts the whole layer. The entries
+// keep their path in the layer, e.g. extracting "etc" creates "<dest>/etc". Modes, modification
+// times, symlinks, hard links, extended attributes and the holes of sparse files are restored
+// from the `TOC`, as well as the ownership when running as root. The regular files are streamed
+// span by span in the order of their content in the layer, so that every span is fetched and
+// decompressed only once.
+func (zt Ztoc) ExtractTree(r *io.SectionReader, root, dest string) error {
+	entries, err := zt.treeEntries(root)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	var (
+		files []extractEntry
+		links []extractEntry
+		dirs  []extractEntry
+	)
+	for _, e := range entries {
+		if err := os.MkdirAll(filepath.Join(dest, path.Dir(e.name)), 0755); err != nil {
+			return err
+		}
+		switch e.metadata.Type {
+		case "reg":
+			files = append(files, e)
+		case "hardlink":
+			links = append(links, e)
+		case "dir":
+			dirs = append(dirs, e)
+			if err := extractDir(filepath.Join(dest, e.name)); err != nil {
+				return err
+			}
+		default:
+			if err := extractSpecialFile(filepath.Join(dest, e.name), e.metadata); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := zt.extractRegularFiles(r, dest, files); err != nil {
+		return err
+	}
+	for _, e := range links {
+		target := filepath.Join(dest, cleanPath(e.metadata.Linkname))
+		p := filepath.Join(dest, e.name)
+		if err := removeExisting(p); err != nil {
+			return err
+		}
+		if err := os.Link(target, p); err != nil {
+			return fmt.Errorf("cannot create hard link %s: %w", e.name, err)
+		}
+	}
+	// directories are restored last, deepest first, so that creating their content
+	// doesn't change their modification time or require write permissions.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := applyMetadata(filepath.Join(dest, dirs[i].name), dirs[i].metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeEntries returns the entries extracted by `ExtractTree`, sorted by path so that
+// parents come before their children. It fails if an entry would be created under an
+// entry that is not a directory, which could write outside of the destination through
+// a symlink.
+func (zt Ztoc) treeEntries(root string) ([]extractEntry, error) {
+	idx := zt.getIndex()
+	root = cleanPath(root)
+	if _, ok := idx.byPath[root]; !ok && root != "" {
+		return nil, fmt.Errorf("file %s does not exist in metadata", root)
+	}
+
+	var entries []extractEntry
+	extracted := make(map[string]bool)
+	for _, p := range idx.paths {
+		if p == "" || (root != "" && p != root && !strings.HasPrefix(p, root+"/")) {
+			continue
+		}
+		for parent := path.Dir(p); parent != "."; parent = path.Dir(parent) {
+			if i, ok := idx.byPath[parent]; ok && zt.FileMetadata[i].Type != "dir" {
+				return nil, fmt.Errorf("cannot extract %s: %s is not a directory", p, parent)
+			}
+		}
+		extracted[p] = true
+		entries = append(entries, extractEntry{name: p, metadata: zt.FileMetadata[idx.byPath[p]]})
+	}
+
+	for i, e := range entries {
+		if e.metadata.Type != "hardlink" {
+			continue
+		}
+		target := cleanPath(e.metadata.Linkname)
+		if m, ok := zt.Lookup(target); ok && m.Type == "reg" && extracted[target] {
+			continue
+		}
+		// the target is not extracted, so the link gets a copy of the content.
+		m, err := zt.Resolve(e.name)
+		if err != nil {
+			return nil, err
+		}
+		if m.Type != "reg" {
+			return nil, fmt.Errorf("hard link %s does not point to a regular file", e.name)
+		}
+		entries[i].metadata = m
+	}
+	return entries, nil
+}
+
+// extractRegularFiles writes the content of the regular `files` under `dest`.
+func (zt Ztoc) extractRegularFiles(r *io.SectionReader, dest string, files []extractEntry) error {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return err
+	}
+	defer zinfo.Close()
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].metadata.UncompressedOffset < files[j].metadata.UncompressedOffset
+	})
+	sr := &spanReader{r: r, zinfo: zinfo, compressedSize: zt.CompressedArchiveSize, uncompressedSize: zt.UncompressedArchiveSize}
+	for _, f := range files {
+		if err := extractRegularFile(sr, filepath.Join(dest, f.name), f.name, f.metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractRegularFile creates the regular file `p` with the metadata `m`, streaming its
+// content from `sr` and verifying it against the digest of `m`, if any.
+func extractRegularFile(sr *spanReader, p, name string, m FileMetadata) (retErr error) {
+	if err := removeExisting(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			os.Remove(p)
+		}
+	}()
+
+	var w io.Writer = &storedWriter{f: f, sparseMap: m.SparseMap}
+	var digester digest.Digester
+	if m.Digest != "" {
+		if err := m.Digest.Validate(); err != nil {
+			return fmt.Errorf("invalid digest of %s: %w", name, err)
+		}
+		if m.SparseMap == nil {
+			digester = m.Digest.Algorithm().Digester()
+			w = io.MultiWriter(w, digester.Hash())
+		}
+	}
+	if err := sr.copyRange(w, m.UncompressedOffset, m.UncompressedOffset+m.StoredSize()); err != nil {
+		return fmt.Errorf("cannot extract %s: %w", name, err)
+	}
+	if err := f.Truncate(int64(m.UncompressedSize)); err != nil {
+		return err
+	}
+	if m.Digest != "" {
+		dgst := m.Digest
+		if digester != nil {
+			dgst = digester.Digest()
+		} else if dgst, err = m.Digest.Algorithm().FromReader(io.NewSectionReader(f, 0, int64(m.UncompressedSize))); err != nil {
+			// the digest of a sparse file covers its holes, so it's computed from the written file.
+			return err
+		}
+		if dgst != m.Digest {
+			return fmt.Errorf("digest of extracted file %s does not match: expected %s", name, m.Digest)
+		}
+	}
+	return applyMetadata(p, m)
+}
+
+// storedWriter writes the stored data of a file, which is only the data fragments of sparse files.
+type storedWriter struct {
+	f         *os.File
+	sparseMap []SparseEntry
+	pos       compression.Offset
+}
+
+func (w *storedWriter) Write(p []byte) (int, error) {
+	if w.sparseMap == nil {
+		n, err := w.f.WriteAt(p, int64(w.pos))
+		w.pos += compression.Offset(n)
+		return n, err
+	}
+	written := 0
+	var fragmentStart compression.Offset
+	for _, e := range w.sparseMap {
+		if len(p) == 0 {
+			break
+		}
+		if w.pos >= fragmentStart+e.Length {
+			fragmentStart += e.Length
+			continue
+		}
+		chunk := p
+		if remaining := fragmentStart + e.Length - w.pos; compression.Offset(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := w.f.WriteAt(chunk, int64(e.Offset+w.pos-fragmentStart))
+		written += n
+		w.pos += compression.Offset(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		fragmentStart += e.Length
+	}
+	if len(p) != 0 {
+		return written, fmt.Errorf("stored data exceeds the sparse map")
+	}
+	return written, nil
+}
+
+// spanReader fetches and decompresses the spans of a layer one at a time, keeping only the last one.
+type spanReader struct {
+	r                *io.SectionReader
+	zinfo            compression.Zinfo
+	compressedSize   compression.Offset
+	uncompressedSize compression.Offset
+
+	loaded bool
+	id     compression.SpanID
+	start  compression.Offset
+	data   []byte
+
+	// the last compressed byte of the last span, which may be the first of the next one.
+	lastByte    byte
+	lastByteEnd compression.Offset
+}
+
+// copyRange writes the uncompressed data [start, end) of the layer to `w`, span by span.
+func (sr *spanReader) copyRange(w io.Writer, start, end compression.Offset) error {
+	for off := start; off < end; {
+		if err := sr.load(sr.zinfo.UncompressedOffsetToSpanID(off)); err != nil {
+			return err
+		}
+		spanEnd := sr.start + compression.Offset(len(sr.data))
+		if off < sr.start || off >= spanEnd {
+			return fmt.Errorf("span %d doesn't contain offset %d", sr.id, off)
+		}
+		n := end - off
+		if n > spanEnd-off {
+			n = spanEnd - off
+		}
+		if _, err := w.Write(sr.data[off-sr.start : off-sr.start+n]); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// load fetches and decompresses the span `id`, unless it's the last loaded span.
+func (sr *spanReader) load(id compression.SpanID) error {
+	if sr.loaded && sr.id == id {
+		return nil
+	}
+	sr.loaded, sr.data = false, nil
+	start := sr.zinfo.StartCompressedOffset(id)
+	end := sr.zinfo.EndCompressedOffset(id, sr.compressedSize)
+	uncompressedStart := sr.zinfo.StartUncompressedOffset(id)
+	uncompressedEnd := sr.zinfo.EndUncompressedOffset(id, sr.uncompressedSize)
+	if end < start || uncompressedEnd < uncompressedStart {
+		return fmt.Errorf("invalid span %d", id)
+	}
+	if size := (end - start) + (uncompressedEnd - uncompressedStart); size > extractMaxSpanSize {
+		return fmt.Errorf("span %d is too large to be extracted: %d bytes, max %d", id, size, extractMaxSpanSize)
+	}
+
+	buf := make([]byte, end-start)
+	readStart := start
+	if len(buf) > 0 && sr.lastByteEnd != 0 && start == sr.lastByteEnd-1 {
+		buf[0] = sr.lastByte
+		readStart++
+	}
+	n, err := sr.r.ReadAt(buf[readStart-start:], int64(readStart))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n != len(buf)-int(readStart-start) {
+		return fmt.Errorf("unexpected data size. read = %d, expected = %d", n, len(buf)-int(readStart-start))
+	}
+	if len(buf) > 0 {
+		sr.lastByte, sr.lastByteEnd = buf[len(buf)-1], end
+	}
+
+	data := []byte{}
+	if uncompressedEnd > uncompressedStart {
+		data, err = sr.zinfo.ExtractDataFromBuffer(buf, uncompressedEnd-uncompressedStart, uncompressedStart, id)
+		if err != nil {
+			return err
+		}
+	}
+	sr.loaded, sr.id, sr.start, sr.data = true, id, uncompressedStart, data
+	return nil
+}
+
+// extractDir creates the directory `p` if it doesn't exist yet.
+func extractDir(p string) error {
+	fi, err := os.Lstat(p)
+	if err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Mkdir(p, 0700)
+}
+
+// extractSpecialFile creates the symlink, device or fifo `p` with the metadata `m`.
+func extractSpecialFile(p string, m FileMetadata) error {
+	if err := removeExisting(p); err != nil {
+		return err
+	}
+	var err error
+	switch m.Type {
+	case "symlink":
+		err = os.Symlink(m.Linkname, p)
+	case "char":
+		err = unix.Mknod(p, unix.S_IFCHR|0600, int(unix.Mkdev(uint32(m.Devmajor), uint32(m.Devminor))))
+	case "block":
+		err = unix.Mknod(p, unix.S_IFBLK|0600, int(unix.Mkdev(uint32(m.Devmajor), uint32(m.Devminor))))
+	case "fifo":
+		err = unix.Mkfifo(p, 0600)
+	default:
+		return fmt.Errorf("unsupported file type %q of %s", m.Type, m.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot create %s: %w", m.Name, err)
+	}
+	return applyMetadata(p, m)
+}
+
+// removeExisting removes the non-directory file at `p`, if any, so that it can be
+// replaced without following a symlink.
+func removeExisting(p string) error {
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// applyMetadata applies the ownership, mode, extended attributes, and modification
+// and access times of `m` to the file `p`. The ownership is only applied when running as root.
+func applyMetadata(p string, m FileMetadata) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(p, m.UID, m.GID); err != nil {
+			return err
+		}
+	}
+	if m.Type != "symlink" {
+		// chmod after chown, which clears the setuid and setgid bits.
+		if err := os.Chmod(p, m.FileMode()&^os.ModeType); err != nil {
+			return err
+		}
+	}
+	for k, v := range m.Xattrs {
+		if !strings.HasPrefix(k, xattrPAXPrefix) {
+			continue
+		}
+		if err := unix.Lsetxattr(p, strings.TrimPrefix(k, xattrPAXPrefix), []byte(v), 0); err != nil {
+			return fmt.Errorf("cannot set xattr %s of %s: %w", k, m.Name, err)
+		}
+	}
+	if m.ModTime.IsZero() {
+		return nil
+	}
+	mtime := unix.NsecToTimespec(m.ModTime.UnixNano())
+	atime := mtime
+	if !m.AccessTime.IsZero() {
+		atime = unix.NsecToTimespec(m.AccessTime.UnixNano())
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, []unix.Timespec{atime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,304 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"golang.org/x/sys/unix"
+)
+
+// countingReaderAt counts the bytes read at every offset.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := int64(0); i < int64(n); i++ {
+		c.reads[off+i]++
+	}
+	return n, err
+}
+
+func TestExtractTree(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	large := string(testutil.RandomByteData(300000))
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("etc/", testutil.WithDirMode(0750), testutil.WithDirModTime(modTime), testutil.WithDirOwner(1000, 1001)),
+		testutil.File("etc/passwd", "root:x:0:0", testutil.WithFileMode(0644), testutil.WithFileModTime(modTime)),
+		testutil.File("etc/shadow", "secret", testutil.WithFileMode(0600), testutil.WithFileOwner(1000, 1001)),
+		testutil.File("etc/setuid", "run", testutil.WithFileMode(0755|os.ModeSetuid)),
+		testutil.File("etc/empty", ""),
+		testutil.File("etc/xattrs", "foo", testutil.WithFileXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.Symlink("etc/localtime", "../usr/share/zoneinfo/UTC"),
+		testutil.Link("etc/passwd-", "etc/passwd"),
+		testutil.Link("etc/large-link", "usr/large"),
+		testutil.Dir("etc/sub/"),
+		testutil.File("etc/sub/nested", "nested"),
+		testutil.Dir("usr/"),
+		testutil.File("usr/large", large),
+		testutil.File("usr/other", "other"),
+	}
+	tarFilePath, contents, _ := buildTarGZ(t, "extract", tarEntries)
+	defer os.Remove(tarFilePath)
+	toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	file, err := os.Open(tarFilePath)
+	if err != nil {
+		t.Fatalf("can't open %s: %v", tarFilePath, err)
+	}
+	defer file.Close()
+
+	xattrsSupported := unix.Setxattr(t.TempDir(), "user.test", []byte("test"), 0) == nil
+
+	testCases := []struct {
+		name   string
+		root   string
+		expect []string
+	}{
+		{
+			name: "whole layer",
+			root: "/",
+			expect: []string{"etc", "etc/empty", "etc/large-link", "etc/localtime", "etc/passwd", "etc/passwd-", "etc/setuid",
+				"etc/shadow", "etc/sub", "etc/sub/nested", "etc/xattrs", "usr", "usr/large", "usr/other"},
+		},
+		{
+			name: "directory",
+			root: "etc",
+			expect: []string{"etc", "etc/empty", "etc/large-link", "etc/localtime", "etc/passwd", "etc/passwd-", "etc/setuid",
+				"etc/shadow", "etc/sub", "etc/sub/nested", "etc/xattrs"},
+		},
+		{
+			name:   "nested directory with trailing slash",
+			root:   "./etc/sub/",
+			expect: []string{"etc/sub", "etc/sub/nested"},
+		},
+		{
+			name:   "single file",
+			root:   "usr/other",
+			expect: []string{"usr/other"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			reader := &countingReaderAt{r: file, reads: make(map[int64]int)}
+			if err := toc.ExtractTree(io.NewSectionReader(reader, 0, int64(toc.CompressedArchiveSize)), tc.root, dest); err != nil {
+				t.Fatalf("can't extract %s: %v", tc.root, err)
+			}
+			for off, n := range reader.reads {
+				if n > 1 {
+					t.Fatalf("compressed byte at offset %d was read %d times", off, n)
+				}
+			}
+
+			var actual []string
+			err := filepath.Walk(dest, func(p string, _ os.FileInfo, err error) error {
+				if err != nil || p == dest {
+					return err
+				}
+				rel, _ := filepath.Rel(dest, p)
+				actual = append(actual, rel)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("can't walk %s: %v", dest, err)
+			}
+			// intermediate directories of the root are created too.
+			var expect []string
+			for _, p := range tc.expect {
+				for dir := filepath.Dir(p); dir != "." && !contains(expect, dir) && !contains(tc.expect, dir); dir = filepath.Dir(dir) {
+					expect = append(expect, dir)
+				}
+			}
+			expect = append(expect, tc.expect...)
+			sort.Strings(expect)
+			if strings.Join(actual, ",") != strings.Join(expect, ",") {
+				t.Fatalf("unexpected extracted files. expect: %v, actual: %v", expect, actual)
+			}
+
+			for _, p := range tc.expect {
+				m, ok := toc.Lookup(p)
+				if !ok {
+					t.Fatalf("missing entry %s", p)
+				}
+				fi, err := os.Lstat(filepath.Join(dest, p))
+				if err != nil {
+					t.Fatalf("can't stat %s: %v", p, err)
+				}
+				if m.Type == "hardlink" {
+					m, _ = toc.Resolve(p)
+				}
+				// the permissions of symlinks are not used on Linux.
+				if m.Type != "symlink" && fi.Mode() != m.FileMode() {
+					t.Fatalf("unexpected mode of %s. expect: %v, actual: %v", p, m.FileMode(), fi.Mode())
+				}
+				if !m.ModTime.IsZero() && !fi.ModTime().Equal(m.ModTime) {
+					t.Fatalf("unexpected modification time of %s. expect: %v, actual: %v", p, m.ModTime, fi.ModTime())
+				}
+				if os.Geteuid() == 0 {
+					st := fi.Sys().(*syscall.Stat_t)
+					if int(st.Uid) != m.UID || int(st.Gid) != m.GID {
+						t.Fatalf("unexpected owner of %s. expect: %d:%d, actual: %d:%d", p, m.UID, m.GID, st.Uid, st.Gid)
+					}
+				}
+				switch m.Type {
+				case "reg":
+					data, err := os.ReadFile(filepath.Join(dest, p))
+					if err != nil {
+						t.Fatalf("can't read %s: %v", p, err)
+					}
+					if !bytes.Equal(data, contents[m.Name]) {
+						t.Fatalf("unexpected content of %s", p)
+					}
+				case "symlink":
+					target, err := os.Readlink(filepath.Join(dest, p))
+					if err != nil || target != m.Linkname {
+						t.Fatalf("unexpected target of symlink %s: %s, %v", p, target, err)
+					}
+				}
+			}
+
+			if contains(tc.expect, "etc/xattrs") && xattrsSupported {
+				buf := make([]byte, 16)
+				n, err := unix.Lgetxattr(filepath.Join(dest, "etc/xattrs"), "user.foo", buf)
+				if err != nil || string(buf[:n]) != "bar" {
+					t.Fatalf("unexpected xattr of etc/xattrs: %q, %v", buf[:n], err)
+				}
+			}
+			if contains(tc.expect, "etc/passwd-") {
+				// the hard link points to an extracted file, so they share the inode.
+				fi1, _ := os.Stat(filepath.Join(dest, "etc/passwd"))
+				fi2, _ := os.Stat(filepath.Join(dest, "etc/passwd-"))
+				if !os.SameFile(fi1, fi2) {
+					t.Fatalf("etc/passwd- is not a hard link to etc/passwd")
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTreeInvalid(t *testing.T) {
+	testCases := []struct {
+		name       string
+		tarEntries []testutil.TarEntry
+		root       string
+	}{
+		{
+			name:       "missing root",
+			tarEntries: []testutil.TarEntry{testutil.File("foo", "bar")},
+			root:       "missing",
+		},
+		{
+			name: "file under a symlink",
+			tarEntries: []testutil.TarEntry{
+				testutil.Symlink("escape", "/tmp"),
+				testutil.File("escape/foo", "bar"),
+			},
+			root: "/",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tarFilePath, _, _ := buildTarGZ(t, "extract", tc.tarEntries)
+			defer os.Remove(tarFilePath)
+			toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			file, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't open %s: %v", tarFilePath, err)
+			}
+			defer file.Close()
+			if err := toc.ExtractTree(io.NewSectionReader(file, 0, int64(toc.CompressedArchiveSize)), tc.root, t.TempDir()); err == nil {
+				t.Fatalf("expect error, actual: nil")
+			}
+		})
+	}
+}
+
+func TestExtractTreeMaxSpanSize(t *testing.T) {
+	tarFilePath, contents, _ := buildTarGZ(t, "extract", []testutil.TarEntry{
+		testutil.File("large", string(testutil.RandomByteData(300000))),
+	})
+	defer os.Remove(tarFilePath)
+	toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	file, err := os.Open(tarFilePath)
+	if err != nil {
+		t.Fatalf("can't open %s: %v", tarFilePath, err)
+	}
+	defer file.Close()
+	sr := io.NewSectionReader(file, 0, int64(toc.CompressedArchiveSize))
+
+	defer func(size compression.Offset) { extractMaxSpanSize = size }(extractMaxSpanSize)
+	// the compressed and uncompressed data of the file are larger than the limit, but
+	// it's streamed span by span.
+	extractMaxSpanSize = 400000
+	dest := t.TempDir()
+	if err := toc.ExtractTree(sr, "/", dest); err != nil {
+		t.Fatalf("can't extract a file larger than the max span size: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "large"))
+	if err != nil || !bytes.Equal(data, contents["large"]) {
+		t.Fatalf("unexpected content of the extracted file: %v", err)
+	}
+
+	// a span larger than the limit is not extracted.
+	extractMaxSpanSize = 65536
+	dest = t.TempDir()
+	if err := toc.ExtractTree(sr, "/", dest); err == nil {
+		t.Fatalf("expected error extracting spans larger than the max span size, but got nil")
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "large")); !os.IsNotExist(err) {
+		t.Fatalf("partially extracted file was not removed: %v", err)
+	}
+}
+
+func contains(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
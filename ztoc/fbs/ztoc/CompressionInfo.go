@@ -108,8 +108,20 @@ func (rcv *CompressionInfo) MutateCheckpoints(j int, n byte) bool {
 	return false
 }
 
+func (rcv *CompressionInfo) CheckpointsEncoding() CheckpointsEncoding {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+	if o != 0 {
+		return CheckpointsEncoding(rcv._tab.GetInt8(o + rcv._tab.Pos))
+	}
+	return 0
+}
+
+func (rcv *CompressionInfo) MutateCheckpointsEncoding(n CheckpointsEncoding) bool {
+	return rcv._tab.MutateInt8Slot(12, int8(n))
+}
+
 func CompressionInfoStart(builder *flatbuffers.Builder) {
-	builder.StartObject(4)
+	builder.StartObject(5)
 }
 func CompressionInfoAddCompressionAlgorithm(builder *flatbuffers.Builder, compressionAlgorithm CompressionAlgorithm) {
 	builder.PrependInt8Slot(0, int8(compressionAlgorithm), 1)
@@ -129,6 +141,9 @@ func CompressionInfoAddCheckpoints(builder *flatbuffers.Builder, checkpoints fla
 func CompressionInfoStartCheckpointsVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(1, numElems, 1)
 }
+func CompressionInfoAddCheckpointsEncoding(builder *flatbuffers.Builder, checkpointsEncoding CheckpointsEncoding) {
+	builder.PrependInt8Slot(4, int8(checkpointsEncoding), 0)
+}
 func CompressionInfoEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
@@ -185,8 +185,51 @@ func (rcv *FileMetadata) XattrsLength() int {
 	return 0
 }
 
+func (rcv *FileMetadata) Digest() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(32))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *FileMetadata) AccessTime() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(34))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *FileMetadata) ChangeTime() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(36))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *FileMetadata) SparseMap(obj *SparseEntry, j int) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(38))
+	if o != 0 {
+		x := rcv._tab.Vector(o)
+		x += flatbuffers.UOffsetT(j) * 16
+		obj.Init(rcv._tab.Bytes, x)
+		return true
+	}
+	return false
+}
+
+func (rcv *FileMetadata) SparseMapLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(38))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
 func FileMetadataStart(builder *flatbuffers.Builder) {
-	builder.StartObject(14)
+	builder.StartObject(18)
 }
 func FileMetadataAddName(builder *flatbuffers.Builder, name flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(name), 0)
@@ -233,6 +276,21 @@ func FileMetadataAddXattrs(builder *flatbuffers.Builder, xattrs flatbuffers.UOff
 func FileMetadataStartXattrsVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(4, numElems, 4)
 }
+func FileMetadataAddDigest(builder *flatbuffers.Builder, digest flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(14, flatbuffers.UOffsetT(digest), 0)
+}
+func FileMetadataAddAccessTime(builder *flatbuffers.Builder, accessTime flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(15, flatbuffers.UOffsetT(accessTime), 0)
+}
+func FileMetadataAddChangeTime(builder *flatbuffers.Builder, changeTime flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(16, flatbuffers.UOffsetT(changeTime), 0)
+}
+func FileMetadataAddSparseMap(builder *flatbuffers.Builder, sparseMap flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(17, flatbuffers.UOffsetT(sparseMap), 0)
+}
+func FileMetadataStartSparseMapVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(16, numElems, 8)
+}
 func FileMetadataEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
@@ -0,0 +1,281 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// JSONSchemaVersion is the version of the JSON schema written by `ToJSON`.
+// It is incremented when a change to the schema can't be read by older versions.
+const JSONSchemaVersion = 1
+
+// checkpointsEncodingRawJSON is the name of `compression.CheckpointsEncodingRaw` in JSON.
+const checkpointsEncodingRawJSON = "raw"
+
+// jsonZtoc is the JSON representation of a `Ztoc`. Every field of the flatbuffers
+// schema is represented, so that a ztoc survives a round trip through JSON.
+type jsonZtoc struct {
+	Schema                  int                 `json:"schema"`
+	Version                 Version             `json:"version"`
+	BuildToolIdentifier     string              `json:"build_tool_identifier"`
+	CompressedArchiveSize   compression.Offset  `json:"compressed_archive_size"`
+	UncompressedArchiveSize compression.Offset  `json:"uncompressed_archive_size"`
+	TOC                     jsonTOC             `json:"toc"`
+	CompressionInfo         jsonCompressionInfo `json:"compression_info"`
+}
+
+type jsonTOC struct {
+	Files []jsonFileMetadata `json:"files"`
+}
+
+type jsonFileMetadata struct {
+	Name               jsonString         `json:"name"`
+	Type               string             `json:"type"`
+	UncompressedOffset compression.Offset `json:"uncompressed_offset"`
+	UncompressedSize   compression.Offset `json:"uncompressed_size"`
+	Linkname           jsonString         `json:"linkname,omitempty"`
+	Mode               int64              `json:"mode"`
+	UID                int                `json:"uid"`
+	GID                int                `json:"gid"`
+	Uname              jsonString         `json:"uname,omitempty"`
+	Gname              jsonString         `json:"gname,omitempty"`
+	ModTime            time.Time          `json:"mod_time"`
+	AccessTime         *time.Time         `json:"access_time,omitempty"`
+	ChangeTime         *time.Time         `json:"change_time,omitempty"`
+	Devmajor           int64              `json:"devmajor,omitempty"`
+	Devminor           int64              `json:"devminor,omitempty"`
+	Xattrs             []jsonXattr        `json:"xattrs,omitempty"`
+	Digest             digest.Digest      `json:"digest,omitempty"`
+	SparseMap          []jsonSparseEntry  `json:"sparse_map,omitempty"`
+}
+
+type jsonXattr struct {
+	Key   jsonString `json:"key"`
+	Value jsonString `json:"value"`
+}
+
+type jsonSparseEntry struct {
+	Offset compression.Offset `json:"offset"`
+	Length compression.Offset `json:"length"`
+}
+
+type jsonCompressionInfo struct {
+	CompressionAlgorithm string             `json:"compression_algorithm"`
+	MaxSpanID            compression.SpanID `json:"max_span_id"`
+	SpanDigests          []digest.Digest    `json:"span_digests"`
+	Checkpoints          []byte             `json:"checkpoints"` // base64 encoded
+	CheckpointsEncoding  string             `json:"checkpoints_encoding"`
+}
+
+// jsonString is a string that is written to JSON as a string if it is valid UTF-8,
+// or as an object with its base64 encoding otherwise (e.g., binary xattrs).
+type jsonString string
+
+type jsonBinaryString struct {
+	Base64 string `json:"base64"`
+}
+
+func (s jsonString) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(string(s)) {
+		return json.Marshal(string(s))
+	}
+	return json.Marshal(jsonBinaryString{Base64: base64.StdEncoding.EncodeToString([]byte(s))})
+}
+
+func (s *jsonString) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = jsonString(str)
+		return nil
+	}
+	var bin jsonBinaryString
+	if err := json.Unmarshal(data, &bin); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(bin.Base64)
+	if err != nil {
+		return err
+	}
+	*s = jsonString(b)
+	return nil
+}
+
+// ToJSON writes `ztoc` to `w` as indented JSON. Unlike `soci ztoc info`, every field of
+// the ztoc is written, including the span digests and the checkpoints (base64 encoded),
+// so that `FromJSON` returns a ztoc that marshals to the same bytes.
+func ToJSON(ztoc *Ztoc, w io.Writer) error {
+	jz := jsonZtoc{
+		Schema:                  JSONSchemaVersion,
+		Version:                 ztoc.Version,
+		BuildToolIdentifier:     ztoc.BuildToolIdentifier,
+		CompressedArchiveSize:   ztoc.CompressedArchiveSize,
+		UncompressedArchiveSize: ztoc.UncompressedArchiveSize,
+		TOC: jsonTOC{
+			Files: make([]jsonFileMetadata, 0, len(ztoc.FileMetadata)),
+		},
+		CompressionInfo: jsonCompressionInfo{
+			CompressionAlgorithm: ztoc.CompressionAlgorithm,
+			MaxSpanID:            ztoc.MaxSpanID,
+			SpanDigests:          ztoc.SpanDigests,
+			Checkpoints:          ztoc.Checkpoints,
+			CheckpointsEncoding:  string(ztoc.CheckpointsEncoding),
+		},
+	}
+	if jz.CompressionInfo.CheckpointsEncoding == string(compression.CheckpointsEncodingRaw) {
+		jz.CompressionInfo.CheckpointsEncoding = checkpointsEncodingRawJSON
+	}
+	if jz.CompressionInfo.SpanDigests == nil {
+		jz.CompressionInfo.SpanDigests = []digest.Digest{}
+	}
+	for _, m := range ztoc.FileMetadata {
+		jm := jsonFileMetadata{
+			Name:               jsonString(m.Name),
+			Type:               m.Type,
+			UncompressedOffset: m.UncompressedOffset,
+			UncompressedSize:   m.UncompressedSize,
+			Linkname:           jsonString(m.Linkname),
+			Mode:               m.Mode,
+			UID:                m.UID,
+			GID:                m.GID,
+			Uname:              jsonString(m.Uname),
+			Gname:              jsonString(m.Gname),
+			ModTime:            m.ModTime,
+			Devmajor:           m.Devmajor,
+			Devminor:           m.Devminor,
+			Digest:             m.Digest,
+		}
+		if !m.AccessTime.IsZero() {
+			accessTime := m.AccessTime
+			jm.AccessTime = &accessTime
+		}
+		if !m.ChangeTime.IsZero() {
+			changeTime := m.ChangeTime
+			jm.ChangeTime = &changeTime
+		}
+		keys := make([]string, 0, len(m.Xattrs))
+		for k := range m.Xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			jm.Xattrs = append(jm.Xattrs, jsonXattr{Key: jsonString(k), Value: jsonString(m.Xattrs[k])})
+		}
+		for _, e := range m.SparseMap {
+			jm.SparseMap = append(jm.SparseMap, jsonSparseEntry{Offset: e.Offset, Length: e.Length})
+		}
+		jz.TOC.Files = append(jz.TOC.Files, jm)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jz)
+}
+
+// FromJSON reads a ztoc written by `ToJSON` from `r`.
+func FromJSON(r io.Reader) (*Ztoc, error) {
+	var jz jsonZtoc
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jz); err != nil {
+		return nil, fmt.Errorf("cannot decode ztoc JSON: %w", err)
+	}
+	if jz.Schema != JSONSchemaVersion {
+		return nil, fmt.Errorf("unsupported ztoc JSON schema version %d, expected %d", jz.Schema, JSONSchemaVersion)
+	}
+
+	ztoc := &Ztoc{
+		Version:                 jz.Version,
+		BuildToolIdentifier:     jz.BuildToolIdentifier,
+		CompressedArchiveSize:   jz.CompressedArchiveSize,
+		UncompressedArchiveSize: jz.UncompressedArchiveSize,
+		CompressionInfo: CompressionInfo{
+			MaxSpanID:            jz.CompressionInfo.MaxSpanID,
+			SpanDigests:          jz.CompressionInfo.SpanDigests,
+			Checkpoints:          jz.CompressionInfo.Checkpoints,
+			CompressionAlgorithm: jz.CompressionInfo.CompressionAlgorithm,
+			CheckpointsEncoding:  compression.CheckpointsEncoding(jz.CompressionInfo.CheckpointsEncoding),
+		},
+	}
+	switch ztoc.CheckpointsEncoding {
+	case checkpointsEncodingRawJSON:
+		ztoc.CheckpointsEncoding = compression.CheckpointsEncodingRaw
+	case compression.CheckpointsEncodingCompact:
+	default:
+		return nil, fmt.Errorf("unknown checkpoints encoding: %s", jz.CompressionInfo.CheckpointsEncoding)
+	}
+	if ztoc.SpanDigests == nil {
+		ztoc.SpanDigests = []digest.Digest{}
+	}
+
+	fm := make([]FileMetadata, 0, len(jz.TOC.Files))
+	for _, jm := range jz.TOC.Files {
+		m := FileMetadata{
+			Name:               string(jm.Name),
+			Type:               jm.Type,
+			UncompressedOffset: jm.UncompressedOffset,
+			UncompressedSize:   jm.UncompressedSize,
+			Linkname:           string(jm.Linkname),
+			Mode:               jm.Mode,
+			UID:                jm.UID,
+			GID:                jm.GID,
+			Uname:              string(jm.Uname),
+			Gname:              string(jm.Gname),
+			ModTime:            jm.ModTime,
+			Devmajor:           jm.Devmajor,
+			Devminor:           jm.Devminor,
+			Xattrs:             make(map[string]string, len(jm.Xattrs)),
+			Digest:             jm.Digest,
+		}
+		if jm.AccessTime != nil {
+			m.AccessTime = *jm.AccessTime
+		}
+		if jm.ChangeTime != nil {
+			m.ChangeTime = *jm.ChangeTime
+		}
+		for _, x := range jm.Xattrs {
+			m.Xattrs[string(x.Key)] = string(x.Value)
+		}
+		if jm.SparseMap != nil {
+			m.SparseMap = make([]SparseEntry, 0, len(jm.SparseMap))
+			for _, e := range jm.SparseMap {
+				m.SparseMap = append(m.SparseMap, SparseEntry{Offset: e.Offset, Length: e.Length})
+			}
+		}
+		if m.Digest != "" {
+			if err := m.Digest.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid digest of file %s: %w", m.Name, err)
+			}
+		}
+		fm = append(fm, m)
+	}
+	ztoc.TOC = NewTOC(fm)
+
+	if encoding := compression.GetCheckpointsEncoding(ztoc.CompressionAlgorithm, ztoc.Checkpoints); encoding != ztoc.CheckpointsEncoding {
+		return nil, fmt.Errorf("checkpoints encoding %q doesn't match the recorded encoding %q", encoding, ztoc.CheckpointsEncoding)
+	}
+	return ztoc, nil
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestZtocJSONRoundTrip(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/", testutil.WithDirOwner(1000, 1001)),
+		testutil.File("dir/file", string(testutil.RandomByteData(100000)), testutil.WithFileModTime(time.Date(2021, 2, 3, 4, 5, 6, 7, time.UTC))),
+		testutil.File("dir/times", "foo", testutil.WithFileAccessTime(time.Date(2022, 1, 1, 0, 0, 0, 1, time.UTC)),
+			testutil.WithFileChangeTime(time.Date(2023, 1, 1, 0, 0, 0, 2, time.UTC))),
+		testutil.File("dir/xattrs", "bar", testutil.WithFileXattrs(map[string]string{
+			"user.text":   "value",
+			"user.binary": "\xff\x00\xfe",
+		})),
+		testutil.Symlink("dir/symlink", "file"),
+		testutil.Link("dir/link", "dir/file"),
+		testutil.SparseFile("dir/sparse", 100000, []testutil.SparseFragment{{Offset: 5000, Data: "sparse"}}, testutil.SparsePAX01),
+	}
+
+	testCases := []struct {
+		name            string
+		compressionAlgo string
+		tarGenerator    tarGenerator
+		options         []BuildOption
+	}{
+		{name: "gzip", compressionAlgo: compression.Gzip, tarGenerator: buildTarGZ},
+		{name: "gzip with compact checkpoints", compressionAlgo: compression.Gzip, tarGenerator: buildTarGZ, options: []BuildOption{WithCompactCheckpoints()}},
+		{name: "zstd", compressionAlgo: compression.Zstd, tarGenerator: buildTarZstd},
+		{name: "uncompressed", compressionAlgo: compression.Uncompressed, tarGenerator: buildTar},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tarFilePath, _, _ := tc.tarGenerator(t, "json", tarEntries)
+			defer os.Remove(tarFilePath)
+			toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 16384, append(tc.options, WithCompression(tc.compressionAlgo))...)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			r, expected, err := Marshal(toc)
+			if err != nil {
+				t.Fatalf("can't marshal ztoc: %v", err)
+			}
+			unmarshalled, err := Unmarshal(r)
+			if err != nil {
+				t.Fatalf("can't unmarshal ztoc: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := ToJSON(unmarshalled, &buf); err != nil {
+				t.Fatalf("can't export ztoc to JSON: %v", err)
+			}
+			if !strings.Contains(buf.String(), `"base64"`) {
+				t.Fatalf("binary xattr is not base64 encoded: %s", buf.String())
+			}
+			imported, err := FromJSON(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("can't import ztoc from JSON: %v", err)
+			}
+			_, actual, err := Marshal(imported)
+			if err != nil {
+				t.Fatalf("can't marshal imported ztoc: %v", err)
+			}
+			if actual.Digest != expected.Digest {
+				t.Fatalf("unexpected digest after JSON round trip. expect: %v, actual: %v", expected.Digest, actual.Digest)
+			}
+			if m, ok := imported.Lookup("dir/xattrs"); !ok || m.Xattrs["SCHILY.xattr.user.binary"] != "\xff\x00\xfe" {
+				t.Fatalf("unexpected xattrs after JSON round trip: %v", m.Xattrs)
+			}
+		})
+	}
+}
+
+func TestZtocFromInvalidJSON(t *testing.T) {
+	tarFilePath, _, _ := buildTarGZ(t, "json", []testutil.TarEntry{testutil.File("file", "foo")})
+	defer os.Remove(tarFilePath)
+	toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 64)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := ToJSON(toc, &buf); err != nil {
+		t.Fatalf("can't export ztoc to JSON: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(m map[string]interface{})
+	}{
+		{
+			name:   "unknown schema version",
+			modify: func(m map[string]interface{}) { m["schema"] = JSONSchemaVersion + 1 },
+		},
+		{
+			name:   "unknown field",
+			modify: func(m map[string]interface{}) { m["foo"] = "bar" },
+		},
+		{
+			name: "unknown checkpoints encoding",
+			modify: func(m map[string]interface{}) {
+				m["compression_info"].(map[string]interface{})["checkpoints_encoding"] = "foo"
+			},
+		},
+		{
+			name: "mismatched checkpoints encoding",
+			modify: func(m map[string]interface{}) {
+				m["compression_info"].(map[string]interface{})["checkpoints_encoding"] = "compact"
+			},
+		},
+		{
+			name: "invalid file digest",
+			modify: func(m map[string]interface{}) {
+				files := m["toc"].(map[string]interface{})["files"].([]interface{})
+				files[0].(map[string]interface{})["digest"] = string(digest.Canonical) + ":foo"
+			},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var m map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+				t.Fatalf("can't decode JSON: %v", err)
+			}
+			tc.modify(m)
+			b, err := json.Marshal(m)
+			if err != nil {
+				t.Fatalf("can't encode JSON: %v", err)
+			}
+			if _, err := FromJSON(bytes.NewReader(b)); err == nil {
+				t.Fatalf("expected error, but got nil")
+			}
+		})
+	}
+}
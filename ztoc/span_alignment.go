@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"sort"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// SpanAlignmentReport describes the effect of `WithSpanAlignment` on a ztoc.
+type SpanAlignmentReport struct {
+	// MultiSpanFiles is the number of files of the ztoc that cross a span boundary.
+	MultiSpanFiles int
+	// DefaultMultiSpanFiles is the number of files that would cross a span boundary
+	// without span alignment.
+	DefaultMultiSpanFiles int
+}
+
+// AvoidedMultiSpanFiles returns how many fewer files cross a span boundary thanks to
+// span alignment. It can be negative, since larger files may cross more boundaries
+// when the spans are moved to keep small files in a single span.
+func (r SpanAlignmentReport) AvoidedMultiSpanFiles() int {
+	return r.DefaultMultiSpanFiles - r.MultiSpanFiles
+}
+
+// spanAligner decides where spans can start so that files up to `maxFileSize` bytes
+// are contained in a single span. It also keeps track of where spans would start
+// without alignment.
+type spanAligner struct {
+	files       []FileMetadata
+	spanSize    compression.Offset
+	maxFileSize compression.Offset
+
+	// next is the position in `files` of the first file that ends after the last
+	// offset passed to `canSplit`.
+	next int
+	// defaultBoundaries are the offsets where spans would start without alignment.
+	defaultBoundaries []compression.Offset
+}
+
+func newSpanAligner(files []FileMetadata, spanSize, maxFileSize int64) *spanAligner {
+	return &spanAligner{
+		files:       files,
+		spanSize:    compression.Offset(spanSize),
+		maxFileSize: compression.Offset(maxFileSize),
+	}
+}
+
+// canSplit implements `compression.SpanBoundaryFunc`. It relies on being called with
+// increasing offsets and on `files` being sorted by offset, as they are in a tar archive.
+func (a *spanAligner) canSplit(offset compression.Offset) bool {
+	// same rule as the default layout: cut at the first boundary after `spanSize` bytes.
+	last := compression.Offset(0)
+	if n := len(a.defaultBoundaries); n > 0 {
+		last = a.defaultBoundaries[n-1]
+	}
+	if offset-last > a.spanSize {
+		a.defaultBoundaries = append(a.defaultBoundaries, offset)
+	}
+
+	for a.next < len(a.files) && a.files[a.next].UncompressedOffset+a.files[a.next].StoredSize() <= offset {
+		a.next++
+	}
+	if a.next == len(a.files) {
+		return true
+	}
+	f := a.files[a.next]
+	return !(f.UncompressedOffset < offset && f.StoredSize() <= a.maxFileSize)
+}
+
+// countMultiSpanFiles returns the number of files that cross any of the sorted span `boundaries`.
+func countMultiSpanFiles(files []FileMetadata, boundaries []compression.Offset) int {
+	count := 0
+	for _, f := range files {
+		end := f.UncompressedOffset + f.StoredSize()
+		// first boundary after the start of the file.
+		i := sort.Search(len(boundaries), func(i int) bool { return boundaries[i] > f.UncompressedOffset })
+		if i < len(boundaries) && boundaries[i] < end {
+			count++
+		}
+	}
+	return count
+}
+
+// spanBoundaries returns the uncompressed offsets where the spans of `zinfo` start,
+// excluding the first span.
+func spanBoundaries(zinfo compression.Zinfo) []compression.Offset {
+	var boundaries []compression.Offset
+	for id := compression.SpanID(1); id <= zinfo.MaxSpanID(); id++ {
+		boundaries = append(boundaries, zinfo.StartUncompressedOffset(id))
+	}
+	return boundaries
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// SpanFiles is a span of a ztoc along with the files whose content is in the span.
+type SpanFiles struct {
+	SpanID                  compression.SpanID
+	StartCompressedOffset   compression.Offset
+	EndCompressedOffset     compression.Offset // exclusive
+	StartUncompressedOffset compression.Offset
+	EndUncompressedOffset   compression.Offset // exclusive
+	// Files are the files whose content overlaps the span, in the order of the TOC.
+	// Files without content (e.g., directories and empty files) are never in a span.
+	Files []FileMetadata
+}
+
+// FilesInRange returns the files whose content overlaps the range [start, end) of the
+// uncompressed archive, in the order of the TOC.
+func (zt Ztoc) FilesInRange(start, end compression.Offset) []FileMetadata {
+	var files []FileMetadata
+	for _, m := range zt.FileMetadata {
+		size := m.StoredSize()
+		if size > 0 && m.UncompressedOffset < end && m.UncompressedOffset+size > start {
+			files = append(files, m)
+		}
+	}
+	return files
+}
+
+// FilesInSpan returns the span `spanID` along with the files whose content is in it.
+func (zt Ztoc) FilesInSpan(spanID compression.SpanID) (SpanFiles, error) {
+	if spanID < 0 || spanID > zt.MaxSpanID {
+		return SpanFiles{}, fmt.Errorf("span %d out of range [0, %d]", spanID, zt.MaxSpanID)
+	}
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return SpanFiles{}, err
+	}
+	defer zinfo.Close()
+
+	span := zt.span(zinfo, spanID)
+	span.Files = zt.FilesInRange(span.StartUncompressedOffset, span.EndUncompressedOffset)
+	return span, nil
+}
+
+// FilesBySpan returns every span of the ztoc along with the files whose content is in it.
+// A file crossing span boundaries is in every span it overlaps.
+func (zt Ztoc) FilesBySpan() ([]SpanFiles, error) {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+
+	spans := make([]SpanFiles, zt.MaxSpanID+1)
+	for id := range spans {
+		spans[id] = zt.span(zinfo, compression.SpanID(id))
+	}
+	for _, m := range zt.FileMetadata {
+		size := m.StoredSize()
+		if size == 0 {
+			continue
+		}
+		startSpan := zinfo.UncompressedOffsetToSpanID(m.UncompressedOffset)
+		endSpan := zinfo.UncompressedOffsetToSpanID(m.UncompressedOffset + size - 1)
+		for id := startSpan; id <= endSpan && id <= zt.MaxSpanID; id++ {
+			spans[id].Files = append(spans[id].Files, m)
+		}
+	}
+	return spans, nil
+}
+
+// span returns the offsets of the span `spanID`.
+func (zt Ztoc) span(zinfo compression.Zinfo, spanID compression.SpanID) SpanFiles {
+	return SpanFiles{
+		SpanID:                  spanID,
+		StartCompressedOffset:   zinfo.StartCompressedOffset(spanID),
+		EndCompressedOffset:     zinfo.EndCompressedOffset(spanID, zt.CompressedArchiveSize),
+		StartUncompressedOffset: zinfo.StartUncompressedOffset(spanID),
+		EndUncompressedOffset:   zinfo.EndUncompressedOffset(spanID, zt.UncompressedArchiveSize),
+	}
+}
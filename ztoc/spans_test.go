@@ -0,0 +1,126 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func TestFilesBySpan(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", "foo"),
+		testutil.File("dir/empty", ""),
+		testutil.File("dir/large", string(testutil.RandomByteData(300000))),
+		testutil.File("dir/medium", string(testutil.RandomByteData(50000))),
+		testutil.SparseFile("dir/sparse", 1000000, []testutil.SparseFragment{{Offset: 5000, Data: "sparse"}}, testutil.SparseGNU),
+		testutil.Symlink("dir/symlink", "small"),
+	}
+
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tarFilePath, _, _ := tc.tarGenerator(t, "spans", tarEntries)
+			defer os.Remove(tarFilePath)
+			toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, WithCompression(tc.compressionAlgo))
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			spans, err := toc.FilesBySpan()
+			if err != nil {
+				t.Fatalf("can't get the files by span: %v", err)
+			}
+			if len(spans) != int(toc.MaxSpanID)+1 {
+				t.Fatalf("unexpected number of spans. expect: %d, actual: %d", toc.MaxSpanID+1, len(spans))
+			}
+
+			var end compression.Offset
+			for i, span := range spans {
+				if span.SpanID != compression.SpanID(i) || span.StartUncompressedOffset != end ||
+					span.EndUncompressedOffset < span.StartUncompressedOffset || span.EndCompressedOffset < span.StartCompressedOffset {
+					t.Fatalf("unexpected offsets of span %d: %+v", i, span)
+				}
+				end = span.EndUncompressedOffset
+
+				actual, err := toc.FilesInSpan(span.SpanID)
+				if err != nil {
+					t.Fatalf("can't get the files of span %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(actual, span) {
+					t.Fatalf("unexpected files of span %d. expect: %v, actual: %v", i, names(span.Files), names(actual.Files))
+				}
+			}
+			if end != toc.UncompressedArchiveSize {
+				t.Fatalf("spans end at %d instead of %d", end, toc.UncompressedArchiveSize)
+			}
+
+			// every file with content is in exactly the spans overlapping its content.
+			for _, m := range toc.FileMetadata {
+				for _, span := range spans {
+					overlaps := m.StoredSize() > 0 && m.UncompressedOffset < span.EndUncompressedOffset &&
+						m.UncompressedOffset+m.StoredSize() > span.StartUncompressedOffset
+					if contains(names(span.Files), m.Name) != overlaps {
+						t.Fatalf("unexpected presence of %s in span %d: %v", m.Name, span.SpanID, names(span.Files))
+					}
+				}
+			}
+
+			if _, err := toc.FilesInSpan(toc.MaxSpanID + 1); err == nil {
+				t.Fatalf("expected error for a span out of range, but got nil")
+			}
+		})
+	}
+}
+
+func TestFilesInRange(t *testing.T) {
+	toc := Ztoc{
+		TOC: NewTOC([]FileMetadata{
+			{Name: "dir", Type: "dir", UncompressedOffset: 512},
+			{Name: "dir/a", Type: "reg", UncompressedOffset: 1024, UncompressedSize: 100},
+			{Name: "dir/empty", Type: "reg", UncompressedOffset: 1536},
+			{Name: "dir/b", Type: "reg", UncompressedOffset: 2048, UncompressedSize: 1000},
+			{Name: "dir/sparse", Type: "reg", UncompressedOffset: 3584, UncompressedSize: 100000,
+				SparseMap: []SparseEntry{{Offset: 50000, Length: 10}}},
+		}),
+	}
+	testCases := []struct {
+		name       string
+		start, end compression.Offset
+		expect     []string
+	}{
+		{name: "whole archive", start: 0, end: 10000, expect: []string{"dir/a", "dir/b", "dir/sparse"}},
+		{name: "between files", start: 1124, end: 2048},
+		{name: "end of a file", start: 1123, end: 1124, expect: []string{"dir/a"}},
+		{name: "start of a file", start: 2000, end: 2049, expect: []string{"dir/b"}},
+		{name: "stored data of a sparse file", start: 3590, end: 3600, expect: []string{"dir/sparse"}},
+		{name: "past the stored data of a sparse file", start: 3594, end: 10000},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual := names(toc.FilesInRange(tc.start, tc.end))
+			if !reflect.DeepEqual(actual, tc.expect) {
+				t.Fatalf("unexpected files. expect: %v, actual: %v", tc.expect, actual)
+			}
+		})
+	}
+}
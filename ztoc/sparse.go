@@ -0,0 +1,330 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// tarBlockSize is the size of the blocks of a tar archive.
+const tarBlockSize = 512
+
+// PAX records describing GNU sparse files.
+const (
+	paxGNUSparsePrefix = "GNU.sparse."
+	paxGNUSparseMap    = "GNU.sparse.map"
+	paxGNUSparseMajor  = "GNU.sparse.major"
+	paxGNUSparseMinor  = "GNU.sparse.minor"
+)
+
+// Offsets of the fields of the old GNU sparse format in a tar header block.
+const (
+	gnuSparseMapOffset        = 386 // 4 entries of a 12 bytes offset and a 12 bytes length
+	gnuSparseIsExtendedOffset = 482
+	gnuSparseEntries          = 4
+	// an extension block has 21 entries, followed by its own "is extended" flag.
+	gnuSparseExtEntries          = 21
+	gnuSparseExtIsExtendedOffset = 504
+	gnuSparseEntrySize           = 24
+	tarTypeflagOffset            = 156
+	tarSizeOffset                = 124
+	tarSizeLength                = 12
+)
+
+// storedSize returns the size of the data of a file of `size` bytes stored in the
+// uncompressed data, given its `sparseMap`.
+func storedSize(size compression.Offset, sparseMap []SparseEntry) compression.Offset {
+	if sparseMap == nil {
+		return size
+	}
+	var stored compression.Offset
+	for _, e := range sparseMap {
+		stored += e.Length
+	}
+	return stored
+}
+
+// expandSparse returns the content of a sparse file of `size` bytes given its stored `data`.
+func expandSparse(data []byte, sparseMap []SparseEntry, size compression.Offset) []byte {
+	content := make([]byte, size)
+	var pos compression.Offset
+	for _, e := range sparseMap {
+		copy(content[e.Offset:e.Offset+e.Length], data[pos:pos+e.Length])
+		pos += e.Length
+	}
+	return content
+}
+
+// sparseReaderAt reads the content of a sparse file from its stored data.
+type sparseReaderAt struct {
+	data      io.ReaderAt
+	sparseMap []SparseEntry
+	size      int64
+}
+
+// NewSparseReaderAt returns a reader of the content of a sparse file of `size` bytes,
+// whose data fragments described by `sparseMap` are read back to back from `data`.
+// The holes of the file read as zeros.
+func NewSparseReaderAt(data io.ReaderAt, sparseMap []SparseEntry, size compression.Offset) io.ReaderAt {
+	return &sparseReaderAt{
+		data:      data,
+		sparseMap: sparseMap,
+		size:      int64(size),
+	}
+}
+
+func (s *sparseReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if remaining := s.size - off; int64(n) > remaining {
+		n = int(remaining)
+	}
+	buf := p[:n]
+	for i := range buf {
+		buf[i] = 0
+	}
+	end := off + int64(n)
+	var dataOff int64
+	for _, e := range s.sparseMap {
+		fragStart, fragEnd := int64(e.Offset), int64(e.Offset+e.Length)
+		start, stop := off, end
+		if fragStart > start {
+			start = fragStart
+		}
+		if fragEnd < stop {
+			stop = fragEnd
+		}
+		if start < stop {
+			read, err := s.data.ReadAt(buf[start-off:stop-off], dataOff+start-fragStart)
+			if read != int(stop-start) {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		}
+		dataOff += int64(e.Length)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// recordingReader records the data read from `r` while recording, so that the raw
+// tar headers parsed by `tar.Reader` can be inspected.
+type recordingReader struct {
+	r         io.Reader
+	recording bool
+	buf       bytes.Buffer
+}
+
+func (rr *recordingReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	if rr.recording {
+		rr.buf.Write(b[:n])
+	}
+	return n, err
+}
+
+// start starts recording the data read from the underlying reader.
+func (rr *recordingReader) start() {
+	rr.buf.Reset()
+	rr.recording = true
+}
+
+// stop stops recording and returns the recorded data.
+func (rr *recordingReader) stop() []byte {
+	rr.recording = false
+	return rr.buf.Bytes()
+}
+
+// sparseMapFromHeader returns the sparse map of the file described by `hdr`, or nil if it
+// is not a sparse file. `archive/tar` expands sparse files without exposing their sparse
+// map, so the map is parsed from `raw`, the data read to get `hdr` from the tar archive,
+// starting at the offset `start` of the archive.
+func sparseMapFromHeader(hdr *tar.Header, raw []byte, start compression.Offset) ([]SparseEntry, error) {
+	var (
+		sparseMap []SparseEntry
+		err       error
+	)
+	major, minor := hdr.PAXRecords[paxGNUSparseMajor], hdr.PAXRecords[paxGNUSparseMinor]
+	switch {
+	case major == "1" && minor == "0":
+		sparseMap, err = parsePAXSparseMap1x0(raw, start)
+	case major == "0" && (minor == "0" || minor == "1"), major == "" && minor == "" && hdr.PAXRecords[paxGNUSparseMap] != "":
+		// 0.0 maps are converted to 0.1 maps by `archive/tar`.
+		sparseMap, err = parsePAXSparseMap0x1(hdr.PAXRecords[paxGNUSparseMap])
+	case major != "" || minor != "":
+		// unknown versions are read as regular files by `archive/tar`.
+		return nil, nil
+	case hdr.Typeflag == tar.TypeGNUSparse:
+		sparseMap, err = parseOldGNUSparseMap(raw, start)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid sparse map of %s: %w", hdr.Name, err)
+	}
+	if len(sparseMap) == 0 {
+		// keep the file sparse even if it is a single hole.
+		sparseMap = []SparseEntry{{Offset: compression.Offset(hdr.Size)}}
+	}
+	return sparseMap, nil
+}
+
+// headerBlock returns the position in `raw` of the header block of the entry, after the
+// meta headers (PAX headers and GNU long names) preceding it.
+func headerBlock(raw []byte, start compression.Offset) (int, error) {
+	pos := int((tarBlockSize - start%tarBlockSize) % tarBlockSize)
+	for pos+tarBlockSize <= len(raw) {
+		blk := raw[pos : pos+tarBlockSize]
+		switch blk[tarTypeflagOffset] {
+		case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, err := parseTarNumeric(blk[tarSizeOffset : tarSizeOffset+tarSizeLength])
+			if err != nil {
+				return 0, err
+			}
+			pos += tarBlockSize + int((size+tarBlockSize-1)/tarBlockSize*tarBlockSize)
+		default:
+			return pos, nil
+		}
+	}
+	return 0, fmt.Errorf("header block not found")
+}
+
+// parseOldGNUSparseMap parses the sparse map of the old GNU format, which is stored in
+// the header block and in the extension blocks following it.
+func parseOldGNUSparseMap(raw []byte, start compression.Offset) ([]SparseEntry, error) {
+	pos, err := headerBlock(raw, start)
+	if err != nil {
+		return nil, err
+	}
+	blk := raw[pos : pos+tarBlockSize]
+	sparseMap, err := parseGNUSparseEntries(blk[gnuSparseMapOffset:], gnuSparseEntries, nil)
+	if err != nil {
+		return nil, err
+	}
+	for isExtended := blk[gnuSparseIsExtendedOffset] != 0; isExtended; isExtended = blk[gnuSparseExtIsExtendedOffset] != 0 {
+		pos += tarBlockSize
+		if pos+tarBlockSize > len(raw) {
+			return nil, fmt.Errorf("missing sparse map extension block")
+		}
+		blk = raw[pos : pos+tarBlockSize]
+		if sparseMap, err = parseGNUSparseEntries(blk, gnuSparseExtEntries, sparseMap); err != nil {
+			return nil, err
+		}
+	}
+	return sparseMap, nil
+}
+
+// parseGNUSparseEntries appends to `sparseMap` the up to `n` entries at the start of `b`.
+func parseGNUSparseEntries(b []byte, n int, sparseMap []SparseEntry) ([]SparseEntry, error) {
+	for i := 0; i < n; i++ {
+		entry := b[i*gnuSparseEntrySize : (i+1)*gnuSparseEntrySize]
+		if entry[0] == 0 {
+			break
+		}
+		offset, err := parseTarNumeric(entry[:12])
+		if err != nil {
+			return nil, err
+		}
+		length, err := parseTarNumeric(entry[12:])
+		if err != nil {
+			return nil, err
+		}
+		sparseMap = append(sparseMap, SparseEntry{Offset: compression.Offset(offset), Length: compression.Offset(length)})
+	}
+	return sparseMap, nil
+}
+
+// parsePAXSparseMap0x1 parses the sparse map of the PAX 0.1 format, a comma separated
+// list of offsets and lengths.
+func parsePAXSparseMap0x1(s string) ([]SparseEntry, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return parseSparseNumbers(strings.Split(s, ","))
+}
+
+// parsePAXSparseMap1x0 parses the sparse map of the PAX 1.0 format, which is stored at the
+// start of the data of the file: the number of entries followed by their offsets and
+// lengths, separated by newlines and padded to a block.
+func parsePAXSparseMap1x0(raw []byte, start compression.Offset) ([]SparseEntry, error) {
+	pos, err := headerBlock(raw, start)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(raw[pos+tarBlockSize:]), "\n")
+	n, err := strconv.ParseInt(fields[0], 10, 0)
+	if err != nil || n < 0 || int64(len(fields)-1) < 2*n {
+		return nil, fmt.Errorf("invalid number of entries %q", fields[0])
+	}
+	return parseSparseNumbers(fields[1 : 1+2*n])
+}
+
+// parseSparseNumbers parses pairs of decimal offsets and lengths.
+func parseSparseNumbers(numbers []string) ([]SparseEntry, error) {
+	if len(numbers)%2 != 0 {
+		return nil, fmt.Errorf("odd number of values")
+	}
+	sparseMap := make([]SparseEntry, 0, len(numbers)/2)
+	for i := 0; i < len(numbers); i += 2 {
+		offset, err := strconv.ParseInt(numbers[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.ParseInt(numbers[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sparseMap = append(sparseMap, SparseEntry{Offset: compression.Offset(offset), Length: compression.Offset(length)})
+	}
+	return sparseMap, nil
+}
+
+// parseTarNumeric parses a numeric field of a tar header, either in octal or,
+// if the high bit of the first byte is set, in base-256.
+func parseTarNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		var x int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if x > (1<<55)-1 {
+				return 0, fmt.Errorf("numeric field overflow")
+			}
+			x = x<<8 | int64(c)
+		}
+		return x, nil
+	}
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
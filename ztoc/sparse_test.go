@@ -0,0 +1,233 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBuildZtocSparse(t *testing.T) {
+	fragment := func(offset int64, size int) testutil.SparseFragment {
+		return testutil.SparseFragment{Offset: offset, Data: string(testutil.RandomByteData(int64(size)))}
+	}
+	// more fragments than fit in an old GNU header, so that extension blocks are used.
+	fragments := []testutil.SparseFragment{
+		fragment(0, 1000),
+		fragment(10000, 5000),
+		fragment(100000, 30000),
+		fragment(200000, 1),
+		fragment(300000, 4096),
+		fragment(500000, 70000),
+	}
+	expectedSparseMap := []SparseEntry{
+		{Offset: 0, Length: 1000},
+		{Offset: 10000, Length: 5000},
+		{Offset: 100000, Length: 30000},
+		{Offset: 200000, Length: 1},
+		{Offset: 300000, Length: 4096},
+		{Offset: 500000, Length: 70000},
+		{Offset: 1000000, Length: 0},
+	}
+
+	for _, format := range []struct {
+		name   string
+		format testutil.SparseFormat
+	}{
+		{name: "old GNU", format: testutil.SparseGNU},
+		{name: "PAX 0.1", format: testutil.SparsePAX01},
+		{name: "PAX 1.0", format: testutil.SparsePAX10},
+	} {
+		format := format
+		t.Run(format.name, func(t *testing.T) {
+			tarEntries := []testutil.TarEntry{
+				testutil.File("before", "before"),
+				testutil.SparseFile("sparse", 1000000, fragments, format.format),
+				testutil.SparseFile("holes", 50000, nil, format.format),
+				testutil.File("after", string(testutil.RandomByteData(40000))),
+			}
+			tarFilePath, contents, _ := buildTarGZ(t, "sparse", tarEntries)
+			defer os.Remove(tarFilePath)
+			toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 20000)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+
+			sparse, ok := toc.Lookup("sparse")
+			if !ok {
+				t.Fatalf("missing entry sparse")
+			}
+			if sparse.Type != "reg" || sparse.UncompressedSize != 1000000 {
+				t.Fatalf("unexpected metadata of sparse file: %+v", sparse)
+			}
+			if !reflect.DeepEqual(sparse.SparseMap, expectedSparseMap) {
+				t.Fatalf("unexpected sparse map. expect: %v, actual: %v", expectedSparseMap, sparse.SparseMap)
+			}
+			if sparse.StoredSize() != 110097 {
+				t.Fatalf("unexpected stored size: %d", sparse.StoredSize())
+			}
+			for k := range sparse.Xattrs {
+				if strings.HasPrefix(k, "GNU.sparse.") {
+					t.Fatalf("unexpected PAX record %s", k)
+				}
+			}
+			holes, _ := toc.Lookup("holes")
+			if holes.UncompressedSize != 50000 || holes.StoredSize() != 0 || holes.SparseMap == nil {
+				t.Fatalf("unexpected metadata of sparse file without data: %+v", holes)
+			}
+			if before, _ := toc.Lookup("before"); before.SparseMap != nil {
+				t.Fatalf("unexpected sparse map of a regular file: %v", before.SparseMap)
+			}
+
+			file, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't open %s: %v", tarFilePath, err)
+			}
+			defer file.Close()
+			sr := io.NewSectionReader(file, 0, int64(toc.CompressedArchiveSize))
+
+			// the ztoc must survive a round trip through its serialized form.
+			r, _, err := Marshal(toc)
+			if err != nil {
+				t.Fatalf("can't marshal ztoc: %v", err)
+			}
+			unmarshalled, err := Unmarshal(r)
+			if err != nil {
+				t.Fatalf("can't unmarshal ztoc: %v", err)
+			}
+
+			for _, zt := range []*Ztoc{toc, unmarshalled} {
+				for _, f := range zt.FileMetadata {
+					data, err := zt.ExtractFile(sr, f.Name)
+					if err != nil {
+						t.Fatalf("can't extract file %s: %v", f.Name, err)
+					}
+					if !bytes.Equal(data, contents[f.Name]) {
+						t.Fatalf("extracted content of file %s differs from the original", f.Name)
+					}
+					if digest.FromBytes(data) != f.Digest {
+						t.Fatalf("unexpected digest of file %s", f.Name)
+					}
+					data2, err := zt.ExtractFromTarGz(tarFilePath, f.Name)
+					if err != nil {
+						t.Fatalf("can't extract file %s from tar.gz: %v", f.Name, err)
+					}
+					if !bytes.Equal([]byte(data2), contents[f.Name]) {
+						t.Fatalf("content of file %s extracted from tar.gz differs from the original", f.Name)
+					}
+				}
+			}
+
+			dest := t.TempDir()
+			if err := toc.ExtractTree(sr, "/", dest); err != nil {
+				t.Fatalf("can't extract the layer: %v", err)
+			}
+			for _, name := range []string{"before", "sparse", "holes", "after"} {
+				data, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatalf("can't read %s: %v", name, err)
+				}
+				if !bytes.Equal(data, contents[name]) {
+					t.Fatalf("extracted content of file %s differs from the original", name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildZtocPAXTimes(t *testing.T) {
+	modTime := time.Date(2021, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	accessTime := time.Date(2022, 3, 4, 5, 6, 7, 987654321, time.UTC)
+	changeTime := time.Date(2023, 4, 5, 6, 7, 8, 1, time.UTC)
+	tarFilePath, _, _ := buildTarGZ(t, "times", []testutil.TarEntry{
+		testutil.File("times", "foo", testutil.WithFileModTime(modTime),
+			testutil.WithFileAccessTime(accessTime), testutil.WithFileChangeTime(changeTime)),
+		testutil.File("notimes", "bar"),
+	})
+	defer os.Remove(tarFilePath)
+	toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	r, _, err := Marshal(toc)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	unmarshalled, err := Unmarshal(r)
+	if err != nil {
+		t.Fatalf("can't unmarshal ztoc: %v", err)
+	}
+
+	for _, zt := range []*Ztoc{toc, unmarshalled} {
+		m, _ := zt.Lookup("times")
+		if !m.ModTime.Equal(modTime) || !m.AccessTime.Equal(accessTime) || !m.ChangeTime.Equal(changeTime) {
+			t.Fatalf("unexpected times. expect: %v %v %v, actual: %v %v %v", modTime, accessTime, changeTime, m.ModTime, m.AccessTime, m.ChangeTime)
+		}
+		m, _ = zt.Lookup("notimes")
+		if !m.AccessTime.IsZero() || !m.ChangeTime.IsZero() {
+			t.Fatalf("unexpected times of a file without PAX times: %v %v", m.AccessTime, m.ChangeTime)
+		}
+	}
+}
+
+func TestSparseReaderAt(t *testing.T) {
+	// content: "ab" at 2, a hole, "cde" at 7 and a hole until 12.
+	sparseMap := []SparseEntry{{Offset: 2, Length: 2}, {Offset: 7, Length: 3}, {Offset: 12, Length: 0}}
+	expected := []byte("\x00\x00ab\x00\x00\x00cde\x00\x00")
+	r := NewSparseReaderAt(bytes.NewReader([]byte("abcde")), sparseMap, compression.Offset(len(expected)))
+
+	testCases := []struct {
+		name   string
+		offset int64
+		size   int
+	}{
+		{name: "whole file", offset: 0, size: 12},
+		{name: "in a hole", offset: 4, size: 2},
+		{name: "in a fragment", offset: 8, size: 1},
+		{name: "across fragments", offset: 3, size: 6},
+		{name: "past the end", offset: 10, size: 5},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			buf := bytes.Repeat([]byte{0xff}, tc.size)
+			n, err := r.ReadAt(buf, tc.offset)
+			end := tc.offset + int64(tc.size)
+			if end > int64(len(expected)) {
+				end = int64(len(expected))
+				if err != io.EOF {
+					t.Fatalf("expect EOF, actual: %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("can't read: %v", err)
+			}
+			if !bytes.Equal(buf[:n], expected[tc.offset:end]) {
+				t.Fatalf("unexpected content. expect: %q, actual: %q", expected[tc.offset:end], buf[:n])
+			}
+		})
+	}
+}
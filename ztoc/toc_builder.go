@@ -22,9 +22,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
 )
 
 // TarProvider creates a tar reader from a compressed file reader (e.g., a gzip file reader),
@@ -87,7 +89,7 @@ func (tb TocBuilder) TocFromFile(algorithm, filename string) (TOC, compression.O
 		return TOC{}, 0, err
 	}
 
-	return TOC{FileMetadata: fm}, uncompressedArchiveSize, nil
+	return NewTOC(fm), uncompressedArchiveSize, nil
 }
 
 // getFileMetadata creates `FileMetadata` for each file within the compressed file
@@ -113,14 +115,23 @@ func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata
 }
 
 // metadataFromTarReader reads every file from tar reader `sr` and creates
-// `FileMetadata` for each file.
+// `FileMetadata` for each file, including the digest of regular files. The content
+// of sparse files is stored as their data fragments, described by their sparse map.
 func metadataFromTarReader(r io.Reader) ([]FileMetadata, compression.Offset, error) {
 	pt := &positionTrackerReader{r: r}
-	tarRdr := tar.NewReader(pt)
+	rr := &recordingReader{r: pt}
+	tarRdr := tar.NewReader(rr)
 	var md []FileMetadata
 
 	for {
+		// skip any unread content, so that only the headers of the next entry are recorded.
+		if _, err := io.Copy(io.Discard, tarRdr); err != nil {
+			return nil, 0, fmt.Errorf("error while reading tar entry: %w", err)
+		}
+		start := pt.CurrentPos()
+		rr.start()
 		hdr, err := tarRdr.Next()
+		raw := rr.stop()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -146,15 +157,42 @@ func metadataFromTarReader(r io.Reader) ([]FileMetadata, compression.Offset, err
 			Uname:              hdr.Uname,
 			Gname:              hdr.Gname,
 			ModTime:            hdr.ModTime,
+			AccessTime:         hdr.AccessTime,
+			ChangeTime:         hdr.ChangeTime,
 			Devmajor:           hdr.Devmajor,
 			Devminor:           hdr.Devminor,
-			Xattrs:             hdr.PAXRecords,
+			Xattrs:             paxRecords(hdr),
+		}
+		if fileType == "reg" {
+			if metadataEntry.SparseMap, err = sparseMapFromHeader(hdr, raw, start); err != nil {
+				return nil, 0, err
+			}
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), tarRdr); err != nil {
+				return nil, 0, fmt.Errorf("error while reading content of %s: %w", hdr.Name, err)
+			}
+			metadataEntry.Digest = digester.Digest()
 		}
 		md = append(md, metadataEntry)
 	}
 	return md, pt.CurrentPos(), nil
 }
 
+// paxRecords returns the PAX records of `hdr`, except the records of GNU sparse files,
+// which describe how the file is stored in the archive rather than the file itself.
+func paxRecords(hdr *tar.Header) map[string]string {
+	if hdr.PAXRecords == nil {
+		return nil
+	}
+	records := make(map[string]string, len(hdr.PAXRecords))
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxGNUSparsePrefix) {
+			records[k] = v
+		}
+	}
+	return records
+}
+
 func getType(header *tar.Header) (fileType string, e error) {
 	switch header.Typeflag {
 	case tar.TypeLink:
@@ -163,7 +201,7 @@ func getType(header *tar.Header) (fileType string, e error) {
 		fileType = "symlink"
 	case tar.TypeDir:
 		fileType = "dir"
-	case tar.TypeReg:
+	case tar.TypeReg, tar.TypeGNUSparse:
 		fileType = "reg"
 	case tar.TypeChar:
 		fileType = "char"
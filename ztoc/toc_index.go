@@ -0,0 +1,170 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrLinkCycle is returned when resolving a path whose links form a cycle.
+var ErrLinkCycle = errors.New("link cycle detected")
+
+// tocIndex indexes the entries of a `TOC` by their cleaned path.
+type tocIndex struct {
+	// byPath maps a cleaned path to the position of its entry in `TOC.FileMetadata`.
+	// If a path appears more than once in the archive, the last entry wins, which is
+	// what extracting the archive would produce.
+	byPath map[string]int
+	// paths contains every indexed path in sorted order.
+	paths []string
+}
+
+func newTOCIndex(metadata []FileMetadata) *tocIndex {
+	idx := &tocIndex{
+		byPath: make(map[string]int, len(metadata)),
+		paths:  make([]string, 0, len(metadata)),
+	}
+	for i, m := range metadata {
+		name := cleanPath(m.Name)
+		if _, ok := idx.byPath[name]; !ok {
+			idx.paths = append(idx.paths, name)
+		}
+		idx.byPath[name] = i
+	}
+	sort.Strings(idx.paths)
+	return idx
+}
+
+// NewTOC creates a `TOC` from `metadata` and indexes it by path.
+func NewTOC(metadata []FileMetadata) TOC {
+	toc := TOC{FileMetadata: metadata}
+	toc.BuildIndex()
+	return toc
+}
+
+// BuildIndex (re)builds the path index of the `TOC`. It must be called after
+// `FileMetadata` is modified so that lookups see the changes.
+func (toc *TOC) BuildIndex() {
+	toc.index = newTOCIndex(toc.FileMetadata)
+}
+
+// getIndex returns the path index of the `TOC`, building a temporary one if the
+// `TOC` was not created with `NewTOC`.
+func (toc TOC) getIndex() *tocIndex {
+	if toc.index != nil {
+		return toc.index
+	}
+	return newTOCIndex(toc.FileMetadata)
+}
+
+// Lookup returns the metadata of the entry at `name` without following links.
+func (toc TOC) Lookup(name string) (FileMetadata, bool) {
+	i, ok := toc.getIndex().byPath[cleanPath(name)]
+	if !ok {
+		return FileMetadata{}, false
+	}
+	return toc.FileMetadata[i], true
+}
+
+// Resolve returns the metadata of the entry at `name`, following hard links and
+// symlinks until a non-link entry is found. It returns an error wrapping
+// `ErrLinkCycle` if the links form a cycle.
+func (toc TOC) Resolve(name string) (FileMetadata, error) {
+	idx := toc.getIndex()
+	visited := make(map[string]struct{})
+	current := cleanPath(name)
+	for {
+		i, ok := idx.byPath[current]
+		if !ok {
+			if len(visited) == 0 {
+				return FileMetadata{}, fmt.Errorf("file %s does not exist in metadata", name)
+			}
+			return FileMetadata{}, fmt.Errorf("link target %s of file %s does not exist in metadata", current, name)
+		}
+		m := toc.FileMetadata[i]
+		if m.Linkname == "" {
+			return m, nil
+		}
+		visited[current] = struct{}{}
+		current = linkTarget(current, m)
+		if _, ok := visited[current]; ok {
+			return FileMetadata{}, fmt.Errorf("%w: resolving %s reached %s again", ErrLinkCycle, name, current)
+		}
+	}
+}
+
+// ListPrefix returns the metadata of all entries whose cleaned path starts with
+// `prefix`, sorted by path. Links are not followed.
+func (toc TOC) ListPrefix(prefix string) []FileMetadata {
+	idx := toc.getIndex()
+	prefix = strings.TrimPrefix(prefix, "/")
+	var entries []FileMetadata
+	for i := sort.SearchStrings(idx.paths, prefix); i < len(idx.paths); i++ {
+		p := idx.paths[i]
+		if !strings.HasPrefix(p, prefix) {
+			break
+		}
+		entries = append(entries, toc.FileMetadata[idx.byPath[p]])
+	}
+	return entries
+}
+
+// ReadDir returns the metadata of the entries directly under the directory `dir`,
+// sorted by path. An empty `dir` or "/" lists the root of the archive. Only entries
+// present in the archive are returned; parent directories that are implied by a
+// path but have no entry of their own are not synthesized.
+func (toc TOC) ReadDir(dir string) []FileMetadata {
+	idx := toc.getIndex()
+	prefix := cleanPath(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var entries []FileMetadata
+	for i := sort.SearchStrings(idx.paths, prefix); i < len(idx.paths); i++ {
+		p := idx.paths[i]
+		if !strings.HasPrefix(p, prefix) {
+			break
+		}
+		child := p[len(prefix):]
+		if child == "" || strings.Contains(child, "/") {
+			continue
+		}
+		entries = append(entries, toc.FileMetadata[idx.byPath[p]])
+	}
+	return entries
+}
+
+// linkTarget returns the cleaned path that the link entry `m` at `name` points to.
+// Hard link targets are relative to the root of the archive, while relative symlink
+// targets are relative to the directory containing the symlink.
+func linkTarget(name string, m FileMetadata) string {
+	if m.Type == "symlink" && !path.IsAbs(m.Linkname) {
+		return cleanPath(path.Join(path.Dir(name), m.Linkname))
+	}
+	return cleanPath(m.Linkname)
+}
+
+// cleanPath normalizes a path in the archive so that "./a/b", "/a/b" and "a/b/"
+// all refer to the same entry "a/b". The root of the archive is "".
+func cleanPath(p string) string {
+	// Use path.Clean to consistently deal with path separators across platforms.
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
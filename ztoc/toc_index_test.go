@@ -0,0 +1,261 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testIndexedTOC() TOC {
+	return NewTOC([]FileMetadata{
+		{Name: "./", Type: "dir"},
+		{Name: "./a/", Type: "dir"},
+		{Name: "./a/file", Type: "reg", UncompressedOffset: 512, UncompressedSize: 10},
+		{Name: "./a/b/", Type: "dir"},
+		{Name: "./a/b/nested", Type: "reg", UncompressedOffset: 1536, UncompressedSize: 20},
+		{Name: "./a/hardlink", Type: "hardlink", Linkname: "a/file"},
+		{Name: "./a/relative", Type: "symlink", Linkname: "b/nested"},
+		{Name: "./a/absolute", Type: "symlink", Linkname: "/a/file"},
+		{Name: "./a/chain", Type: "symlink", Linkname: "relative"},
+		{Name: "./a/dangling", Type: "symlink", Linkname: "missing"},
+		{Name: "./a/self", Type: "symlink", Linkname: "self"},
+		{Name: "./a/loop1", Type: "symlink", Linkname: "loop2"},
+		{Name: "./a/loop2", Type: "symlink", Linkname: "../a/loop1"},
+		{Name: "./ab", Type: "reg", UncompressedOffset: 2560, UncompressedSize: 30},
+		{Name: "./ab", Type: "reg", UncompressedOffset: 3584, UncompressedSize: 40},
+	})
+}
+
+func names(entries []FileMetadata) []string {
+	var n []string
+	for _, e := range entries {
+		n = append(n, e.Name)
+	}
+	return n
+}
+
+func TestTOCLookup(t *testing.T) {
+	t.Parallel()
+	toc := testIndexedTOC()
+	testCases := []struct {
+		name         string
+		path         string
+		expectFound  bool
+		expectOffset int64
+	}{
+		{
+			name:         "path without leading ./",
+			path:         "a/file",
+			expectFound:  true,
+			expectOffset: 512,
+		},
+		{
+			name:         "path with leading /",
+			path:         "/a/b/nested",
+			expectFound:  true,
+			expectOffset: 1536,
+		},
+		{
+			name:        "directory with trailing slash",
+			path:        "./a/b/",
+			expectFound: true,
+		},
+		{
+			name:         "duplicate path returns the last entry",
+			path:         "ab",
+			expectFound:  true,
+			expectOffset: 3584,
+		},
+		{
+			name:        "missing path",
+			path:        "a/missing",
+			expectFound: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			m, ok := toc.Lookup(tc.path)
+			if ok != tc.expectFound {
+				t.Fatalf("expect found: %t, actual: %t", tc.expectFound, ok)
+			}
+			if ok && int64(m.UncompressedOffset) != tc.expectOffset {
+				t.Fatalf("unexpected offset. expect: %d, actual: %d", tc.expectOffset, m.UncompressedOffset)
+			}
+		})
+	}
+}
+
+func TestTOCResolve(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name           string
+		path           string
+		expectName     string
+		expectErr      bool
+		expectLinkLoop bool
+	}{
+		{
+			name:       "regular file resolves to itself",
+			path:       "a/file",
+			expectName: "./a/file",
+		},
+		{
+			name:       "hardlink target is relative to the archive root",
+			path:       "a/hardlink",
+			expectName: "./a/file",
+		},
+		{
+			name:       "relative symlink target is relative to the symlink directory",
+			path:       "a/relative",
+			expectName: "./a/b/nested",
+		},
+		{
+			name:       "absolute symlink target is relative to the archive root",
+			path:       "a/absolute",
+			expectName: "./a/file",
+		},
+		{
+			name:       "chain of symlinks is followed",
+			path:       "a/chain",
+			expectName: "./a/b/nested",
+		},
+		{
+			name:      "dangling symlink returns error",
+			path:      "a/dangling",
+			expectErr: true,
+		},
+		{
+			name:      "missing file returns error",
+			path:      "a/missing",
+			expectErr: true,
+		},
+		{
+			name:           "symlink to itself returns cycle error",
+			path:           "a/self",
+			expectErr:      true,
+			expectLinkLoop: true,
+		},
+		{
+			name:           "symlink loop returns cycle error",
+			path:           "a/loop1",
+			expectErr:      true,
+			expectLinkLoop: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		// exercise both the prebuilt index and the temporary one.
+		for _, toc := range []TOC{testIndexedTOC(), {FileMetadata: testIndexedTOC().FileMetadata}} {
+			toc := toc
+			t.Run(tc.name, func(t *testing.T) {
+				m, err := toc.Resolve(tc.path)
+				if tc.expectErr != (err != nil) {
+					t.Fatalf("expect error: %t, actual error: %v", tc.expectErr, err)
+				}
+				if tc.expectLinkLoop != errors.Is(err, ErrLinkCycle) {
+					t.Fatalf("expect link cycle: %t, actual error: %v", tc.expectLinkLoop, err)
+				}
+				if err == nil && m.Name != tc.expectName {
+					t.Fatalf("unexpected entry. expect: %s, actual: %s", tc.expectName, m.Name)
+				}
+			})
+		}
+	}
+}
+
+func TestTOCListPrefix(t *testing.T) {
+	t.Parallel()
+	toc := testIndexedTOC()
+	testCases := []struct {
+		name   string
+		prefix string
+		expect []string
+	}{
+		{
+			name:   "prefix matches partial path components",
+			prefix: "a/b",
+			expect: []string{"./a/b/", "./a/b/nested"},
+		},
+		{
+			name:   "prefix with leading /",
+			prefix: "/ab",
+			expect: []string{"./ab"},
+		},
+		{
+			name:   "prefix without matches",
+			prefix: "z",
+			expect: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual := names(toc.ListPrefix(tc.prefix))
+			if !reflect.DeepEqual(actual, tc.expect) {
+				t.Fatalf("unexpected entries. expect: %v, actual: %v", tc.expect, actual)
+			}
+		})
+	}
+}
+
+func TestTOCReadDir(t *testing.T) {
+	t.Parallel()
+	toc := testIndexedTOC()
+	testCases := []struct {
+		name   string
+		dir    string
+		expect []string
+	}{
+		{
+			name:   "root directory",
+			dir:    "/",
+			expect: []string{"./a/", "./ab"},
+		},
+		{
+			name: "subdirectory excludes nested entries",
+			dir:  "./a/",
+			expect: []string{"./a/absolute", "./a/b/", "./a/chain", "./a/dangling", "./a/file",
+				"./a/hardlink", "./a/loop1", "./a/loop2", "./a/relative", "./a/self"},
+		},
+		{
+			name:   "nested directory",
+			dir:    "a/b",
+			expect: []string{"./a/b/nested"},
+		},
+		{
+			name:   "missing directory",
+			dir:    "c",
+			expect: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual := names(toc.ReadDir(tc.dir))
+			if !reflect.DeepEqual(actual, tc.expect) {
+				t.Fatalf("unexpected entries. expect: %v, actual: %v", tc.expect, actual)
+			}
+		})
+	}
+}
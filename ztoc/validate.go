@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// Errors returned by `Ztoc.Validate`. They are wrapped with the details of the
+// violation, so they must be checked with `errors.Is`.
+var (
+	// ErrInvalidArchiveSize is returned if the size of the compressed or uncompressed archive is negative.
+	ErrInvalidArchiveSize = errors.New("invalid archive size")
+	// ErrFileOutOfBounds is returned if the content of a file is not within the uncompressed archive.
+	ErrFileOutOfBounds = errors.New("file out of bounds of the uncompressed archive")
+	// ErrInvalidSparseMap is returned if the fragments of a sparse file are out of order or out of the file.
+	ErrInvalidSparseMap = errors.New("invalid sparse map")
+	// ErrSpanDigestsMismatch is returned if the number of span digests doesn't match `MaxSpanID`.
+	ErrSpanDigestsMismatch = errors.New("number of span digests doesn't match the number of spans")
+	// ErrInvalidSpanDigest is returned if a span digest can't be parsed.
+	ErrInvalidSpanDigest = errors.New("invalid span digest")
+	// ErrInvalidCheckpoints is returned if the checkpoints can't be deserialized (e.g., if their
+	// size doesn't match the number of checkpoints they claim to contain).
+	ErrInvalidCheckpoints = errors.New("invalid checkpoints")
+	// ErrCheckpointsMismatch is returned if the number of checkpoints doesn't match `MaxSpanID`.
+	ErrCheckpointsMismatch = errors.New("number of checkpoints doesn't match the number of spans")
+	// ErrCheckpointOutOfBounds is returned if a checkpoint is not within the compressed or uncompressed archive.
+	ErrCheckpointOutOfBounds = errors.New("checkpoint out of bounds of the archive")
+	// ErrCheckpointsOutOfOrder is returned if the start offsets of the spans don't strictly increase with their ID.
+	ErrCheckpointsOutOfOrder = errors.New("checkpoints out of order")
+)
+
+// Validate checks the invariants that the rest of the snapshotter relies on when it reads
+// a layer with the ztoc, so that a malformed ztoc (e.g., fetched from a registry) is
+// rejected instead of causing out of bounds reads.
+func (zt *Ztoc) Validate() error {
+	if zt.CompressedArchiveSize < 0 || zt.UncompressedArchiveSize < 0 {
+		return fmt.Errorf("%w: compressed size %d, uncompressed size %d", ErrInvalidArchiveSize, zt.CompressedArchiveSize, zt.UncompressedArchiveSize)
+	}
+	for _, m := range zt.FileMetadata {
+		if err := m.validate(zt.UncompressedArchiveSize); err != nil {
+			return err
+		}
+	}
+
+	if zt.MaxSpanID < 0 || len(zt.SpanDigests) != int(zt.MaxSpanID)+1 {
+		return fmt.Errorf("%w: max span ID %d, %d span digests", ErrSpanDigestsMismatch, zt.MaxSpanID, len(zt.SpanDigests))
+	}
+	for i, d := range zt.SpanDigests {
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("%w: span %d: %v", ErrInvalidSpanDigest, i, err)
+		}
+	}
+
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCheckpoints, err)
+	}
+	defer zinfo.Close()
+	if zinfo.MaxSpanID() != zt.MaxSpanID {
+		return fmt.Errorf("%w: max span ID %d, checkpoints max span ID %d", ErrCheckpointsMismatch, zt.MaxSpanID, zinfo.MaxSpanID())
+	}
+	for id := compression.SpanID(0); id <= zt.MaxSpanID; id++ {
+		compressedOffset, uncompressedOffset := zinfo.StartCompressedOffset(id), zinfo.StartUncompressedOffset(id)
+		if compressedOffset < 0 || compressedOffset > zt.CompressedArchiveSize ||
+			uncompressedOffset < 0 || uncompressedOffset > zt.UncompressedArchiveSize {
+			return fmt.Errorf("%w: span %d starts at compressed offset %d and uncompressed offset %d",
+				ErrCheckpointOutOfBounds, id, compressedOffset, uncompressedOffset)
+		}
+		if id > 0 && (compressedOffset <= zinfo.StartCompressedOffset(id-1) || uncompressedOffset <= zinfo.StartUncompressedOffset(id-1)) {
+			return fmt.Errorf("%w: span %d starts at compressed offset %d and uncompressed offset %d, span %d at %d and %d",
+				ErrCheckpointsOutOfOrder, id, compressedOffset, uncompressedOffset, id-1, zinfo.StartCompressedOffset(id-1), zinfo.StartUncompressedOffset(id-1))
+		}
+	}
+	return nil
+}
+
+// validate checks that the content of the file is within an uncompressed archive of `archiveSize` bytes.
+func (src FileMetadata) validate(archiveSize compression.Offset) error {
+	var end compression.Offset
+	for i, e := range src.SparseMap {
+		if e.Offset < end || e.Length < 0 || e.Offset > src.UncompressedSize || e.Length > src.UncompressedSize-e.Offset {
+			return fmt.Errorf("%w: %s: fragment %d at offset %d with %d bytes, file size %d",
+				ErrInvalidSparseMap, src.Name, i, e.Offset, e.Length, src.UncompressedSize)
+		}
+		end = e.Offset + e.Length
+	}
+	stored := src.StoredSize()
+	if src.UncompressedOffset < 0 || src.UncompressedSize < 0 ||
+		src.UncompressedOffset > archiveSize || stored > archiveSize-src.UncompressedOffset {
+		return fmt.Errorf("%w: %s at offset %d with %d bytes, archive size %d",
+			ErrFileOutOfBounds, src.Name, src.UncompressedOffset, stored, archiveSize)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+var validateTarEntries = []testutil.TarEntry{
+	testutil.Dir("dir/"),
+	testutil.File("dir/file1", string(testutil.RandomByteData(300000))),
+	testutil.File("dir/file2", string(testutil.RandomByteData(200000))),
+	testutil.SparseFile("dir/sparse", 1000000, []testutil.SparseFragment{{Offset: 5000, Data: "sparse"}}, testutil.SparsePAX10),
+	testutil.Symlink("dir/symlink", "file1"),
+}
+
+// buildValidateZtoc builds a ztoc for `validateTarEntries` and round trips it through
+// its serialized form, like a ztoc fetched from a registry.
+func buildValidateZtoc(t *testing.T, compressionAlgo string, generator tarGenerator, options ...BuildOption) *Ztoc {
+	tarFilePath, _, _ := generator(t, "validate", validateTarEntries)
+	defer os.Remove(tarFilePath)
+	toc, err := NewBuilder("test").BuildZtoc(tarFilePath, 65536, append(options, WithCompression(compressionAlgo))...)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	r, _, err := Marshal(toc)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	unmarshalled, err := Unmarshal(r)
+	if err != nil {
+		t.Fatalf("can't unmarshal ztoc: %v", err)
+	}
+	return unmarshalled
+}
+
+func TestValidateZtoc(t *testing.T) {
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			toc := buildValidateZtoc(t, tc.compressionAlgo, tc.tarGenerator)
+			if err := toc.Validate(); err != nil {
+				t.Fatalf("unexpected error validating ztoc: %v", err)
+			}
+		})
+	}
+	t.Run("gzip with compact checkpoints", func(t *testing.T) {
+		toc := buildValidateZtoc(t, compression.Gzip, buildTarGZ, WithCompactCheckpoints())
+		if err := toc.Validate(); err != nil {
+			t.Fatalf("unexpected error validating ztoc: %v", err)
+		}
+	})
+	t.Run("gzip with span alignment", func(t *testing.T) {
+		toc := buildValidateZtoc(t, compression.Gzip, buildTarGZ, WithSpanAlignment(1000, nil))
+		if err := toc.Validate(); err != nil {
+			t.Fatalf("unexpected error validating ztoc: %v", err)
+		}
+	})
+	t.Run("estargz", func(t *testing.T) {
+		tarFilePath, _ := buildEStargz(t, validateTarEntries[:3], 8192)
+		defer os.Remove(tarFilePath)
+		toc, err := NewBuilder("test").BuildZtocFromEStargz(tarFilePath, 65536)
+		if err != nil {
+			t.Fatalf("can't build ztoc: %v", err)
+		}
+		if err := toc.Validate(); err != nil {
+			t.Fatalf("unexpected error validating ztoc: %v", err)
+		}
+	})
+}
+
+func TestValidateInvalidZtoc(t *testing.T) {
+	testCases := []struct {
+		name            string
+		compressionAlgo string
+		modify          func(zt *Ztoc)
+		expected        error
+	}{
+		{
+			name:     "negative archive size",
+			modify:   func(zt *Ztoc) { zt.CompressedArchiveSize = -1 },
+			expected: ErrInvalidArchiveSize,
+		},
+		{
+			name:     "file past the end of the archive",
+			modify:   func(zt *Ztoc) { zt.FileMetadata[1].UncompressedOffset = zt.UncompressedArchiveSize - 10 },
+			expected: ErrFileOutOfBounds,
+		},
+		{
+			name:     "file size overflowing the archive",
+			modify:   func(zt *Ztoc) { zt.FileMetadata[1].UncompressedSize = 1<<63 - 1 },
+			expected: ErrFileOutOfBounds,
+		},
+		{
+			name:     "negative file offset",
+			modify:   func(zt *Ztoc) { zt.FileMetadata[1].UncompressedOffset = -512 },
+			expected: ErrFileOutOfBounds,
+		},
+		{
+			name:     "archive smaller than its files",
+			modify:   func(zt *Ztoc) { zt.UncompressedArchiveSize = 1000 },
+			expected: ErrFileOutOfBounds,
+		},
+		{
+			name: "sparse fragment past the end of the file",
+			modify: func(zt *Ztoc) {
+				m := findFileMetadata(zt, "dir/sparse")
+				m.SparseMap[0].Offset = m.UncompressedSize
+			},
+			expected: ErrInvalidSparseMap,
+		},
+		{
+			name: "overlapping sparse fragments",
+			modify: func(zt *Ztoc) {
+				m := findFileMetadata(zt, "dir/sparse")
+				m.SparseMap = []SparseEntry{{Offset: 10, Length: 5}, {Offset: 12, Length: 1}}
+			},
+			expected: ErrInvalidSparseMap,
+		},
+		{
+			name:     "missing span digests",
+			modify:   func(zt *Ztoc) { zt.SpanDigests = zt.SpanDigests[:len(zt.SpanDigests)-1] },
+			expected: ErrSpanDigestsMismatch,
+		},
+		{
+			name:     "negative max span ID",
+			modify:   func(zt *Ztoc) { zt.MaxSpanID = -1 },
+			expected: ErrSpanDigestsMismatch,
+		},
+		{
+			name:     "invalid span digest",
+			modify:   func(zt *Ztoc) { zt.SpanDigests[0] = "" },
+			expected: ErrInvalidSpanDigest,
+		},
+		{
+			name: "more spans than checkpoints",
+			modify: func(zt *Ztoc) {
+				zt.MaxSpanID++
+				zt.SpanDigests = append(zt.SpanDigests, digest.FromString("span"))
+			},
+			expected: ErrCheckpointsMismatch,
+		},
+		{
+			name:     "truncated gzip checkpoints",
+			modify:   func(zt *Ztoc) { zt.Checkpoints = zt.Checkpoints[:len(zt.Checkpoints)-1] },
+			expected: ErrInvalidCheckpoints,
+		},
+		{
+			name: "gzip checkpoints claiming more checkpoints than stored",
+			modify: func(zt *Ztoc) {
+				binary.LittleEndian.PutUint32(zt.Checkpoints[0:4], binary.LittleEndian.Uint32(zt.Checkpoints[0:4])+10)
+			},
+			expected: ErrInvalidCheckpoints,
+		},
+		{
+			name:            "truncated zstd checkpoints",
+			compressionAlgo: compression.Zstd,
+			modify:          func(zt *Ztoc) { zt.Checkpoints = zt.Checkpoints[:8] },
+			expected:        ErrInvalidCheckpoints,
+		},
+		{
+			name:     "checkpoint past the end of the compressed archive",
+			modify:   func(zt *Ztoc) { zt.CompressedArchiveSize = 100 },
+			expected: ErrCheckpointOutOfBounds,
+		},
+		{
+			name: "checkpoints with decreasing compressed offsets",
+			modify: func(zt *Ztoc) {
+				cp1, cp2 := gzipCheckpointOffset(1), gzipCheckpointOffset(2)
+				in1 := binary.LittleEndian.Uint64(zt.Checkpoints[cp1:])
+				copy(zt.Checkpoints[cp1:cp1+8], zt.Checkpoints[cp2:cp2+8])
+				binary.LittleEndian.PutUint64(zt.Checkpoints[cp2:], in1)
+			},
+			expected: ErrCheckpointsOutOfOrder,
+		},
+		{
+			name: "checkpoints with the same uncompressed offset",
+			modify: func(zt *Ztoc) {
+				cp1, cp2 := gzipCheckpointOffset(1), gzipCheckpointOffset(2)
+				copy(zt.Checkpoints[cp2+8:cp2+16], zt.Checkpoints[cp1+8:cp1+16])
+			},
+			expected: ErrCheckpointsOutOfOrder,
+		},
+		{
+			name:     "unknown compression algorithm",
+			modify:   func(zt *Ztoc) { zt.CompressionAlgorithm = "foo" },
+			expected: ErrInvalidCheckpoints,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var toc *Ztoc
+			if tc.compressionAlgo == compression.Zstd {
+				toc = buildValidateZtoc(t, compression.Zstd, buildTarZstd)
+			} else {
+				toc = buildValidateZtoc(t, compression.Gzip, buildTarGZ)
+			}
+			tc.modify(toc)
+			err := toc.Validate()
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+// gzipCheckpointOffset returns the offset of checkpoint `id` in raw gzip checkpoints,
+// which start with the compressed (8 bytes) and uncompressed (8 bytes) offsets of the span.
+func gzipCheckpointOffset(id int) int {
+	// header (12 bytes), then per checkpoint: offsets (16 bytes), bits (1 byte), window (32 KiB).
+	return 12 + id*(8+8+1+32768)
+}
+
+func findFileMetadata(zt *Ztoc, name string) *FileMetadata {
+	for i := range zt.FileMetadata {
+		if zt.FileMetadata[i].Name == name {
+			return &zt.FileMetadata[i]
+		}
+	}
+	return nil
+}
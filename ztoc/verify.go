@@ -0,0 +1,85 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// ErrTOCMismatch is returned by `VerifyTOC` if the TOC doesn't match the files of the layer.
+var ErrTOCMismatch = errors.New("TOC doesn't match the layer")
+
+// VerifyTOC checks that the TOC of the ztoc describes the files of `r`, the uncompressed tar archive
+// of the layer, with the content of regular files at the same offsets. The file digests are only
+// checked if the ztoc version has them.
+func (zt *Ztoc) VerifyTOC(r io.Reader) error {
+	md, size, err := metadataFromTarReader(r)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(md) && i < len(zt.FileMetadata); i++ {
+		if field := diffFileMetadata(zt.FileMetadata[i], md[i], zt.Version.HasFileDigests()); field != "" {
+			return fmt.Errorf("%w: %s of file %d (%s) differs", ErrTOCMismatch, field, i, md[i].Name)
+		}
+	}
+	if len(md) != len(zt.FileMetadata) {
+		return fmt.Errorf("%w: the TOC has %d files, the layer has %d", ErrTOCMismatch, len(zt.FileMetadata), len(md))
+	}
+	if size != zt.UncompressedArchiveSize {
+		return fmt.Errorf("%w: the uncompressed size is %d, the layer's is %d", ErrTOCMismatch, zt.UncompressedArchiveSize, size)
+	}
+	return nil
+}
+
+// diffFileMetadata returns the name of the first field that differs between `expected` and `actual`,
+// or "" if they match.
+func diffFileMetadata(expected, actual FileMetadata, withDigest bool) string {
+	// ztocs built from the TOC of an eStargz layer have clean names and only
+	// record the offsets of the content of regular files.
+	switch {
+	case cleanPath(expected.Name) != cleanPath(actual.Name):
+		return "name"
+	case expected.Type != actual.Type:
+		return "type"
+	case expected.Type == "reg" && expected.UncompressedOffset != actual.UncompressedOffset:
+		return "offset"
+	case expected.Type == "reg" && expected.UncompressedSize != actual.UncompressedSize:
+		return "size"
+	case expected.Linkname != actual.Linkname:
+		return "link name"
+	case expected.Mode != actual.Mode:
+		return "mode"
+	case expected.UID != actual.UID || expected.GID != actual.GID:
+		return "owner"
+	case expected.Uname != actual.Uname || expected.Gname != actual.Gname:
+		return "owner name"
+	case !expected.ModTime.Equal(actual.ModTime):
+		return "modification time"
+	case expected.Devmajor != actual.Devmajor || expected.Devminor != actual.Devminor:
+		return "device number"
+	case len(expected.Xattrs) != len(actual.Xattrs) || (len(expected.Xattrs) > 0 && !reflect.DeepEqual(expected.Xattrs, actual.Xattrs)):
+		return "xattrs"
+	case len(expected.SparseMap) != len(actual.SparseMap) || (len(expected.SparseMap) > 0 && !reflect.DeepEqual(expected.SparseMap, actual.SparseMap)):
+		return "sparse map"
+	case withDigest && expected.Digest != actual.Digest:
+		return "digest"
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestVerifyTOC(t *testing.T) {
+	entries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file", string(testutil.RandomByteData(100000))),
+		testutil.Symlink("link", "dir/file"),
+		testutil.File("other", "content"),
+	}
+	gzipReader := func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	zstdReader := func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }
+	buildGzip := func() (*Ztoc, *io.SectionReader, error) {
+		return BuildZtocReader(t, entries, gzip.DefaultCompression, 20000)
+	}
+	buildZstd := func() (*Ztoc, *io.SectionReader, error) { return BuildZtocReaderZstd(t, entries, 3, 20000) }
+	buildEStargz := func() (*Ztoc, *io.SectionReader, error) { return BuildZtocReaderEStargz(t, entries, 10000, 20000) }
+
+	testCases := []struct {
+		name       string
+		build      func() (*Ztoc, *io.SectionReader, error)
+		decompress func(io.Reader) (io.Reader, error)
+		mutate     func(*Ztoc)
+		expectErr  error
+	}{
+		{
+			name:       "gzip",
+			build:      buildGzip,
+			decompress: gzipReader,
+		},
+		{
+			name:       "zstd",
+			build:      buildZstd,
+			decompress: zstdReader,
+		},
+		{
+			name:       "estargz",
+			build:      buildEStargz,
+			decompress: gzipReader,
+		},
+		{
+			name:       "different mode",
+			build:      buildGzip,
+			decompress: gzipReader,
+			mutate:     func(zt *Ztoc) { zt.FileMetadata[1].Mode = 0777 },
+			expectErr:  ErrTOCMismatch,
+		},
+		{
+			name:       "different file digest",
+			build:      buildGzip,
+			decompress: gzipReader,
+			mutate:     func(zt *Ztoc) { zt.FileMetadata[1].Digest = zt.FileMetadata[3].Digest },
+			expectErr:  ErrTOCMismatch,
+		},
+		{
+			name:       "missing file",
+			build:      buildGzip,
+			decompress: gzipReader,
+			mutate:     func(zt *Ztoc) { zt.FileMetadata = zt.FileMetadata[:len(zt.FileMetadata)-1] },
+			expectErr:  ErrTOCMismatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			zt, sr, err := tc.build()
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if tc.mutate != nil {
+				tc.mutate(zt)
+			}
+			r, err := tc.decompress(sr)
+			if err != nil {
+				t.Fatalf("can't decompress layer: %v", err)
+			}
+			err = zt.VerifyTOC(r)
+			if tc.expectErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expectErr != nil && !errors.Is(err, tc.expectErr) {
+				t.Fatalf("unexpected error. expect: %v, actual: %v", tc.expectErr, err)
+			}
+		})
+	}
+}
@@ -17,12 +17,16 @@
 package ztoc
 
 import (
+	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
 )
 
 // ZinfoBuilder builds the `zinfo` part of a ztoc. This interface should be
@@ -32,6 +36,32 @@ type ZinfoBuilder interface {
 	ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error)
 }
 
+// ZinfoStreamBuilder is implemented by a `ZinfoBuilder` that can also build zinfo
+// in a single pass over a compressed stream, which is needed by `Builder.BuildZtocFromReader`.
+type ZinfoStreamBuilder interface {
+	// ZinfoFromReader builds zinfo given a compressed tar stream and span size, writes the
+	// uncompressed tar stream to `w`, and calculates the size of the compressed stream.
+	ZinfoFromReader(r io.Reader, w io.Writer, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error)
+}
+
+// ConcurrentZinfoBuilder is implemented by a `ZinfoBuilder` that can compute the
+// span digests concurrently with the scan of the compressed file, which is used by
+// `Builder.BuildZtoc` if `WithConcurrency` is specified.
+type ConcurrentZinfoBuilder interface {
+	// ZinfoFromFileConcurrently builds zinfo given a compressed tar filename and span size,
+	// writes the uncompressed tar stream to `w`, and calculates the size of the file. Up to
+	// `concurrency` span digests are computed at the same time.
+	ZinfoFromFileConcurrently(filename string, spanSize int64, w io.Writer, concurrency int) (zinfo CompressionInfo, fs compression.Offset, err error)
+}
+
+// SpanBoundaryZinfoBuilder is implemented by a `ZinfoBuilder` that can choose where
+// spans start, which is used by `Builder.BuildZtoc` if `WithSpanAlignment` is specified.
+type SpanBoundaryZinfoBuilder interface {
+	// ZinfoFromFileWithSpanBoundaries builds zinfo given a compressed tar filename and span size
+	// like `ZinfoFromFile`, but spans only start where `canSplit` allows it.
+	ZinfoFromFileWithSpanBoundaries(filename string, spanSize int64, canSplit compression.SpanBoundaryFunc) (zinfo CompressionInfo, fs compression.Offset, err error)
+}
+
 type gzipZinfoBuilder struct{}
 
 // ZinfoFromFile creates zinfo for a gzip file. The underlying zinfo object (i.e. `GzipZinfo`)
@@ -42,6 +72,109 @@ func (gzb gzipZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinf
 		return
 	}
 	defer index.Close()
+	return zinfoFromIndex(compression.Gzip, filename, index)
+}
+
+// ZinfoFromFileWithSpanBoundaries creates zinfo for a gzip file whose spans only start
+// where `canSplit` allows it.
+func (gzb gzipZinfoBuilder) ZinfoFromFileWithSpanBoundaries(filename string, spanSize int64, canSplit compression.SpanBoundaryFunc) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	index, err := compression.NewZinfoFromFileWithSpanBoundaries(compression.Gzip, filename, spanSize, canSplit)
+	if err != nil {
+		return
+	}
+	defer index.Close()
+	return zinfoFromIndex(compression.Gzip, filename, index)
+}
+
+// ZinfoFromReader creates zinfo for a gzip stream.
+func (gzb gzipZinfoBuilder) ZinfoFromReader(r io.Reader, w io.Writer, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromReader(compression.Gzip, r, w, spanSize)
+}
+
+// ZinfoFromFileConcurrently creates zinfo for a gzip file, computing the span digests
+// while the file is being decompressed. The C engine can't build zinfo from a stream,
+// so it builds zinfo from the file while the file is decompressed to `w`, then computes
+// the span digests.
+func (gzb gzipZinfoBuilder) ZinfoFromFileConcurrently(filename string, spanSize int64, w io.Writer, concurrency int) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	if compression.CurrentGzipEngine() == compression.GzipEngineCgo {
+		return gzipZinfoFromFileConcurrently(filename, spanSize, w, concurrency)
+	}
+	return zinfoFromFileConcurrently(compression.Gzip, filename, spanSize, w, concurrency)
+}
+
+// gzipZinfoFromFileConcurrently builds zinfo from a gzip file with the current gzip engine
+// while the file is decompressed to `w`, then computes up to `concurrency` span digests at
+// the same time.
+func gzipZinfoFromFileConcurrently(filename string, spanSize int64, w io.Writer, concurrency int) (CompressionInfo, compression.Offset, error) {
+	if concurrency <= 0 {
+		return CompressionInfo{}, 0, fmt.Errorf("invalid concurrency: %d", concurrency)
+	}
+	var (
+		eg    errgroup.Group
+		index compression.Zinfo
+	)
+	eg.Go(func() error {
+		var err error
+		index, err = compression.NewZinfoFromFile(compression.Gzip, filename, spanSize)
+		return err
+	})
+	decompressErr := decompressGzipFile(filename, w)
+	if err := eg.Wait(); err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	defer index.Close()
+	if decompressErr != nil {
+		return CompressionInfo{}, 0, decompressErr
+	}
+
+	fs, err := getFileSize(filename)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	digests, err := getPerSpanDigestsConcurrently(filename, int64(fs), index, concurrency)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: compression.Gzip,
+	}, fs, nil
+}
+
+// decompressGzipFile writes the uncompressed content of a gzip file to `w`.
+func decompressGzipFile(filename string, w io.Writer) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("could not read gzip file: %w", err)
+	}
+	if _, err := io.Copy(w, gr); err != nil {
+		return fmt.Errorf("could not decompress gzip file: %w", err)
+	}
+	return nil
+}
+
+type zstdZinfoBuilder struct{}
+
+// ZinfoFromFile creates zinfo for a zstd file. The underlying zinfo object (i.e. `ZstdZinfo`)
+// is stored in `CompressionInfo.Checkpoints` as byte slice.
+func (zzb zstdZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	index, err := compression.NewZinfoFromFile(compression.Zstd, filename, spanSize)
+	if err != nil {
+		return
+	}
+	defer index.Close()
 
 	fs, err = getFileSize(filename)
 	if err != nil {
@@ -62,10 +195,21 @@ func (gzb gzipZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinf
 		MaxSpanID:            index.MaxSpanID(),
 		SpanDigests:          digests,
 		Checkpoints:          checkpoints,
-		CompressionAlgorithm: compression.Gzip,
+		CompressionAlgorithm: compression.Zstd,
 	}, fs, nil
 }
 
+// ZinfoFromReader creates zinfo for a zstd stream.
+func (zzb zstdZinfoBuilder) ZinfoFromReader(r io.Reader, w io.Writer, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromReader(compression.Zstd, r, w, spanSize)
+}
+
+// ZinfoFromFileConcurrently creates zinfo for a zstd file, computing the span digests
+// while the file is being decompressed.
+func (zzb zstdZinfoBuilder) ZinfoFromFileConcurrently(filename string, spanSize int64, w io.Writer, concurrency int) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromFileConcurrently(compression.Zstd, filename, spanSize, w, concurrency)
+}
+
 type tarZinfoBuilder struct{}
 
 func (tzb tarZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
@@ -98,6 +242,220 @@ func (tzb tarZinfoBuilder) ZinfoFromFile(filename string, spanSize int64) (zinfo
 	}, fs, nil
 }
 
+func (tzb tarZinfoBuilder) ZinfoFromReader(r io.Reader, w io.Writer, spanSize int64) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromReader(compression.Uncompressed, r, w, spanSize)
+}
+
+func (tzb tarZinfoBuilder) ZinfoFromFileConcurrently(filename string, spanSize int64, w io.Writer, concurrency int) (zinfo CompressionInfo, fs compression.Offset, err error) {
+	return zinfoFromFileConcurrently(compression.Uncompressed, filename, spanSize, w, concurrency)
+}
+
+// zinfoFromFileConcurrently builds zinfo in a single pass over the compressed file, while
+// up to `concurrency` goroutines compute the digests of the spans which have been scanned.
+func zinfoFromFileConcurrently(algorithm, filename string, spanSize int64, w io.Writer, concurrency int) (CompressionInfo, compression.Offset, error) {
+	if concurrency <= 0 {
+		return CompressionInfo{}, 0, fmt.Errorf("invalid concurrency: %d", concurrency)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return CompressionInfo{}, 0, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer file.Close()
+	fs, err := getFileSize(filename)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	sd := newConcurrentSpanDigester(file, concurrency)
+	index, err := compression.NewZinfoFromReader(algorithm, io.NewSectionReader(file, 0, int64(fs)), w, spanSize, sd.startSpan)
+	if err != nil {
+		sd.wait()
+		return CompressionInfo{}, 0, err
+	}
+	defer index.Close()
+
+	digests, err := sd.finish(fs)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	if len(digests) != int(index.MaxSpanID())+1 {
+		return CompressionInfo{}, 0, fmt.Errorf("unexpected number of span digests; expected %d, got %d", index.MaxSpanID()+1, len(digests))
+	}
+
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: algorithm,
+	}, fs, nil
+}
+
+// concurrentSpanDigester computes the per span digests of a compressed file with a
+// bounded number of goroutines. Starting a span blocks while all goroutines are busy,
+// so the scan of the file never gets too far ahead of the digests.
+type concurrentSpanDigester struct {
+	file    io.ReaderAt
+	eg      errgroup.Group
+	mu      sync.Mutex
+	digests []digest.Digest
+	start   compression.Offset // start offset of the current span
+	started bool
+}
+
+func newConcurrentSpanDigester(file io.ReaderAt, concurrency int) *concurrentSpanDigester {
+	sd := &concurrentSpanDigester{file: file}
+	sd.eg.SetLimit(concurrency)
+	return sd
+}
+
+// startSpan is a `compression.SpanFunc` that computes the digest of the previous span
+// in the background.
+func (sd *concurrentSpanDigester) startSpan(start, prevEnd compression.Offset) {
+	if sd.started {
+		sd.digest(sd.start, prevEnd)
+	}
+	sd.start = start
+	sd.started = true
+}
+
+func (sd *concurrentSpanDigester) digest(start, end compression.Offset) {
+	sd.mu.Lock()
+	spanID := len(sd.digests)
+	sd.digests = append(sd.digests, "")
+	sd.mu.Unlock()
+
+	sd.eg.Go(func() error {
+		section := io.NewSectionReader(sd.file, int64(start), int64(end-start))
+		dgst, err := digest.FromReader(section)
+		if err != nil {
+			return fmt.Errorf("unable to compute digest for section; start=%d, end=%d: %w", start, end, err)
+		}
+		sd.mu.Lock()
+		sd.digests[spanID] = dgst
+		sd.mu.Unlock()
+		return nil
+	})
+}
+
+// finish computes the digest of the last span, which ends at `fileSize`, and
+// returns the digests of all spans once they have been computed.
+func (sd *concurrentSpanDigester) finish(fileSize compression.Offset) ([]digest.Digest, error) {
+	if sd.started {
+		sd.digest(sd.start, fileSize)
+	}
+	if err := sd.wait(); err != nil {
+		return nil, err
+	}
+	return sd.digests, nil
+}
+
+func (sd *concurrentSpanDigester) wait() error {
+	return sd.eg.Wait()
+}
+
+// zinfoFromReader builds zinfo and computes the per span digests in a single pass
+// over the compressed stream `r`.
+func zinfoFromReader(algorithm string, r io.Reader, w io.Writer, spanSize int64) (CompressionInfo, compression.Offset, error) {
+	sr := &spanDigestReader{r: r}
+	index, err := compression.NewZinfoFromReader(algorithm, sr, w, spanSize, sr.startSpan)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	defer index.Close()
+
+	// the zinfo may not need the whole stream (e.g. trailing data after a gzip member),
+	// but it still belongs to the last span.
+	digests, fs, err := sr.finish()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+	if len(digests) != int(index.MaxSpanID())+1 {
+		return CompressionInfo{}, 0, fmt.Errorf("unexpected number of span digests; expected %d, got %d", index.MaxSpanID()+1, len(digests))
+	}
+
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: algorithm,
+	}, fs, nil
+}
+
+// spanDigestReader computes the per span digests of a compressed stream while
+// it's being read. Only the compressed data of the current span is kept in memory.
+type spanDigestReader struct {
+	r       io.Reader
+	buf     []byte             // compressed data read since `start`
+	start   compression.Offset // start offset of the current span
+	started bool
+	digests []digest.Digest
+}
+
+func (sr *spanDigestReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.buf = append(sr.buf, p[:n]...)
+	return n, err
+}
+
+// startSpan is a `compression.SpanFunc` that computes the digest of the previous span
+// and drops the data that doesn't belong to the new span.
+func (sr *spanDigestReader) startSpan(start, prevEnd compression.Offset) {
+	if sr.started {
+		sr.digests = append(sr.digests, digest.FromBytes(sr.buf[:prevEnd-sr.start]))
+	}
+	sr.buf = append(sr.buf[:0], sr.buf[start-sr.start:]...)
+	sr.start = start
+	sr.started = true
+}
+
+// finish reads the rest of the stream and returns the digests of all spans
+// and the size of the compressed stream.
+func (sr *spanDigestReader) finish() ([]digest.Digest, compression.Offset, error) {
+	if _, err := io.Copy(io.Discard, sr); err != nil {
+		return nil, 0, err
+	}
+	fs := sr.start + compression.Offset(len(sr.buf))
+	if sr.started {
+		sr.digests = append(sr.digests, digest.FromBytes(sr.buf))
+	}
+	return sr.digests, fs, nil
+}
+
+// zinfoFromIndex creates the zinfo of a compressed file from its `index`.
+func zinfoFromIndex(algorithm, filename string, index compression.Zinfo) (CompressionInfo, compression.Offset, error) {
+	fs, err := getFileSize(filename)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	digests, err := getPerSpanDigests(filename, int64(fs), index)
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return CompressionInfo{}, 0, err
+	}
+
+	return CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: algorithm,
+	}, fs, nil
+}
+
 func getPerSpanDigests(filename string, fileSize int64, index compression.Zinfo) ([]digest.Digest, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -122,6 +480,38 @@ func getPerSpanDigests(filename string, fileSize int64, index compression.Zinfo)
 	return digests, nil
 }
 
+// getPerSpanDigestsConcurrently computes the digests of the spans of `index` like
+// `getPerSpanDigests`, up to `concurrency` at the same time.
+func getPerSpanDigestsConcurrently(filename string, fileSize int64, index compression.Zinfo, concurrency int) ([]digest.Digest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer file.Close()
+
+	var eg errgroup.Group
+	eg.SetLimit(concurrency)
+	digests := make([]digest.Digest, index.MaxSpanID()+1)
+	for i := range digests {
+		i := i
+		startOffset := index.StartCompressedOffset(compression.SpanID(i))
+		endOffset := index.EndCompressedOffset(compression.SpanID(i), compression.Offset(fileSize))
+		eg.Go(func() error {
+			section := io.NewSectionReader(file, int64(startOffset), int64(endOffset-startOffset))
+			dgst, err := digest.FromReader(section)
+			if err != nil {
+				return fmt.Errorf("unable to compute digest for section; start=%d, end=%d, file=%s, size=%d", startOffset, endOffset, filename, fileSize)
+			}
+			digests[i] = dgst
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
 func getFileSize(file string) (compression.Offset, error) {
 	st, err := os.Stat(file)
 	if err != nil {
@@ -36,8 +36,16 @@ type Version string
 // Ztoc versions available.
 const (
 	Version09 Version = "0.9"
+	// Version10 adds the digest of the content of regular files to `FileMetadata`.
+	Version10 Version = "1.0"
 )
 
+// HasFileDigests returns true if ztocs of this version record the digest of
+// every regular file.
+func (v Version) HasFileDigests() bool {
+	return v == Version10
+}
+
 // Ztoc is a table of contents for compressed data which consists 2 parts:
 //
 // (1). toc (`TOC`): a table of contents containing file metadata and its
@@ -61,12 +69,15 @@ type CompressionInfo struct {
 	SpanDigests          []digest.Digest
 	Checkpoints          []byte
 	CompressionAlgorithm string
+	CheckpointsEncoding  compression.CheckpointsEncoding // Encoding of `Checkpoints`, which is raw by default
 }
 
 // TOC is the "ztoc" part of ztoc including metadata of all files in the compressed
 // data (e.g., a gzip tar file).
 type TOC struct {
 	FileMetadata []FileMetadata
+
+	index *tocIndex
 }
 
 // FileMetadata contains metadata of a file in the compressed data.
@@ -87,6 +98,28 @@ type FileMetadata struct {
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
 	Xattrs map[string]string
+
+	Digest digest.Digest // Digest of the file content (valid for regular files since Version10)
+
+	AccessTime time.Time // Access time (only if recorded in PAX records)
+	ChangeTime time.Time // Status change time (only if recorded in PAX records)
+
+	// SparseMap are the data fragments of a sparse file, which are stored back to back
+	// at `UncompressedOffset`. The rest of the file is a hole. It is nil if the file is
+	// not sparse; a sparse file without data has a single fragment of length 0.
+	SparseMap []SparseEntry
+}
+
+// SparseEntry is a fragment of data of a sparse file.
+type SparseEntry struct {
+	Offset compression.Offset // Offset of the fragment in the file
+	Length compression.Offset // Length of the fragment
+}
+
+// StoredSize returns the size of the file content stored in the uncompressed data,
+// which is smaller than `UncompressedSize` if the file is sparse.
+func (src FileMetadata) StoredSize() compression.Offset {
+	return storedSize(src.UncompressedSize, src.SparseMap)
 }
 
 // FileMode gets file mode for the file metadata
@@ -113,22 +146,20 @@ func (src FileMetadata) FileMode() (m os.FileMode) {
 type MetadataEntry struct {
 	UncompressedSize   compression.Offset
 	UncompressedOffset compression.Offset
+	SparseMap          []SparseEntry
 }
 
-// GetMetadataEntry gets MetadataEntry given a filename.
+// GetMetadataEntry gets MetadataEntry given a filename, following links.
 func (toc TOC) GetMetadataEntry(filename string) (MetadataEntry, error) {
-	for _, v := range toc.FileMetadata {
-		if v.Name == filename {
-			if v.Linkname != "" {
-				return toc.GetMetadataEntry(v.Linkname)
-			}
-			return MetadataEntry{
-				UncompressedSize:   v.UncompressedSize,
-				UncompressedOffset: v.UncompressedOffset,
-			}, nil
-		}
+	m, err := toc.Resolve(filename)
+	if err != nil {
+		return MetadataEntry{}, err
 	}
-	return MetadataEntry{}, fmt.Errorf("file %s does not exist in metadata", filename)
+	return MetadataEntry{
+		UncompressedSize:   m.UncompressedSize,
+		UncompressedOffset: m.UncompressedOffset,
+		SparseMap:          m.SparseMap,
+	}, nil
 }
 
 // ExtractFile extracts a file from compressed data (as a reader) and returns the
@@ -141,6 +172,10 @@ func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error)
 	if entry.UncompressedSize == 0 {
 		return []byte{}, nil
 	}
+	size := storedSize(entry.UncompressedSize, entry.SparseMap)
+	if size == 0 {
+		return expandSparse(nil, entry.SparseMap, entry.UncompressedSize), nil
+	}
 
 	zinfo, err := zt.Zinfo()
 	if err != nil {
@@ -149,7 +184,7 @@ func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error)
 	defer zinfo.Close()
 
 	spanStart := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset)
-	spanEnd := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset + entry.UncompressedSize)
+	spanEnd := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset + size)
 	numSpans := spanEnd - spanStart + 1
 
 	checkpoints := make([]compression.Offset, numSpans+1)
@@ -187,10 +222,13 @@ func (zt Ztoc) ExtractFile(r *io.SectionReader, filename string) ([]byte, error)
 		return nil, err
 	}
 
-	bytes, err := zinfo.ExtractDataFromBuffer(buf, entry.UncompressedSize, entry.UncompressedOffset, spanStart)
+	bytes, err := zinfo.ExtractDataFromBuffer(buf, size, entry.UncompressedOffset, spanStart)
 	if err != nil {
 		return nil, err
 	}
+	if entry.SparseMap != nil {
+		return expandSparse(bytes, entry.SparseMap, entry.UncompressedSize), nil
+	}
 
 	return bytes, nil
 }
@@ -205,6 +243,10 @@ func (zt Ztoc) ExtractFromTarGz(gz string, filename string) (string, error) {
 	if entry.UncompressedSize == 0 {
 		return "", nil
 	}
+	size := storedSize(entry.UncompressedSize, entry.SparseMap)
+	if size == 0 {
+		return string(expandSparse(nil, entry.SparseMap, entry.UncompressedSize)), nil
+	}
 
 	zinfo, err := zt.Zinfo()
 	if err != nil {
@@ -212,10 +254,13 @@ func (zt Ztoc) ExtractFromTarGz(gz string, filename string) (string, error) {
 	}
 	defer zinfo.Close()
 
-	bytes, err := zinfo.ExtractDataFromFile(gz, entry.UncompressedSize, entry.UncompressedOffset)
+	bytes, err := zinfo.ExtractDataFromFile(gz, size, entry.UncompressedOffset)
 	if err != nil {
 		return "", err
 	}
+	if entry.SparseMap != nil {
+		bytes = expandSparse(bytes, entry.SparseMap, entry.UncompressedSize)
+	}
 
 	return string(bytes), nil
 }
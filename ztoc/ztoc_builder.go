@@ -18,8 +18,11 @@ package ztoc
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
 )
 
 // Builder holds a single `TocBuilder` that builds toc, and one `ZinfoBuilder`
@@ -34,7 +37,7 @@ type Builder struct {
 }
 
 // NewBuilder creates a `Builder` used to build ztocs. By default it supports gzip,
-// user can register new compression algorithms by calling `RegisterCompressionAlgorithm`.
+// zstd and uncompressed tar, user can register new compression algorithms by calling `RegisterCompressionAlgorithm`.
 func NewBuilder(buildToolIdentifier string) *Builder {
 	builder := Builder{
 		tocBuilder:          NewTocBuilder(),
@@ -42,6 +45,7 @@ func NewBuilder(buildToolIdentifier string) *Builder {
 		buildToolIdentifier: buildToolIdentifier,
 	}
 	builder.RegisterCompressionAlgorithm(compression.Gzip, TarProviderGzip, gzipZinfoBuilder{})
+	builder.RegisterCompressionAlgorithm(compression.Zstd, TarProviderZstd, zstdZinfoBuilder{})
 	builder.RegisterCompressionAlgorithm(compression.Uncompressed, TarProviderTar, tarZinfoBuilder{})
 	builder.RegisterCompressionAlgorithm(compression.Unknown, TarProviderTar, tarZinfoBuilder{})
 
@@ -50,7 +54,15 @@ func NewBuilder(buildToolIdentifier string) *Builder {
 
 // buildConfig contains configuration used when `ztoc.Builder` builds a `Ztoc`.
 type buildConfig struct {
-	algorithm string
+	algorithm   string
+	concurrency int
+
+	spanAlignmentMaxFileSize int64
+	spanAlignmentReport      *SpanAlignmentReport
+
+	checkpointsEncoding compression.CheckpointsEncoding
+
+	estargzTOCDigest digest.Digest
 }
 
 // BuildOption specifies a change to `buildConfig` when building a ztoc.
@@ -64,6 +76,61 @@ func WithCompression(algorithm string) BuildOption {
 	}
 }
 
+// WithConcurrency builds the ztoc in a single pass over the layer, computing up to `concurrency`
+// span digests at the same time while the layer is being decompressed. The decompression and the
+// creation of the TOC run in their own goroutines, so up to `concurrency`+2 goroutines are used.
+// The ztoc is identical to the one built without this option. It requires the `ZinfoBuilder` of
+// the compression algorithm to implement `ConcurrentZinfoBuilder`.
+func WithConcurrency(concurrency int) BuildOption {
+	return func(opt *buildConfig) error {
+		if concurrency <= 0 {
+			return fmt.Errorf("invalid concurrency: %d", concurrency)
+		}
+		opt.concurrency = concurrency
+		return nil
+	}
+}
+
+// WithSpanAlignment moves the start of the spans close to the start of files, so that
+// files up to `maxFileSize` bytes don't cross a span boundary and can be fetched in a
+// single span. Spans can thus be smaller or larger than the span size. The ztoc
+// is built in two passes over the layer, so it can't be combined with `WithConcurrency`.
+// If `report` is not nil, it is filled in with the effect of the alignment. If the
+// `ZinfoBuilder` of the compression algorithm doesn't implement `SpanBoundaryZinfoBuilder`,
+// the default span layout is used.
+func WithSpanAlignment(maxFileSize int64, report *SpanAlignmentReport) BuildOption {
+	return func(opt *buildConfig) error {
+		if maxFileSize <= 0 {
+			return fmt.Errorf("invalid span alignment max file size: %d", maxFileSize)
+		}
+		opt.spanAlignmentMaxFileSize = maxFileSize
+		opt.spanAlignmentReport = report
+		return nil
+	}
+}
+
+// WithEStargzTOCDigest specifies the digest of the TOC embedded in an eStargz layer (i.e., the
+// value of its `EStargzTOCDigestAnnotation` annotation), which the embedded TOC must match.
+func WithEStargzTOCDigest(dgst digest.Digest) BuildOption {
+	return func(opt *buildConfig) error {
+		if err := dgst.Validate(); err != nil {
+			return fmt.Errorf("invalid eStargz TOC digest: %w", err)
+		}
+		opt.estargzTOCDigest = dgst
+		return nil
+	}
+}
+
+// WithCompactCheckpoints compresses the checkpoints of gzip layers, which are dominated by
+// the 32 KiB dictionary window of every checkpoint, to make the ztoc smaller. Ztocs of other
+// compression algorithms are not affected.
+func WithCompactCheckpoints() BuildOption {
+	return func(opt *buildConfig) error {
+		opt.checkpointsEncoding = compression.CheckpointsEncodingCompact
+		return nil
+	}
+}
+
 // defaultBuildConfig creates a `buildConfig` with default values.
 func defaultBuildConfig() buildConfig {
 	return buildConfig{
@@ -87,7 +154,33 @@ func (b *Builder) BuildZtoc(filename string, span int64, options ...BuildOption)
 	}
 
 	if !b.CheckCompressionAlgorithm(opt.algorithm) {
-		return nil, fmt.Errorf("unsupported compression algorithm, supported: gzip, got: %s", opt.algorithm)
+		return nil, fmt.Errorf("unsupported compression algorithm, supported: gzip, zstd, uncompressed, got: %s", opt.algorithm)
+	}
+
+	ztoc, err := b.buildZtoc(filename, span, opt)
+	if err != nil {
+		return nil, err
+	}
+	return encodeCheckpoints(ztoc, opt)
+}
+
+// buildZtoc builds a `Ztoc` with raw checkpoints given the filename of a layer blob.
+func (b *Builder) buildZtoc(filename string, span int64, opt buildConfig) (*Ztoc, error) {
+	if opt.spanAlignmentMaxFileSize > 0 {
+		if opt.concurrency > 0 {
+			return nil, fmt.Errorf("span alignment can't be used when building ztoc concurrently")
+		}
+		return b.buildSpanAlignedZtoc(filename, span, opt)
+	}
+
+	if opt.concurrency > 0 {
+		zinfoBuilder, ok := b.zinfoBuilders[opt.algorithm].(ConcurrentZinfoBuilder)
+		if !ok {
+			return nil, fmt.Errorf("compression algorithm %s does not support building ztoc concurrently", opt.algorithm)
+		}
+		return b.buildZtocFromStream(func(w io.Writer) (CompressionInfo, compression.Offset, error) {
+			return zinfoBuilder.ZinfoFromFileConcurrently(filename, span, w, opt.concurrency)
+		})
 	}
 
 	compressionInfo, fs, err := b.zinfoBuilders[opt.algorithm].ZinfoFromFile(filename, span)
@@ -101,7 +194,143 @@ func (b *Builder) BuildZtoc(filename string, span int64, options ...BuildOption)
 	}
 
 	return &Ztoc{
-		Version:                 Version09,
+		Version:                 Version10,
+		TOC:                     toc,
+		CompressedArchiveSize:   fs,
+		UncompressedArchiveSize: uncompressedArchiveSize,
+		BuildToolIdentifier:     b.buildToolIdentifier,
+		CompressionInfo:         compressionInfo,
+	}, nil
+}
+
+// buildSpanAlignedZtoc builds a `Ztoc` whose spans are aligned to the files of its `TOC`,
+// which is built first.
+func (b *Builder) buildSpanAlignedZtoc(filename string, span int64, opt buildConfig) (*Ztoc, error) {
+	toc, uncompressedArchiveSize, err := b.tocBuilder.TocFromFile(opt.algorithm, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		aligner         *spanAligner
+		compressionInfo CompressionInfo
+		fs              compression.Offset
+	)
+	if zinfoBuilder, ok := b.zinfoBuilders[opt.algorithm].(SpanBoundaryZinfoBuilder); ok {
+		aligner = newSpanAligner(toc.FileMetadata, span, opt.spanAlignmentMaxFileSize)
+		compressionInfo, fs, err = zinfoBuilder.ZinfoFromFileWithSpanBoundaries(filename, span, aligner.canSplit)
+	} else {
+		compressionInfo, fs, err = b.zinfoBuilders[opt.algorithm].ZinfoFromFile(filename, span)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ztoc := &Ztoc{
+		Version:                 Version10,
+		TOC:                     toc,
+		CompressedArchiveSize:   fs,
+		UncompressedArchiveSize: uncompressedArchiveSize,
+		BuildToolIdentifier:     b.buildToolIdentifier,
+		CompressionInfo:         compressionInfo,
+	}
+
+	if opt.spanAlignmentReport != nil {
+		zinfo, err := ztoc.Zinfo()
+		if err != nil {
+			return nil, err
+		}
+		defer zinfo.Close()
+		multiSpanFiles := countMultiSpanFiles(toc.FileMetadata, spanBoundaries(zinfo))
+		defaultMultiSpanFiles := multiSpanFiles
+		if aligner != nil {
+			defaultMultiSpanFiles = countMultiSpanFiles(toc.FileMetadata, aligner.defaultBoundaries)
+		}
+		*opt.spanAlignmentReport = SpanAlignmentReport{
+			MultiSpanFiles:        multiSpanFiles,
+			DefaultMultiSpanFiles: defaultMultiSpanFiles,
+		}
+	}
+	return ztoc, nil
+}
+
+// BuildZtocFromReader builds a `Ztoc` in a single pass over a layer blob stream, so the
+// layer doesn't need to be stored locally (e.g., it can be built while the layer is being
+// downloaded). The `ZinfoBuilder` of the compression algorithm must implement `ZinfoStreamBuilder`.
+// By default it assumes the layer is compressed using `gzip`, unless specified via `WithCompression`.
+func (b *Builder) BuildZtocFromReader(r io.Reader, span int64, options ...BuildOption) (*Ztoc, error) {
+	opt := defaultBuildConfig()
+	for _, f := range options {
+		err := f(&opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !b.CheckCompressionAlgorithm(opt.algorithm) {
+		return nil, fmt.Errorf("unsupported compression algorithm, supported: gzip, zstd, uncompressed, got: %s", opt.algorithm)
+	}
+	zinfoBuilder, ok := b.zinfoBuilders[opt.algorithm].(ZinfoStreamBuilder)
+	if !ok {
+		return nil, fmt.Errorf("compression algorithm %s does not support building ztoc from a stream", opt.algorithm)
+	}
+
+	ztoc, err := b.buildZtocFromStream(func(w io.Writer) (CompressionInfo, compression.Offset, error) {
+		return zinfoBuilder.ZinfoFromReader(r, w, span)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeCheckpoints(ztoc, opt)
+}
+
+// encodeCheckpoints encodes the raw checkpoints of `ztoc` as specified by `opt`.
+func encodeCheckpoints(ztoc *Ztoc, opt buildConfig) (*Ztoc, error) {
+	if opt.checkpointsEncoding == compression.CheckpointsEncodingRaw || ztoc.CompressionAlgorithm != compression.Gzip {
+		return ztoc, nil
+	}
+	checkpoints, err := compression.EncodeCheckpoints(ztoc.CompressionAlgorithm, ztoc.Checkpoints, opt.checkpointsEncoding)
+	if err != nil {
+		return nil, err
+	}
+	ztoc.Checkpoints = checkpoints
+	ztoc.CheckpointsEncoding = opt.checkpointsEncoding
+	return ztoc, nil
+}
+
+// buildZtocFromStream builds a `Ztoc` with `zinfoFromStream`, which must write the uncompressed
+// layer to the passed writer. The `TOC` is built from the uncompressed layer at the same time.
+func (b *Builder) buildZtocFromStream(zinfoFromStream func(w io.Writer) (CompressionInfo, compression.Offset, error)) (*Ztoc, error) {
+	var (
+		toc                     TOC
+		uncompressedArchiveSize compression.Offset
+		compressionInfo         CompressionInfo
+		fs                      compression.Offset
+	)
+	pr, pw := io.Pipe()
+	var eg errgroup.Group
+	eg.Go(func() error {
+		fm, size, err := metadataFromTarReader(pr)
+		if err == nil {
+			// consume anything after the end of the tar archive (e.g. padding).
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		toc, uncompressedArchiveSize = NewTOC(fm), size
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		compressionInfo, fs, err = zinfoFromStream(pw)
+		pw.CloseWithError(err)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return &Ztoc{
+		Version:                 Version10,
 		TOC:                     toc,
 		CompressedArchiveSize:   fs,
 		UncompressedArchiveSize: uncompressedArchiveSize,
@@ -128,3 +357,10 @@ func (b *Builder) CheckCompressionAlgorithm(algorithm string) bool {
 	_, ok := b.zinfoBuilders[algorithm]
 	return ok && b.tocBuilder.CheckCompressionAlgorithm(algorithm)
 }
+
+// CheckStreamCompressionAlgorithm checks if a compression algorithm is supported by
+// `BuildZtocFromReader`, i.e., its `ZinfoBuilder` implements `ZinfoStreamBuilder`.
+func (b *Builder) CheckStreamCompressionAlgorithm(algorithm string) bool {
+	_, ok := b.zinfoBuilders[algorithm].(ZinfoStreamBuilder)
+	return ok && b.tocBuilder.CheckCompressionAlgorithm(algorithm)
+}
@@ -111,9 +111,33 @@ func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
 			value := string(xattrEntry.Value())
 			me.Xattrs[key] = value
 		}
+		if dgst := metadataEntry.Digest(); len(dgst) != 0 {
+			me.Digest, err = digest.Parse(string(dgst))
+			if err != nil {
+				return nil, fmt.Errorf("invalid digest of file %s: %w", me.Name, err)
+			}
+		}
+		if accessTime := metadataEntry.AccessTime(); len(accessTime) != 0 {
+			me.AccessTime.UnmarshalText(accessTime)
+		}
+		if changeTime := metadataEntry.ChangeTime(); len(changeTime) != 0 {
+			me.ChangeTime.UnmarshalText(changeTime)
+		}
+		if n := metadataEntry.SparseMapLength(); n != 0 {
+			me.SparseMap = make([]SparseEntry, n)
+			sparseEntry := new(ztoc_flatbuffers.SparseEntry)
+			for j := 0; j < n; j++ {
+				metadataEntry.SparseMap(sparseEntry, j)
+				me.SparseMap[j] = SparseEntry{
+					Offset: compression.Offset(sparseEntry.Offset()),
+					Length: compression.Offset(sparseEntry.Length()),
+				}
+			}
+		}
 
 		ztoc.FileMetadata[i] = me
 	}
+	ztoc.TOC.BuildIndex()
 
 	// ztoc - zinfo
 	compressionInfo := new(ztoc_flatbuffers.CompressionInfo)
@@ -126,6 +150,12 @@ func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
 	}
 	ztoc.Checkpoints = compressionInfo.CheckpointsBytes()
 	ztoc.CompressionAlgorithm = strings.ToLower(compressionInfo.CompressionAlgorithm().String())
+	if compressionInfo.CheckpointsEncoding() == ztoc_flatbuffers.CheckpointsEncodingCompact {
+		ztoc.CheckpointsEncoding = compression.CheckpointsEncodingCompact
+	}
+	if encoding := compression.GetCheckpointsEncoding(ztoc.CompressionAlgorithm, ztoc.Checkpoints); encoding != ztoc.CheckpointsEncoding {
+		return nil, fmt.Errorf("checkpoints encoding %q doesn't match the recorded encoding %q", encoding, ztoc.CheckpointsEncoding)
+	}
 	return ztoc, nil
 }
 
@@ -186,6 +216,13 @@ func ztocToFlatbuffer(ztoc *Ztoc) (fb []byte, err error) {
 		}
 		ztoc_flatbuffers.CompressionInfoAddCompressionAlgorithm(builder, compressionAlgorithm)
 	}
+	switch ztoc.CheckpointsEncoding {
+	case compression.CheckpointsEncodingRaw:
+	case compression.CheckpointsEncodingCompact:
+		ztoc_flatbuffers.CompressionInfoAddCheckpointsEncoding(builder, ztoc_flatbuffers.CheckpointsEncodingCompact)
+	default:
+		return nil, fmt.Errorf("unknown checkpoints encoding: %s", ztoc.CheckpointsEncoding)
+	}
 	ztocInfo := ztoc_flatbuffers.CompressionInfoEnd(builder)
 
 	ztoc_flatbuffers.ZtocStart(builder)
@@ -210,6 +247,28 @@ func prepareMetadataOffset(builder *flatbuffers.Builder, me FileMetadata) flatbu
 	modTime := builder.CreateString(string(modTimeBinary))
 
 	xattrs := prepareXattrsOffset(me, builder)
+	var dgst flatbuffers.UOffsetT
+	if me.Digest != "" {
+		dgst = builder.CreateString(me.Digest.String())
+	}
+	// the access and change times and the sparse map are only added if present,
+	// so that ztocs of layers without them are unchanged.
+	var accessTime, changeTime, sparseMap flatbuffers.UOffsetT
+	if !me.AccessTime.IsZero() {
+		accessTimeBinary, _ := me.AccessTime.MarshalText()
+		accessTime = builder.CreateString(string(accessTimeBinary))
+	}
+	if !me.ChangeTime.IsZero() {
+		changeTimeBinary, _ := me.ChangeTime.MarshalText()
+		changeTime = builder.CreateString(string(changeTimeBinary))
+	}
+	if me.SparseMap != nil {
+		ztoc_flatbuffers.FileMetadataStartSparseMapVector(builder, len(me.SparseMap))
+		for j := len(me.SparseMap) - 1; j >= 0; j-- {
+			ztoc_flatbuffers.CreateSparseEntry(builder, int64(me.SparseMap[j].Offset), int64(me.SparseMap[j].Length))
+		}
+		sparseMap = builder.EndVector(len(me.SparseMap))
+	}
 
 	ztoc_flatbuffers.FileMetadataStart(builder)
 	ztoc_flatbuffers.FileMetadataAddName(builder, name)
@@ -227,6 +286,18 @@ func prepareMetadataOffset(builder *flatbuffers.Builder, me FileMetadata) flatbu
 	ztoc_flatbuffers.FileMetadataAddDevminor(builder, me.Devminor)
 
 	ztoc_flatbuffers.FileMetadataAddXattrs(builder, xattrs)
+	if me.Digest != "" {
+		ztoc_flatbuffers.FileMetadataAddDigest(builder, dgst)
+	}
+	if accessTime != 0 {
+		ztoc_flatbuffers.FileMetadataAddAccessTime(builder, accessTime)
+	}
+	if changeTime != 0 {
+		ztoc_flatbuffers.FileMetadataAddChangeTime(builder, changeTime)
+	}
+	if sparseMap != 0 {
+		ztoc_flatbuffers.FileMetadataAddSparseMap(builder, sparseMap)
+	}
 
 	off := ztoc_flatbuffers.FileMetadataEnd(builder)
 	return off
@@ -24,6 +24,8 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/util/testutil"
@@ -52,6 +54,22 @@ func buildTarGZ(t *testing.T, tarName string, tarEntries []testutil.TarEntry) (s
 	return tarGzFilePath, m, fileNames
 }
 
+// buildTarZstd creates a temp tar zstd file with the given `tarEntries`. The tar
+// is compressed as multiple zstd frames so that the layer can be split into spans.
+func buildTarZstd(t *testing.T, tarName string, tarEntries []testutil.TarEntry) (string, map[string][]byte, []string) {
+	tarReader := testutil.BuildTarZstd(tarEntries, 3, testutil.WithZstdFrameSize(32000))
+	tarZstdFilePath, _, err := testutil.WriteTarToTempFile(tarName+".tar.zst", tarReader)
+	if err != nil {
+		t.Fatalf("cannot prepare the .tar.zst file for testing")
+	}
+	m, fileNames, err := testutil.GetFilesAndContentsWithinTarZstd(tarZstdFilePath)
+	if err != nil {
+		os.Remove(tarZstdFilePath)
+		t.Fatalf("failed to get tar zstd files and their contents: %v", err)
+	}
+	return tarZstdFilePath, m, fileNames
+}
+
 func buildTar(t *testing.T, tarName string, tarEntries []testutil.TarEntry) (string, map[string][]byte, []string) {
 	tarReader := testutil.BuildTar(tarEntries)
 	tarFilePath, _, err := testutil.WriteTarToTempFile(tarName+".tar", tarReader)
@@ -82,6 +100,11 @@ var testZtocs = []struct {
 		compressionAlgo: compression.Gzip,
 		tarGenerator:    buildTarGZ,
 	},
+	{
+		name:            "zstd",
+		compressionAlgo: compression.Zstd,
+		tarGenerator:    buildTarZstd,
+	},
 	{
 		name:            "uncompressed",
 		compressionAlgo: compression.Uncompressed,
@@ -325,6 +348,450 @@ func testZtocGenerationConsistency(t *testing.T, compressionAlgo string, generat
 
 }
 
+func TestBuildZtocFromReader(t *testing.T) {
+	for _, tc := range testZtocs {
+		testBuildZtocFromReader(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func testBuildZtocFromReader(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	testcases := []struct {
+		name       string
+		tarEntries []testutil.TarEntry
+		spanSize   int64
+		tarName    string
+	}{
+		{
+			name: "streamed ztoc equals ztoc built from file, two small files, span_size=64",
+			tarEntries: []testutil.TarEntry{
+				testutil.File("file1", string(testutil.RandomByteData(10))),
+				testutil.File("file2", string(testutil.RandomByteData(15))),
+			},
+			spanSize: 64,
+			tarName:  "testcase0",
+		},
+		{
+			name: "streamed ztoc equals ztoc built from file, mixed files, span_size=64KiB",
+			tarEntries: []testutil.TarEntry{
+				testutil.Dir("dir1/"),
+				testutil.File("dir1/file1", string(testutil.RandomByteData(1000000))),
+				testutil.File("file2", string(testutil.RandomByteData(2500000))),
+				testutil.Symlink("file3", "file2"),
+				testutil.File("file4", string(testutil.RandomByteData(88888))),
+			},
+			spanSize: 65535,
+			tarName:  "testcase1",
+		},
+	}
+
+	ztocBuilder := NewBuilder("test")
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", compressionAlgo, tc.name), func(t *testing.T) {
+			tarFilePath, _, _ := generator(t, tc.tarName, tc.tarEntries)
+			defer os.Remove(tarFilePath)
+
+			expected, err := ztocBuilder.BuildZtoc(tarFilePath, tc.spanSize, WithCompression(compressionAlgo))
+			if err != nil {
+				t.Fatalf("can't build ztoc from file: %v", err)
+			}
+
+			f, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			// hide `f`'s other interfaces so that the layer can only be read as a stream.
+			actual, err := ztocBuilder.BuildZtocFromReader(struct{ io.Reader }{f}, tc.spanSize, WithCompression(compressionAlgo))
+			if err != nil {
+				t.Fatalf("can't build ztoc from reader: %v", err)
+			}
+
+			if !reflect.DeepEqual(expected, actual) {
+				if !reflect.DeepEqual(expected.TOC, actual.TOC) {
+					t.Fatalf("streamed ztoc TOC differs from ztoc built from file")
+				}
+				if !reflect.DeepEqual(expected.SpanDigests, actual.SpanDigests) {
+					t.Fatalf("streamed ztoc span digests differ from ztoc built from file")
+				}
+				if !bytes.Equal(expected.Checkpoints, actual.Checkpoints) {
+					diffIdx := getPositionOfFirstDiffInByteSlice(expected.Checkpoints, actual.Checkpoints)
+					t.Fatalf("streamed ztoc checkpoints differ from ztoc built from file starting from position %d", diffIdx)
+				}
+				t.Fatalf("streamed ztoc differs from ztoc built from file")
+			}
+		})
+	}
+}
+
+func TestBuildZtocConcurrently(t *testing.T) {
+	for _, tc := range testZtocs {
+		testBuildZtocConcurrently(t, tc.compressionAlgo, tc.tarGenerator)
+	}
+}
+
+func TestBuildZtocConcurrentlyWithGoGzipEngine(t *testing.T) {
+	engine := compression.CurrentGzipEngine()
+	defer compression.SetGzipEngine(engine)
+	if err := compression.SetGzipEngine(compression.GzipEngineGo); err != nil {
+		t.Fatalf("can't set gzip engine: %v", err)
+	}
+	testBuildZtocConcurrently(t, compression.Gzip, buildTarGZ)
+}
+
+func testBuildZtocConcurrently(t *testing.T, compressionAlgo string, generator tarGenerator) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(testutil.RandomByteData(1000000))),
+		testutil.File("file2", string(testutil.RandomByteData(2500000))),
+		testutil.File("file3", string(testutil.RandomByteData(25))),
+		testutil.File("file4", string(testutil.RandomByteData(88888))),
+	}
+	tarFilePath, _, _ := generator(t, "testcase0", tarEntries)
+	defer os.Remove(tarFilePath)
+
+	ztocBuilder := NewBuilder("test")
+	for _, spanSize := range []int64{64, 65535, 1 << 22} {
+		expected, err := ztocBuilder.BuildZtoc(tarFilePath, spanSize, WithCompression(compressionAlgo))
+		if err != nil {
+			t.Fatalf("can't build ztoc: %v", err)
+		}
+		for _, concurrency := range []int{1, 4} {
+			spanSize, concurrency := spanSize, concurrency
+			t.Run(fmt.Sprintf("%s-span_size=%d-concurrency=%d", compressionAlgo, spanSize, concurrency), func(t *testing.T) {
+				actual, err := ztocBuilder.BuildZtoc(tarFilePath, spanSize, WithCompression(compressionAlgo), WithConcurrency(concurrency))
+				if err != nil {
+					t.Fatalf("can't build ztoc concurrently: %v", err)
+				}
+				if !reflect.DeepEqual(expected.TOC, actual.TOC) {
+					t.Fatalf("TOC of ztoc built concurrently differs from sequentially built ztoc")
+				}
+				if !reflect.DeepEqual(expected.SpanDigests, actual.SpanDigests) {
+					t.Fatalf("span digests of ztoc built concurrently differ from sequentially built ztoc")
+				}
+				if !bytes.Equal(expected.Checkpoints, actual.Checkpoints) {
+					diffIdx := getPositionOfFirstDiffInByteSlice(expected.Checkpoints, actual.Checkpoints)
+					t.Fatalf("checkpoints of ztoc built concurrently differ from sequentially built ztoc starting from position %d", diffIdx)
+				}
+				if !reflect.DeepEqual(expected, actual) {
+					t.Fatalf("ztoc built concurrently differs from sequentially built ztoc")
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBuildZtoc compares building the ztoc of a gzip layer of 64 MiB, half of which is
+// compressible, with each gzip engine, sequentially and concurrently.
+func BenchmarkBuildZtoc(b *testing.B) {
+	const spanSize = 1 << 22
+	var tarEntries []testutil.TarEntry
+	for i := 0; i < 32; i++ {
+		tarEntries = append(tarEntries,
+			testutil.File(fmt.Sprintf("random%d", i), string(testutil.RandomByteData(1<<20))),
+			testutil.File(fmt.Sprintf("text%d", i), strings.Repeat(fmt.Sprintf("line %d of a text file\n", i), 1<<20/24)))
+	}
+	tarFilePath, _, err := testutil.WriteTarToTempFile("layer.tar.gz", testutil.BuildTarGz(tarEntries, gzip.DefaultCompression))
+	if err != nil {
+		b.Fatalf("cannot prepare the .tar.gz file for testing: %v", err)
+	}
+	defer os.Remove(tarFilePath)
+
+	engines := []compression.GzipEngine{compression.GzipEngineGo}
+	if compression.CurrentGzipEngine() == compression.GzipEngineCgo {
+		engines = append(engines, compression.GzipEngineCgo)
+	}
+	defer compression.SetGzipEngine(compression.CurrentGzipEngine())
+	for _, engine := range engines {
+		for _, concurrency := range []int{0, runtime.NumCPU()} {
+			engine, concurrency := engine, concurrency
+			b.Run(fmt.Sprintf("engine=%s-concurrency=%d", engine, concurrency), func(b *testing.B) {
+				if err := compression.SetGzipEngine(engine); err != nil {
+					b.Fatalf("can't set gzip engine: %v", err)
+				}
+				var opts []BuildOption
+				if concurrency > 0 {
+					opts = append(opts, WithConcurrency(concurrency))
+				}
+				for i := 0; i < b.N; i++ {
+					if _, err := NewBuilder("test").BuildZtoc(tarFilePath, spanSize, opts...); err != nil {
+						b.Fatalf("can't build ztoc: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBuildZtocWithInvalidConcurrency(t *testing.T) {
+	tarFilePath, _, _ := buildTarGZ(t, "testcase0", []testutil.TarEntry{testutil.File("file1", "foo")})
+	defer os.Remove(tarFilePath)
+	for _, concurrency := range []int{0, -1} {
+		if _, err := NewBuilder("test").BuildZtoc(tarFilePath, 64, WithConcurrency(concurrency)); err == nil {
+			t.Fatalf("expected error for concurrency %d, but got nil", concurrency)
+		}
+	}
+}
+
+func TestBuildZtocWithSpanAlignment(t *testing.T) {
+	const (
+		// spans must be larger than the deflate blocks, which are up to 64 KiB.
+		spanSize    = 150000
+		maxFileSize = 10000
+	)
+	// compressible data, so that the layer has many deflate blocks where spans can start.
+	compressibleData := func(size int) string {
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = "abcd"[rand.Intn(4)]
+		}
+		return string(b)
+	}
+	var tarEntries []testutil.TarEntry
+	for i := 0; i < 600; i++ {
+		tarEntries = append(tarEntries, testutil.File(fmt.Sprintf("small%d", i), compressibleData(1000+rand.Intn(8000))))
+		if i%200 == 0 {
+			tarEntries = append(tarEntries, testutil.File(fmt.Sprintf("large%d", i), compressibleData(200000)))
+		}
+	}
+
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.compressionAlgo, func(t *testing.T) {
+			tarFilePath, contents, _ := tc.tarGenerator(t, "testcase0", tarEntries)
+			defer os.Remove(tarFilePath)
+
+			ztocBuilder := NewBuilder("test")
+			expected, err := ztocBuilder.BuildZtoc(tarFilePath, spanSize, WithCompression(tc.compressionAlgo))
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			var report SpanAlignmentReport
+			actual, err := ztocBuilder.BuildZtoc(tarFilePath, spanSize, WithCompression(tc.compressionAlgo), WithSpanAlignment(maxFileSize, &report))
+			if err != nil {
+				t.Fatalf("can't build ztoc with span alignment: %v", err)
+			}
+
+			expectedZinfo, err := expected.Zinfo()
+			if err != nil {
+				t.Fatalf("can't get zinfo: %v", err)
+			}
+			actualZinfo, err := actual.Zinfo()
+			if err != nil {
+				t.Fatalf("can't get zinfo: %v", err)
+			}
+			if report.DefaultMultiSpanFiles != countMultiSpanFiles(expected.FileMetadata, spanBoundaries(expectedZinfo)) {
+				t.Fatalf("unexpected number of multi span files without alignment: %d", report.DefaultMultiSpanFiles)
+			}
+			actualBoundaries := spanBoundaries(actualZinfo)
+			if report.MultiSpanFiles != countMultiSpanFiles(actual.FileMetadata, actualBoundaries) {
+				t.Fatalf("unexpected number of multi span files with alignment: %d", report.MultiSpanFiles)
+			}
+
+			if tc.compressionAlgo != compression.Gzip {
+				// span alignment is only supported for gzip, other algorithms use the default layout.
+				if !reflect.DeepEqual(expected, actual) {
+					t.Fatalf("ztoc built with unsupported span alignment differs from default ztoc")
+				}
+				return
+			}
+			if report.AvoidedMultiSpanFiles() <= 0 {
+				t.Fatalf("expected span alignment to avoid multi span files, report: %+v", report)
+			}
+			file, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't open %s: %v", tarFilePath, err)
+			}
+			defer file.Close()
+			sr := io.NewSectionReader(file, 0, int64(actual.CompressedArchiveSize))
+			for _, f := range actual.FileMetadata {
+				if f.UncompressedSize <= maxFileSize && countMultiSpanFiles([]FileMetadata{f}, actualBoundaries) != 0 {
+					t.Fatalf("file %s of size %d crosses a span boundary", f.Name, f.UncompressedSize)
+				}
+				if f.Type != "reg" {
+					continue
+				}
+				data, err := actual.ExtractFile(sr, f.Name)
+				if err != nil {
+					t.Fatalf("can't extract file %s: %v", f.Name, err)
+				}
+				if !bytes.Equal(data, contents[f.Name]) {
+					t.Fatalf("extracted content of file %s differs from the original", f.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildZtocWithInvalidSpanAlignment(t *testing.T) {
+	tarFilePath, _, _ := buildTarGZ(t, "testcase0", []testutil.TarEntry{testutil.File("file1", "foo")})
+	defer os.Remove(tarFilePath)
+	testCases := []struct {
+		name    string
+		options []BuildOption
+	}{
+		{
+			name:    "zero max file size",
+			options: []BuildOption{WithSpanAlignment(0, nil)},
+		},
+		{
+			name:    "negative max file size",
+			options: []BuildOption{WithSpanAlignment(-1, nil)},
+		},
+		{
+			name:    "combined with concurrency",
+			options: []BuildOption{WithSpanAlignment(100, nil), WithConcurrency(2)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewBuilder("test").BuildZtoc(tarFilePath, 64, tc.options...); err == nil {
+				t.Fatalf("expected error, but got nil")
+			}
+		})
+	}
+}
+
+func TestBuildZtocWithCompactCheckpoints(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(testutil.RandomByteData(1000000))),
+		testutil.File("file2", strings.Repeat("foobar", 500000)),
+		testutil.File("file3", string(testutil.RandomByteData(25))),
+	}
+
+	for _, tc := range testZtocs {
+		tc := tc
+		t.Run(tc.compressionAlgo, func(t *testing.T) {
+			tarFilePath, contents, _ := tc.tarGenerator(t, "testcase0", tarEntries)
+			defer os.Remove(tarFilePath)
+
+			ztocBuilder := NewBuilder("test")
+			expected, err := ztocBuilder.BuildZtoc(tarFilePath, 65535, WithCompression(tc.compressionAlgo))
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			actual, err := ztocBuilder.BuildZtoc(tarFilePath, 65535, WithCompression(tc.compressionAlgo), WithCompactCheckpoints())
+			if err != nil {
+				t.Fatalf("can't build ztoc with compact checkpoints: %v", err)
+			}
+			if tc.compressionAlgo != compression.Gzip {
+				// only gzip checkpoints have windows to compress.
+				if !reflect.DeepEqual(expected, actual) {
+					t.Fatalf("ztoc with compact checkpoints differs from default ztoc")
+				}
+				return
+			}
+			if actual.CheckpointsEncoding != compression.CheckpointsEncodingCompact {
+				t.Fatalf("unexpected checkpoints encoding: %q", actual.CheckpointsEncoding)
+			}
+			if len(actual.Checkpoints) >= len(expected.Checkpoints) {
+				t.Fatalf("compact checkpoints are not smaller than raw checkpoints: %d >= %d", len(actual.Checkpoints), len(expected.Checkpoints))
+			}
+
+			r, _, err := Marshal(actual)
+			if err != nil {
+				t.Fatalf("can't marshal ztoc: %v", err)
+			}
+			unmarshalled, err := Unmarshal(r)
+			if err != nil {
+				t.Fatalf("can't unmarshal ztoc: %v", err)
+			}
+			if unmarshalled.CheckpointsEncoding != compression.CheckpointsEncodingCompact {
+				t.Fatalf("unexpected checkpoints encoding after unmarshalling: %q", unmarshalled.CheckpointsEncoding)
+			}
+			if !bytes.Equal(unmarshalled.Checkpoints, actual.Checkpoints) {
+				t.Fatalf("checkpoints differ after unmarshalling")
+			}
+
+			zinfo, err := unmarshalled.Zinfo()
+			if err != nil {
+				t.Fatalf("can't get zinfo from compact checkpoints: %v", err)
+			}
+			defer zinfo.Close()
+			b, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("can't serialize zinfo: %v", err)
+			}
+			if !bytes.Equal(b, expected.Checkpoints) {
+				t.Fatalf("zinfo from compact checkpoints differs from raw checkpoints")
+			}
+
+			file, err := os.Open(tarFilePath)
+			if err != nil {
+				t.Fatalf("can't open %s: %v", tarFilePath, err)
+			}
+			defer file.Close()
+			sr := io.NewSectionReader(file, 0, int64(unmarshalled.CompressedArchiveSize))
+			for name, content := range contents {
+				data, err := unmarshalled.ExtractFile(sr, name)
+				if err != nil {
+					t.Fatalf("can't extract file %s: %v", name, err)
+				}
+				if !bytes.Equal(data, content) {
+					t.Fatalf("extracted content of file %s differs from the original", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalZtocWithMismatchedCheckpointsEncoding(t *testing.T) {
+	tarFilePath, _, _ := buildTarGZ(t, "testcase0", []testutil.TarEntry{testutil.File("file1", "foo")})
+	defer os.Remove(tarFilePath)
+	ztoc, err := NewBuilder("test").BuildZtoc(tarFilePath, 64)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	// raw checkpoints recorded as compact.
+	ztoc.CheckpointsEncoding = compression.CheckpointsEncodingCompact
+	r, _, err := Marshal(ztoc)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	if _, err := Unmarshal(r); err == nil {
+		t.Fatalf("expected error, but got nil")
+	}
+}
+
+func TestBuildZtocFromInvalidReader(t *testing.T) {
+	testCases := []struct {
+		name            string
+		compressionAlgo string
+		data            []byte
+	}{
+		{
+			name:            "not a gzip stream",
+			compressionAlgo: compression.Gzip,
+			data:            []byte("foobar"),
+		},
+		{
+			name:            "not a zstd stream",
+			compressionAlgo: compression.Zstd,
+			data:            []byte("foobar"),
+		},
+		{
+			name:            "not a tar stream",
+			compressionAlgo: compression.Uncompressed,
+			data:            testutil.RandomByteData(1000),
+		},
+		{
+			name:            "unsupported compression algorithm",
+			compressionAlgo: "foo",
+			data:            []byte("foobar"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewBuilder("test").BuildZtocFromReader(bytes.NewReader(tc.data), 64, WithCompression(tc.compressionAlgo))
+			if err == nil {
+				t.Fatalf("expected error, but got nil")
+			}
+		})
+	}
+}
+
 func TestZtocGeneration(t *testing.T) {
 	for _, tc := range testZtocs {
 		testZtocGeneration(t, tc.compressionAlgo, tc.tarGenerator)
@@ -415,6 +882,10 @@ func testZtocGeneration(t *testing.T, compressionAlgo string, generator tarGener
 				t.Fatalf("ztoc build tool identifiers do not match: expected %s, got %s", tc.buildTool, ztoc.BuildToolIdentifier)
 			}
 
+			if ztoc.Version != Version10 {
+				t.Fatalf("ztoc version mismatch. expected: %s, actual: %s", Version10, ztoc.Version)
+			}
+
 			if len(ztoc.FileMetadata) != len(fileNames) {
 				t.Fatalf("ztoc metadata count mismatch. expected: %d, actual: %d", len(fileNames), len(ztoc.FileMetadata))
 			}
@@ -434,6 +905,10 @@ func testZtocGeneration(t *testing.T, compressionAlgo string, generator tarGener
 						i, len(m[fileNames[i]]), int(ztoc.FileMetadata[i].UncompressedSize))
 				}
 
+				if expected := digest.FromBytes(m[fileNames[i]]); ztoc.FileMetadata[i].Digest != expected {
+					t.Fatalf("%d file digest mismatch. expected: %s, actual: %s", i, expected, ztoc.FileMetadata[i].Digest)
+				}
+
 				extractedBytes, err := ztoc.ExtractFromTarGz(tarFilePath, compressedFileName)
 				if err != nil {
 					t.Fatalf("could not extract file %s from %s using generated ztoc: %v", compressedFileName, tarFilePath, err)
@@ -629,6 +1104,9 @@ func testZtocSerialization(t *testing.T, compressionAlgo string, generator tarGe
 					if readZtocMetadata.Devminor != createdZtocMetadata.Devminor {
 						t.Fatalf("createdZtoc.FileMetadata[%d].Devminor should be equal to readZtoc.FileMetadata[%d].Devminor", i, i)
 					}
+					if readZtocMetadata.Digest != createdZtocMetadata.Digest {
+						t.Fatalf("createdZtoc.FileMetadata[%d].Digest should be equal to readZtoc.FileMetadata[%d].Digest", i, i)
+					}
 				}
 
 				extractedBytes, err := readZtoc.ExtractFromTarGz(tarFilePath, compressedFileName)
@@ -676,6 +1154,21 @@ func TestWriteZtoc(t *testing.T) {
 			expDigest:               "sha256:eba28fdf50b1b57543f57dd051b2468c1d4f57b64d2006c75aa4de1d03e6c7ec",
 			expSize:                 65928,
 		},
+		{
+			name:        "success write succeeds - same digest and size " + string(Version10),
+			version:     Version10,
+			checkpoints: make([]byte, 1<<16),
+			metadata: []FileMetadata{
+				{Name: "file1", Type: "reg", Digest: digest.FromString("file1")},
+				{Name: "dir1", Type: "dir"},
+			},
+			compressedArchiveSize:   2000000,
+			uncompressedArchiveSize: 2500000,
+			maxSpanID:               3,
+			buildTool:               "AWS SOCI CLI",
+			expDigest:               "sha256:dc1cde19c36892a0259f69be894de5cbd59cf040a84a434d9c73995708c8bed1",
+			expSize:                 66056,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -733,6 +1226,22 @@ func TestReadZtocInWrongFormat(t *testing.T) {
 	}
 }
 
+func TestReadZtocWithInvalidFileDigest(t *testing.T) {
+	ztoc := &Ztoc{
+		Version: Version10,
+		TOC: TOC{
+			FileMetadata: []FileMetadata{{Name: "file1", Type: "reg", Digest: "sha256:foo"}},
+		},
+	}
+	r, _, err := Marshal(ztoc)
+	if err != nil {
+		t.Fatalf("error occurred when getting ztoc reader: %v", err)
+	}
+	if _, err := Unmarshal(r); err == nil {
+		t.Fatalf("expected error, but got nil")
+	}
+}
+
 func getPositionOfFirstDiffInByteSlice(a, b []byte) int {
 	sz := len(a)
 	if len(b) < len(a) {